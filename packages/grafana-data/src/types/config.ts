@@ -186,6 +186,8 @@ export interface GrafanaConfig {
   loginHint: string;
   passwordHint: string;
   loginError?: string;
+  loginErrorMessageId?: string;
+  loginErrorCorrelationId?: string;
   viewersCanEdit: boolean;
   editorsCanAdmin: boolean;
   disableSanitizeHtml: boolean;
@@ -80,6 +80,8 @@ export class GrafanaBootConfig implements GrafanaConfig {
   loginHint = '';
   passwordHint = '';
   loginError: string | undefined = undefined;
+  loginErrorMessageId: string | undefined = undefined;
+  loginErrorCorrelationId: string | undefined = undefined;
   viewersCanEdit = false;
   editorsCanAdmin = false;
   disableSanitizeHtml = false;
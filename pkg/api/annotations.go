@@ -62,11 +62,22 @@ func (hs *HTTPServer) GetAnnotations(c *contextmodel.ReqContext) response.Respon
 		return response.Error(500, "Failed to get annotations", err)
 	}
 
+	userIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		if item.Email != "" {
+			userIDs = append(userIDs, item.UserID)
+		}
+	}
+	avatarURLs := hs.syncedAvatarURLs(c.Req.Context(), userIDs...)
+
 	// since there are several annotations per dashboard, we can cache dashboard uid
 	dashboardCache := make(map[int64]*string)
 	for _, item := range items {
 		if item.Email != "" {
 			item.AvatarURL = dtos.GetGravatarUrl(item.Email)
+			if avatarURL, ok := avatarURLs[item.UserID]; ok {
+				item.AvatarURL = avatarURL
+			}
 		}
 
 		if item.DashboardID != 0 {
@@ -445,6 +456,9 @@ func (hs *HTTPServer) GetAnnotationByID(c *contextmodel.ReqContext) response.Res
 
 	if annotation.Email != "" {
 		annotation.AvatarURL = dtos.GetGravatarUrl(annotation.Email)
+		if avatarURL, ok := hs.syncedAvatarURLs(c.Req.Context(), annotation.UserID)[annotation.UserID]; ok {
+			annotation.AvatarURL = avatarURL
+		}
 	}
 
 	return response.JSON(200, annotation)
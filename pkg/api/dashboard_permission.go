@@ -79,10 +79,29 @@ func (hs *HTTPServer) GetDashboardPermissionList(c *contextmodel.ReqContext) res
 
 		filteredACLs = append(filteredACLs, perm)
 	}
+	hs.setSyncedUserAvatars(c.Req.Context(), filteredACLs)
 
 	return response.JSON(http.StatusOK, filteredACLs)
 }
 
+// setSyncedUserAvatars replaces the gravatar of the users granted a permission by the avatar synced
+// from their identity provider.
+func (hs *HTTPServer) setSyncedUserAvatars(ctx context.Context, acl []*dashboards.DashboardACLInfoDTO) {
+	userIDs := make([]int64, 0, len(acl))
+	for _, perm := range acl {
+		if perm.UserID > 0 {
+			userIDs = append(userIDs, perm.UserID)
+		}
+	}
+
+	avatarURLs := hs.syncedAvatarURLs(ctx, userIDs...)
+	for _, perm := range acl {
+		if avatarURL, ok := avatarURLs[perm.UserID]; ok && perm.UserID > 0 {
+			perm.UserAvatarURL = avatarURL
+		}
+	}
+}
+
 // swagger:route POST /dashboards/uid/{uid}/permissions dashboard_permissions updateDashboardPermissionsByUID
 //
 // Updates permissions for a dashboard.
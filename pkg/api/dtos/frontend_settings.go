@@ -222,6 +222,10 @@ type FrontendSettingsDTO struct {
 	DateFormats setting.DateFormats `json:"dateFormats,omitempty"`
 
 	LoginError string `json:"loginError,omitempty"`
+	// LoginErrorMessageID identifies the login error so the frontend can show a translated message.
+	LoginErrorMessageID string `json:"loginErrorMessageId,omitempty"`
+	// LoginErrorCorrelationID identifies the failed login in the server logs.
+	LoginErrorCorrelationID string `json:"loginErrorCorrelationId,omitempty"`
 
 	PluginsCDNBaseURL string `json:"pluginsCDNBaseURL,omitempty"`
 
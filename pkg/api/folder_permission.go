@@ -60,6 +60,7 @@ func (hs *HTTPServer) GetFolderPermissionList(c *contextmodel.ReqContext) respon
 
 		filteredACLs = append(filteredACLs, perm)
 	}
+	hs.setSyncedUserAvatars(c.Req.Context(), filteredACLs)
 
 	return response.JSON(http.StatusOK, filteredACLs)
 }
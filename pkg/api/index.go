@@ -157,6 +157,15 @@ func (hs *HTTPServer) setIndexViewData(c *contextmodel.ReqContext) (*dtos.IndexV
 		data.User.GravatarUrl = hs.Cfg.AppSubURL + "/public/img/user_profile.png"
 	}
 
+	if c.IsSignedIn {
+		if avatarURL, ok := hs.syncedAvatarURLs(c.Req.Context(), c.UserID)[c.UserID]; ok {
+			data.User.GravatarUrl = avatarURL
+			if profile := data.NavTree.FindById("profile"); profile != nil {
+				profile.Img = avatarURL
+			}
+		}
+	}
+
 	if len(data.User.Name) == 0 {
 		data.User.Name = data.User.Login
 	}
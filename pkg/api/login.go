@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -110,13 +111,16 @@ func (hs *HTTPServer) LoginView(c *contextmodel.ReqContext) {
 		return
 	}
 
-	if loginError, ok := hs.tryGetEncryptedCookie(c, loginErrorCookieName); ok {
+	if cookie, ok := hs.tryGetEncryptedCookie(c, loginErrorCookieName); ok {
 		// this cookie is only set whenever an OAuth login fails
 		// therefore the loginError should be passed to the view data
 		// and the view should return immediately before attempting
 		// to login again via OAuth and enter to a redirect loop
 		cookies.DeleteCookie(c.Resp, loginErrorCookieName, hs.CookieOptionsFromCfg)
-		viewData.Settings.LoginError = loginError
+		loginErr := parseLoginErrorCookie(cookie)
+		viewData.Settings.LoginError = loginErr.Message
+		viewData.Settings.LoginErrorMessageID = loginErr.MessageID
+		viewData.Settings.LoginErrorCorrelationID = loginErr.CorrelationID
 		c.HTML(http.StatusOK, getViewIndex(), viewData)
 		return
 	}
@@ -327,6 +331,10 @@ func (hs *HTTPServer) RedirectResponseWithError(c *contextmodel.ReqContext, err
 }
 
 func (hs *HTTPServer) redirectURLWithErrorCookie(c *contextmodel.ReqContext, err error) string {
+	return hs.redirectURLWithLoginError(c, getLoginExternalError(err))
+}
+
+func (hs *HTTPServer) redirectURLWithLoginError(c *contextmodel.ReqContext, loginErr loginError) string {
 	setCookie := true
 	if hs.Features.IsEnabled(featuremgmt.FlagIndividualCookiePreferences) {
 		prefsQuery := pref.GetPreferenceWithDefaultsQuery{UserID: c.UserID, OrgID: c.OrgID, Teams: c.Teams}
@@ -338,7 +346,7 @@ func (hs *HTTPServer) redirectURLWithErrorCookie(c *contextmodel.ReqContext, err
 	}
 
 	if setCookie {
-		if err := hs.trySetEncryptedCookie(c, loginErrorCookieName, getLoginExternalError(err), 60); err != nil {
+		if err := hs.trySetEncryptedCookie(c, loginErrorCookieName, encodeLoginErrorCookie(loginErr), 60); err != nil {
 			hs.log.Error("Failed to set encrypted cookie", "err", err)
 		}
 	}
@@ -362,34 +370,60 @@ func (hs *HTTPServer) samlAutoLoginEnabled() bool {
 	return hs.samlEnabled() && hs.SettingsProvider.KeyValue("auth.saml", "auto_login").MustBool(false)
 }
 
-func getLoginExternalError(err error) string {
+// loginError is the error shown on the login page after a failed OAuth login.
+// The frontend uses the message id to show a translated message and falls back to the message.
+type loginError struct {
+	MessageID string `json:"messageId,omitempty"`
+	Message   string `json:"message"`
+	// CorrelationID identifies the failed login flow in the server logs so the user can quote it to support.
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+func encodeLoginErrorCookie(loginErr loginError) string {
+	data, err := json.Marshal(loginErr)
+	if err != nil {
+		return loginErr.Message
+	}
+	return string(data)
+}
+
+func parseLoginErrorCookie(cookie string) loginError {
+	var loginErr loginError
+	if err := json.Unmarshal([]byte(cookie), &loginErr); err != nil {
+		// cookies set before the message id was added only contain the message
+		return loginError{Message: cookie}
+	}
+	return loginErr
+}
+
+func getLoginExternalError(err error) loginError {
 	var createTokenErr *auth.CreateTokenErr
 	if errors.As(err, &createTokenErr) {
-		return createTokenErr.ExternalErr
+		return loginError{Message: createTokenErr.ExternalErr}
 	}
 
 	// unwrap until we get to the error message
 	gfErr := &errutil.Error{}
 	if errors.As(err, gfErr) {
-		return getFirstPublicErrorMessage(gfErr)
+		return getFirstPublicError(gfErr)
 	}
 
-	return err.Error()
+	return loginError{Message: err.Error()}
 }
 
-// Get the first public error message from an error chain.
-func getFirstPublicErrorMessage(err *errutil.Error) string {
+// Get the first public error from an error chain.
+func getFirstPublicError(err *errutil.Error) loginError {
 	errPublic := err.Public()
 	if err.PublicMessage != "" {
-		return errPublic.Message
+		return loginError{MessageID: errPublic.MessageID, Message: errPublic.Message}
 	}
 
 	underlyingErr := &errutil.Error{}
 	if err.Underlying != nil && errors.As(err.Underlying, underlyingErr) {
-		return getFirstPublicErrorMessage(underlyingErr)
+		return getFirstPublicError(underlyingErr)
 	}
 
-	return errPublic.Message
+	return loginError{MessageID: errPublic.MessageID, Message: errPublic.Message}
 }
 
 func isPostLogoutRedirectConfigured(redirectUrl string) bool {
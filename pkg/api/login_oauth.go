@@ -2,27 +2,55 @@ package api
 
 import (
 	"errors"
+	"net/http"
+	"strings"
 
+	"github.com/grafana/grafana/pkg/api/response"
 	"github.com/grafana/grafana/pkg/infra/metrics"
+	"github.com/grafana/grafana/pkg/login/social"
 	"github.com/grafana/grafana/pkg/middleware/cookies"
 	"github.com/grafana/grafana/pkg/services/authn"
 	contextmodel "github.com/grafana/grafana/pkg/services/contexthandler/model"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/util/errutil"
 	"github.com/grafana/grafana/pkg/web"
 )
 
 const (
 	OauthStateCookieName = "oauth_state"
 	OauthPKCECookieName  = "oauth_code_verifier"
+	// OauthReauthCookieName marks a login prompted again because the authentication was too old,
+	// so the user isn't prompted in a loop when the provider doesn't honor it
+	OauthReauthCookieName = "oauth_reauth"
 )
 
+var errOAuthLoginDenied = errutil.Unauthorized("auth.oauth.denied", errutil.WithPublicMessage("Login provider denied login request"))
+
+// oauthErrorAccessDenied is the error returned by the provider when the user cancels the login, e.g. on the consent screen.
+const oauthErrorAccessDenied = "access_denied"
+
+// loginCancelled is shown on the login page when the user cancelled the login at the provider.
+var loginCancelled = loginError{MessageID: "auth.oauth.cancelled", Message: "Login cancelled"}
+
 func (hs *HTTPServer) OAuthLogin(reqCtx *contextmodel.ReqContext) {
 	name := web.Params(reqCtx.Req)[":name"]
 
+	// fail fast for unknown providers without probing the configured ones,
+	// they get the same response as a supported provider that isn't configured.
+	if !social.IsKnownProvider(name) {
+		reqCtx.Redirect(hs.redirectURLWithErrorCookie(reqCtx, authn.ErrClientNotConfigured.Errorf("client not configured: %s", name)))
+		return
+	}
+
 	if errorParam := reqCtx.Query("error"); errorParam != "" {
 		errorDesc := reqCtx.Query("error_description")
+		if errorParam == oauthErrorAccessDenied {
+			hs.oauthLoginCancelled(reqCtx, name, errorDesc)
+			return
+		}
 		hs.log.Error("failed to login ", "error", errorParam, "errorDesc", errorDesc)
 
-		hs.redirectWithError(reqCtx, errors.New("login provider denied login request"), "error", errorParam, "errorDesc", errorDesc)
+		hs.redirectWithError(reqCtx, errOAuthLoginDenied.Errorf("login provider denied login request"), "error", errorParam, "errorDesc", errorDesc)
 		return
 	}
 
@@ -30,19 +58,7 @@ func (hs *HTTPServer) OAuthLogin(reqCtx *contextmodel.ReqContext) {
 
 	req := &authn.Request{HTTPRequest: reqCtx.Req, Resp: reqCtx.Resp}
 	if code == "" {
-		redirect, err := hs.authnService.RedirectURL(reqCtx.Req.Context(), authn.ClientWithPrefix(name), req)
-		if err != nil {
-			reqCtx.Redirect(hs.redirectURLWithErrorCookie(reqCtx, err))
-			return
-		}
-
-		cookies.WriteCookie(reqCtx.Resp, OauthStateCookieName, redirect.Extra[authn.KeyOAuthState], hs.Cfg.OAuthCookieMaxAge, hs.CookieOptionsFromCfg)
-
-		if pkce := redirect.Extra[authn.KeyOAuthPKCE]; pkce != "" {
-			cookies.WriteCookie(reqCtx.Resp, OauthPKCECookieName, pkce, hs.Cfg.OAuthCookieMaxAge, hs.CookieOptionsFromCfg)
-		}
-
-		reqCtx.Redirect(redirect.URL)
+		hs.oauthRedirect(reqCtx, name, req)
 		return
 	}
 
@@ -50,12 +66,203 @@ func (hs *HTTPServer) OAuthLogin(reqCtx *contextmodel.ReqContext) {
 	// NOTE: always delete these cookies, even if login failed
 	cookies.DeleteCookie(reqCtx.Resp, OauthStateCookieName, hs.CookieOptionsFromCfg)
 	cookies.DeleteCookie(reqCtx.Resp, OauthPKCECookieName, hs.CookieOptionsFromCfg)
+	_, reauthErr := reqCtx.Req.Cookie(OauthReauthCookieName)
+	reprompted := reauthErr == nil
+	if reprompted {
+		cookies.DeleteCookie(reqCtx.Resp, OauthReauthCookieName, hs.CookieOptionsFromCfg)
+	}
+
+	// prompt the login again once when the authentication is older than the provider max_age
+	if errors.Is(err, authn.ErrReauthenticate) && !reprompted {
+		req := &authn.Request{HTTPRequest: reqCtx.Req, Resp: reqCtx.Resp}
+		req.SetMeta(authn.MetaKeyPrompt, "login")
+		cookies.WriteCookie(reqCtx.Resp, OauthReauthCookieName, "1", hs.Cfg.OAuthCookieMaxAge, hs.CookieOptionsFromCfg)
+		hs.oauthRedirect(reqCtx, name, req)
+		return
+	}
 
 	if err != nil {
-		reqCtx.Redirect(hs.redirectURLWithErrorCookie(reqCtx, err))
+		hs.oauthLoginFailed(reqCtx, name, req, err)
 		return
 	}
 
 	metrics.MApiLoginOAuth.Inc()
 	authn.HandleLoginRedirect(reqCtx.Req, reqCtx.Resp, hs.Cfg, identity, hs.ValidateRedirectTo)
 }
+
+// oauthRedirect redirects to the provider to start the authorization flow.
+func (hs *HTTPServer) oauthRedirect(reqCtx *contextmodel.ReqContext, name string, req *authn.Request) {
+	redirect, err := hs.authnService.RedirectURL(reqCtx.Req.Context(), authn.ClientWithPrefix(name), req)
+	if err != nil {
+		hs.oauthLoginFailed(reqCtx, name, req, err)
+		return
+	}
+
+	cookies.WriteCookie(reqCtx.Resp, OauthStateCookieName, redirect.Extra[authn.KeyOAuthState], hs.Cfg.OAuthCookieMaxAge, hs.CookieOptionsFromCfg)
+
+	if pkce := redirect.Extra[authn.KeyOAuthPKCE]; pkce != "" {
+		cookies.WriteCookie(reqCtx.Resp, OauthPKCECookieName, pkce, hs.Cfg.OAuthCookieMaxAge, hs.CookieOptionsFromCfg)
+	}
+
+	reqCtx.Redirect(redirect.URL)
+}
+
+// oauthLoginCancelled ends a flow the user cancelled at the provider. The user is sent back to the page
+// the login started from when redirect_to is valid, or to the login page with a notice otherwise.
+func (hs *HTTPServer) oauthLoginCancelled(reqCtx *contextmodel.ReqContext, name, errorDesc string) {
+	hs.log.Info("OAuth login cancelled", "provider", name, "errorDesc", errorDesc)
+	cookies.DeleteCookie(reqCtx.Resp, OauthStateCookieName, hs.CookieOptionsFromCfg)
+	cookies.DeleteCookie(reqCtx.Resp, OauthPKCECookieName, hs.CookieOptionsFromCfg)
+	cookies.DeleteCookie(reqCtx.Resp, OauthReauthCookieName, hs.CookieOptionsFromCfg)
+
+	if redirectTo := reqCtx.GetCookie("redirect_to"); redirectTo != "" {
+		cookies.DeleteCookie(reqCtx.Resp, "redirect_to", hs.CookieOptionsFromCfg)
+		// with auto login the page would start the login again right away, the login page stops it
+		if err := hs.ValidateRedirectTo(redirectTo); err == nil && !hs.oauthAutoLogin(name) {
+			reqCtx.Redirect(redirectTo)
+			return
+		}
+	}
+
+	reqCtx.Redirect(hs.redirectURLWithLoginError(reqCtx, loginCancelled))
+}
+
+func (hs *HTTPServer) oauthAutoLogin(name string) bool {
+	if hs.Cfg.OAuthAutoLogin {
+		return true
+	}
+	info := hs.SocialService.GetOAuthInfoProvider(name)
+	return info != nil && info.AutoLogin
+}
+
+// oauthLoginFailed redirects to the login page showing the error. The correlation id of the flow is
+// logged with the error and shown to the user so support can find the matching logs.
+func (hs *HTTPServer) oauthLoginFailed(reqCtx *contextmodel.ReqContext, name string, req *authn.Request, err error) {
+	loginErr := getLoginExternalError(err)
+	loginErr.CorrelationID = req.GetMeta(authn.MetaKeyCorrelationID)
+	hs.log.Warn("OAuth login failed", "provider", name, "correlation_id", loginErr.CorrelationID, "error", err)
+	reqCtx.Redirect(hs.redirectURLWithLoginError(reqCtx, loginErr))
+}
+
+// OAuthBackchannelLogout ends the sessions bound to the provider session targeted by the
+// logout token the provider posts when a user logs out from it.
+func (hs *HTTPServer) OAuthBackchannelLogout(c *contextmodel.ReqContext) response.Response {
+	name := web.Params(c.Req)[":name"]
+	if !social.IsKnownProvider(name) {
+		return response.Error(http.StatusNotFound, "OAuth provider not found", nil)
+	}
+
+	logoutToken := c.Req.PostFormValue("logout_token")
+	if logoutToken == "" {
+		return response.Error(http.StatusBadRequest, "Missing logout token", nil)
+	}
+
+	if err := hs.authnService.BackchannelLogout(c.Req.Context(), authn.ClientWithPrefix(name), logoutToken); err != nil {
+		return response.ErrOrFallback(http.StatusBadRequest, "Failed to logout", err)
+	}
+
+	return response.Empty(http.StatusOK).SetHeader("Cache-Control", "no-store")
+}
+
+type oauthDiscoveryDTO struct {
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+}
+
+// OAuthDiscoverProvider returns the OAuth provider users log in with based on the domain of their
+// email (home realm discovery), so the login page can redirect them without picking a provider.
+func (hs *HTTPServer) OAuthDiscoverProvider(c *contextmodel.ReqContext) response.Response {
+	cmd := struct {
+		Email string `json:"email"`
+	}{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return response.Error(http.StatusBadRequest, "bad request data", err)
+	}
+
+	name, ok := homeRealmProvider(hs.Cfg.OAuthHomeRealmDomains, cmd.Email)
+	// providers that aren't enabled get the same response as domains without a provider
+	if !ok || !social.IsKnownProvider(name) || hs.SocialService.GetOAuthInfoProvider(name) == nil {
+		return response.Error(http.StatusNotFound, "No provider for domain", nil)
+	}
+
+	return response.JSON(http.StatusOK, oauthDiscoveryDTO{
+		Provider: name,
+		URL:      hs.Cfg.AppSubURL + social.SocialBaseUrl + name,
+	})
+}
+
+// homeRealmProvider returns the provider mapped to the domain of the email. An exact domain takes
+// precedence over wildcard domains, which match the closest parent domain first.
+func homeRealmProvider(domains map[string]string, email string) (string, bool) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", false
+	}
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(email[at+1:])), ".")
+	if domain == "" {
+		return "", false
+	}
+
+	if provider, ok := domains[domain]; ok {
+		return provider, true
+	}
+	for parent := domain; ; {
+		dot := strings.Index(parent, ".")
+		if dot < 0 {
+			return "", false
+		}
+		parent = parent[dot+1:]
+		if provider, ok := domains["*."+parent]; ok {
+			return provider, true
+		}
+	}
+}
+
+// GetOAuthShadowSyncDiffs returns the role changes OAuth logins would have synced for each user
+// while oauth_sync_shadow_mode is enabled.
+func (hs *HTTPServer) GetOAuthShadowSyncDiffs(c *contextmodel.ReqContext) response.Response {
+	diffs, err := hs.authnService.ShadowSyncDiffs(c.Req.Context())
+	if err != nil {
+		return response.Error(http.StatusInternalServerError, "Failed to get shadow sync changes", err)
+	}
+	return response.JSON(http.StatusOK, diffs)
+}
+
+type oauthIdentityPreviewDTO struct {
+	Login          string                 `json:"login"`
+	Name           string                 `json:"name"`
+	Email          string                 `json:"email"`
+	AuthID         string                 `json:"authId"`
+	OrgRoles       map[int64]org.RoleType `json:"orgRoles"`
+	Groups         []string               `json:"groups"`
+	IsGrafanaAdmin *bool                  `json:"isGrafanaAdmin"`
+}
+
+// PreviewOAuthIdentity returns the identity a login with the posted claims would produce,
+// using the role, group and Grafana admin mappings configured for the provider.
+func (hs *HTTPServer) PreviewOAuthIdentity(c *contextmodel.ReqContext) response.Response {
+	name := web.Params(c.Req)[":name"]
+	if !social.IsKnownProvider(name) {
+		return response.Error(http.StatusNotFound, "OAuth provider not found", nil)
+	}
+
+	claims := map[string]any{}
+	if err := web.Bind(c.Req, &claims); err != nil {
+		return response.Error(http.StatusBadRequest, "bad request data", err)
+	}
+
+	identity, err := hs.authnService.PreviewIdentity(c.Req.Context(), authn.ClientWithPrefix(name), claims)
+	if err != nil {
+		return response.ErrOrFallback(http.StatusBadRequest, "Failed to preview identity", err)
+	}
+
+	return response.JSON(http.StatusOK, oauthIdentityPreviewDTO{
+		Login:          identity.Login,
+		Name:           identity.Name,
+		Email:          identity.Email,
+		AuthID:         identity.AuthID,
+		OrgRoles:       identity.OrgRoles,
+		Groups:         identity.Groups,
+		IsGrafanaAdmin: identity.IsGrafanaAdmin,
+	})
+}
@@ -1,19 +1,30 @@
 package api
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/login/social"
+	"github.com/grafana/grafana/pkg/login/socialtest"
 	"github.com/grafana/grafana/pkg/models/usertoken"
 	"github.com/grafana/grafana/pkg/services/authn"
 	"github.com/grafana/grafana/pkg/services/authn/authntest"
+	"github.com/grafana/grafana/pkg/services/org"
 	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util/errutil"
+	"github.com/grafana/grafana/pkg/web/webtest"
 )
 
 func setClientWithoutRedirectFollow(t *testing.T) {
@@ -71,6 +82,7 @@ func TestOAuthLogin_Redirect(t *testing.T) {
 		t.Run(tt.desc, func(t *testing.T) {
 			server := SetupAPITestServer(t, func(hs *HTTPServer) {
 				hs.Cfg = setting.NewCfg()
+				hs.log = log.NewNopLogger()
 				hs.SecretsService = fakes.NewFakeSecretsService()
 				hs.authnService = &authntest.FakeService{
 					ExpectedErr:      tt.expectedErr,
@@ -147,6 +159,7 @@ func TestOAuthLogin_AuthorizationCode(t *testing.T) {
 				cfg = setting.NewCfg()
 				hs.Cfg = cfg
 				hs.Cfg.LoginCookieName = "some_name"
+				hs.log = log.NewNopLogger()
 				hs.SecretsService = fakes.NewFakeSecretsService()
 				hs.authnService = &authntest.FakeService{
 					ExpectedErr:      tt.expectedErr,
@@ -192,6 +205,139 @@ func TestOAuthLogin_AuthorizationCode(t *testing.T) {
 	}
 }
 
+func TestOAuthLogin_MaxTokenLifetime(t *testing.T) {
+	type testCase struct {
+		desc                  string
+		loginMaxLifetime      time.Duration
+		oauthMaxTokenLifetime time.Duration
+		tokenExpiry           time.Duration
+		expectedMaxAge        time.Duration
+	}
+
+	tests := []testCase{
+		{
+			desc:             "should use the session lifetime when no maximum token lifetime is configured",
+			loginMaxLifetime: 30 * 24 * time.Hour,
+			tokenExpiry:      time.Hour,
+			expectedMaxAge:   30 * 24 * time.Hour,
+		},
+		{
+			desc:                  "should expire the session with a token shorter than the maximum token lifetime",
+			loginMaxLifetime:      30 * 24 * time.Hour,
+			oauthMaxTokenLifetime: 8 * time.Hour,
+			tokenExpiry:           time.Hour,
+			expectedMaxAge:        time.Hour,
+		},
+		{
+			desc:                  "should cap the session with a token longer than the maximum token lifetime",
+			loginMaxLifetime:      30 * 24 * time.Hour,
+			oauthMaxTokenLifetime: 8 * time.Hour,
+			tokenExpiry:           24 * time.Hour,
+			expectedMaxAge:        8 * time.Hour,
+		},
+		{
+			desc:                  "should keep a session lifetime shorter than the maximum token lifetime",
+			loginMaxLifetime:      2 * time.Hour,
+			oauthMaxTokenLifetime: 8 * time.Hour,
+			tokenExpiry:           24 * time.Hour,
+			expectedMaxAge:        2 * time.Hour,
+		},
+		{
+			desc:                  "should cap sessions without a session lifetime",
+			oauthMaxTokenLifetime: 8 * time.Hour,
+			tokenExpiry:           24 * time.Hour,
+			expectedMaxAge:        8 * time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := SetupAPITestServer(t, func(hs *HTTPServer) {
+				hs.Cfg = setting.NewCfg()
+				hs.Cfg.LoginCookieName = "some_name"
+				hs.Cfg.LoginMaxLifetime = tt.loginMaxLifetime
+				hs.Cfg.OAuthMaxTokenLifetime = tt.oauthMaxTokenLifetime
+				hs.SecretsService = fakes.NewFakeSecretsService()
+				hs.authnService = &authntest.FakeService{
+					ExpectedIdentity: &authn.Identity{
+						SessionToken: &usertoken.UserToken{UnhashedToken: "some-token"},
+						OAuthToken:   &oauth2.Token{AccessToken: "access-token", Expiry: time.Now().Add(tt.tokenExpiry)},
+					},
+				}
+			})
+			setClientWithoutRedirectFollow(t)
+
+			res, err := server.Send(server.NewGetRequest("/login/generic_oauth?code=code"))
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+
+			require.Len(t, res.Cookies(), 4)
+			for _, cookie := range res.Cookies()[2:] {
+				assert.InDelta(t, tt.expectedMaxAge.Seconds(), cookie.MaxAge, 5, cookie.Name)
+			}
+		})
+	}
+}
+
+func TestOAuthLogin_Reauthenticate(t *testing.T) {
+	authnService := &reauthAuthnService{FakeService: &authntest.FakeService{
+		ExpectedRedirect: &authn.Redirect{URL: "https://some-provider.com", Extra: map[string]string{authn.KeyOAuthState: "some-state"}},
+	}}
+	server := SetupAPITestServer(t, func(hs *HTTPServer) {
+		hs.Cfg = setting.NewCfg()
+		hs.log = log.NewNopLogger()
+		hs.SecretsService = fakes.NewFakeSecretsService()
+		hs.authnService = authnService
+	})
+
+	setClientWithoutRedirectFollow(t)
+
+	t.Run("should prompt the login again when the authentication is too old", func(t *testing.T) {
+		res, err := server.Send(server.NewGetRequest("/login/generic_oauth?code=code"))
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		assert.Equal(t, "https://some-provider.com", res.Header.Get("Location"))
+		assert.Equal(t, "login", authnService.prompt)
+
+		cookies := map[string]string{}
+		for _, c := range res.Cookies() {
+			cookies[c.Name] = c.Value
+		}
+		assert.Equal(t, "some-state", cookies[OauthStateCookieName])
+		assert.NotEmpty(t, cookies[OauthReauthCookieName])
+		require.NoError(t, res.Body.Close())
+	})
+
+	t.Run("should fail when the authentication is still too old after prompting again", func(t *testing.T) {
+		authnService.prompt = ""
+		req := server.NewGetRequest("/login/generic_oauth?code=code")
+		req.AddCookie(&http.Cookie{Name: OauthReauthCookieName, Value: "1"})
+
+		res, err := server.Send(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		assert.Equal(t, "/login", res.Header.Get("Location"))
+		assert.Empty(t, authnService.prompt)
+		require.NoError(t, res.Body.Close())
+	})
+}
+
+type reauthAuthnService struct {
+	*authntest.FakeService
+	prompt string
+}
+
+func (s *reauthAuthnService) Login(ctx context.Context, client string, r *authn.Request) (*authn.Identity, error) {
+	return nil, authn.ErrReauthenticate.Errorf("authentication too old")
+}
+
+func (s *reauthAuthnService) RedirectURL(ctx context.Context, client string, r *authn.Request) (*authn.Redirect, error) {
+	s.prompt = r.GetMeta(authn.MetaKeyPrompt)
+	return s.FakeService.RedirectURL(ctx, client, r)
+}
+
 func TestOAuthLogin_Error(t *testing.T) {
 	server := SetupAPITestServer(t, func(hs *HTTPServer) {
 		hs.Cfg = setting.NewCfg()
@@ -212,3 +358,353 @@ func TestOAuthLogin_Error(t *testing.T) {
 	assert.Equal(t, loginErrorCookieName, errCookie.Name)
 	require.NoError(t, res.Body.Close())
 }
+
+func TestOAuthLogin_Cancelled(t *testing.T) {
+	type testCase struct {
+		desc             string
+		redirectTo       string
+		autoLogin        bool
+		expectedLocation string
+	}
+
+	tests := []testCase{
+		{
+			desc:             "should redirect to the originating page",
+			redirectTo:       "/d/some-dashboard",
+			expectedLocation: "/d/some-dashboard",
+		},
+		{
+			desc:             "should redirect to the login page with a notice when redirect_to is invalid",
+			redirectTo:       "https://evil.com/",
+			expectedLocation: "/login",
+		},
+		{
+			desc:             "should redirect to the login page with a notice without redirect_to",
+			expectedLocation: "/login",
+		},
+		{
+			desc:             "should redirect to the login page with a notice when auto login is enabled",
+			redirectTo:       "/d/some-dashboard",
+			autoLogin:        true,
+			expectedLocation: "/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := SetupAPITestServer(t, func(hs *HTTPServer) {
+				hs.Cfg = setting.NewCfg()
+				hs.log = log.NewNopLogger()
+				hs.SecretsService = fakes.NewFakeSecretsService()
+				hs.SocialService = &socialtest.FakeSocialService{ExpectedAuthInfoProvider: &social.OAuthInfo{AutoLogin: tt.autoLogin}}
+			})
+			setClientWithoutRedirectFollow(t)
+
+			req := server.NewGetRequest("/login/generic_oauth?error=access_denied&error_description=user+cancelled")
+			req.AddCookie(&http.Cookie{Name: OauthStateCookieName, Value: "some-state"})
+			if tt.redirectTo != "" {
+				req.AddCookie(&http.Cookie{Name: "redirect_to", Value: tt.redirectTo})
+			}
+
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+
+			assert.Equal(t, http.StatusFound, res.StatusCode)
+			assert.Equal(t, tt.expectedLocation, res.Header.Get("Location"))
+
+			cookies := map[string]*http.Cookie{}
+			for _, c := range res.Cookies() {
+				cookies[c.Name] = c
+			}
+			for _, name := range []string{OauthStateCookieName, OauthPKCECookieName, OauthReauthCookieName} {
+				require.Contains(t, cookies, name)
+				assert.Equal(t, -1, cookies[name].MaxAge, "the flow cookies should be deleted")
+			}
+
+			loginErrCookie, ok := cookies[loginErrorCookieName]
+			if tt.expectedLocation != "/login" {
+				assert.False(t, ok, "no notice should be shown on the originating page")
+				return
+			}
+			require.True(t, ok)
+
+			// the fake secrets service doesn't encrypt
+			value, err := hex.DecodeString(loginErrCookie.Value)
+			require.NoError(t, err)
+			var loginErr loginError
+			require.NoError(t, json.Unmarshal(value, &loginErr))
+			assert.Equal(t, loginCancelled, loginErr)
+		})
+	}
+}
+
+func TestOAuthLogin_ErrorMessageID(t *testing.T) {
+	type testCase struct {
+		desc              string
+		url               string
+		loginErr          error
+		expectedMessageID string
+		expectedMessage   string
+	}
+
+	tests := []testCase{
+		{
+			desc:              "should use denied message when provider denies the login",
+			url:               "/login/generic_oauth?error=unauthorized_client",
+			expectedMessageID: "auth.oauth.denied",
+			expectedMessage:   "Login provider denied login request",
+		},
+		{
+			desc:              "should use not configured message for unknown provider",
+			url:               "/login/not_a_provider",
+			expectedMessageID: "auth.client.notConfigured",
+			expectedMessage:   "Bad request",
+		},
+		{
+			desc:              "should use message of the login error",
+			url:               "/login/generic_oauth?code=code",
+			loginErr:          errutil.Unauthorized("auth.oauth.state.invalid", errutil.WithPublicMessage("Provided state does not match stored state")).Errorf("state mismatch"),
+			expectedMessageID: "auth.oauth.state.invalid",
+			expectedMessage:   "Provided state does not match stored state",
+		},
+		{
+			desc:            "should only set message for errors without message id",
+			url:             "/login/generic_oauth?code=code",
+			loginErr:        errors.New("some error"),
+			expectedMessage: "some error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := SetupAPITestServer(t, func(hs *HTTPServer) {
+				hs.Cfg = setting.NewCfg()
+				hs.log = log.NewNopLogger()
+				hs.SecretsService = fakes.NewFakeSecretsService()
+				hs.authnService = &authntest.FakeService{ExpectedErr: tt.loginErr}
+			})
+
+			setClientWithoutRedirectFollow(t)
+
+			res, err := server.Send(server.NewGetRequest(tt.url))
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+
+			var cookie *http.Cookie
+			for _, c := range res.Cookies() {
+				if c.Name == loginErrorCookieName {
+					cookie = c
+				}
+			}
+			require.NotNil(t, cookie)
+
+			// the fake secrets service doesn't encrypt
+			value, err := hex.DecodeString(cookie.Value)
+			require.NoError(t, err)
+
+			var loginErr loginError
+			require.NoError(t, json.Unmarshal(value, &loginErr))
+			assert.Equal(t, tt.expectedMessageID, loginErr.MessageID)
+			assert.Equal(t, tt.expectedMessage, loginErr.Message)
+		})
+	}
+}
+
+func TestOAuthLogin_ErrorCorrelationID(t *testing.T) {
+	server := SetupAPITestServer(t, func(hs *HTTPServer) {
+		hs.Cfg = setting.NewCfg()
+		hs.log = log.NewNopLogger()
+		hs.SecretsService = fakes.NewFakeSecretsService()
+		hs.authnService = &correlatingAuthnService{FakeService: &authntest.FakeService{}, correlationID: "0a1b2c3d4e5f"}
+	})
+
+	setClientWithoutRedirectFollow(t)
+
+	res, err := server.Send(server.NewGetRequest("/login/generic_oauth?code=code"))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == loginErrorCookieName {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie)
+
+	// the fake secrets service doesn't encrypt
+	value, err := hex.DecodeString(cookie.Value)
+	require.NoError(t, err)
+
+	var loginErr loginError
+	require.NoError(t, json.Unmarshal(value, &loginErr))
+	assert.Equal(t, "0a1b2c3d4e5f", loginErr.CorrelationID)
+}
+
+// correlatingAuthnService fails logins after the client found the correlation id of the flow.
+type correlatingAuthnService struct {
+	*authntest.FakeService
+	correlationID string
+}
+
+func (s *correlatingAuthnService) Login(ctx context.Context, client string, r *authn.Request) (*authn.Identity, error) {
+	r.SetMeta(authn.MetaKeyCorrelationID, s.correlationID)
+	return nil, errors.New("some error")
+}
+
+func TestOAuthLogin_UnknownProvider(t *testing.T) {
+	send := func(t *testing.T, path string, authnService authn.Service) *http.Response {
+		server := SetupAPITestServer(t, func(hs *HTTPServer) {
+			hs.Cfg = setting.NewCfg()
+			hs.log = log.NewNopLogger()
+			hs.SecretsService = fakes.NewFakeSecretsService()
+			hs.authnService = authnService
+		})
+
+		setClientWithoutRedirectFollow(t)
+
+		res, err := server.Send(server.NewGetRequest(path))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+
+	// the authn service would redirect to the provider if it was consulted
+	unknown := send(t, "/login/not_a_provider", &authntest.FakeService{
+		ExpectedRedirect: &authn.Redirect{URL: "https://some-provider.com"},
+	})
+	notConfigured := send(t, "/login/generic_oauth", &authntest.FakeService{
+		ExpectedErr: authn.ErrClientNotConfigured,
+	})
+
+	assert.Equal(t, http.StatusFound, unknown.StatusCode)
+	assert.Equal(t, "/login", unknown.Header.Get("Location"))
+
+	// unknown providers can't be told apart from supported providers that aren't configured
+	assert.Equal(t, notConfigured.StatusCode, unknown.StatusCode)
+	assert.Equal(t, notConfigured.Header.Get("Location"), unknown.Header.Get("Location"))
+	require.Len(t, unknown.Cookies(), len(notConfigured.Cookies()))
+	for i, c := range unknown.Cookies() {
+		assert.Equal(t, notConfigured.Cookies()[i].Name, c.Name)
+	}
+}
+
+func TestPreviewOAuthIdentity(t *testing.T) {
+	type testCase struct {
+		desc         string
+		url          string
+		admin        bool
+		expectedCode int
+	}
+
+	tests := []testCase{
+		{desc: "should return preview for grafana admin", url: "/api/admin/oauth/generic_oauth/preview", admin: true, expectedCode: http.StatusOK},
+		{desc: "should return 403 for users who are not grafana admin", url: "/api/admin/oauth/generic_oauth/preview", expectedCode: http.StatusForbidden},
+		{desc: "should return 404 for unknown provider", url: "/api/admin/oauth/not_a_provider/preview", admin: true, expectedCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			isGrafanaAdmin := true
+			server := SetupAPITestServer(t, func(hs *HTTPServer) {
+				hs.authnService = &authntest.FakeService{ExpectedIdentity: &authn.Identity{
+					Email:          "admin@grafana.com",
+					OrgRoles:       map[int64]org.RoleType{1: org.RoleAdmin},
+					Groups:         []string{"superusers"},
+					IsGrafanaAdmin: &isGrafanaAdmin,
+				}}
+			})
+
+			usr := userWithPermissions(1, nil)
+			usr.IsGrafanaAdmin = tt.admin
+
+			req := server.NewPostRequest(tt.url, strings.NewReader(`{"sub":"123","email":"admin@grafana.com","groups":["superusers"]}`))
+			req.Header.Set("Content-Type", "application/json")
+			res, err := server.Send(webtest.RequestWithSignedInUser(req, usr))
+			require.NoError(t, err)
+			defer func() { require.NoError(t, res.Body.Close()) }()
+
+			require.Equal(t, tt.expectedCode, res.StatusCode)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var preview oauthIdentityPreviewDTO
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&preview))
+			assert.Equal(t, "admin@grafana.com", preview.Email)
+			assert.Equal(t, map[int64]org.RoleType{1: org.RoleAdmin}, preview.OrgRoles)
+			assert.Equal(t, []string{"superusers"}, preview.Groups)
+			require.NotNil(t, preview.IsGrafanaAdmin)
+			assert.True(t, *preview.IsGrafanaAdmin)
+		})
+	}
+}
+
+func TestOAuthDiscoverProvider(t *testing.T) {
+	domains := map[string]string{
+		"example.com":        "okta",
+		"*.example.com":      "generic_oauth",
+		"*.corp.example.com": "azuread",
+		"*.disabled.com":     "not_a_provider",
+	}
+
+	type testCase struct {
+		desc             string
+		email            string
+		expectedCode     int
+		expectedProvider string
+	}
+
+	tests := []testCase{
+		{desc: "should return the provider mapped to the domain", email: "bob@example.com", expectedCode: http.StatusOK, expectedProvider: "okta"},
+		{desc: "should match domains case insensitively", email: "Bob@EXAMPLE.com", expectedCode: http.StatusOK, expectedProvider: "okta"},
+		{desc: "should match subdomains with a wildcard domain", email: "bob@eu.example.com", expectedCode: http.StatusOK, expectedProvider: "generic_oauth"},
+		{desc: "should prefer the most specific wildcard domain", email: "bob@eu.corp.example.com", expectedCode: http.StatusOK, expectedProvider: "azuread"},
+		{desc: "should not match the parent of a wildcard domain", email: "bob@disabled.com", expectedCode: http.StatusNotFound},
+		{desc: "should return not found for an unmapped domain", email: "bob@other.com", expectedCode: http.StatusNotFound},
+		{desc: "should return not found for an unknown provider", email: "bob@app.disabled.com", expectedCode: http.StatusNotFound},
+		{desc: "should return not found for an invalid email", email: "bob", expectedCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := SetupAPITestServer(t, func(hs *HTTPServer) {
+				hs.Cfg = setting.NewCfg()
+				hs.Cfg.OAuthHomeRealmDomains = domains
+				hs.SocialService = &socialtest.FakeSocialService{ExpectedAuthInfoProvider: &social.OAuthInfo{Enabled: true}}
+			})
+
+			req := server.NewPostRequest("/login/discover", strings.NewReader(`{"email":"`+tt.email+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, res.Body.Close()) }()
+
+			require.Equal(t, tt.expectedCode, res.StatusCode)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var discovery oauthDiscoveryDTO
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&discovery))
+			assert.Equal(t, tt.expectedProvider, discovery.Provider)
+			assert.Equal(t, "/login/"+tt.expectedProvider, discovery.URL)
+		})
+	}
+
+	t.Run("should return not found for a provider that isn't enabled", func(t *testing.T) {
+		server := SetupAPITestServer(t, func(hs *HTTPServer) {
+			hs.Cfg = setting.NewCfg()
+			hs.Cfg.OAuthHomeRealmDomains = domains
+			hs.SocialService = &socialtest.FakeSocialService{}
+		})
+
+		req := server.NewPostRequest("/login/discover", strings.NewReader(`{"email":"bob@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := server.Send(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
@@ -301,6 +301,13 @@ func (hs *HTTPServer) searchOrgUsersHelper(c *contextmodel.ReqContext, query *or
 		filteredUsers = append(filteredUsers, user)
 	}
 
+	avatarURLs := hs.syncedAvatarURLs(c.Req.Context(), authLabelsUserIDs...)
+	for _, user := range filteredUsers {
+		if avatarURL, ok := avatarURLs[user.UserID]; ok {
+			user.AvatarURL = avatarURL
+		}
+	}
+
 	modules, err := hs.authInfoService.GetUserLabels(c.Req.Context(), login.GetUserLabelsQuery{
 		UserIDs: authLabelsUserIDs,
 	})
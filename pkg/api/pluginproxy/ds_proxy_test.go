@@ -1135,6 +1135,10 @@ func (m *mockOAuthTokenService) TryTokenRefresh(context.Context, *login.UserAuth
 	return nil
 }
 
+func (m *mockOAuthTokenService) RefreshToken(context.Context, int64, string) (*oauth2.Token, error) {
+	return m.token, nil
+}
+
 func (m *mockOAuthTokenService) InvalidateOAuthTokens(context.Context, *login.UserAuth) error {
 	return nil
 }
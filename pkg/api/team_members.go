@@ -58,6 +58,17 @@ func (hs *HTTPServer) GetTeamMembers(c *contextmodel.ReqContext) response.Respon
 		filteredMembers = append(filteredMembers, member)
 	}
 
+	userIDs := make([]int64, 0, len(filteredMembers))
+	for _, member := range filteredMembers {
+		userIDs = append(userIDs, member.UserID)
+	}
+	avatarURLs := hs.syncedAvatarURLs(c.Req.Context(), userIDs...)
+	for _, member := range filteredMembers {
+		if avatarURL, ok := avatarURLs[member.UserID]; ok {
+			member.AvatarURL = avatarURL
+		}
+	}
+
 	return response.JSON(http.StatusOK, filteredMembers)
 }
 
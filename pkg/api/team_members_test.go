@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
 	"testing"
@@ -8,8 +9,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/api/dtos"
 	ac "github.com/grafana/grafana/pkg/services/accesscontrol"
 	"github.com/grafana/grafana/pkg/services/accesscontrol/actest"
+	"github.com/grafana/grafana/pkg/services/authn/authntest"
+	"github.com/grafana/grafana/pkg/services/team"
 	"github.com/grafana/grafana/pkg/services/team/teamtest"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/web/webtest"
@@ -72,6 +76,32 @@ func TestGetTeamMembersAPIEndpoint(t *testing.T) {
 		assert.Equal(t, http.StatusForbidden, res.StatusCode)
 		require.NoError(t, res.Body.Close())
 	})
+	t.Run("should use the avatars synced from the identity provider", func(t *testing.T) {
+		server := SetupAPITestServer(t, func(hs *HTTPServer) {
+			hs.Cfg = setting.NewCfg()
+			hs.teamService = &teamtest.FakeService{ExpectedMembers: []*team.TeamMemberDTO{
+				{UserID: 2, Login: "synced", Email: "synced@example.com"},
+				{UserID: 3, Login: "gravatar", Email: "gravatar@example.com"},
+			}}
+			hs.teamPermissionsService = &actest.FakePermissionsService{}
+			hs.authnService = &authntest.FakeService{ExpectedAvatarURLs: map[int64]string{2: "https://idp.example.com/photos/2.png"}}
+		})
+
+		req := webtest.RequestWithSignedInUser(
+			server.NewGetRequest("/api/teams/1/members"),
+			userWithPermissions(1, []ac.Permission{{Action: ac.ActionTeamsPermissionsRead, Scope: "teams:id:1"}}),
+		)
+		res, err := server.SendJSON(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		var members []*team.TeamMemberDTO
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&members))
+		require.NoError(t, res.Body.Close())
+		require.Len(t, members, 2)
+		assert.Equal(t, "https://idp.example.com/photos/2.png", members[0].AvatarURL)
+		assert.Equal(t, dtos.GetGravatarUrl("gravatar@example.com"), members[1].AvatarURL)
+	})
 }
 
 func TestUpdateTeamMembersAPIEndpoint(t *testing.T) {
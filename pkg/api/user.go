@@ -82,10 +82,28 @@ func (hs *HTTPServer) getUserUserProfile(c *contextmodel.ReqContext, userID int6
 
 	userProfile.AccessControl = hs.getAccessControlMetadata(c, c.SignedInUser.GetOrgID(), "global.users:id:", strconv.FormatInt(userID, 10))
 	userProfile.AvatarURL = dtos.GetGravatarUrl(userProfile.Email)
+	if avatarURL, ok := hs.syncedAvatarURLs(c.Req.Context(), userID)[userID]; ok {
+		userProfile.AvatarURL = avatarURL
+	}
 
 	return response.JSON(http.StatusOK, userProfile)
 }
 
+// syncedAvatarURLs returns the avatars synced from the identity providers of the users, users
+// without one keep their gravatar and are left out.
+func (hs *HTTPServer) syncedAvatarURLs(ctx context.Context, userIDs ...int64) map[int64]string {
+	if hs.authnService == nil || len(userIDs) == 0 {
+		return nil
+	}
+
+	avatarURLs, err := hs.authnService.AvatarURLs(ctx, userIDs...)
+	if err != nil {
+		hs.log.Warn("Failed to get synced avatars", "error", err)
+		return nil
+	}
+	return avatarURLs
+}
+
 // swagger:route GET /users/lookup users getUserByLoginOrEmail
 //
 // Get user by login or email.
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"sync"
 )
 
 // In memory kv store used for testing
 type FakeKVStore struct {
+	mu       sync.RWMutex
 	store    map[Key]string
 	delError bool
 }
@@ -21,12 +23,16 @@ func (f *FakeKVStore) DeletionError(shouldErr bool) {
 }
 
 func (f *FakeKVStore) Get(ctx context.Context, orgId int64, namespace string, key string) (string, bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	value := f.store[buildKey(orgId, namespace, key)]
 	found := value != ""
 	return value, found, nil
 }
 
 func (f *FakeKVStore) Set(ctx context.Context, orgId int64, namespace string, key string, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.store[buildKey(orgId, namespace, key)] = value
 	return nil
 }
@@ -35,12 +41,16 @@ func (f *FakeKVStore) Del(ctx context.Context, orgId int64, namespace string, ke
 	if f.delError {
 		return errors.New("mocked del error")
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	delete(f.store, buildKey(orgId, namespace, key))
 	return nil
 }
 
 // List all keys with an optional filter. If default values are provided, filter is not applied.
 func (f *FakeKVStore) Keys(ctx context.Context, orgId int64, namespace string, keyPrefix string) ([]Key, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	res := make([]Key, 0)
 	for k := range f.store {
 		if orgId == AllOrganizations && namespace == "" && keyPrefix == "" {
@@ -53,16 +63,19 @@ func (f *FakeKVStore) Keys(ctx context.Context, orgId int64, namespace string, k
 }
 
 func (f *FakeKVStore) GetAll(ctx context.Context, orgId int64, namespace string) (map[int64]map[string]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	items := make(map[int64]map[string]string)
-	for k := range f.store {
-		orgId := k.OrgId
-		namespace := k.Namespace
+	for k, v := range f.store {
+		if k.Namespace != namespace || (orgId != AllOrganizations && k.OrgId != orgId) {
+			continue
+		}
 
-		if _, ok := items[orgId]; !ok {
-			items[orgId] = make(map[string]string)
+		if _, ok := items[k.OrgId]; !ok {
+			items[k.OrgId] = make(map[string]string)
 		}
 
-		items[orgId][namespace] = f.store[k]
+		items[k.OrgId][k.Key] = v
 	}
 
 	return items, nil
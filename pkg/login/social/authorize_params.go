@@ -0,0 +1,61 @@
+package social
+
+import (
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// reservedAuthorizeParams are set by the OAuth flow itself. Letting them be configured would
+// break the CSRF, PKCE and replay protections or the callback.
+var reservedAuthorizeParams = map[string]bool{
+	"client_id":             true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+	"nonce":                 true,
+	"redirect_uri":          true,
+	"response_type":         true,
+	"scope":                 true,
+	"state":                 true,
+}
+
+// IsReservedAuthorizeParam reports whether the authorize query param name is managed by the OAuth flow
+// and can't be set with extra_authorize_params.
+func IsReservedAuthorizeParam(name string) bool {
+	return reservedAuthorizeParams[strings.ToLower(name)]
+}
+
+// IsOfflineAccessParam reports whether the authorize query param asks the provider for offline access,
+// i.e. to issue a refresh token.
+func IsOfflineAccessParam(name, value string) bool {
+	switch strings.ToLower(name) {
+	case "access_type":
+		return strings.EqualFold(value, "offline")
+	case "prompt":
+		return slices.Contains(strings.Fields(strings.ToLower(value)), "consent")
+	}
+	return false
+}
+
+// parseExtraAuthorizeParams parses the extra_authorize_params setting, a list of name=value pairs
+// added to the authorize URL. Reserved params are logged and skipped.
+func parseExtraAuthorizeParams(logger log.Logger, provider, value string) map[string]string {
+	params := map[string]string{}
+	for _, pair := range util.SplitString(value) {
+		name, paramValue, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			logger.Warn("Ignoring invalid extra authorize param, expected name=value", "oauth", provider, "param", pair)
+			continue
+		}
+		if IsReservedAuthorizeParam(name) {
+			logger.Warn("Ignoring extra authorize param, it is set by the OAuth flow", "oauth", provider, "param", name)
+			continue
+		}
+		params[name] = strings.TrimSpace(paramValue)
+	}
+	return params
+}
@@ -0,0 +1,17 @@
+package social
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+)
+
+func TestParseExtraAuthorizeParams(t *testing.T) {
+	logger := &logtest.Fake{}
+	params := parseExtraAuthorizeParams(logger, "azuread", "tenant=acme p=B2C_1_signin state=fixed Nonce=fixed invalid")
+
+	assert.Equal(t, map[string]string{"tenant": "acme", "p": "B2C_1_signin"}, params)
+	assert.Equal(t, 3, logger.WarnLogs.Calls)
+}
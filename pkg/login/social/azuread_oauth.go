@@ -64,7 +64,12 @@ func (s *SocialAzureAD) UserInfo(ctx context.Context, client *http.Client, token
 		return nil, ErrIDTokenNotFound
 	}
 
-	parsedToken, err := jwt.ParseSigned(idToken.(string))
+	rawIDToken, err := s.decryptIDToken(idToken.(string))
+	if err != nil {
+		return nil, err
+	}
+
+	parsedToken, err := jwt.ParseSigned(rawIDToken)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing id token: %w", err)
 	}
@@ -0,0 +1,102 @@
+package social
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const pemPrefix = "-----BEGIN"
+
+// clientCertificate is the certificate presented to providers requiring mutual TLS.
+// The certificate and key are either PEM encoded values, e.g. read from a secret, or paths
+// to files that are reloaded when they change so certificates can be rotated without a restart.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+	log      log.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newClientCertificate(cert, key string, logger log.Logger) (*clientCertificate, error) {
+	if isPEM(cert) || isPEM(key) {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		return &clientCertificate{cert: &pair, log: logger}, nil
+	}
+
+	c := &clientCertificate{certFile: cert, keyFile: key, log: logger}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetClientCertificate is used as tls.Config.GetClientCertificate. When the files changed since they
+// were last read the certificate is reloaded, the previous one is kept if the new files are invalid.
+func (c *clientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.certFile != "" {
+		if modTime, err := c.lastModified(); err == nil && !modTime.Equal(c.modTime) {
+			if err := c.reloadLocked(); err != nil {
+				c.log.Warn("Failed to reload TLS client certificate, keeping the previous one", "cert", c.certFile, "error", err)
+			}
+		}
+	}
+
+	return c.cert, nil
+}
+
+func (c *clientCertificate) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reloadLocked()
+}
+
+func (c *clientCertificate) reloadLocked() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &pair
+	c.modTime = modTime
+	return nil
+}
+
+// lastModified returns the most recent modification time of the certificate and key files.
+func (c *clientCertificate) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func isPEM(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), pemPrefix)
+}
@@ -0,0 +1,179 @@
+package social
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issueClientCert returns the PEM encoded certificate and key of a client certificate signed by the CA.
+func (ca *testCA) issueClientCert(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "grafana"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// newMTLSTokenServer starts a fake token endpoint rejecting connections without a client certificate signed by ca.
+func newMTLSTokenServer(t *testing.T, ca *testCA) (*httptest.Server, string) {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every request performs a new handshake so rotated certificates are presented
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "token", "token_type": "Bearer"}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	serverCA := filepath.Join(t.TempDir(), "server-ca.pem")
+	require.NoError(t, os.WriteFile(serverCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	return server, serverCA
+}
+
+func writeClientCert(t *testing.T, dir string, certPEM, keyPEM []byte, modTime time.Time) (string, string) {
+	t.Helper()
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+
+	return certFile, keyFile
+}
+
+func TestSocialService_GetOAuthHttpClient_MutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server, serverCA := newMTLSTokenServer(t, ca)
+
+	newClient := func(t *testing.T, info *OAuthInfo) *http.Client {
+		t.Helper()
+		ss := &SocialService{oAuthProvider: map[string]*OAuthInfo{"generic_oauth": info}, log: log.NewNopLogger()}
+		client, err := ss.GetOAuthHttpClient("oauth_generic_oauth")
+		require.NoError(t, err)
+		return client
+	}
+
+	post := func(client *http.Client) error {
+		resp, err := client.Post(server.URL+"/token", "application/x-www-form-urlencoded", nil)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	t.Run("should reject connections without a client certificate", func(t *testing.T) {
+		client := newClient(t, &OAuthInfo{TlsClientCa: serverCA})
+		assert.Error(t, post(client))
+	})
+
+	t.Run("should accept connections with a client certificate from files", func(t *testing.T) {
+		certPEM, keyPEM := ca.issueClientCert(t)
+		certFile, keyFile := writeClientCert(t, t.TempDir(), certPEM, keyPEM, time.Now())
+
+		client := newClient(t, &OAuthInfo{TlsClientCa: serverCA, TlsClientCert: certFile, TlsClientKey: keyFile})
+		assert.NoError(t, post(client))
+	})
+
+	t.Run("should accept connections with a PEM encoded client certificate", func(t *testing.T) {
+		certPEM, keyPEM := ca.issueClientCert(t)
+
+		client := newClient(t, &OAuthInfo{TlsClientCa: serverCA, TlsClientCert: string(certPEM), TlsClientKey: string(keyPEM)})
+		assert.NoError(t, post(client))
+	})
+
+	t.Run("should reload the client certificate when the files are rotated", func(t *testing.T) {
+		dir := t.TempDir()
+		untrustedCert, untrustedKey := newTestCA(t).issueClientCert(t)
+		certFile, keyFile := writeClientCert(t, dir, untrustedCert, untrustedKey, time.Now().Add(-time.Minute))
+
+		client := newClient(t, &OAuthInfo{TlsClientCa: serverCA, TlsClientCert: certFile, TlsClientKey: keyFile})
+		require.Error(t, post(client))
+
+		certPEM, keyPEM := ca.issueClientCert(t)
+		writeClientCert(t, dir, certPEM, keyPEM, time.Now())
+		assert.NoError(t, post(client))
+	})
+
+	t.Run("should keep the previous certificate when the rotated files are invalid", func(t *testing.T) {
+		dir := t.TempDir()
+		certPEM, keyPEM := ca.issueClientCert(t)
+		certFile, keyFile := writeClientCert(t, dir, certPEM, keyPEM, time.Now().Add(-time.Minute))
+
+		client := newClient(t, &OAuthInfo{TlsClientCa: serverCA, TlsClientCert: certFile, TlsClientKey: keyFile})
+		require.NoError(t, post(client))
+
+		writeClientCert(t, dir, []byte("invalid"), keyPEM, time.Now())
+		assert.NoError(t, post(client))
+	})
+
+	t.Run("should fail when the client certificate can't be loaded", func(t *testing.T) {
+		ss := &SocialService{oAuthProvider: map[string]*OAuthInfo{"generic_oauth": {TlsClientCert: "missing.crt", TlsClientKey: "missing.key"}}, log: log.NewNopLogger()}
+		_, err := ss.GetOAuthHttpClient("generic_oauth")
+		assert.Error(t, err)
+	})
+}
@@ -29,6 +29,43 @@ func (s *SocialBase) IsSignupAllowed() bool {
 	return s.allowSignup
 }
 
+func (s *SocialBase) NormalizeEmail(email string) string {
+	return normalizeEmail(email, s.emailNormalization)
+}
+
+// emailNormalization configures how the emails returned by a provider are canonicalized.
+type emailNormalization struct {
+	enabled bool
+	// lowercaseLocalPart lowercases the part before the @, the domain is always lowercased.
+	lowercaseLocalPart bool
+	// stripPlusAddress drops the +tag suffix of the local part.
+	stripPlusAddress bool
+}
+
+func normalizeEmail(email string, opts emailNormalization) string {
+	if !opts.enabled {
+		return email
+	}
+
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return email
+	}
+
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+	if opts.stripPlusAddress {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	if opts.lowercaseLocalPart {
+		local = strings.ToLower(local)
+	}
+
+	return local + "@" + domain
+}
+
 func isEmailAllowed(email string, allowedDomains []string) bool {
 	if len(allowedDomains) == 0 {
 		return true
@@ -60,7 +97,7 @@ func (s *SocialBase) httpGet(ctx context.Context, client *http.Client, url strin
 		}
 	}()
 
-	body, errRead := io.ReadAll(r.Body)
+	body, errRead := s.readResponseBody(r.Body)
 	if errRead != nil {
 		return nil, errRead
 	}
@@ -76,6 +113,24 @@ func (s *SocialBase) httpGet(ctx context.Context, client *http.Client, url strin
 	return response, nil
 }
 
+// readResponseBody reads a response from the provider API, up to the configured maximum size.
+// Oversized responses are rejected as a truncated JSON document can't be decoded.
+func (s *SocialBase) readResponseBody(body io.Reader) ([]byte, error) {
+	if s.maxResponseSize <= 0 {
+		return io.ReadAll(body)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, s.maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxResponseSize {
+		s.log.Warn("Provider response exceeds the maximum size", "max_bytes", s.maxResponseSize)
+		return nil, &Error{fmt.Sprintf("provider response exceeds the maximum size of %d bytes", s.maxResponseSize)}
+	}
+	return data, nil
+}
+
 func (s *SocialBase) searchJSONForAttr(attributePath string, data []byte) (any, error) {
 	if attributePath == "" {
 		return "", errors.New("no attribute path specified")
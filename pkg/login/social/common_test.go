@@ -0,0 +1,101 @@
+package social
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     *OAuthInfo
+		email    string
+		expected string
+	}{
+		{
+			name:     "lowercases the domain",
+			info:     &OAuthInfo{NormalizeEmail: true},
+			email:    "John.Doe@Example.COM",
+			expected: "John.Doe@example.com",
+		},
+		{
+			name:     "lowercases the local part when enabled",
+			info:     &OAuthInfo{NormalizeEmail: true, NormalizeEmailLocalPart: true},
+			email:    "John.Doe@Example.COM",
+			expected: "john.doe@example.com",
+		},
+		{
+			name:     "drops plus addressing when enabled",
+			info:     &OAuthInfo{NormalizeEmail: true, NormalizeEmailPlus: true},
+			email:    "john+grafana@example.com",
+			expected: "john@example.com",
+		},
+		{
+			name:     "keeps plus addressing by default",
+			info:     &OAuthInfo{NormalizeEmail: true},
+			email:    "john+grafana@example.com",
+			expected: "john+grafana@example.com",
+		},
+		{
+			name:     "keeps a local part starting with plus",
+			info:     &OAuthInfo{NormalizeEmail: true, NormalizeEmailPlus: true},
+			email:    "+john@example.com",
+			expected: "+john@example.com",
+		},
+		{
+			name:     "leaves values without a domain untouched",
+			info:     &OAuthInfo{NormalizeEmail: true, NormalizeEmailLocalPart: true},
+			email:    "John",
+			expected: "John",
+		},
+		{
+			name:     "does nothing when disabled",
+			info:     &OAuthInfo{NormalizeEmail: false, NormalizeEmailLocalPart: true, NormalizeEmailPlus: true},
+			email:    "John+grafana@Example.COM",
+			expected: "John+grafana@Example.COM",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSocialBase("generic_oauth", &oauth2.Config{}, tt.info, "", false, *featuremgmt.WithFeatures())
+
+			normalized := s.NormalizeEmail(tt.email)
+			assert.Equal(t, tt.expected, normalized)
+			// normalizing is idempotent so lookups stay stable
+			assert.Equal(t, normalized, s.NormalizeEmail(normalized))
+		})
+	}
+}
+
+func TestSocialBase_httpGetMaxResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"groups":["` + strings.Repeat("a", 100) + `"]}`))
+	}))
+	defer server.Close()
+
+	t.Run("reads responses within the maximum size", func(t *testing.T) {
+		s := newSocialBase("generic_oauth", &oauth2.Config{}, &OAuthInfo{MaxUserInfoSize: 1024}, "", false, *featuremgmt.WithFeatures())
+
+		resp, err := s.httpGet(context.Background(), server.Client(), server.URL)
+		require.NoError(t, err)
+		assert.Len(t, resp.Body, 115)
+	})
+
+	t.Run("rejects oversized responses", func(t *testing.T) {
+		s := newSocialBase("generic_oauth", &oauth2.Config{}, &OAuthInfo{MaxUserInfoSize: 64}, "", false, *featuremgmt.WithFeatures())
+
+		_, err := s.httpGet(context.Background(), server.Client(), server.URL)
+		var sErr *Error
+		require.ErrorAs(t, err, &sErr)
+	})
+}
@@ -22,6 +22,7 @@ type SocialGenericOAuth struct {
 	emailAttributePath   string
 	loginAttributePath   string
 	nameAttributePath    string
+	avatarAttributePath  string
 	groupsAttributePath  string
 	idTokenAttributeName string
 	teamIdsAttributePath string
@@ -89,16 +90,18 @@ func (s *SocialGenericOAuth) IsOrganizationMember(ctx context.Context, client *h
 }
 
 type UserInfoJson struct {
-	Sub         string              `json:"sub"`
-	Name        string              `json:"name"`
-	DisplayName string              `json:"display_name"`
-	Login       string              `json:"login"`
-	Username    string              `json:"username"`
-	Email       string              `json:"email"`
-	Upn         string              `json:"upn"`
-	Attributes  map[string][]string `json:"attributes"`
-	rawJSON     []byte
-	source      string
+	Sub         string `json:"sub"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Login       string `json:"login"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	// EmailVerified is nil when the claim is absent
+	EmailVerified *bool               `json:"email_verified"`
+	Upn           string              `json:"upn"`
+	Attributes    map[string][]string `json:"attributes"`
+	rawJSON       []byte
+	source        string
 }
 
 func (info *UserInfoJson) String() string {
@@ -141,6 +144,14 @@ func (s *SocialGenericOAuth) UserInfo(ctx context.Context, client *http.Client,
 			}
 		}
 
+		if userInfo.EmailVerified == nil {
+			userInfo.EmailVerified = data.EmailVerified
+		}
+
+		if userInfo.AvatarURL == "" {
+			userInfo.AvatarURL = s.extractAvatar(data)
+		}
+
 		if userInfo.Role == "" && !s.skipOrgRoleSync {
 			role, grafanaAdmin, err := s.extractRoleAndAdminOptional(data.rawJSON, []string{})
 			if err != nil {
@@ -346,6 +357,20 @@ func (s *SocialGenericOAuth) extractUserName(data *UserInfoJson) string {
 	return ""
 }
 
+// extractAvatar returns the profile picture URL of the user, it is validated before being synced.
+func (s *SocialGenericOAuth) extractAvatar(data *UserInfoJson) string {
+	if s.avatarAttributePath == "" {
+		return ""
+	}
+
+	avatar, err := s.searchJSONForStringAttr(s.avatarAttributePath, data.rawJSON)
+	if err != nil {
+		s.log.Debug("Failed to search JSON for avatar attribute", "error", err)
+		return ""
+	}
+	return avatar
+}
+
 func (s *SocialGenericOAuth) extractGroups(data *UserInfoJson) ([]string, error) {
 	if s.groupsAttributePath == "" {
 		return []string{}, nil
@@ -495,6 +520,7 @@ func (s *SocialGenericOAuth) SupportBundleContent(bf *bytes.Buffer) error {
 	bf.WriteString("```ini\n")
 	bf.WriteString(fmt.Sprintf("name_attribute_path = %s\n", s.nameAttributePath))
 	bf.WriteString(fmt.Sprintf("login_attribute_path = %s\n", s.loginAttributePath))
+	bf.WriteString(fmt.Sprintf("avatar_attribute_path = %s\n", s.avatarAttributePath))
 	bf.WriteString(fmt.Sprintf("id_token_attribute_name = %s\n", s.idTokenAttributeName))
 	bf.WriteString(fmt.Sprintf("team_ids_attribute_path = %s\n", s.teamIdsAttributePath))
 	bf.WriteString(fmt.Sprintf("team_ids = %v\n", s.teamIds))
@@ -768,6 +768,59 @@ func TestUserInfoSearchesForGroup(t *testing.T) {
 	})
 }
 
+func TestUserInfoSearchesForAvatar(t *testing.T) {
+	provider := SocialGenericOAuth{
+		SocialBase: &SocialBase{
+			log: newLogger("generic_oauth_test", "debug"),
+		},
+	}
+
+	tests := []struct {
+		name                string
+		avatarAttributePath string
+		expectedResult      string
+	}{
+		{
+			name:                "If the avatar path is not set, the avatar is empty",
+			avatarAttributePath: "",
+			expectedResult:      "",
+		},
+		{
+			name:                "If the avatar path is set, the avatar is set",
+			avatarAttributePath: "picture",
+			expectedResult:      "https://idp.example.com/photos/john.png",
+		},
+		{
+			name:                "If the avatar path is nested, the avatar is set",
+			avatarAttributePath: "profile.photo",
+			expectedResult:      "https://idp.example.com/photos/john-large.png",
+		},
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"email":   "john.doe@example.com",
+		"picture": "https://idp.example.com/photos/john.png",
+		"profile": map[string]any{"photo": "https://idp.example.com/photos/john-large.png"},
+	})
+	require.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write(body)
+		require.NoError(t, err)
+	}))
+	t.Cleanup(ts.Close)
+	provider.apiUrl = ts.URL
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider.avatarAttributePath = test.avatarAttributePath
+			userInfo, err := provider.UserInfo(context.Background(), ts.Client(), &oauth2.Token{Expiry: time.Now()})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedResult, userInfo.AvatarURL)
+		})
+	}
+}
+
 func TestPayloadCompression(t *testing.T) {
 	provider := SocialGenericOAuth{
 		SocialBase: &SocialBase{
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
 )
 
 func TestSocialGoogle_retrieveGroups(t *testing.T) {
@@ -502,3 +504,33 @@ func TestSocialGoogle_UserInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestSocialGoogle_AuthCodeURL_RequestRefreshToken(t *testing.T) {
+	for _, requestRefreshToken := range []bool{true, false} {
+		info := &OAuthInfo{UseRefreshToken: true, RequestRefreshToken: requestRefreshToken}
+		config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.google.com/o/oauth2/auth"}}
+		s := &SocialGoogle{
+			SocialBase: newSocialBase("google", config, info, "Viewer", false, *featuremgmt.WithFeatures(featuremgmt.FlagAccessTokenExpirationCheck)),
+		}
+
+		u, err := url.Parse(s.AuthCodeURL("state"))
+		require.NoError(t, err)
+
+		if requestRefreshToken {
+			assert.Equal(t, "offline", u.Query().Get("access_type"))
+			assert.Equal(t, "consent", u.Query().Get("prompt"))
+		} else {
+			assert.False(t, u.Query().Has("access_type"))
+			assert.False(t, u.Query().Has("prompt"))
+		}
+	}
+}
+
+func TestIsOfflineAccessParam(t *testing.T) {
+	assert.True(t, IsOfflineAccessParam("access_type", "offline"))
+	assert.True(t, IsOfflineAccessParam("prompt", "consent"))
+	assert.True(t, IsOfflineAccessParam("Prompt", "login consent"))
+	assert.False(t, IsOfflineAccessParam("access_type", "online"))
+	assert.False(t, IsOfflineAccessParam("prompt", "login"))
+	assert.False(t, IsOfflineAccessParam("tenant", "offline"))
+}
@@ -0,0 +1,49 @@
+package social
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// parseCustomHeaders parses the custom_headers setting, a list of Name:Value pairs.
+// Values may be read from files or the environment with $__file{} and $__env{} so they
+// can be kept as secrets. The Authorization header is reserved for the oauth2 client.
+func parseCustomHeaders(logger log.Logger, provider, value string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range util.SplitString(value) {
+		name, headerValue, ok := strings.Cut(pair, ":")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !ok || name == "" {
+			logger.Warn("Ignoring invalid custom header, expected Name:Value", "oauth", provider)
+			continue
+		}
+		if name == "Authorization" {
+			logger.Warn("Ignoring custom Authorization header, it is set by the OAuth client", "oauth", provider)
+			continue
+		}
+		headers[name] = strings.TrimSpace(headerValue)
+	}
+	return headers
+}
+
+// headerTransport adds the configured custom headers to the requests sent to the IdP.
+// Headers already set on the request, such as the Authorization header set by the
+// oauth2 client, are never overridden.
+type headerTransport struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,60 @@
+package social
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+)
+
+func TestParseCustomHeaders(t *testing.T) {
+	logger := &logtest.Fake{}
+	headers := parseCustomHeaders(logger, "generic_oauth", "x-tenant:acme X-Api-Key:secret-key Authorization:Bearer invalid")
+
+	assert.Equal(t, map[string]string{"X-Tenant": "acme", "X-Api-Key": "secret-key"}, headers)
+	assert.Equal(t, 2, logger.WarnLogs.Calls)
+	assert.NotContains(t, fmt.Sprint(logger.WarnLogs.Ctx...), "secret")
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"some-token","token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &headerTransport{
+		headers: map[string]string{"X-Tenant": "acme", "X-Api-Key": "secret-key"},
+		next:    http.DefaultTransport,
+	}}
+
+	config := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "client-secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInHeader},
+	}
+	token, err := config.Exchange(context.WithValue(context.Background(), oauth2.HTTPClient, client), "some-code")
+	require.NoError(t, err)
+
+	assert.Equal(t, "acme", received.Get("X-Tenant"))
+	assert.Equal(t, "secret-key", received.Get("X-Api-Key"))
+	assert.Contains(t, received.Get("Authorization"), "Basic ", "the client credentials set by the oauth2 client are kept")
+
+	t.Run("headers set on the request are not overridden", func(t *testing.T) {
+		resp, err := config.Client(context.WithValue(context.Background(), oauth2.HTTPClient, client), token).Get(server.URL)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		assert.Equal(t, "Bearer some-token", received.Get("Authorization"))
+		assert.Equal(t, "acme", received.Get("X-Tenant"))
+	})
+}
@@ -0,0 +1,180 @@
+package social
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	defaultIDTokenEncryptionAlgs = []string{
+		string(jose.RSA_OAEP), string(jose.RSA_OAEP_256),
+		string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A256KW),
+	}
+	defaultIDTokenEncryptionEncs = []string{
+		string(jose.A128GCM), string(jose.A256GCM),
+		string(jose.A128CBC_HS256), string(jose.A256CBC_HS512),
+	}
+)
+
+// idTokenDecrypter decrypts the ID tokens issued as JWE by providers encrypting them to Grafana.
+// A previous key can be configured so tokens encrypted to it keep working while the key is rotated.
+type idTokenDecrypter struct {
+	keys []*decryptionKey
+	algs []string
+	encs []string
+}
+
+// newIDTokenDecrypter returns nil when no decryption key is configured.
+func newIDTokenDecrypter(info *OAuthInfo) *idTokenDecrypter {
+	if info.IDTokenDecryptionKey == "" {
+		return nil
+	}
+
+	d := &idTokenDecrypter{
+		keys: []*decryptionKey{{source: info.IDTokenDecryptionKey}},
+		algs: info.IDTokenEncryptionAlgs,
+		encs: info.IDTokenEncryptionEncs,
+	}
+	if info.IDTokenDecryptionKeyPrevious != "" {
+		d.keys = append(d.keys, &decryptionKey{source: info.IDTokenDecryptionKeyPrevious})
+	}
+	if len(d.algs) == 0 {
+		d.algs = defaultIDTokenEncryptionAlgs
+	}
+	if len(d.encs) == 0 {
+		d.encs = defaultIDTokenEncryptionEncs
+	}
+	return d
+}
+
+// isJWE returns true if the token is in the JWE compact serialization.
+func isJWE(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// decrypt returns the plaintext of an encrypted ID token, usually a nested signed JWT.
+func (d *idTokenDecrypter) decrypt(token string) ([]byte, error) {
+	header, err := jweHeader(token)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(d.algs, header.Alg) {
+		return nil, fmt.Errorf("id_token key encryption algorithm %q is not allowed", header.Alg)
+	}
+	if !slices.Contains(d.encs, header.Enc) {
+		return nil, fmt.Errorf("id_token content encryption algorithm %q is not allowed", header.Enc)
+	}
+
+	encrypted, err := jose.ParseEncrypted(token)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing encrypted id_token: %w", err)
+	}
+
+	var errs []error
+	for _, k := range d.keys {
+		key, err := k.get()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		plaintext, err := encrypted.Decrypt(key)
+		if err == nil {
+			return plaintext, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("error decrypting id_token: %w", errors.Join(errs...))
+}
+
+type jweProtectedHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+}
+
+func jweHeader(token string) (*jweProtectedHeader, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.SplitN(token, ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("error base64 decoding id_token header: %w", err)
+	}
+
+	var header jweProtectedHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, fmt.Errorf("error deserializing id_token header: %w", err)
+	}
+	return &header, nil
+}
+
+// decryptionKey is a PEM encoded private key, e.g. read from a secret, or the path to a file
+// holding one. Files are reloaded when they change so the key can be rotated without a restart.
+type decryptionKey struct {
+	source string
+
+	mu      sync.Mutex
+	key     any
+	modTime time.Time
+}
+
+func (k *decryptionKey) get() (any, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if isPEM(k.source) {
+		if k.key == nil {
+			key, err := parsePrivateKey([]byte(k.source))
+			if err != nil {
+				return nil, err
+			}
+			k.key = key
+		}
+		return k.key, nil
+	}
+
+	info, err := os.Stat(k.source)
+	if err != nil {
+		return nil, err
+	}
+	if k.key != nil && info.ModTime().Equal(k.modTime) {
+		return k.key, nil
+	}
+
+	data, err := os.ReadFile(k.source)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	k.key, k.modTime = key, info.ModTime()
+	return key, nil
+}
+
+func parsePrivateKey(data []byte) (any, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("id_token decryption key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("id_token decryption key is not a supported private key")
+}
@@ -0,0 +1,165 @@
+package social
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+type idTokenClaims struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email"`
+}
+
+func newDecryptionKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func signIDToken(t *testing.T, claims idTokenClaims) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("signing-secret-of-32-bytes-long!")}, nil)
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func encryptIDToken(t *testing.T, key *rsa.PrivateKey, alg jose.KeyAlgorithm, payload string) string {
+	t.Helper()
+
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: &key.PublicKey}, (&jose.EncrypterOptions{}).WithContentType("JWT"))
+	require.NoError(t, err)
+	encrypted, err := encrypter.Encrypt([]byte(payload))
+	require.NoError(t, err)
+	token, err := encrypted.CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestSocialBase_retrieveRawIDToken_Encrypted(t *testing.T) {
+	key, keyPEM := newDecryptionKey(t)
+	claims := idTokenClaims{Subject: "123", Email: "test@example.com"}
+	signed := signIDToken(t, claims)
+
+	newBase := func(info *OAuthInfo) *SocialBase {
+		return newSocialBase("generic_oauth", &oauth2.Config{}, info, "Viewer", false, *featuremgmt.WithFeatures())
+	}
+
+	t.Run("should decrypt an encrypted id token", func(t *testing.T) {
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: keyPEM})
+
+		rawJSON, err := s.retrieveRawIDToken(encryptIDToken(t, key, jose.RSA_OAEP_256, signed))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"sub": "123", "email": "test@example.com"}`, string(rawJSON))
+	})
+
+	t.Run("should still read a signed id token", func(t *testing.T) {
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: keyPEM})
+
+		rawJSON, err := s.retrieveRawIDToken(signed)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"sub": "123", "email": "test@example.com"}`, string(rawJSON))
+	})
+
+	t.Run("should read claims encrypted without a nested token", func(t *testing.T) {
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: keyPEM})
+
+		rawJSON, err := s.retrieveRawIDToken(encryptIDToken(t, key, jose.RSA_OAEP, `{"sub": "123"}`))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"sub": "123"}`, string(rawJSON))
+	})
+
+	t.Run("should decrypt tokens encrypted to the previous key while rotating", func(t *testing.T) {
+		previousKey, previousPEM := newDecryptionKey(t)
+		_, currentPEM := newDecryptionKey(t)
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: currentPEM, IDTokenDecryptionKeyPrevious: previousPEM})
+
+		_, err := s.retrieveRawIDToken(encryptIDToken(t, previousKey, jose.RSA_OAEP_256, signed))
+		require.NoError(t, err)
+	})
+
+	t.Run("should reload the key file when it is rotated", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "id_token.key")
+		require.NoError(t, os.WriteFile(keyFile, []byte(keyPEM), 0o600))
+		require.NoError(t, os.Chtimes(keyFile, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)))
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: keyFile})
+
+		_, err := s.retrieveRawIDToken(encryptIDToken(t, key, jose.RSA_OAEP_256, signed))
+		require.NoError(t, err)
+
+		rotatedKey, rotatedPEM := newDecryptionKey(t)
+		require.NoError(t, os.WriteFile(keyFile, []byte(rotatedPEM), 0o600))
+		require.NoError(t, os.Chtimes(keyFile, time.Now(), time.Now()))
+
+		_, err = s.retrieveRawIDToken(encryptIDToken(t, rotatedKey, jose.RSA_OAEP_256, signed))
+		require.NoError(t, err)
+	})
+
+	t.Run("should reject key encryption algorithms that are not allowed", func(t *testing.T) {
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: keyPEM, IDTokenEncryptionAlgs: []string{string(jose.RSA_OAEP_256)}})
+
+		_, err := s.retrieveRawIDToken(encryptIDToken(t, key, jose.RSA_OAEP, signed))
+		require.ErrorContains(t, err, "not allowed")
+	})
+
+	t.Run("should reject encrypted id tokens when no key is configured", func(t *testing.T) {
+		s := newBase(&OAuthInfo{})
+
+		_, err := s.retrieveRawIDToken(encryptIDToken(t, key, jose.RSA_OAEP_256, signed))
+		require.Error(t, err)
+	})
+
+	t.Run("should reject id tokens encrypted to another key", func(t *testing.T) {
+		otherKey, _ := newDecryptionKey(t)
+		s := newBase(&OAuthInfo{IDTokenDecryptionKey: keyPEM})
+
+		_, err := s.retrieveRawIDToken(encryptIDToken(t, otherKey, jose.RSA_OAEP_256, signed))
+		require.Error(t, err)
+	})
+}
+
+func TestSocialBase_IDTokenClaims(t *testing.T) {
+	key, keyPEM := newDecryptionKey(t)
+	s := newSocialBase("generic_oauth", &oauth2.Config{}, &OAuthInfo{IDTokenDecryptionKey: keyPEM}, "Viewer", false, *featuremgmt.WithFeatures())
+	signed := signIDToken(t, idTokenClaims{Subject: "123", Email: "test@example.com"})
+
+	t.Run("should read the claims of an encrypted id token", func(t *testing.T) {
+		token := (&oauth2.Token{}).WithExtra(map[string]any{"id_token": encryptIDToken(t, key, jose.RSA_OAEP_256, signed)})
+
+		claims, err := s.IDTokenClaims(token)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{"sub": "123", "email": "test@example.com"}, claims)
+	})
+
+	t.Run("should read the claims of a signed id token", func(t *testing.T) {
+		claims, err := s.IDTokenClaims((&oauth2.Token{}).WithExtra(map[string]any{"id_token": signed}))
+		require.NoError(t, err)
+		assert.Equal(t, "123", claims["sub"])
+	})
+
+	t.Run("should return no claims without id token", func(t *testing.T) {
+		claims, err := s.IDTokenClaims(&oauth2.Token{})
+		require.NoError(t, err)
+		assert.Nil(t, claims)
+	})
+}
@@ -0,0 +1,112 @@
+package social
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+// Phases of the OAuth flow used to label requests sent to the IdP.
+const (
+	PhaseToken    = "token"
+	PhaseUserInfo = "userinfo"
+	PhaseJWKS     = "jwks"
+	phaseOther    = "other"
+)
+
+var idpRequestHistogram = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Subsystem: "oauth",
+		Name:      "idp_request_duration_seconds",
+		Help:      "histogram of durations of requests sent from Grafana to OAuth identity providers",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"provider", "phase", "code"},
+)
+
+// loggedResponseHeaders are the response headers that are safe to include in debug logs.
+var loggedResponseHeaders = []string{
+	"Age",
+	"Cache-Control",
+	"Content-Length",
+	"Content-Type",
+	"Date",
+	"Expires",
+	"Retry-After",
+	"X-Request-Id",
+}
+
+type requestPhaseKey struct{}
+
+// WithRequestPhase returns a context labeling the requests sent to the IdP with the given phase.
+func WithRequestPhase(ctx context.Context, phase string) context.Context {
+	return context.WithValue(ctx, requestPhaseKey{}, phase)
+}
+
+func requestPhase(ctx context.Context) string {
+	if phase, ok := ctx.Value(requestPhaseKey{}).(string); ok {
+		return phase
+	}
+	return phaseOther
+}
+
+// instrumentedTransport measures the requests sent to the IdP and, when debug is enabled,
+// logs their timing together with a safe subset of the response headers.
+// Request headers and bodies are never logged as they carry credentials and tokens.
+type instrumentedTransport struct {
+	provider string
+	debug    bool
+	log      log.Logger
+	next     http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	phase := requestPhase(req.Context())
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	duration := time.Since(start)
+
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	idpRequestHistogram.WithLabelValues(t.provider, phase, code).Observe(duration.Seconds())
+
+	if t.debug {
+		args := []any{
+			"provider", t.provider,
+			"phase", phase,
+			"method", req.Method,
+			"host", req.URL.Host,
+			"path", req.URL.Path,
+			"status", code,
+			"duration", duration,
+		}
+		if resp != nil {
+			args = append(args, "headers", safeResponseHeaders(resp.Header))
+		}
+		if err != nil {
+			args = append(args, "error", err)
+		}
+		t.log.Debug("OAuth IdP request", args...)
+	}
+
+	return resp, err
+}
+
+func safeResponseHeaders(header http.Header) map[string]string {
+	result := make(map[string]string, len(loggedResponseHeaders))
+	for _, name := range loggedResponseHeaders {
+		if v := header.Get(name); v != "" {
+			result[name] = v
+		}
+	}
+	return result
+}
@@ -53,7 +53,12 @@ func (s *SocialOkta) UserInfo(ctx context.Context, client *http.Client, token *o
 		return nil, fmt.Errorf("no id_token found")
 	}
 
-	parsedToken, err := jwt.ParseSigned(idToken.(string))
+	rawIDToken, err := s.decryptIDToken(idToken.(string))
+	if err != nil {
+		return nil, err
+	}
+
+	parsedToken, err := jwt.ParseSigned(rawIDToken)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing id token: %w", err)
 	}
@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -54,7 +55,12 @@ type OAuthInfo struct {
 	GroupsAttributePath     string   `toml:"groups_attribute_path"`
 	HostedDomain            string   `toml:"hosted_domain"`
 	Icon                    string   `toml:"icon"`
+	Issuer                  string   `toml:"issuer"`
+	JwkSetUrl               string   `toml:"jwk_set_url"`
+	LoginGeneration         string   `toml:"login_generation"`
+	LoginGenerationClaim    string   `toml:"login_generation_claim"`
 	Name                    string   `toml:"name"`
+	OversizedClaims         string   `toml:"oversized_claims"`
 	RoleAttributePath       string   `toml:"role_attribute_path"`
 	TeamIdsAttributePath    string   `toml:"team_ids_attribute_path"`
 	TeamsUrl                string   `toml:"teams_url"`
@@ -63,15 +69,53 @@ type OAuthInfo struct {
 	TlsClientKey            string   `toml:"tls_client_key"`
 	TokenUrl                string   `toml:"token_url"`
 	AllowedDomains          []string `toml:"allowed_domains"`
+	Audiences               []string `toml:"audience"`
+	Resources               []string `toml:"resource"`
 	Scopes                  []string `toml:"scopes"`
+	MaxAge                  int      `toml:"max_age"`
+	MaxGroups               int      `toml:"max_groups"`
+	MaxUserInfoSize         int64    `toml:"max_userinfo_size_bytes"`
 	AllowAssignGrafanaAdmin bool     `toml:"allow_assign_grafana_admin"`
 	AllowSignup             bool     `toml:"allow_signup"`
 	AutoLogin               bool     `toml:"auto_login"`
+	BindSessionSID          bool     `toml:"bind_session_sid"`
 	Enabled                 bool     `toml:"enabled"`
+	LogIdPRequests          bool     `toml:"log_idp_requests"`
+	NormalizeEmail          bool     `toml:"normalize_email"`
+	NormalizeEmailLocalPart bool     `toml:"normalize_email_local_part"`
+	NormalizeEmailPlus      bool     `toml:"normalize_email_plus_addressing"`
 	RoleAttributeStrict     bool     `toml:"role_attribute_strict"`
+	SyncAvatar              bool     `toml:"sync_avatar"`
 	TlsSkipVerify           bool     `toml:"tls_skip_verify"`
 	UsePKCE                 bool     `toml:"use_pkce"`
 	UseRefreshToken         bool     `toml:"use_refresh_token"`
+
+	// CustomHeaders are sent on every request to the IdP, the values may be secrets
+	CustomHeaders map[string]string `toml:"-"`
+	// ExtraAuthorizeParams are static query params added to the authorize URL
+	ExtraAuthorizeParams map[string]string `toml:"extra_authorize_params"`
+	// IDTokenDecryptionKey decrypts encrypted ID tokens, it is a PEM encoded private key or the path to one
+	IDTokenDecryptionKey string `toml:"-"`
+	// IDTokenDecryptionKeyPrevious is tried when the current key fails while the key is rotated
+	IDTokenDecryptionKeyPrevious string `toml:"-"`
+	// IDTokenEncryptionAlgs and IDTokenEncryptionEncs restrict the algorithms accepted for encrypted ID tokens
+	IDTokenEncryptionAlgs []string `toml:"id_token_encryption_algs"`
+	IDTokenEncryptionEncs []string `toml:"id_token_encryption_encs"`
+	// AuthorizationResponseIssRequired rejects authorization responses without the iss parameter (RFC 9207),
+	// the parameter is validated against Issuer whenever it is sent
+	AuthorizationResponseIssRequired bool `toml:"authorization_response_iss_required"`
+	// RequestRefreshToken controls whether offline access is requested from the provider. When false no refresh
+	// token is requested or stored, so the tokens can't be refreshed in the background
+	RequestRefreshToken bool `toml:"request_refresh_token"`
+	// TenantClaim is the ID token claim holding the tenant of the user. When set, only users of the tenants in
+	// AllowedTenants or TenantOrgMapping can log in
+	TenantClaim    string   `toml:"tenant_claim"`
+	AllowedTenants []string `toml:"allowed_tenants"`
+	// TenantOrgMapping maps tenants to the org their users are assigned to instead of the auto assigned org
+	TenantOrgMapping map[string]int64 `toml:"tenant_org_mapping"`
+	// UserInfoIDTokenFallback tolerates failures to fetch the user info when the ID token has an email,
+	// the user info is then read from the ID token claims
+	UserInfoIDTokenFallback bool `toml:"userinfo_id_token_fallback"`
 }
 
 func ProvideService(cfg *setting.Cfg,
@@ -105,9 +149,12 @@ func ProvideService(cfg *setting.Cfg,
 			EmailAttributePath:      sec.Key("email_attribute_path").String(),
 			RoleAttributePath:       sec.Key("role_attribute_path").String(),
 			RoleAttributeStrict:     sec.Key("role_attribute_strict").MustBool(),
+			SyncAvatar:              sec.Key("sync_avatar").MustBool(true),
 			GroupsAttributePath:     sec.Key("groups_attribute_path").String(),
 			TeamIdsAttributePath:    sec.Key("team_ids_attribute_path").String(),
 			AllowedDomains:          util.SplitString(sec.Key("allowed_domains").String()),
+			Audiences:               util.SplitString(sec.Key("audience").String()),
+			Resources:               util.SplitString(sec.Key("resource").String()),
 			HostedDomain:            sec.Key("hosted_domain").String(),
 			AllowSignup:             sec.Key("allow_sign_up").MustBool(),
 			Name:                    sec.Key("name").MustString(name),
@@ -120,8 +167,35 @@ func ProvideService(cfg *setting.Cfg,
 			UseRefreshToken:         sec.Key("use_refresh_token").MustBool(false),
 			AllowAssignGrafanaAdmin: sec.Key("allow_assign_grafana_admin").MustBool(false),
 			AutoLogin:               sec.Key("auto_login").MustBool(false),
+			LogIdPRequests:          sec.Key("log_idp_requests").MustBool(false),
+			NormalizeEmail:          sec.Key("normalize_email").MustBool(true),
+			NormalizeEmailLocalPart: sec.Key("normalize_email_local_part").MustBool(false),
+			NormalizeEmailPlus:      sec.Key("normalize_email_plus_addressing").MustBool(false),
+			MaxAge:                  sec.Key("max_age").MustInt(0),
+			MaxGroups:               sec.Key("max_groups").MustInt(0),
+			MaxUserInfoSize:         sec.Key("max_userinfo_size_bytes").MustInt64(0),
+			OversizedClaims:         sec.Key("oversized_claims").In(OversizedClaimsTruncate, []string{OversizedClaimsTruncate, OversizedClaimsReject}),
+			BindSessionSID:          sec.Key("bind_session_sid").MustBool(false),
+			JwkSetUrl:               sec.Key("jwk_set_url").String(),
+			Issuer:                  sec.Key("issuer").String(),
+			LoginGeneration:         sec.Key("login_generation").In("", []string{LoginGenerationEmailLocalPart, LoginGenerationName, LoginGenerationClaim}),
+			LoginGenerationClaim:    sec.Key("login_generation_claim").String(),
+			CustomHeaders:           parseCustomHeaders(ss.log, name, sec.Key("custom_headers").String()),
+			ExtraAuthorizeParams:    parseExtraAuthorizeParams(ss.log, name, sec.Key("extra_authorize_params").String()),
 		}
 
+		// the decryption keys are secrets, either PEM encoded values, e.g. from $__file{}, or paths to key files
+		info.IDTokenDecryptionKey = sec.Key("id_token_decryption_key").String()
+		info.IDTokenDecryptionKeyPrevious = sec.Key("id_token_decryption_key_previous").String()
+		info.IDTokenEncryptionAlgs = util.SplitString(sec.Key("id_token_encryption_algs").String())
+		info.IDTokenEncryptionEncs = util.SplitString(sec.Key("id_token_encryption_encs").String())
+		info.AuthorizationResponseIssRequired = sec.Key("authorization_response_iss_required").MustBool(false)
+		info.RequestRefreshToken = sec.Key("request_refresh_token").MustBool(true)
+		info.TenantClaim = sec.Key("tenant_claim").String()
+		info.AllowedTenants = util.SplitString(sec.Key("allowed_tenants").String())
+		info.TenantOrgMapping = parseTenantOrgMapping(ss.log, name, sec.Key("tenant_org_mapping").String())
+		info.UserInfoIDTokenFallback = sec.Key("userinfo_id_token_fallback").MustBool(false)
+
 		// when empty_scopes parameter exists and is true, overwrite scope with empty value
 		if sec.Key("empty_scopes").MustBool() {
 			info.Scopes = []string{}
@@ -162,6 +236,11 @@ func ProvideService(cfg *setting.Cfg,
 			Scopes:      info.Scopes,
 		}
 
+		// offline access is what makes providers issue refresh tokens, it is dropped from the configured scopes too
+		if !info.RequestRefreshToken {
+			config.Scopes = removeScope(config.Scopes, OfflineAccessScope)
+		}
+
 		// GitHub.
 		if name == "github" {
 			ss.socialMap["github"] = &SocialGithub{
@@ -206,7 +285,7 @@ func ProvideService(cfg *setting.Cfg,
 				forceUseGraphAPI:     sec.Key("force_use_graph_api").MustBool(false),
 				skipOrgRoleSync:      cfg.AzureADSkipOrgRoleSync,
 			}
-			if info.UseRefreshToken && features.IsEnabled(featuremgmt.FlagAccessTokenExpirationCheck) {
+			if info.UseRefreshToken && info.RequestRefreshToken && features.IsEnabled(featuremgmt.FlagAccessTokenExpirationCheck) {
 				appendUniqueScope(&config, OfflineAccessScope)
 			}
 		}
@@ -219,7 +298,7 @@ func ProvideService(cfg *setting.Cfg,
 				allowedGroups:   util.SplitString(sec.Key("allowed_groups").String()),
 				skipOrgRoleSync: cfg.OktaSkipOrgRoleSync,
 			}
-			if info.UseRefreshToken && features.IsEnabled(featuremgmt.FlagAccessTokenExpirationCheck) {
+			if info.UseRefreshToken && info.RequestRefreshToken && features.IsEnabled(featuremgmt.FlagAccessTokenExpirationCheck) {
 				appendUniqueScope(&config, OfflineAccessScope)
 			}
 		}
@@ -235,6 +314,7 @@ func ProvideService(cfg *setting.Cfg,
 				nameAttributePath:    sec.Key("name_attribute_path").String(),
 				groupsAttributePath:  info.GroupsAttributePath,
 				loginAttributePath:   sec.Key("login_attribute_path").String(),
+				avatarAttributePath:  sec.Key("avatar_attribute_path").MustString("picture"),
 				idTokenAttributeName: sec.Key("id_token_attribute_name").String(),
 				teamIdsAttributePath: sec.Key("team_ids_attribute_path").String(),
 				teamIds:              sec.Key("team_ids").Strings(","),
@@ -279,6 +359,8 @@ type BasicUserInfo struct {
 	Role           org.RoleType
 	IsGrafanaAdmin *bool // nil will avoid overriding user's set server admin setting
 	Groups         []string
+	EmailVerified  *bool // nil when the provider didn't assert whether the email is verified
+	AvatarURL      string
 }
 
 func (b *BasicUserInfo) String() string {
@@ -286,11 +368,33 @@ func (b *BasicUserInfo) String() string {
 		b.Id, b.Name, b.Email, b.Login, b.Role, b.Groups)
 }
 
+const (
+	// OversizedClaimsTruncate drops the groups over the configured maximum.
+	OversizedClaimsTruncate = "truncate"
+	// OversizedClaimsReject fails the login of users with more groups than the configured maximum.
+	OversizedClaimsReject = "reject"
+)
+
+const (
+	// LoginGenerationEmailLocalPart generates the login of users without login from the local part of their email.
+	LoginGenerationEmailLocalPart = "email_local_part"
+	// LoginGenerationName generates the login of users without login from their name.
+	LoginGenerationName = "name"
+	// LoginGenerationClaim generates the login of users without login from the id token claim set in login_generation_claim.
+	LoginGenerationClaim = "claim"
+)
+
 //go:generate mockery --name SocialConnector --structname MockSocialConnector --outpkg socialtest --filename social_connector_mock.go --output ../socialtest/
 type SocialConnector interface {
 	UserInfo(ctx context.Context, client *http.Client, token *oauth2.Token) (*BasicUserInfo, error)
 	IsEmailAllowed(email string) bool
 	IsSignupAllowed() bool
+	// NormalizeEmail returns the canonical form of an email returned by the provider
+	// so the same person always maps to the same user.
+	NormalizeEmail(email string) string
+	// IDTokenClaims returns the claims of the id token of the token, decrypting it first when it's
+	// encrypted, or nil when there is no id token. The signature isn't verified.
+	IDTokenClaims(token *oauth2.Token) (map[string]any, error)
 
 	AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string
 	Exchange(ctx context.Context, code string, authOptions ...oauth2.AuthCodeOption) (*oauth2.Token, error)
@@ -305,13 +409,19 @@ type SocialBase struct {
 	allowSignup             bool
 	allowAssignGrafanaAdmin bool
 	allowedDomains          []string
+	emailNormalization      emailNormalization
+	// maxResponseSize is the maximum size of the responses read from the provider API, 0 means no limit.
+	maxResponseSize int64
 
 	roleAttributePath   string
 	roleAttributeStrict bool
 	autoAssignOrgRole   string
 	skipOrgRoleSync     bool
 	features            featuremgmt.FeatureManager
-	useRefreshToken     bool
+	// useRefreshToken is set when refresh tokens are used and requested from the provider
+	useRefreshToken bool
+	// idTokenDecrypter decrypts encrypted ID tokens, they are rejected when nil
+	idTokenDecrypter *idTokenDecrypter
 }
 
 type Error struct {
@@ -361,7 +471,14 @@ func newSocialBase(name string,
 		roleAttributeStrict:     info.RoleAttributeStrict,
 		skipOrgRoleSync:         skipOrgRoleSync,
 		features:                features,
-		useRefreshToken:         info.UseRefreshToken,
+		useRefreshToken:         info.UseRefreshToken && info.RequestRefreshToken,
+		maxResponseSize:         info.MaxUserInfoSize,
+		idTokenDecrypter:        newIDTokenDecrypter(info),
+		emailNormalization: emailNormalization{
+			enabled:            info.NormalizeEmail,
+			lowercaseLocalPart: info.NormalizeEmailLocalPart,
+			stripPlusAddress:   info.NormalizeEmailPlus,
+		},
 	}
 }
 
@@ -505,19 +622,25 @@ func (ss *SocialService) GetOAuthHttpClient(name string) (*http.Client, error) {
 		IdleConnTimeout:       90 * time.Second,
 	}
 
+	var next http.RoundTripper = tr
+	if len(info.CustomHeaders) > 0 {
+		next = &headerTransport{headers: info.CustomHeaders, next: tr}
+	}
+
 	oauthClient := &http.Client{
-		Transport: tr,
+		Transport: &instrumentedTransport{provider: name, debug: info.LogIdPRequests, log: ss.log, next: next},
 		Timeout:   time.Second * 15,
 	}
 
 	if info.TlsClientCert != "" || info.TlsClientKey != "" {
-		cert, err := tls.LoadX509KeyPair(info.TlsClientCert, info.TlsClientKey)
+		cert, err := newClientCertificate(info.TlsClientCert, info.TlsClientKey, ss.log.New("oauth", name))
 		if err != nil {
 			ss.log.Error("Failed to setup TlsClientCert", "oauth", name, "error", err)
 			return nil, fmt.Errorf("failed to setup TlsClientCert: %w", err)
 		}
 
-		tr.TLSClientConfig.Certificates = append(tr.TLSClientConfig.Certificates, cert)
+		// the certificate is presented on every connection, including the token, user info and jwks requests
+		tr.TLSClientConfig.GetClientCertificate = cert.GetClientCertificate
 	}
 
 	if info.TlsClientCa != "" {
@@ -543,6 +666,12 @@ func (ss *SocialService) GetConnector(name string) (SocialConnector, error) {
 	return connector, nil
 }
 
+// IsKnownProvider returns true if name is one of the supported OAuth providers.
+// It only checks the name against the fixed set of providers, regardless of configuration.
+func IsKnownProvider(name string) bool {
+	return name != "grafananet" && slices.Contains(allOauthes, name)
+}
+
 func (ss *SocialService) GetOAuthInfoProvider(name string) *OAuthInfo {
 	return ss.oAuthProvider[name]
 }
@@ -577,6 +706,15 @@ func (s *SocialBase) retrieveRawIDToken(idToken interface{}) ([]byte, error) {
 		return nil, fmt.Errorf("id_token is not a string: %v", idToken)
 	}
 
+	tokenString, err := s.decryptIDToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	// encrypted tokens can hold the claims directly instead of a nested signed token
+	if strings.HasPrefix(tokenString, "{") {
+		return []byte(tokenString), nil
+	}
+
 	jwtRegexp := regexp.MustCompile("^([-_a-zA-Z0-9=]+)[.]([-_a-zA-Z0-9=]+)[.]([-_a-zA-Z0-9=]+)$")
 	matched := jwtRegexp.FindStringSubmatch(tokenString)
 	if matched == nil {
@@ -627,6 +765,50 @@ func (s *SocialBase) retrieveRawIDToken(idToken interface{}) ([]byte, error) {
 	return rawJSON, nil
 }
 
+func (s *SocialBase) IDTokenClaims(token *oauth2.Token) (map[string]any, error) {
+	idToken := token.Extra("id_token")
+	if idToken == nil || idToken == "" {
+		return nil, nil
+	}
+
+	rawJSON, err := s.retrieveRawIDToken(idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(rawJSON, &claims); err != nil {
+		return nil, fmt.Errorf("error deserializing id_token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// decryptIDToken returns the plaintext of encrypted ID tokens, other tokens are returned as is.
+func (s *SocialBase) decryptIDToken(token string) (string, error) {
+	if !isJWE(token) {
+		return token, nil
+	}
+	if s.idTokenDecrypter == nil {
+		return "", errors.New("id_token is encrypted but no decryption key is configured")
+	}
+
+	plaintext, err := s.idTokenDecrypter.decrypt(token)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func removeScope(scopes []string, scope string) []string {
+	res := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		if s != scope {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
 func appendUniqueScope(config *oauth2.Config, scope string) {
 	if !slices.Contains(config.Scopes, OfflineAccessScope) {
 		config.Scopes = append(config.Scopes, OfflineAccessScope)
@@ -0,0 +1,25 @@
+package social
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// parseTenantOrgMapping parses the tenant_org_mapping setting, a list of tenant:orgId pairs.
+func parseTenantOrgMapping(logger log.Logger, provider, value string) map[string]int64 {
+	mapping := map[string]int64{}
+	for _, pair := range util.SplitString(value) {
+		tenant, org, ok := strings.Cut(pair, ":")
+		tenant = strings.TrimSpace(tenant)
+		orgID, err := strconv.ParseInt(strings.TrimSpace(org), 10, 64)
+		if !ok || tenant == "" || err != nil || orgID <= 0 {
+			logger.Warn("Ignoring invalid tenant org mapping, expected tenant:orgId", "oauth", provider, "mapping", pair)
+			continue
+		}
+		mapping[tenant] = orgID
+	}
+	return mapping
+}
@@ -0,0 +1,17 @@
+package social
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+)
+
+func TestParseTenantOrgMapping(t *testing.T) {
+	logger := &logtest.Fake{}
+	mapping := parseTenantOrgMapping(logger, "generic_oauth", "acme:2, globex:3 initech invalid:org :4 zero:0")
+
+	assert.Equal(t, map[string]int64{"acme": 2, "globex": 3}, mapping)
+	assert.Equal(t, 4, logger.WarnLogs.Calls)
+}
@@ -90,6 +90,32 @@ func (_m *MockSocialConnector) Exchange(ctx context.Context, code string, authOp
 	return r0, r1
 }
 
+// IDTokenClaims provides a mock function with given fields: token
+func (_m *MockSocialConnector) IDTokenClaims(token *oauth2.Token) (map[string]any, error) {
+	ret := _m.Called(token)
+
+	var r0 map[string]any
+	var r1 error
+	if rf, ok := ret.Get(0).(func(*oauth2.Token) (map[string]any, error)); ok {
+		return rf(token)
+	}
+	if rf, ok := ret.Get(0).(func(*oauth2.Token) map[string]any); ok {
+		r0 = rf(token)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]any)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(*oauth2.Token) error); ok {
+		r1 = rf(token)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // IsEmailAllowed provides a mock function with given fields: email
 func (_m *MockSocialConnector) IsEmailAllowed(email string) bool {
 	ret := _m.Called(email)
@@ -104,6 +130,20 @@ func (_m *MockSocialConnector) IsEmailAllowed(email string) bool {
 	return r0
 }
 
+// NormalizeEmail provides a mock function with given fields: email
+func (_m *MockSocialConnector) NormalizeEmail(email string) string {
+	ret := _m.Called(email)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(email)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // IsSignupAllowed provides a mock function with given fields:
 func (_m *MockSocialConnector) IsSignupAllowed() bool {
 	ret := _m.Called()
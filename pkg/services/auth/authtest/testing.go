@@ -159,3 +159,10 @@ func (ts *FakeOAuthTokenService) TryTokenRefresh(ctx context.Context, usr *login
 	}
 	return nil
 }
+
+func (ts *FakeOAuthTokenService) RefreshToken(ctx context.Context, userID int64, provider string) (*oauth2.Token, error) {
+	if err, ok := ts.ExpectedErrors["RefreshToken"]; ok {
+		return nil, err
+	}
+	return ts.GetCurrentOAuthToken(ctx, nil), nil
+}
@@ -39,6 +39,12 @@ const (
 	MetaKeyUsername   = "username"
 	MetaKeyAuthModule = "authModule"
 	MetaKeyIsLogin    = "isLogin"
+	// MetaKeyPrompt is the prompt value clients supporting it send to the identity provider, e.g. "login"
+	// to force the user to authenticate again
+	MetaKeyPrompt = "prompt"
+	// MetaKeyCorrelationID identifies a login flow across the redirect to the identity provider and the callback,
+	// it is logged with the flow and shown to the user when the login fails
+	MetaKeyCorrelationID = "correlationID"
 )
 
 // ClientParams are hints to the auth service about how to handle the identity management
@@ -48,6 +54,14 @@ type ClientParams struct {
 	SyncUser bool
 	// AllowSignUp Adds identity to DB if it doesn't exist when, only work if SyncUser is enabled
 	AllowSignUp bool
+	// VerifyEmailDomain requires the email domain to have MX records before signing up the identity, only work if AllowSignUp is enabled
+	VerifyEmailDomain bool
+	// UnverifiedEmail rejects signing up the identity, the identity provider didn't assert its email is verified.
+	// Only work if AllowSignUp is enabled
+	UnverifiedEmail bool
+	// GeneratedLogin is used as login when signing up an identity without login, a numeric suffix is
+	// appended when it's already taken. Only work if AllowSignUp is enabled
+	GeneratedLogin string
 	// EnableDisabledUsers will enable disabled user, only work if SyncUser is enabled
 	EnableDisabledUsers bool
 	// FetchSyncedUser ensure that all required information is added to the identity
@@ -56,6 +70,19 @@ type ClientParams struct {
 	SyncTeams bool
 	// SyncOrgRoles will sync the roles from the identity to orgs in grafana
 	SyncOrgRoles bool
+	// PreserveManualOrgs only removes the user from orgs previously added or updated by org sync,
+	// memberships assigned manually are kept. Only work if SyncOrgRoles is enabled
+	PreserveManualOrgs bool
+	// ShadowSync records the changes syncing ShadowOrgRoles, ShadowIsGrafanaAdmin and the groups of the
+	// identity would make without applying them, only work if SyncUser is enabled
+	ShadowSync bool
+	// ShadowOrgRoles are the org roles the identity would be synced to, only used if ShadowSync is enabled
+	ShadowOrgRoles map[int64]org.RoleType
+	// ShadowIsGrafanaAdmin is the server admin flag the identity would be synced to, only used if ShadowSync is enabled
+	ShadowIsGrafanaAdmin *bool
+	// SyncAvatar stores the AvatarURL of the identity, or removes the stored one when it is empty,
+	// only work if SyncUser is enabled
+	SyncAvatar bool
 	// CacheAuthProxyKey  if this key is set we will try to cache the user id for proxy client
 	CacheAuthProxyKey string
 	// LookUpParams are the arguments used to look up the entity in the DB.
@@ -67,6 +94,9 @@ type ClientParams struct {
 type PostAuthHookFn func(ctx context.Context, identity *Identity, r *Request) error
 type PostLoginHookFn func(ctx context.Context, identity *Identity, r *Request, err error)
 
+// TeamGroupsFn returns the ids of the teams of an org that team sync adds members of the groups to.
+type TeamGroupsFn func(ctx context.Context, orgID int64, groups []string) ([]int64, error)
+
 type Service interface {
 	// Authenticate authenticates a request
 	Authenticate(ctx context.Context, r *Request) (*Identity, error)
@@ -80,6 +110,19 @@ type Service interface {
 	RegisterPostLoginHook(hook PostLoginHookFn, priority uint)
 	// RedirectURL will generate url that we can use to initiate auth flow for supported clients.
 	RedirectURL(ctx context.Context, client string, r *Request) (*Redirect, error)
+	// PreviewIdentity returns the identity a login with the provided claims would produce for supported clients.
+	// Nothing is persisted and no request is sent to the identity provider.
+	PreviewIdentity(ctx context.Context, client string, claims map[string]any) (*Identity, error)
+	// BackchannelLogout revokes the sessions bound to the identity provider session targeted by the logout token
+	// for supported clients.
+	BackchannelLogout(ctx context.Context, client string, logoutToken string) error
+	// ShadowSyncDiffs returns the changes shadow sync recorded for each user on their last login.
+	ShadowSyncDiffs(ctx context.Context) ([]*SyncDiff, error)
+	// RegisterShadowTeamSync registers how team sync maps groups to teams so shadow sync records the team
+	// changes. Team sync is an enterprise feature, no team changes are recorded until it is registered.
+	RegisterShadowTeamSync(fn TeamGroupsFn)
+	// AvatarURLs returns the avatars synced from the identity providers for the users, users without one are left out.
+	AvatarURLs(ctx context.Context, userIDs ...int64) (map[int64]string, error)
 	// RegisterClient will register a new authn.Client that can be used for authentication
 	RegisterClient(c Client)
 }
@@ -113,6 +156,14 @@ type HookClient interface {
 	Hook(ctx context.Context, identity *Identity, r *Request) error
 }
 
+// FailedLoginClient is an optional interface that auth clients can implement.
+// Clients that implements this interface are notified when a login they authenticated
+// fails afterwards, e.g. when the user can't be synced.
+type FailedLoginClient interface {
+	Client
+	FailedLogin(ctx context.Context, identity *Identity, r *Request)
+}
+
 // RedirectClient is an optional interface that auth clients can implement.
 // Clients that implements this interface can be used to generate redirect urls
 // for authentication flows, e.g. oauth clients
@@ -121,6 +172,23 @@ type RedirectClient interface {
 	RedirectURL(ctx context.Context, r *Request) (*Redirect, error)
 }
 
+// PreviewClient is an optional interface that auth clients can implement.
+// Clients that implements this interface can preview the identity produced
+// by a sample set of claims, e.g. to validate role and group mappings
+type PreviewClient interface {
+	Client
+	PreviewIdentity(ctx context.Context, claims map[string]any) (*Identity, error)
+}
+
+// BackchannelLogoutClient is an optional interface that auth clients can implement.
+// Clients that implements this interface can validate logout tokens sent by the
+// identity provider to end the sessions bound to an identity provider session
+type BackchannelLogoutClient interface {
+	Client
+	// ValidateLogoutToken validates the logout token and returns the identity provider session id it targets
+	ValidateLogoutToken(ctx context.Context, logoutToken string) (string, error)
+}
+
 type PasswordClient interface {
 	AuthenticatePassword(ctx context.Context, r *Request, username, password string) (*Identity, error)
 }
@@ -176,6 +244,43 @@ type Redirect struct {
 	Extra map[string]string
 }
 
+// SyncDiff is the changes syncing an identity would have made to the user it logged in as.
+type SyncDiff struct {
+	UserID     int64     `json:"userId"`
+	AuthModule string    `json:"authModule"`
+	RecordedAt time.Time `json:"recordedAt"`
+	// OrgRoles are the org memberships that would have been added, updated or removed
+	OrgRoles []OrgRoleChange `json:"orgRoles,omitempty"`
+	// IsGrafanaAdmin is the server admin flag the user would have been given, nil when unchanged
+	IsGrafanaAdmin *bool `json:"isGrafanaAdmin,omitempty"`
+	// Groups are the groups the user joined or left at the identity provider since their previous login
+	Groups *GroupChanges `json:"groups,omitempty"`
+	// Teams are the external team memberships team sync would have added or removed
+	Teams []TeamChange `json:"teams,omitempty"`
+}
+
+// GroupChanges are the groups of a user that changed between two logins.
+type GroupChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// TeamChange is a change of the membership of a user in a team. Added is false when the user would
+// have been removed from the team.
+type TeamChange struct {
+	OrgID  int64 `json:"orgId"`
+	TeamID int64 `json:"teamId"`
+	Added  bool  `json:"added"`
+}
+
+// OrgRoleChange is a change of the role of a user in an org. From is empty when the user would
+// have been added to the org and To is empty when the user would have been removed from it.
+type OrgRoleChange struct {
+	OrgID int64        `json:"orgId"`
+	From  org.RoleType `json:"from,omitempty"`
+	To    org.RoleType `json:"to,omitempty"`
+}
+
 const (
 	NamespaceUser           = identity.NamespaceUser
 	NamespaceAPIKey         = identity.NamespaceAPIKey
@@ -204,6 +309,8 @@ type Identity struct {
 	Name string
 	// Email is the email address of the entity. Should be unique.
 	Email string
+	// AvatarURL is the profile picture provided by the identity provider, only synced if SyncAvatar is enabled.
+	AvatarURL string
 	// IsGrafanaAdmin is true if the entity is a Grafana admin.
 	IsGrafanaAdmin *bool
 	// AuthenticatedBy is the name of the authentication client that was used to authenticate the current Identity.
@@ -225,6 +332,9 @@ type Identity struct {
 	Groups []string
 	// OAuthToken is the OAuth token used to authenticate the entity.
 	OAuthToken *oauth2.Token
+	// IdPSessionID is the session id (sid) of the identity provider session the entity authenticated with.
+	// Sessions created for the identity are bound to it so the identity provider can end them.
+	IdPSessionID string
 	// SessionToken is the session token used to authenticate the entity.
 	SessionToken *usertoken.UserToken
 	// ClientParams are hints for the auth service on how to handle the identity.
@@ -368,10 +478,34 @@ func handleLogin(r *http.Request, w http.ResponseWriter, cfg *setting.Cfg, ident
 		cookies.DeleteCookie(w, "redirect_to", cookieOptions(cfg))
 	}
 
-	WriteSessionCookie(w, cfg, identity.SessionToken)
+	writeSessionCookie(w, cfg, identity.SessionToken, sessionLifetime(cfg, identity))
 	return redirectURL
 }
 
+// sessionLifetime returns the lifetime of the session cookie written at login. When oauth_max_token_lifetime
+// is configured, sessions created by an OAuth login expire with the access token or the configured lifetime,
+// whichever comes first, and never after login_maximum_lifetime_duration.
+func sessionLifetime(cfg *setting.Cfg, identity *Identity) time.Duration {
+	lifetime := cfg.LoginMaxLifetime
+	if cfg.OAuthMaxTokenLifetime <= 0 || identity.OAuthToken == nil {
+		return lifetime
+	}
+
+	limit := cfg.OAuthMaxTokenLifetime
+	if expiry := identity.OAuthToken.Expiry; !expiry.IsZero() && time.Until(expiry) < limit {
+		// a cookie max age of zero or less deletes the cookie, keep it around until the next request
+		limit = time.Until(expiry)
+		if limit < time.Second {
+			limit = time.Second
+		}
+	}
+
+	if lifetime <= 0 || limit < lifetime {
+		return limit
+	}
+	return lifetime
+}
+
 func getRedirectURL(r *http.Request) string {
 	cookie, err := r.Cookie("redirect_to")
 	if err != nil {
@@ -385,8 +519,12 @@ func getRedirectURL(r *http.Request) string {
 const sessionExpiryCookie = "grafana_session_expiry"
 
 func WriteSessionCookie(w http.ResponseWriter, cfg *setting.Cfg, token *usertoken.UserToken) {
-	maxAge := int(cfg.LoginMaxLifetime.Seconds())
-	if cfg.LoginMaxLifetime <= 0 {
+	writeSessionCookie(w, cfg, token, cfg.LoginMaxLifetime)
+}
+
+func writeSessionCookie(w http.ResponseWriter, cfg *setting.Cfg, token *usertoken.UserToken, lifetime time.Duration) {
+	maxAge := int(lifetime.Seconds())
+	if lifetime <= 0 {
 		maxAge = -1
 	}
 
@@ -0,0 +1,193 @@
+package authnimpl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/auth"
+)
+
+const (
+	// defaultIdPSessionLifetime is how long sessions are kept bound when no maximum session lifetime is configured.
+	defaultIdPSessionLifetime = 30 * 24 * time.Hour
+	// idpSessionSweepInterval is how often the sessions bound to every identity provider session are pruned.
+	idpSessionSweepInterval = time.Hour
+)
+
+// boundSession references a session created for an identity provider session.
+type boundSession struct {
+	UserID  int64 `json:"userId"`
+	TokenID int64 `json:"tokenId"`
+	// ExpiresAt is when the session reaches its maximum lifetime, as a unix timestamp.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+// idpSessionStore keeps track of the sessions created for each identity provider session,
+// so they can be revoked when the identity provider ends its session. Sessions are forgotten
+// once they reach their maximum lifetime or are found to be revoked, since identity providers
+// only send a logout token for some of the sessions that end.
+type idpSessionStore struct {
+	kv       *kvstore.NamespacedKVStore
+	sessions auth.UserTokenService
+	// lifetime is the maximum lifetime of the bound sessions
+	lifetime time.Duration
+	log      log.Logger
+	mu       sync.Mutex
+
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newIdPSessionStore(kv kvstore.KVStore, sessions auth.UserTokenService, lifetime time.Duration) *idpSessionStore {
+	if lifetime <= 0 {
+		lifetime = defaultIdPSessionLifetime
+	}
+
+	return &idpSessionStore{
+		kv:       kvstore.WithNamespace(kv, 0, "authn.idpsession"),
+		sessions: sessions,
+		lifetime: lifetime,
+		log:      log.New("authn.idpsession"),
+		now:      time.Now,
+	}
+}
+
+// bind records the session token as created for the identity provider session sid of the client.
+// The sessions already bound to sid that ended are pruned.
+func (s *idpSessionStore) bind(ctx context.Context, client, sid string, token *auth.UserToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(ctx)
+
+	sessions, err := s.get(ctx, client, sid)
+	if err != nil {
+		return err
+	}
+
+	active := make([]boundSession, 0, len(sessions)+1)
+	for _, session := range sessions {
+		if s.active(ctx, session) {
+			active = append(active, session)
+		}
+	}
+	active = append(active, boundSession{
+		UserID:    token.UserId,
+		TokenID:   token.Id,
+		ExpiresAt: s.now().Add(s.lifetime).Unix(),
+	})
+
+	return s.set(ctx, idpSessionKey(client, sid), active)
+}
+
+// take returns the sessions bound to the identity provider session sid of the client and forgets about them.
+func (s *idpSessionStore) take(ctx context.Context, client, sid string) ([]boundSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions, err := s.get(ctx, client, sid)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.kv.Del(ctx, idpSessionKey(client, sid)); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// sweep removes the sessions that reached their maximum lifetime from every identity provider session,
+// at most once per idpSessionSweepInterval. Identity provider sessions without any session left are removed.
+func (s *idpSessionStore) sweep(ctx context.Context) {
+	now := s.now()
+	if now.Sub(s.lastSweep) < idpSessionSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	all, err := s.kv.GetAll(ctx)
+	if err != nil {
+		s.log.Warn("Failed to list the sessions bound to identity provider sessions", "error", err)
+		return
+	}
+
+	for _, entries := range all {
+		for key, data := range entries {
+			var sessions []boundSession
+			if err := json.Unmarshal([]byte(data), &sessions); err != nil {
+				s.log.Warn("Failed to decode the sessions bound to an identity provider session", "key", key, "error", err)
+				continue
+			}
+
+			unexpired := make([]boundSession, 0, len(sessions))
+			for _, session := range sessions {
+				if !s.expired(session) {
+					unexpired = append(unexpired, session)
+				}
+			}
+			if len(unexpired) == len(sessions) {
+				continue
+			}
+			if err := s.set(ctx, key, unexpired); err != nil {
+				s.log.Warn("Failed to prune the sessions bound to an identity provider session", "key", key, "error", err)
+			}
+		}
+	}
+}
+
+// active reports whether the session can still be used, it isn't when it expired or was revoked.
+// Sessions that can't be looked up are kept.
+func (s *idpSessionStore) active(ctx context.Context, session boundSession) bool {
+	if s.expired(session) {
+		return false
+	}
+
+	token, err := s.sessions.GetUserToken(ctx, session.UserID, session.TokenID)
+	if errors.Is(err, auth.ErrUserTokenNotFound) {
+		return false
+	}
+	if err != nil {
+		s.log.Warn("Failed to look up a session bound to an identity provider session", "tokenId", session.TokenID, "error", err)
+		return true
+	}
+	return token.RevokedAt == 0
+}
+
+// expired reports whether the session reached its maximum lifetime.
+func (s *idpSessionStore) expired(session boundSession) bool {
+	return session.ExpiresAt > 0 && s.now().Unix() >= session.ExpiresAt
+}
+
+func (s *idpSessionStore) get(ctx context.Context, client, sid string) ([]boundSession, error) {
+	data, ok, err := s.kv.Get(ctx, idpSessionKey(client, sid))
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var sessions []boundSession
+	if err := json.Unmarshal([]byte(data), &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// set stores the sessions bound under key, the key is removed when there are none.
+func (s *idpSessionStore) set(ctx context.Context, key string, sessions []boundSession) error {
+	if len(sessions) == 0 {
+		return s.kv.Del(ctx, key)
+	}
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(ctx, key, string(data))
+}
+
+func idpSessionKey(client, sid string) string {
+	return client + "/" + sid
+}
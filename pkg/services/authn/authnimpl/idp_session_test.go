@@ -0,0 +1,76 @@
+package authnimpl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/auth"
+	"github.com/grafana/grafana/pkg/services/auth/authtest"
+)
+
+func TestIdPSessionStore_Prune(t *testing.T) {
+	ctx := context.Background()
+	tokens := map[int64]*auth.UserToken{}
+	sessions := &authtest.FakeUserAuthTokenService{
+		GetUserTokenProvider: func(ctx context.Context, userID, userTokenID int64) (*auth.UserToken, error) {
+			token, ok := tokens[userTokenID]
+			if !ok {
+				return nil, auth.ErrUserTokenNotFound
+			}
+			return token, nil
+		},
+	}
+
+	now := time.Now()
+	s := newIdPSessionStore(kvstore.NewFakeKVStore(), sessions, time.Hour)
+	s.now = func() time.Time { return now }
+
+	bind := func(sid string, tokenID int64) {
+		t.Helper()
+		tokens[tokenID] = &auth.UserToken{Id: tokenID, UserId: 1}
+		require.NoError(t, s.bind(ctx, "oauth_generic_oauth", sid, tokens[tokenID]))
+	}
+	bound := func(sid string) []int64 {
+		t.Helper()
+		sessions, err := s.get(ctx, "oauth_generic_oauth", sid)
+		require.NoError(t, err)
+		ids := []int64{}
+		for _, session := range sessions {
+			ids = append(ids, session.TokenID)
+		}
+		return ids
+	}
+
+	t.Run("should forget the sessions that ended when binding another one", func(t *testing.T) {
+		bind("idp-session", 1)
+		bind("idp-session", 2)
+		bind("idp-session", 3)
+
+		// one session was logged out locally and another revoked
+		delete(tokens, 1)
+		tokens[2].RevokedAt = now.Unix()
+
+		bind("idp-session", 4)
+		assert.Equal(t, []int64{3, 4}, bound("idp-session"))
+	})
+
+	t.Run("should forget the sessions that reached their maximum lifetime", func(t *testing.T) {
+		bind("expiring-session", 5)
+
+		now = now.Add(2 * time.Hour)
+		bind("other-session", 6)
+
+		assert.Empty(t, bound("expiring-session"))
+		assert.Empty(t, bound("idp-session"))
+		assert.Equal(t, []int64{6}, bound("other-session"))
+
+		keys, err := s.kv.Keys(ctx, "")
+		require.NoError(t, err)
+		assert.Len(t, keys, 1, "identity provider sessions without sessions should be removed")
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/network"
 	"github.com/grafana/grafana/pkg/infra/remotecache"
@@ -32,6 +33,7 @@ import (
 	"github.com/grafana/grafana/pkg/services/quota"
 	"github.com/grafana/grafana/pkg/services/rendering"
 	"github.com/grafana/grafana/pkg/services/signingkeys"
+	"github.com/grafana/grafana/pkg/services/team"
 	"github.com/grafana/grafana/pkg/services/user"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util/errutil"
@@ -72,6 +74,7 @@ func ProvideService(
 	socialService social.Service, cache *remotecache.RemoteCache,
 	ldapService service.LDAP, registerer prometheus.Registerer,
 	signingKeysService signingkeys.Service, oauthServer oauthserver.OAuth2Server,
+	kvStore kvstore.KVStore, teamService team.Service,
 ) *Service {
 	s := &Service{
 		log:            log.New("authn.service"),
@@ -81,6 +84,7 @@ func ProvideService(
 		tracer:         tracer,
 		metrics:        newMetrics(registerer),
 		sessionService: sessionService,
+		idpSessions:    newIdPSessionStore(kvStore, sessionService, cfg.LoginMaxLifetime),
 		postAuthHooks:  newQueue[authn.PostAuthHookFn](),
 		postLoginHooks: newQueue[authn.PostLoginHookFn](),
 	}
@@ -141,6 +145,7 @@ func ProvideService(
 		s.RegisterClient(clients.ProvideExtendedJWT(userService, cfg, signingKeysService, oauthServer))
 	}
 
+	keySets := clients.NewKeySetCache(cfg.OAuthKeySetCacheMaxEntries, cfg.OAuthKeySetCacheMaxTTL)
 	for name := range socialService.GetOAuthProviders() {
 		oauthCfg := socialService.GetOAuthInfoProvider(name)
 		if oauthCfg != nil && oauthCfg.Enabled {
@@ -151,21 +156,25 @@ func ProvideService(
 			if errConnector != nil || errHTTPClient != nil {
 				s.log.Error("Failed to configure oauth client", "client", clientName, "err", errors.Join(errConnector, errHTTPClient))
 			} else {
-				s.RegisterClient(clients.ProvideOAuth(clientName, cfg, oauthCfg, connector, httpClient))
+				s.RegisterClient(clients.ProvideOAuth(clientName, cfg, oauthCfg, connector, httpClient, loginAttempts, tracer, keySets))
 			}
 		}
 	}
 
 	// FIXME (jguer): move to User package
-	userSyncService := sync.ProvideUserSync(userService, userProtectionService, authInfoService, quotaService)
-	orgUserSyncService := sync.ProvideOrgSync(userService, orgService, accessControlService)
+	userSyncService := sync.ProvideUserSync(userService, userProtectionService, authInfoService, quotaService, cfg, tracer)
+	orgUserSyncService := sync.ProvideOrgSync(userService, orgService, accessControlService, kvStore)
+	s.shadowSync = sync.ProvideShadowSync(orgService, teamService, orgUserSyncService, kvStore)
+	s.avatarSync = sync.ProvideAvatarSync(kvStore)
 	s.RegisterPostAuthHook(userSyncService.SyncUserHook, 10)
 	s.RegisterPostAuthHook(userSyncService.EnableDisabledUserHook, 20)
 	s.RegisterPostAuthHook(orgUserSyncService.SyncOrgRolesHook, 30)
+	s.RegisterPostAuthHook(s.shadowSync.ShadowSyncHook, 30)
+	s.RegisterPostAuthHook(s.avatarSync.SyncAvatarHook, 40)
 	s.RegisterPostAuthHook(userSyncService.SyncLastSeenHook, 120)
 
 	if features.IsEnabled(featuremgmt.FlagAccessTokenExpirationCheck) {
-		s.RegisterPostAuthHook(sync.ProvideOAuthTokenSync(oauthTokenService, sessionService, socialService).SyncOauthTokenHook, 60)
+		s.RegisterPostAuthHook(sync.ProvideOAuthTokenSync(oauthTokenService, sessionService, socialService, cfg).SyncOauthTokenHook, 60)
 	}
 
 	s.RegisterPostAuthHook(userSyncService.FetchSyncedUserHook, 100)
@@ -185,6 +194,12 @@ type Service struct {
 	metrics *metrics
 
 	sessionService auth.UserTokenService
+	// idpSessions are the sessions bound to identity provider sessions
+	idpSessions *idpSessionStore
+	// shadowSync records the changes syncing identities would make without applying them
+	shadowSync *sync.ShadowSync
+	// avatarSync stores the avatars provided by identity providers
+	avatarSync *sync.AvatarSync
 
 	// postAuthHooks are called after a successful authentication. They can modify the identity.
 	postAuthHooks *queue[authn.PostAuthHookFn]
@@ -237,6 +252,9 @@ func (s *Service) authenticate(ctx context.Context, c authn.Client, r *authn.Req
 
 	if err := s.runPostAuthHooks(ctx, identity, r); err != nil {
 		s.log.FromContext(ctx).Warn("Failed to run post auth hook", "client", c.Name(), "id", identity.ID, "error", err)
+		if fc, ok := c.(authn.FailedLoginClient); ok && r.GetMeta(authn.MetaKeyIsLogin) != "" {
+			fc.FailedLogin(ctx, identity, r)
+		}
 		return nil, err
 	}
 
@@ -312,6 +330,12 @@ func (s *Service) Login(ctx context.Context, client string, r *authn.Request) (i
 		return nil, err
 	}
 
+	if identity.IdPSessionID != "" && s.idpSessions != nil {
+		if err := s.idpSessions.bind(ctx, client, identity.IdPSessionID, sessionToken); err != nil {
+			s.log.FromContext(ctx).Error("Failed to bind session to identity provider session", "client", client, "id", identity.ID, "err", err)
+		}
+	}
+
 	s.metrics.successfulLogin.WithLabelValues(client).Inc()
 	identity.SessionToken = sessionToken
 	return identity, nil
@@ -339,6 +363,87 @@ func (s *Service) RedirectURL(ctx context.Context, client string, r *authn.Reque
 	return redirectClient.RedirectURL(ctx, r)
 }
 
+func (s *Service) PreviewIdentity(ctx context.Context, client string, claims map[string]any) (*authn.Identity, error) {
+	ctx, span := s.tracer.Start(ctx, "authn.PreviewIdentity")
+	defer span.End()
+	span.SetAttributes(attributeKeyClient, client, attribute.Key(attributeKeyClient).String(client))
+
+	c, ok := s.clients[client]
+	if !ok {
+		return nil, authn.ErrClientNotConfigured.Errorf("client not configured: %s", client)
+	}
+
+	previewClient, ok := c.(authn.PreviewClient)
+	if !ok {
+		return nil, authn.ErrUnsupportedClient.Errorf("client does not support previewing identities: %s", client)
+	}
+
+	return previewClient.PreviewIdentity(ctx, claims)
+}
+
+func (s *Service) BackchannelLogout(ctx context.Context, client string, logoutToken string) error {
+	ctx, span := s.tracer.Start(ctx, "authn.BackchannelLogout")
+	defer span.End()
+	span.SetAttributes(attributeKeyClient, client, attribute.Key(attributeKeyClient).String(client))
+
+	c, ok := s.clients[client]
+	if !ok {
+		return authn.ErrClientNotConfigured.Errorf("client not configured: %s", client)
+	}
+
+	logoutClient, ok := c.(authn.BackchannelLogoutClient)
+	if !ok || s.idpSessions == nil {
+		return authn.ErrUnsupportedClient.Errorf("client does not support back-channel logout: %s", client)
+	}
+
+	sid, err := logoutClient.ValidateLogoutToken(ctx, logoutToken)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.idpSessions.take(ctx, client, sid)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		token, err := s.sessionService.GetUserToken(ctx, session.UserID, session.TokenID)
+		if err != nil {
+			// the session already ended
+			if errors.Is(err, auth.ErrUserTokenNotFound) {
+				continue
+			}
+			return err
+		}
+		if err := s.sessionService.RevokeToken(ctx, token, false); err != nil {
+			return err
+		}
+	}
+
+	s.log.FromContext(ctx).Info("Revoked sessions on back-channel logout", "client", client, "sessions", len(sessions))
+	return nil
+}
+
+func (s *Service) ShadowSyncDiffs(ctx context.Context) ([]*authn.SyncDiff, error) {
+	if s.shadowSync == nil {
+		return []*authn.SyncDiff{}, nil
+	}
+	return s.shadowSync.Diffs(ctx)
+}
+
+func (s *Service) RegisterShadowTeamSync(fn authn.TeamGroupsFn) {
+	if s.shadowSync != nil {
+		s.shadowSync.RegisterTeamGroups(fn)
+	}
+}
+
+func (s *Service) AvatarURLs(ctx context.Context, userIDs ...int64) (map[int64]string, error) {
+	if s.avatarSync == nil {
+		return map[int64]string{}, nil
+	}
+	return s.avatarSync.AvatarURLs(ctx, userIDs...)
+}
+
 func (s *Service) RegisterClient(c authn.Client) {
 	s.clients[c.Name()] = c
 	if cac, ok := c.(authn.ContextAwareClient); ok {
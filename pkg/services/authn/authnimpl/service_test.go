@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/services/auth"
@@ -262,6 +263,46 @@ func TestService_Login(t *testing.T) {
 	}
 }
 
+func TestService_LoginFailedAfterAuthentication(t *testing.T) {
+	s := setupTests(t)
+	client := &fakeFailedLoginClient{FakeClient: authntest.FakeClient{
+		ExpectedName:     "fake",
+		ExpectedTest:     true,
+		ExpectedIdentity: &authn.Identity{ID: "user:1", Login: "bob"},
+	}}
+	s.RegisterClient(client)
+	s.RegisterPostAuthHook(func(ctx context.Context, identity *authn.Identity, r *authn.Request) error {
+		return errors.New("sync failed")
+	}, 10)
+
+	_, err := s.Login(context.Background(), "fake", &authn.Request{HTTPRequest: &http.Request{
+		Header: map[string][]string{},
+		URL:    &url.URL{},
+	}})
+	require.Error(t, err)
+	require.NotNil(t, client.failed)
+	assert.Equal(t, "bob", client.failed.Login)
+
+	t.Run("should not notify the client for requests that are not logins", func(t *testing.T) {
+		client.failed = nil
+		_, err := s.Authenticate(context.Background(), &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    &url.URL{},
+		}})
+		require.Error(t, err)
+		assert.Nil(t, client.failed)
+	})
+}
+
+type fakeFailedLoginClient struct {
+	authntest.FakeClient
+	failed *authn.Identity
+}
+
+func (f *fakeFailedLoginClient) FailedLogin(ctx context.Context, identity *authn.Identity, r *authn.Request) {
+	f.failed = identity
+}
+
 func TestService_RedirectURL(t *testing.T) {
 	type testCase struct {
 		desc        string
@@ -299,6 +340,83 @@ func TestService_RedirectURL(t *testing.T) {
 	}
 }
 
+func TestService_BackchannelLogout(t *testing.T) {
+	var created int64
+	tokens := map[int64]*auth.UserToken{}
+	var revoked []int64
+
+	s := setupTests(t, func(svc *Service) {
+		svc.sessionService = &authtest.FakeUserAuthTokenService{
+			CreateTokenProvider: func(ctx context.Context, user *user.User, clientIP net.IP, userAgent string) (*auth.UserToken, error) {
+				created++
+				tokens[created] = &auth.UserToken{Id: created, UserId: user.ID}
+				return tokens[created], nil
+			},
+			GetUserTokenProvider: func(ctx context.Context, userID, userTokenID int64) (*auth.UserToken, error) {
+				token, ok := tokens[userTokenID]
+				if !ok || token.UserId != userID {
+					return nil, auth.ErrUserTokenNotFound
+				}
+				return token, nil
+			},
+			RevokeTokenProvider: func(ctx context.Context, token *auth.UserToken, soft bool) error {
+				revoked = append(revoked, token.Id)
+				delete(tokens, token.Id)
+				return nil
+			},
+		}
+		svc.idpSessions = newIdPSessionStore(kvstore.NewFakeKVStore(), svc.sessionService, 0)
+	})
+
+	client := &fakeLogoutClient{FakeClient: authntest.FakeClient{ExpectedName: "fake", ExpectedTest: true}}
+	s.RegisterClient(client)
+	s.RegisterClient(&authntest.FakeClient{ExpectedName: "unsupported"})
+
+	login := func(sid string) {
+		client.ExpectedIdentity = &authn.Identity{ID: "user:1", IdPSessionID: sid}
+		_, err := s.Login(context.Background(), "fake", &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    &url.URL{},
+		}})
+		require.NoError(t, err)
+	}
+
+	// two sessions bound to the same idp session and one bound to another
+	login("idp-session")
+	login("idp-session")
+	login("other-session")
+	// sessions without idp session aren't bound
+	login("")
+
+	client.expectedSID = "idp-session"
+	require.NoError(t, s.BackchannelLogout(context.Background(), "fake", "logout-token"))
+	assert.ElementsMatch(t, []int64{1, 2}, revoked)
+
+	// the bound sessions are forgotten once revoked
+	require.NoError(t, s.BackchannelLogout(context.Background(), "fake", "logout-token"))
+	assert.Len(t, revoked, 2)
+
+	client.expectedErr = errors.New("invalid logout token")
+	require.Error(t, s.BackchannelLogout(context.Background(), "fake", "logout-token"))
+
+	assert.ErrorIs(t, s.BackchannelLogout(context.Background(), "unsupported", "logout-token"), authn.ErrUnsupportedClient)
+	assert.ErrorIs(t, s.BackchannelLogout(context.Background(), "missing", "logout-token"), authn.ErrClientNotConfigured)
+
+	assert.Len(t, revoked, 2)
+	assert.Contains(t, tokens, int64(3))
+	assert.Contains(t, tokens, int64(4))
+}
+
+type fakeLogoutClient struct {
+	authntest.FakeClient
+	expectedSID string
+	expectedErr error
+}
+
+func (f *fakeLogoutClient) ValidateLogoutToken(ctx context.Context, logoutToken string) (string, error) {
+	return f.expectedSID, f.expectedErr
+}
+
 func mustParseURL(s string) *url.URL {
 	u, err := url.Parse(s)
 	if err != nil {
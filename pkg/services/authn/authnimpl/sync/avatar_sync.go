@@ -0,0 +1,111 @@
+package sync
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/localcache"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/authn"
+)
+
+const (
+	// avatarCacheTTL is how long the synced avatars are cached, the avatars synced by other instances
+	// are picked up once it expires.
+	avatarCacheTTL = time.Minute
+	avatarCacheKey = "avatars"
+)
+
+func ProvideAvatarSync(kvStore kvstore.KVStore) *AvatarSync {
+	return &AvatarSync{
+		kv:    kvstore.WithNamespace(kvStore, 0, "authn.avatar"),
+		cache: localcache.New(avatarCacheTTL, 2*avatarCacheTTL),
+		log:   log.New("avatar.sync"),
+	}
+}
+
+// AvatarSync stores the avatars provided by identity providers, they are used instead of gravatar.
+type AvatarSync struct {
+	kv *kvstore.NamespacedKVStore
+	// cache holds every synced avatar so avatars are resolved without a lookup per user
+	cache *localcache.CacheService
+
+	log log.Logger
+}
+
+func (s *AvatarSync) SyncAvatarHook(ctx context.Context, id *authn.Identity, _ *authn.Request) error {
+	if !id.ClientParams.SyncAvatar {
+		return nil
+	}
+
+	ctxLogger := s.log.FromContext(ctx)
+
+	namespace, userID := id.NamespacedID()
+	if namespace != authn.NamespaceUser || userID <= 0 {
+		ctxLogger.Warn("Failed to sync avatar, invalid namespace for identity", "id", id.ID, "namespace", namespace)
+		return nil
+	}
+
+	if avatars, err := s.avatars(ctx); err == nil && avatars[userID] == id.AvatarURL {
+		return nil
+	}
+	// the cached avatars are never modified, they are reloaded with the change instead
+	defer s.cache.Delete(avatarCacheKey)
+
+	key := strconv.FormatInt(userID, 10)
+	if id.AvatarURL == "" {
+		// the provider no longer returns an avatar, fall back to gravatar
+		if err := s.kv.Del(ctx, key); err != nil {
+			ctxLogger.Warn("Failed to remove avatar", "id", id.ID, "error", err)
+		}
+		return nil
+	}
+
+	if err := s.kv.Set(ctx, key, id.AvatarURL); err != nil {
+		ctxLogger.Warn("Failed to sync avatar", "id", id.ID, "error", err)
+	}
+	return nil
+}
+
+// AvatarURLs returns the avatars synced for the users, users without one are left out.
+func (s *AvatarSync) AvatarURLs(ctx context.Context, userIDs ...int64) (map[int64]string, error) {
+	avatars, err := s.avatars(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int64]string, len(userIDs))
+	for _, userID := range userIDs {
+		if avatarURL, ok := avatars[userID]; ok {
+			res[userID] = avatarURL
+		}
+	}
+	return res, nil
+}
+
+// avatars returns the avatars synced for every user, loaded at once and cached for avatarCacheTTL.
+func (s *AvatarSync) avatars(ctx context.Context) (map[int64]string, error) {
+	if cached, ok := s.cache.Get(avatarCacheKey); ok {
+		return cached.(map[int64]string), nil
+	}
+
+	all, err := s.kv.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	avatars := map[int64]string{}
+	for _, items := range all {
+		for key, avatarURL := range items {
+			userID, err := strconv.ParseInt(key, 10, 64)
+			if err != nil {
+				continue
+			}
+			avatars[userID] = avatarURL
+		}
+	}
+	s.cache.SetDefault(avatarCacheKey, avatars)
+	return avatars, nil
+}
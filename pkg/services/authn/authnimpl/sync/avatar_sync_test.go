@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/authn"
+)
+
+func TestAvatarSync_SyncAvatarHook(t *testing.T) {
+	s := ProvideAvatarSync(kvstore.NewFakeKVStore())
+	ctx := context.Background()
+
+	identity := &authn.Identity{
+		ID:           authn.NamespacedID(authn.NamespaceUser, 2),
+		AvatarURL:    "https://idp.example.com/photos/2.png",
+		ClientParams: authn.ClientParams{SyncUser: true, SyncAvatar: true},
+	}
+	require.NoError(t, s.SyncAvatarHook(ctx, identity, nil))
+
+	avatarURLs, err := s.AvatarURLs(ctx, 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, map[int64]string{2: "https://idp.example.com/photos/2.png"}, avatarURLs)
+
+	t.Run("the avatar is kept when avatar sync is disabled", func(t *testing.T) {
+		identity := &authn.Identity{ID: identity.ID, ClientParams: authn.ClientParams{SyncUser: true}}
+		require.NoError(t, s.SyncAvatarHook(ctx, identity, nil))
+
+		avatarURLs, err := s.AvatarURLs(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, "https://idp.example.com/photos/2.png", avatarURLs[2])
+	})
+
+	t.Run("the avatar is removed when the provider no longer returns one", func(t *testing.T) {
+		identity.AvatarURL = ""
+		require.NoError(t, s.SyncAvatarHook(ctx, identity, nil))
+
+		avatarURLs, err := s.AvatarURLs(ctx, 2)
+		require.NoError(t, err)
+		assert.Empty(t, avatarURLs)
+	})
+
+	t.Run("avatars synced by other instances are loaded once the cache expires", func(t *testing.T) {
+		require.NoError(t, s.kv.Set(ctx, "4", "https://idp.example.com/photos/4.png"))
+
+		avatarURLs, err := s.AvatarURLs(ctx, 4)
+		require.NoError(t, err)
+		assert.Empty(t, avatarURLs, "the avatars are cached")
+
+		s.cache.Delete(avatarCacheKey)
+		avatarURLs, err = s.AvatarURLs(ctx, 4)
+		require.NoError(t, err)
+		assert.Equal(t, "https://idp.example.com/photos/4.png", avatarURLs[4])
+	})
+}
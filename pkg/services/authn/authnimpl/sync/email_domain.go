@@ -0,0 +1,124 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/localcache"
+	"github.com/grafana/grafana/pkg/util/errutil"
+)
+
+const (
+	emailDomainLookupTimeout = 5 * time.Second
+	emailDomainCacheTTL      = time.Hour
+)
+
+var (
+	errEmailDomainUnverified = errutil.Forbidden(
+		"user.sync.email-domain-unverified",
+		errutil.WithPublicMessage("Email domain is not able to receive email"),
+	)
+	errEmailDomainBlocked = errutil.Forbidden(
+		"user.sync.email-domain-blocked",
+		errutil.WithPublicMessage("Email domain is not allowed to sign up"),
+	)
+)
+
+// mxResolver is the subset of net.Resolver used to look up mail exchangers.
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// emailDomainVerifier checks that the domain of an email address can receive
+// email before a user is signed up with it.
+type emailDomainVerifier struct {
+	resolver mxResolver
+	blocked  map[string]bool
+	// cache holds the result of previous MX lookups keyed by domain
+	cache *localcache.CacheService
+}
+
+func newEmailDomainVerifier(resolver mxResolver, blockedDomains []string) *emailDomainVerifier {
+	blocked := make(map[string]bool, len(blockedDomains))
+	for _, domain := range blockedDomains {
+		blocked[normalizeDomain(domain)] = true
+	}
+
+	return &emailDomainVerifier{
+		resolver: resolver,
+		blocked:  blocked,
+		cache:    localcache.New(emailDomainCacheTTL, 2*emailDomainCacheTTL),
+	}
+}
+
+func (v *emailDomainVerifier) verify(ctx context.Context, email string) error {
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return errEmailDomainUnverified.Errorf("email %q has no domain", email)
+	}
+	domain := normalizeDomain(email[at+1:])
+
+	if v.isBlocked(domain) {
+		return errEmailDomainBlocked.Errorf("email domain %q is blocked", domain)
+	}
+
+	if valid, ok := v.cache.Get(domain); ok {
+		if !valid.(bool) {
+			return errEmailDomainUnverified.Errorf("email domain %q has no MX records", domain)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, emailDomainLookupTimeout)
+	defer cancel()
+
+	records, err := v.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			v.cache.Set(domain, false, 0)
+			return errEmailDomainUnverified.Errorf("email domain %q has no MX records", domain)
+		}
+		// transient failures are not cached so the next sign up attempt retries the lookup
+		return errEmailDomainUnverified.Errorf("failed to look up MX records for %q: %w", domain, err)
+	}
+
+	valid := hasMailExchanger(records)
+	v.cache.Set(domain, valid, 0)
+	if !valid {
+		return errEmailDomainUnverified.Errorf("email domain %q has no MX records", domain)
+	}
+	return nil
+}
+
+// isBlocked reports whether the domain or any of its parent domains is blocked.
+func (v *emailDomainVerifier) isBlocked(domain string) bool {
+	for {
+		if v.blocked[domain] {
+			return true
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// hasMailExchanger reports whether the records contain a usable mail exchanger,
+// a single "." host being a null MX (RFC 7505) that refuses all email.
+func hasMailExchanger(records []*net.MX) bool {
+	for _, mx := range records {
+		if mx.Host != "" && mx.Host != "." {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
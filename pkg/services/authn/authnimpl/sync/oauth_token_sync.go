@@ -17,15 +17,17 @@ import (
 	"github.com/grafana/grafana/pkg/services/login"
 	"github.com/grafana/grafana/pkg/services/oauthtoken"
 	"github.com/grafana/grafana/pkg/services/user"
+	"github.com/grafana/grafana/pkg/setting"
 )
 
-func ProvideOAuthTokenSync(service oauthtoken.OAuthTokenService, sessionService auth.UserTokenService, socialService social.Service) *OAuthTokenSync {
+func ProvideOAuthTokenSync(service oauthtoken.OAuthTokenService, sessionService auth.UserTokenService, socialService social.Service, cfg *setting.Cfg) *OAuthTokenSync {
 	return &OAuthTokenSync{
 		log.New("oauth_token.sync"),
 		localcache.New(maxOAuthTokenCacheTTL, 15*time.Minute),
 		service,
 		sessionService,
 		socialService,
+		cfg.OAuthMaxTokenLifetime,
 	}
 }
 
@@ -35,6 +37,9 @@ type OAuthTokenSync struct {
 	service        oauthtoken.OAuthTokenService
 	sessionService auth.UserTokenService
 	socialService  social.Service
+	// maxSessionLifetime is the lifetime after which sessions created by an OAuth login are revoked, even
+	// when their tokens can still be refreshed. Disabled when zero.
+	maxSessionLifetime time.Duration
 }
 
 func (s *OAuthTokenSync) SyncOauthTokenHook(ctx context.Context, identity *authn.Identity, _ *authn.Request) error {
@@ -60,6 +65,17 @@ func (s *OAuthTokenSync) SyncOauthTokenHook(ctx context.Context, identity *authn
 		return nil
 	}
 
+	sessionExpires := time.Time{}
+	if s.maxSessionLifetime > 0 {
+		sessionExpires = time.Unix(identity.SessionToken.CreatedAt, 0).Add(s.maxSessionLifetime)
+		if !sessionExpires.After(time.Now()) {
+			if err := s.sessionService.RevokeToken(ctx, identity.SessionToken, false); err != nil {
+				s.log.FromContext(ctx).Error("Failed to revoke session token", "id", identity.ID, "tokenId", identity.SessionToken.Id, "error", err)
+			}
+			return authn.ErrExpiredAccessToken.Errorf("oauth session exceeded the maximum lifetime of %s", s.maxSessionLifetime)
+		}
+	}
+
 	idTokenExpiry, err := getIDTokenExpiry(token)
 	if err != nil {
 		s.log.FromContext(ctx).Error("Failed to extract expiry of ID token", "id", identity.ID, "error", err)
@@ -68,7 +84,7 @@ func (s *OAuthTokenSync) SyncOauthTokenHook(ctx context.Context, identity *authn
 	// token has no expire time configured, so we don't have to refresh it
 	if token.OAuthExpiry.IsZero() {
 		// cache the token check, so we don't perform it on every request
-		s.cache.Set(identity.ID, struct{}{}, getOAuthTokenCacheTTL(token.OAuthExpiry, idTokenExpiry))
+		s.cache.Set(identity.ID, struct{}{}, capCacheTTL(getOAuthTokenCacheTTL(token.OAuthExpiry, idTokenExpiry), sessionExpires))
 		return nil
 	}
 
@@ -80,8 +96,8 @@ func (s *OAuthTokenSync) SyncOauthTokenHook(ctx context.Context, identity *authn
 		return nil
 	}
 
-	// if refresh token handling is disabled for this provider, we can skip the hook
-	if !currentOAuthInfo.UseRefreshToken {
+	// if refresh token handling is disabled for this provider or no refresh token is requested, we can skip the hook
+	if !currentOAuthInfo.UseRefreshToken || !currentOAuthInfo.RequestRefreshToken {
 		return nil
 	}
 
@@ -97,7 +113,7 @@ func (s *OAuthTokenSync) SyncOauthTokenHook(ctx context.Context, identity *authn
 	// token has not expired, so we don't have to refresh it
 	if !accessTokenExpires.Before(time.Now()) && !hasIdTokenExpired {
 		// cache the token check, so we don't perform it on every request
-		s.cache.Set(identity.ID, struct{}{}, getOAuthTokenCacheTTL(accessTokenExpires, idTokenExpires))
+		s.cache.Set(identity.ID, struct{}{}, capCacheTTL(getOAuthTokenCacheTTL(accessTokenExpires, idTokenExpires), sessionExpires))
 		return nil
 	}
 
@@ -145,6 +161,21 @@ func getOAuthTokenCacheTTL(accessTokenExpiry, idTokenExpiry time.Time) time.Dura
 	return min(min(time.Until(accessTokenExpiry), time.Until(idTokenExpiry)), maxOAuthTokenCacheTTL)
 }
 
+// capCacheTTL shortens ttl so the check runs again once the session reaches its maximum lifetime
+func capCacheTTL(ttl time.Duration, sessionExpires time.Time) time.Duration {
+	if sessionExpires.IsZero() {
+		return ttl
+	}
+	if until := time.Until(sessionExpires); until < ttl {
+		// a zero ttl would fall back to the default expiration of the cache
+		if until < time.Millisecond {
+			return time.Millisecond
+		}
+		return until
+	}
+	return ttl
+}
+
 // getIDTokenExpiry extracts the expiry time from the ID token
 func getIDTokenExpiry(token *login.UserAuth) (time.Time, error) {
 	if token.OAuthIdToken == "" {
@@ -30,6 +30,8 @@ func TestOAuthTokenSync_SyncOAuthTokenHook(t *testing.T) {
 		identity  *authn.Identity
 		oauthInfo *social.OAuthInfo
 
+		maxSessionLifetime time.Duration
+
 		expectedHasEntryToken *login.UserAuth
 		expectHasEntryCalled  bool
 
@@ -99,6 +101,14 @@ func TestOAuthTokenSync_SyncOAuthTokenHook(t *testing.T) {
 			expectedHasEntryToken:       &login.UserAuth{OAuthExpiry: time.Now().Add(-10 * time.Minute)},
 			oauthInfo:                   &social.OAuthInfo{UseRefreshToken: false},
 		},
+		{
+			desc:                        "should skip sync when request_refresh_token is disabled",
+			identity:                    &authn.Identity{ID: "user:1", SessionToken: &auth.UserToken{}, AuthenticatedBy: login.GitLabAuthModule},
+			expectHasEntryCalled:        true,
+			expectTryRefreshTokenCalled: false,
+			expectedHasEntryToken:       &login.UserAuth{OAuthExpiry: time.Now().Add(-10 * time.Minute)},
+			oauthInfo:                   &social.OAuthInfo{UseRefreshToken: true, RequestRefreshToken: false},
+		},
 		{
 			desc:                        "should refresh access token when ID token has expired",
 			identity:                    &authn.Identity{ID: "user:1", SessionToken: &auth.UserToken{}},
@@ -106,6 +116,22 @@ func TestOAuthTokenSync_SyncOAuthTokenHook(t *testing.T) {
 			expectTryRefreshTokenCalled: true,
 			expectedHasEntryToken:       &login.UserAuth{OAuthExpiry: time.Now().Add(10 * time.Minute), OAuthIdToken: fakeIDToken(t, time.Now().Add(-10*time.Minute))},
 		},
+		{
+			desc:                  "should skip sync when session is within the maximum lifetime",
+			identity:              &authn.Identity{ID: "user:1", SessionToken: &auth.UserToken{CreatedAt: time.Now().Add(-10 * time.Minute).Unix()}},
+			maxSessionLifetime:    time.Hour,
+			expectHasEntryCalled:  true,
+			expectedHasEntryToken: &login.UserAuth{OAuthExpiry: time.Now().Add(10 * time.Minute)},
+		},
+		{
+			desc:                    "should revoke session token when session exceeded the maximum lifetime",
+			identity:                &authn.Identity{ID: "user:1", SessionToken: &auth.UserToken{CreatedAt: time.Now().Add(-2 * time.Hour).Unix()}},
+			maxSessionLifetime:      time.Hour,
+			expectHasEntryCalled:    true,
+			expectRevokeTokenCalled: true,
+			expectedHasEntryToken:   &login.UserAuth{OAuthExpiry: time.Now().Add(10 * time.Minute)},
+			expectedErr:             authn.ErrExpiredAccessToken,
+		},
 	}
 
 	for _, tt := range tests {
@@ -141,7 +167,8 @@ func TestOAuthTokenSync_SyncOAuthTokenHook(t *testing.T) {
 
 			if tt.oauthInfo == nil {
 				tt.oauthInfo = &social.OAuthInfo{
-					UseRefreshToken: true,
+					UseRefreshToken:     true,
+					RequestRefreshToken: true,
 				}
 			}
 
@@ -155,6 +182,8 @@ func TestOAuthTokenSync_SyncOAuthTokenHook(t *testing.T) {
 				service:        service,
 				sessionService: sessionService,
 				socialService:  socialService,
+
+				maxSessionLifetime: tt.maxSessionLifetime,
 			}
 
 			err := sync.SyncOauthTokenHook(context.Background(), tt.identity, nil)
@@ -2,9 +2,12 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"sort"
+	"strconv"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
 	"github.com/grafana/grafana/pkg/services/authn"
@@ -12,14 +15,17 @@ import (
 	"github.com/grafana/grafana/pkg/services/user"
 )
 
-func ProvideOrgSync(userService user.Service, orgService org.Service, accessControl accesscontrol.Service) *OrgSync {
-	return &OrgSync{userService, orgService, accessControl, log.New("org.sync")}
+func ProvideOrgSync(userService user.Service, orgService org.Service, accessControl accesscontrol.Service, kvStore kvstore.KVStore) *OrgSync {
+	return &OrgSync{userService, orgService, accessControl, kvstore.WithNamespace(kvStore, 0, "authn.orgsync"), log.New("org.sync")}
 }
 
 type OrgSync struct {
 	userService   user.Service
 	orgService    org.Service
 	accessControl accesscontrol.Service
+	// managedOrgs records per user the orgs memberships managed by org sync, other memberships
+	// were assigned manually and are kept when PreserveManualOrgs is enabled
+	managedOrgs *kvstore.NamespacedKVStore
 
 	log log.Logger
 }
@@ -51,6 +57,15 @@ func (s *OrgSync) SyncOrgRolesHook(ctx context.Context, id *authn.Identity, _ *a
 		return nil
 	}
 
+	var managedOrgIDs map[int64]bool
+	if id.ClientParams.PreserveManualOrgs {
+		managedOrgIDs, err = s.getManagedOrgs(ctx, userID)
+		if err != nil {
+			ctxLogger.Error("Failed to get user's sync managed organizations", "id", id.ID, "error", err)
+			return nil
+		}
+	}
+
 	handledOrgIds := map[int64]bool{}
 	deleteOrgIds := []int64{}
 
@@ -60,6 +75,10 @@ func (s *OrgSync) SyncOrgRolesHook(ctx context.Context, id *authn.Identity, _ *a
 
 		extRole := id.OrgRoles[orga.OrgID]
 		if extRole == "" {
+			if managedOrgIDs != nil && !managedOrgIDs[orga.OrgID] {
+				ctxLogger.Debug("Keeping user's manually assigned organization membership", "id", id.ID, "orgId", orga.OrgID)
+				continue
+			}
 			deleteOrgIds = append(deleteOrgIds, orga.OrgID)
 		} else if extRole != orga.Role {
 			// update role
@@ -106,6 +125,13 @@ func (s *OrgSync) SyncOrgRolesHook(ctx context.Context, id *authn.Identity, _ *a
 		}
 	}
 
+	if id.ClientParams.PreserveManualOrgs {
+		// the memberships mapped from the identity are managed by sync from now on, even if they were assigned manually before
+		if err := s.setManagedOrgs(ctx, userID, orgIDs); err != nil {
+			ctxLogger.Error("Failed to record user's sync managed organizations", "id", id.ID, "error", err)
+		}
+	}
+
 	// Note: sort all org ids to not make it flaky, for now we default to the lowest id
 	sort.Slice(orgIDs, func(i, j int) bool { return orgIDs[i] < orgIDs[j] })
 	// update user's default org if needed
@@ -121,3 +147,30 @@ func (s *OrgSync) SyncOrgRolesHook(ctx context.Context, id *authn.Identity, _ *a
 
 	return nil
 }
+
+// getManagedOrgs returns the orgs memberships of the user managed by org sync. Users synced before
+// PreserveManualOrgs was enabled have no record, all their memberships are then kept.
+func (s *OrgSync) getManagedOrgs(ctx context.Context, userID int64) (map[int64]bool, error) {
+	managed := map[int64]bool{}
+	data, ok, err := s.managedOrgs.Get(ctx, strconv.FormatInt(userID, 10))
+	if err != nil || !ok {
+		return managed, err
+	}
+
+	var orgIDs []int64
+	if err := json.Unmarshal([]byte(data), &orgIDs); err != nil {
+		return nil, err
+	}
+	for _, orgID := range orgIDs {
+		managed[orgID] = true
+	}
+	return managed, nil
+}
+
+func (s *OrgSync) setManagedOrgs(ctx context.Context, userID int64, orgIDs []int64) error {
+	data, err := json.Marshal(orgIDs)
+	if err != nil {
+		return err
+	}
+	return s.managedOrgs.Set(ctx, strconv.FormatInt(userID, 10), string(data))
+}
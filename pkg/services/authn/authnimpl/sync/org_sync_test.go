@@ -5,7 +5,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models/roletype"
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
@@ -124,3 +126,64 @@ func TestOrgSync_SyncOrgRolesHook(t *testing.T) {
 		})
 	}
 }
+
+func TestOrgSync_SyncOrgRolesHook_PreserveManualOrgs(t *testing.T) {
+	orgService := &membershipOrgService{
+		FakeOrgService: &orgtest.FakeOrgService{},
+		memberships:    map[int64]org.RoleType{1: org.RoleViewer, 4: org.RoleViewer},
+	}
+	s := ProvideOrgSync(&usertest.FakeUserService{}, orgService, &actest.FakeService{}, kvstore.NewFakeKVStore())
+
+	syncOrgs := func(orgRoles map[int64]org.RoleType) {
+		id := &authn.Identity{
+			ID:       authn.NamespacedID(authn.NamespaceUser, 1),
+			OrgID:    1,
+			OrgRoles: orgRoles,
+			ClientParams: authn.ClientParams{
+				SyncOrgRoles:       true,
+				PreserveManualOrgs: true,
+			},
+		}
+		require.NoError(t, s.SyncOrgRolesHook(context.Background(), id, nil))
+	}
+
+	// org 4 was assigned before sync managed the user's orgs and is kept
+	syncOrgs(map[int64]org.RoleType{1: org.RoleViewer, 2: org.RoleEditor})
+	assert.Equal(t, map[int64]org.RoleType{1: org.RoleViewer, 2: org.RoleEditor, 4: org.RoleViewer}, orgService.memberships)
+
+	// an admin manually adds the user to org 3 and the identity provider no longer maps org 2
+	orgService.memberships[3] = org.RoleEditor
+	syncOrgs(map[int64]org.RoleType{1: org.RoleAdmin})
+
+	assert.Equal(t, map[int64]org.RoleType{1: org.RoleAdmin, 3: org.RoleEditor, 4: org.RoleViewer}, orgService.memberships,
+		"the stale sync managed org should be removed and the manually assigned orgs kept")
+}
+
+// membershipOrgService keeps the org memberships of a single user in memory.
+type membershipOrgService struct {
+	*orgtest.FakeOrgService
+	memberships map[int64]org.RoleType
+}
+
+func (m *membershipOrgService) GetUserOrgList(ctx context.Context, query *org.GetUserOrgListQuery) ([]*org.UserOrgDTO, error) {
+	result := make([]*org.UserOrgDTO, 0, len(m.memberships))
+	for orgID, role := range m.memberships {
+		result = append(result, &org.UserOrgDTO{OrgID: orgID, Role: role})
+	}
+	return result, nil
+}
+
+func (m *membershipOrgService) AddOrgUser(ctx context.Context, cmd *org.AddOrgUserCommand) error {
+	m.memberships[cmd.OrgID] = cmd.Role
+	return nil
+}
+
+func (m *membershipOrgService) UpdateOrgUser(ctx context.Context, cmd *org.UpdateOrgUserCommand) error {
+	m.memberships[cmd.OrgID] = cmd.Role
+	return nil
+}
+
+func (m *membershipOrgService) RemoveOrgUser(ctx context.Context, cmd *org.RemoveOrgUserCommand) error {
+	delete(m.memberships, cmd.OrgID)
+	return nil
+}
@@ -0,0 +1,257 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/team"
+)
+
+func ProvideShadowSync(orgService org.Service, teamService team.Service, orgSync *OrgSync, kvStore kvstore.KVStore) *ShadowSync {
+	return &ShadowSync{
+		orgService:  orgService,
+		teamService: teamService,
+		orgSync:     orgSync,
+		kv:          kvstore.WithNamespace(kvStore, 0, "authn.shadowsync"),
+		groups:      kvstore.WithNamespace(kvStore, 0, "authn.shadowsync.groups"),
+		log:         log.New("shadow.sync"),
+	}
+}
+
+// ShadowSync records the changes syncing an identity would make to the user without applying them,
+// so mappings can be validated against real logins before syncing is enabled.
+type ShadowSync struct {
+	orgService  org.Service
+	teamService team.Service
+	// orgSync provides the org memberships managed by org sync, manual ones are kept when
+	// PreserveManualOrgs is enabled
+	orgSync *OrgSync
+	kv      *kvstore.NamespacedKVStore
+	// groups records per user the groups of their previous login
+	groups *kvstore.NamespacedKVStore
+	// teamGroups maps groups to teams, it is registered by team sync
+	teamGroups authn.TeamGroupsFn
+
+	log log.Logger
+}
+
+// RegisterTeamGroups registers how team sync maps groups to teams, team changes are only recorded once registered.
+func (s *ShadowSync) RegisterTeamGroups(fn authn.TeamGroupsFn) {
+	s.teamGroups = fn
+}
+
+func (s *ShadowSync) ShadowSyncHook(ctx context.Context, id *authn.Identity, _ *authn.Request) error {
+	if !id.ClientParams.ShadowSync {
+		return nil
+	}
+
+	ctxLogger := s.log.FromContext(ctx)
+
+	namespace, userID := id.NamespacedID()
+	if namespace != authn.NamespaceUser || userID <= 0 {
+		ctxLogger.Warn("Failed to shadow sync, invalid namespace for identity", "id", id.ID, "namespace", namespace)
+		return nil
+	}
+
+	diff := &authn.SyncDiff{UserID: userID, AuthModule: id.AuthenticatedBy, RecordedAt: time.Now()}
+
+	orgs, err := s.orgService.GetUserOrgList(ctx, &org.GetUserOrgListQuery{UserID: userID})
+	if err != nil {
+		ctxLogger.Error("Failed to get user's organizations", "id", id.ID, "error", err)
+		return nil
+	}
+
+	if len(id.ClientParams.ShadowOrgRoles) > 0 {
+		var managedOrgIDs map[int64]bool
+		if id.ClientParams.PreserveManualOrgs {
+			managedOrgIDs, err = s.orgSync.getManagedOrgs(ctx, userID)
+			if err != nil {
+				ctxLogger.Error("Failed to get user's sync managed organizations", "id", id.ID, "error", err)
+				return nil
+			}
+		}
+		diff.OrgRoles = orgRoleChanges(orgs, id.ClientParams.ShadowOrgRoles, managedOrgIDs)
+	}
+
+	// the identity holds the stored flag once the user is synced
+	if admin := id.ClientParams.ShadowIsGrafanaAdmin; admin != nil && (id.IsGrafanaAdmin == nil || *admin != *id.IsGrafanaAdmin) {
+		diff.IsGrafanaAdmin = admin
+	}
+
+	key := strconv.FormatInt(userID, 10)
+	if diff.Groups, err = s.groupChanges(ctx, key, id.Groups); err != nil {
+		ctxLogger.Warn("Failed to compare user's groups with their previous login", "id", id.ID, "error", err)
+	}
+
+	if s.teamGroups != nil {
+		if diff.Teams, err = s.teamChanges(ctx, userID, orgs, id.Groups); err != nil {
+			ctxLogger.Error("Failed to get user's team changes", "id", id.ID, "error", err)
+			return nil
+		}
+	}
+
+	if len(diff.OrgRoles) == 0 && diff.IsGrafanaAdmin == nil && diff.Groups == nil && len(diff.Teams) == 0 {
+		// the user is in sync, drop the changes recorded on a previous login
+		if err := s.kv.Del(ctx, key); err != nil {
+			ctxLogger.Warn("Failed to remove shadow sync changes", "id", id.ID, "error", err)
+		}
+		return nil
+	}
+
+	ctxLogger.Info("Shadow sync would change user", "id", id.ID, "orgRoles", diff.OrgRoles, "isGrafanaAdmin", diff.IsGrafanaAdmin, "groups", diff.Groups, "teams", diff.Teams)
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	if err := s.kv.Set(ctx, key, string(data)); err != nil {
+		ctxLogger.Warn("Failed to record shadow sync changes", "id", id.ID, "error", err)
+	}
+	return nil
+}
+
+// Diffs returns the changes recorded for each user on their last login, most recent first.
+func (s *ShadowSync) Diffs(ctx context.Context) ([]*authn.SyncDiff, error) {
+	all, err := s.kv.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]*authn.SyncDiff, 0)
+	for _, items := range all {
+		for _, data := range items {
+			var diff authn.SyncDiff
+			if err := json.Unmarshal([]byte(data), &diff); err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, &diff)
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].RecordedAt.After(diffs[j].RecordedAt) })
+	return diffs, nil
+}
+
+// orgRoleChanges returns the changes SyncOrgRolesHook makes to sync the org memberships to the external roles.
+// When managedOrgIDs is not nil, the memberships not managed by org sync are kept as with PreserveManualOrgs.
+func orgRoleChanges(orgs []*org.UserOrgDTO, extRoles map[int64]org.RoleType, managedOrgIDs map[int64]bool) []authn.OrgRoleChange {
+	var changes []authn.OrgRoleChange
+
+	handled := map[int64]bool{}
+	for _, o := range orgs {
+		handled[o.OrgID] = true
+		extRole := extRoles[o.OrgID]
+		if extRole == "" && managedOrgIDs != nil && !managedOrgIDs[o.OrgID] {
+			continue
+		}
+		if extRole != o.Role {
+			changes = append(changes, authn.OrgRoleChange{OrgID: o.OrgID, From: o.Role, To: extRole})
+		}
+	}
+
+	for orgID, role := range extRoles {
+		if !handled[orgID] {
+			changes = append(changes, authn.OrgRoleChange{OrgID: orgID, To: role})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].OrgID < changes[j].OrgID })
+	return changes
+}
+
+// groupChanges returns the groups the user joined or left since their previous login and records the
+// current ones. Nil is returned on the first login recorded for the user.
+func (s *ShadowSync) groupChanges(ctx context.Context, key string, groups []string) (*authn.GroupChanges, error) {
+	data, ok, err := s.groups.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := json.Marshal(groups)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.groups.Set(ctx, key, string(current)); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var previous []string
+	if err := json.Unmarshal([]byte(data), &previous); err != nil {
+		return nil, err
+	}
+
+	changes := &authn.GroupChanges{Added: missing(groups, previous), Removed: missing(previous, groups)}
+	if len(changes.Added) == 0 && len(changes.Removed) == 0 {
+		return nil, nil
+	}
+	return changes, nil
+}
+
+// missing returns the sorted values of from that aren't in in.
+func missing(from, in []string) []string {
+	seen := make(map[string]bool, len(in))
+	for _, v := range in {
+		seen[v] = true
+	}
+
+	var values []string
+	for _, v := range from {
+		if !seen[v] {
+			values = append(values, v)
+			seen[v] = true
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// teamChanges returns the changes team sync makes to the external team memberships of the user in
+// each of their orgs to match the teams the groups are mapped to.
+func (s *ShadowSync) teamChanges(ctx context.Context, userID int64, orgs []*org.UserOrgDTO, groups []string) ([]authn.TeamChange, error) {
+	var changes []authn.TeamChange
+
+	for _, o := range orgs {
+		teamIDs, err := s.teamGroups(ctx, o.OrgID, groups)
+		if err != nil {
+			return nil, err
+		}
+		memberships, err := s.teamService.GetUserTeamMemberships(ctx, o.OrgID, userID, true)
+		if err != nil {
+			return nil, err
+		}
+
+		synced := make(map[int64]bool, len(teamIDs))
+		for _, teamID := range teamIDs {
+			synced[teamID] = true
+		}
+		member := make(map[int64]bool, len(memberships))
+		for _, m := range memberships {
+			member[m.TeamID] = true
+			if !synced[m.TeamID] {
+				changes = append(changes, authn.TeamChange{OrgID: o.OrgID, TeamID: m.TeamID})
+			}
+		}
+		for teamID := range synced {
+			if !member[teamID] {
+				changes = append(changes, authn.TeamChange{OrgID: o.OrgID, TeamID: teamID, Added: true})
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].OrgID != changes[j].OrgID {
+			return changes[i].OrgID < changes[j].OrgID
+		}
+		return changes[i].TeamID < changes[j].TeamID
+	})
+	return changes, nil
+}
@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/accesscontrol/actest"
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/org/orgtest"
+	"github.com/grafana/grafana/pkg/services/team"
+	"github.com/grafana/grafana/pkg/services/team/teamtest"
+	"github.com/grafana/grafana/pkg/services/user/usertest"
+)
+
+func TestShadowSync_ShadowSyncHook(t *testing.T) {
+	orgService := &mutationCountingOrgService{FakeOrgService: &orgtest.FakeOrgService{ExpectedUserOrgDTO: []*org.UserOrgDTO{
+		{OrgID: 1, Role: org.RoleViewer},
+		{OrgID: 3, Role: org.RoleEditor},
+	}}}
+	kvStore := kvstore.NewFakeKVStore()
+	orgSync := ProvideOrgSync(&usertest.FakeUserService{}, orgService, &actest.FakeService{}, kvStore)
+	orgSync.log = log.NewNopLogger()
+	teamService := &orgTeamService{FakeService: &teamtest.FakeService{ExpectedMembers: []*team.TeamMemberDTO{{OrgID: 1, TeamID: 10}, {OrgID: 1, TeamID: 11}}}}
+	s := ProvideShadowSync(orgService, teamService, orgSync, kvStore)
+
+	isAdmin, notAdmin := true, false
+	// the identity an OAuth login produces in shadow mode, once the user is synced
+	identity := &authn.Identity{
+		ID:              authn.NamespacedID(authn.NamespaceUser, 2),
+		AuthenticatedBy: "oauth_generic_oauth",
+		IsGrafanaAdmin:  &notAdmin,
+		OrgRoles:        map[int64]org.RoleType{},
+		Groups:          []string{"devs", "ops"},
+		ClientParams: authn.ClientParams{
+			SyncUser:             true,
+			ShadowSync:           true,
+			ShadowOrgRoles:       map[int64]org.RoleType{1: org.RoleAdmin, 2: org.RoleViewer},
+			ShadowIsGrafanaAdmin: &isAdmin,
+		},
+	}
+
+	ctx := context.Background()
+	require.NoError(t, orgSync.SyncOrgRolesHook(ctx, identity, nil))
+	require.NoError(t, s.ShadowSyncHook(ctx, identity, nil))
+
+	assert.Zero(t, orgService.mutations, "memberships are left unchanged")
+
+	diffs, err := s.Diffs(ctx)
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+	assert.Equal(t, int64(2), diffs[0].UserID)
+	assert.Equal(t, "oauth_generic_oauth", diffs[0].AuthModule)
+	assert.Equal(t, []authn.OrgRoleChange{
+		{OrgID: 1, From: org.RoleViewer, To: org.RoleAdmin},
+		{OrgID: 2, To: org.RoleViewer},
+		{OrgID: 3, From: org.RoleEditor},
+	}, diffs[0].OrgRoles)
+	assert.Equal(t, &isAdmin, diffs[0].IsGrafanaAdmin)
+	assert.Nil(t, diffs[0].Groups, "groups are only compared from the second login")
+
+	t.Run("changes are dropped once the user is in sync", func(t *testing.T) {
+		identity.IsGrafanaAdmin = &isAdmin
+		identity.ClientParams.ShadowOrgRoles = map[int64]org.RoleType{1: org.RoleViewer, 3: org.RoleEditor}
+		require.NoError(t, s.ShadowSyncHook(ctx, identity, nil))
+
+		diffs, err := s.Diffs(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, diffs)
+	})
+
+	t.Run("manually assigned orgs are kept when preserving manual orgs", func(t *testing.T) {
+		// org 1 was assigned by sync, org 3 manually
+		require.NoError(t, orgSync.setManagedOrgs(ctx, 2, []int64{1}))
+		identity.ClientParams.PreserveManualOrgs = true
+		identity.ClientParams.ShadowOrgRoles = map[int64]org.RoleType{2: org.RoleViewer}
+		require.NoError(t, s.ShadowSyncHook(ctx, identity, nil))
+
+		diffs, err := s.Diffs(ctx)
+		require.NoError(t, err)
+		require.Len(t, diffs, 1)
+		assert.Equal(t, []authn.OrgRoleChange{
+			{OrgID: 1, From: org.RoleViewer},
+			{OrgID: 2, To: org.RoleViewer},
+		}, diffs[0].OrgRoles)
+
+		identity.ClientParams.PreserveManualOrgs = false
+		identity.ClientParams.ShadowOrgRoles = map[int64]org.RoleType{1: org.RoleViewer, 3: org.RoleEditor}
+	})
+
+	t.Run("group and team changes are recorded", func(t *testing.T) {
+		// team sync maps ops to team 11 and admins to team 12 in org 1
+		s.RegisterTeamGroups(func(ctx context.Context, orgID int64, groups []string) ([]int64, error) {
+			var teamIDs []int64
+			for _, g := range groups {
+				if orgID == 1 && g == "ops" {
+					teamIDs = append(teamIDs, 11)
+				}
+				if orgID == 1 && g == "admins" {
+					teamIDs = append(teamIDs, 12)
+				}
+			}
+			return teamIDs, nil
+		})
+		identity.Groups = []string{"ops", "admins"}
+		require.NoError(t, s.ShadowSyncHook(ctx, identity, nil))
+
+		diffs, err := s.Diffs(ctx)
+		require.NoError(t, err)
+		require.Len(t, diffs, 1)
+		assert.Empty(t, diffs[0].OrgRoles)
+		assert.Equal(t, &authn.GroupChanges{Added: []string{"admins"}, Removed: []string{"devs"}}, diffs[0].Groups)
+		assert.Equal(t, []authn.TeamChange{
+			{OrgID: 1, TeamID: 10},
+			{OrgID: 1, TeamID: 12, Added: true},
+		}, diffs[0].Teams)
+	})
+
+	t.Run("nothing is recorded when shadow sync is disabled", func(t *testing.T) {
+		require.NoError(t, s.kv.Del(ctx, "2"))
+		identity.ClientParams = authn.ClientParams{SyncUser: true, ShadowOrgRoles: map[int64]org.RoleType{1: org.RoleAdmin}}
+		require.NoError(t, s.ShadowSyncHook(ctx, identity, nil))
+
+		diffs, err := s.Diffs(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, diffs)
+	})
+}
+
+type mutationCountingOrgService struct {
+	*orgtest.FakeOrgService
+	mutations int
+}
+
+func (m *mutationCountingOrgService) AddOrgUser(ctx context.Context, cmd *org.AddOrgUserCommand) error {
+	m.mutations++
+	return m.FakeOrgService.AddOrgUser(ctx, cmd)
+}
+
+func (m *mutationCountingOrgService) UpdateOrgUser(ctx context.Context, cmd *org.UpdateOrgUserCommand) error {
+	m.mutations++
+	return m.FakeOrgService.UpdateOrgUser(ctx, cmd)
+}
+
+func (m *mutationCountingOrgService) RemoveOrgUser(ctx context.Context, cmd *org.RemoveOrgUserCommand) error {
+	m.mutations++
+	return m.FakeOrgService.RemoveOrgUser(ctx, cmd)
+}
+
+// orgTeamService returns the memberships of the requested org only.
+type orgTeamService struct {
+	*teamtest.FakeService
+}
+
+func (o *orgTeamService) GetUserTeamMemberships(ctx context.Context, orgID, userID int64, external bool) ([]*team.TeamMemberDTO, error) {
+	var memberships []*team.TeamMemberDTO
+	for _, m := range o.ExpectedMembers {
+		if m.OrgID == orgID {
+			memberships = append(memberships, m)
+		}
+	}
+	return memberships, nil
+}
@@ -4,13 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/services/authn"
 	"github.com/grafana/grafana/pkg/services/login"
 	"github.com/grafana/grafana/pkg/services/org"
 	"github.com/grafana/grafana/pkg/services/quota"
 	"github.com/grafana/grafana/pkg/services/user"
+	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util/errutil"
 )
 
@@ -41,6 +48,9 @@ var (
 	)
 )
 
+// maxGeneratedLoginAttempts is the number of suffixes tried for a generated login already taken.
+const maxGeneratedLoginAttempts = 100
+
 var (
 	errUsersQuotaReached = errors.New("users quota reached")
 	errGettingUserQuota  = errors.New("error getting user quota")
@@ -49,13 +59,15 @@ var (
 
 func ProvideUserSync(userService user.Service,
 	userProtectionService login.UserProtectionService,
-	authInfoService login.AuthInfoService, quotaService quota.Service) *UserSync {
+	authInfoService login.AuthInfoService, quotaService quota.Service, cfg *setting.Cfg, tracer tracing.Tracer) *UserSync {
 	return &UserSync{
 		userService:           userService,
 		authInfoService:       authInfoService,
 		userProtectionService: userProtectionService,
 		quotaService:          quotaService,
+		emailDomainVerifier:   newEmailDomainVerifier(net.DefaultResolver, cfg.OAuthSignupBlockedEmailDomains),
 		log:                   log.New("user.sync"),
+		tracer:                tracer,
 	}
 }
 
@@ -64,15 +76,30 @@ type UserSync struct {
 	authInfoService       login.AuthInfoService
 	userProtectionService login.UserProtectionService
 	quotaService          quota.Service
+	emailDomainVerifier   *emailDomainVerifier
 	log                   log.Logger
+	tracer                tracing.Tracer
 }
 
 // SyncUserHook syncs a user with the database
-func (s *UserSync) SyncUserHook(ctx context.Context, id *authn.Identity, _ *authn.Request) error {
+func (s *UserSync) SyncUserHook(ctx context.Context, id *authn.Identity, _ *authn.Request) (err error) {
 	if !id.ClientParams.SyncUser {
 		return nil
 	}
 
+	ctx, span := s.tracer.Start(ctx, "user.sync.SyncUserHook")
+	span.SetAttributes("auth_module", id.AuthenticatedBy, attribute.Key("auth_module").String(id.AuthenticatedBy))
+	result := "updated"
+	defer func() {
+		if err != nil {
+			result = "error"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.SetAttributes("result", result, attribute.Key("result").String(result))
+		span.End()
+	}()
+
 	// Does user exist in the database?
 	usr, userAuth, errUserInDB := s.getUser(ctx, id)
 	if errUserInDB != nil && !errors.Is(errUserInDB, user.ErrUserNotFound) {
@@ -86,7 +113,20 @@ func (s *UserSync) SyncUserHook(ctx context.Context, id *authn.Identity, _ *auth
 			return errUserSignupDisabled.Errorf("%w", errSignupNotAllowed)
 		}
 
+		if id.ClientParams.UnverifiedEmail {
+			s.log.FromContext(ctx).Warn("Failed to create user, email is not verified", "auth_module", id.AuthenticatedBy, "auth_id", id.AuthID)
+			return authn.ErrEmailNotVerified.Errorf("identity provider didn't assert the email is verified")
+		}
+
+		if id.ClientParams.VerifyEmailDomain {
+			if err := s.emailDomainVerifier.verify(ctx, id.Email); err != nil {
+				s.log.FromContext(ctx).Warn("Failed to create user, email domain could not be verified", "error", err, "auth_module", id.AuthenticatedBy, "auth_id", id.AuthID)
+				return err
+			}
+		}
+
 		// create user
+		result = "created"
 		var errCreate error
 		usr, errCreate = s.createUser(ctx, id)
 		if errCreate != nil {
@@ -272,8 +312,16 @@ func (s *UserSync) createUser(ctx context.Context, id *authn.Identity) (*user.Us
 		isAdmin = *id.IsGrafanaAdmin
 	}
 
+	login := id.Login
+	if login == "" && id.ClientParams.GeneratedLogin != "" {
+		var err error
+		if login, err = s.availableLogin(ctx, id.ClientParams.GeneratedLogin); err != nil {
+			return nil, err
+		}
+	}
+
 	usr, errCreateUser := s.userService.Create(ctx, &user.CreateUserCommand{
-		Login:        id.Login,
+		Login:        login,
 		Email:        id.Email,
 		Name:         id.Name,
 		IsAdmin:      isAdmin,
@@ -291,6 +339,25 @@ func (s *UserSync) createUser(ctx context.Context, id *authn.Identity) (*user.Us
 	return usr, nil
 }
 
+// availableLogin returns the login, with a numeric suffix appended when it's already taken.
+func (s *UserSync) availableLogin(ctx context.Context, login string) (string, error) {
+	for attempt := 1; attempt <= maxGeneratedLoginAttempts; attempt++ {
+		candidate := login
+		if attempt > 1 {
+			candidate = login + strconv.Itoa(attempt)
+		}
+
+		_, err := s.userService.GetByLogin(ctx, &user.GetUserByLoginQuery{LoginOrEmail: candidate})
+		if errors.Is(err, user.ErrUserNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no available login for %s", login)
+}
+
 func (s *UserSync) getUser(ctx context.Context, identity *authn.Identity) (*user.User, *login.UserAuth, error) {
 	// Check auth info fist
 	if identity.AuthID != "" && identity.AuthenticatedBy != "" {
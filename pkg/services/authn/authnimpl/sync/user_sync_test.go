@@ -2,11 +2,14 @@ package sync
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/services/authn"
 	"github.com/grafana/grafana/pkg/services/login"
 	"github.com/grafana/grafana/pkg/services/login/authinfoservice"
@@ -15,6 +18,7 @@ import (
 	"github.com/grafana/grafana/pkg/services/quota/quotatest"
 	"github.com/grafana/grafana/pkg/services/user"
 	"github.com/grafana/grafana/pkg/services/user/usertest"
+	"github.com/grafana/grafana/pkg/setting"
 )
 
 func ptrString(s string) *string {
@@ -430,7 +434,7 @@ func TestUserSync_SyncUserHook(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := ProvideUserSync(tt.fields.userService, userProtection, tt.fields.authInfoService, tt.fields.quotaService)
+			s := ProvideUserSync(tt.fields.userService, userProtection, tt.fields.authInfoService, tt.fields.quotaService, setting.NewCfg(), tracing.InitializeTracerForTest())
 			err := s.SyncUserHook(tt.args.ctx, tt.args.id, nil)
 			if tt.wantErr {
 				require.Error(t, err)
@@ -443,6 +447,280 @@ func TestUserSync_SyncUserHook(t *testing.T) {
 	}
 }
 
+type fakeMXResolver struct {
+	records map[string][]*net.MX
+	calls   int
+}
+
+func (f *fakeMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	f.calls++
+	records, ok := f.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestUserSync_SyncUserHook_VerifyEmailDomain(t *testing.T) {
+	newIdentity := func(email string) *authn.Identity {
+		return &authn.Identity{
+			Login:           "test_create",
+			Name:            "test_create",
+			Email:           email,
+			AuthenticatedBy: "oauth",
+			AuthID:          "2032",
+			ClientParams: authn.ClientParams{
+				SyncUser:          true,
+				AllowSignUp:       true,
+				VerifyEmailDomain: true,
+				LookUpParams: login.UserLookupParams{
+					Email: ptrString(email),
+				},
+			},
+		}
+	}
+
+	newUserSync := func(userService user.Service, resolver mxResolver) *UserSync {
+		return &UserSync{
+			userService: userService,
+			authInfoService: &logintest.AuthInfoServiceFake{
+				ExpectedError: user.ErrUserNotFound,
+				SetAuthInfoFn: func(ctx context.Context, cmd *login.SetAuthInfoCommand) error { return nil },
+			},
+			userProtectionService: &authinfoservice.OSSUserProtectionImpl{},
+			quotaService:          &quotatest.FakeQuotaService{},
+			emailDomainVerifier:   newEmailDomainVerifier(resolver, []string{"mailinator.com"}),
+			log:                   log.NewNopLogger(),
+			tracer:                tracing.InitializeTracerForTest(),
+		}
+	}
+
+	newUserServiceNil := func() *usertest.FakeUserService {
+		return &usertest.FakeUserService{
+			ExpectedError: user.ErrUserNotFound,
+			CreateFn: func(ctx context.Context, cmd *user.CreateUserCommand) (*user.User, error) {
+				return &user.User{ID: 2, Login: cmd.Login, Name: cmd.Name, Email: cmd.Email}, nil
+			},
+		}
+	}
+
+	resolver := func() *fakeMXResolver {
+		return &fakeMXResolver{records: map[string][]*net.MX{
+			"example.com":    {{Host: "mx.example.com.", Pref: 10}},
+			"null-mx.com":    {{Host: ".", Pref: 0}},
+			"mailinator.com": {{Host: "mx.mailinator.com.", Pref: 10}},
+		}}
+	}
+
+	t.Run("should create user when email domain has MX records", func(t *testing.T) {
+		s := newUserSync(newUserServiceNil(), resolver())
+		id := newIdentity("test@example.com")
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Equal(t, "user:2", id.ID)
+	})
+
+	t.Run("should reject user when email domain has no MX records", func(t *testing.T) {
+		s := newUserSync(newUserServiceNil(), resolver())
+
+		err := s.SyncUserHook(context.Background(), newIdentity("test@unknown.example.org"), nil)
+		assert.ErrorIs(t, err, errEmailDomainUnverified)
+
+		err = s.SyncUserHook(context.Background(), newIdentity("test@null-mx.com"), nil)
+		assert.ErrorIs(t, err, errEmailDomainUnverified)
+	})
+
+	t.Run("should reject user when email domain is blocked", func(t *testing.T) {
+		r := resolver()
+		s := newUserSync(newUserServiceNil(), r)
+
+		err := s.SyncUserHook(context.Background(), newIdentity("test@mailinator.com"), nil)
+		assert.ErrorIs(t, err, errEmailDomainBlocked)
+
+		err = s.SyncUserHook(context.Background(), newIdentity("test@eu.Mailinator.com"), nil)
+		assert.ErrorIs(t, err, errEmailDomainBlocked)
+		assert.Equal(t, 0, r.calls)
+	})
+
+	t.Run("should cache lookups", func(t *testing.T) {
+		r := resolver()
+		s := newUserSync(newUserServiceNil(), r)
+
+		require.NoError(t, s.SyncUserHook(context.Background(), newIdentity("first@example.com"), nil))
+		require.NoError(t, s.SyncUserHook(context.Background(), newIdentity("second@example.com"), nil))
+		require.Error(t, s.SyncUserHook(context.Background(), newIdentity("first@unknown.example.org"), nil))
+		require.Error(t, s.SyncUserHook(context.Background(), newIdentity("second@unknown.example.org"), nil))
+		assert.Equal(t, 2, r.calls)
+	})
+
+	t.Run("should not verify email domain of existing users", func(t *testing.T) {
+		r := resolver()
+		s := newUserSync(&usertest.FakeUserService{ExpectedUser: &user.User{ID: 1, Login: "test", Email: "test@unknown.example.org"}}, r)
+		s.authInfoService = &logintest.AuthInfoServiceFake{
+			ExpectedUserAuth: &login.UserAuth{AuthModule: "oauth", AuthId: "2032", UserId: 1, Id: 1},
+		}
+		id := newIdentity("test@unknown.example.org")
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Equal(t, "user:1", id.ID)
+		assert.Equal(t, 0, r.calls)
+	})
+}
+
+func TestUserSync_SyncUserHook_GeneratedLogin(t *testing.T) {
+	newIdentity := func(providerLogin, generatedLogin string) *authn.Identity {
+		return &authn.Identity{
+			Login:           providerLogin,
+			Name:            "Jane Doe",
+			Email:           "jane@example.com",
+			AuthenticatedBy: "oauth",
+			AuthID:          "2032",
+			ClientParams: authn.ClientParams{
+				SyncUser:       true,
+				AllowSignUp:    true,
+				GeneratedLogin: generatedLogin,
+				LookUpParams: login.UserLookupParams{
+					Email: ptrString("jane@example.com"),
+				},
+			},
+		}
+	}
+
+	newUserSync := func(taken ...string) (*UserSync, *string) {
+		var created string
+		userService := &takenLoginUserService{
+			FakeUserService: &usertest.FakeUserService{
+				ExpectedError: user.ErrUserNotFound,
+				CreateFn: func(ctx context.Context, cmd *user.CreateUserCommand) (*user.User, error) {
+					created = cmd.Login
+					return &user.User{ID: 2, Login: cmd.Login, Name: cmd.Name, Email: cmd.Email}, nil
+				},
+			},
+			taken: taken,
+		}
+		return &UserSync{
+			userService: userService,
+			authInfoService: &logintest.AuthInfoServiceFake{
+				ExpectedError: user.ErrUserNotFound,
+				SetAuthInfoFn: func(ctx context.Context, cmd *login.SetAuthInfoCommand) error { return nil },
+			},
+			userProtectionService: &authinfoservice.OSSUserProtectionImpl{},
+			quotaService:          &quotatest.FakeQuotaService{},
+			log:                   log.NewNopLogger(),
+			tracer:                tracing.InitializeTracerForTest(),
+		}, &created
+	}
+
+	t.Run("should sign up with the generated login", func(t *testing.T) {
+		s, created := newUserSync()
+		id := newIdentity("", "jane")
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Equal(t, "jane", *created)
+		assert.Equal(t, "jane", id.Login)
+	})
+
+	t.Run("should append a numeric suffix when the generated login is taken", func(t *testing.T) {
+		s, created := newUserSync("jane", "jane2")
+		id := newIdentity("", "jane")
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Equal(t, "jane3", *created)
+	})
+
+	t.Run("should prefer the login of the provider", func(t *testing.T) {
+		s, created := newUserSync()
+		id := newIdentity("jdoe", "jane")
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Equal(t, "jdoe", *created)
+	})
+
+	t.Run("should not change the login of existing users", func(t *testing.T) {
+		s, created := newUserSync()
+		s.userService = &usertest.FakeUserService{ExpectedUser: &user.User{ID: 1, Login: "existing", Email: "jane@example.com"}}
+		s.authInfoService = &logintest.AuthInfoServiceFake{
+			ExpectedUserAuth: &login.UserAuth{AuthModule: "oauth", AuthId: "2032", UserId: 1, Id: 1},
+		}
+		id := newIdentity("", "jane")
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Empty(t, *created)
+		assert.Equal(t, "existing", id.Login)
+	})
+}
+
+// takenLoginUserService only finds the users with a taken login.
+type takenLoginUserService struct {
+	*usertest.FakeUserService
+	taken []string
+}
+
+func (s *takenLoginUserService) GetByLogin(ctx context.Context, query *user.GetUserByLoginQuery) (*user.User, error) {
+	for _, taken := range s.taken {
+		if taken == query.LoginOrEmail {
+			return &user.User{ID: 1, Login: taken}, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func TestUserSync_SyncUserHook_UnverifiedEmail(t *testing.T) {
+	newIdentity := func() *authn.Identity {
+		return &authn.Identity{
+			Login:           "test",
+			Email:           "test@example.com",
+			AuthenticatedBy: "oauth",
+			AuthID:          "2032",
+			ClientParams: authn.ClientParams{
+				SyncUser:        true,
+				AllowSignUp:     true,
+				UnverifiedEmail: true,
+				LookUpParams: login.UserLookupParams{
+					Email: ptrString("test@example.com"),
+				},
+			},
+		}
+	}
+
+	newUserSync := func(userService user.Service, authInfoService login.AuthInfoService) *UserSync {
+		return &UserSync{
+			userService:           userService,
+			authInfoService:       authInfoService,
+			userProtectionService: &authinfoservice.OSSUserProtectionImpl{},
+			quotaService:          &quotatest.FakeQuotaService{},
+			log:                   log.NewNopLogger(),
+			tracer:                tracing.InitializeTracerForTest(),
+		}
+	}
+
+	t.Run("should reject signup with unverified email", func(t *testing.T) {
+		created := false
+		s := newUserSync(&usertest.FakeUserService{
+			ExpectedError: user.ErrUserNotFound,
+			CreateFn: func(ctx context.Context, cmd *user.CreateUserCommand) (*user.User, error) {
+				created = true
+				return &user.User{ID: 2, Login: cmd.Login, Email: cmd.Email}, nil
+			},
+		}, &logintest.AuthInfoServiceFake{ExpectedError: user.ErrUserNotFound})
+
+		err := s.SyncUserHook(context.Background(), newIdentity(), nil)
+		assert.ErrorIs(t, err, authn.ErrEmailNotVerified)
+		assert.False(t, created)
+	})
+
+	t.Run("should let existing users with unverified email log in", func(t *testing.T) {
+		s := newUserSync(
+			&usertest.FakeUserService{ExpectedUser: &user.User{ID: 1, Login: "test", Email: "test@example.com"}},
+			&logintest.AuthInfoServiceFake{ExpectedUserAuth: &login.UserAuth{AuthModule: "oauth", AuthId: "2032", UserId: 1, Id: 1}},
+		)
+		id := newIdentity()
+
+		require.NoError(t, s.SyncUserHook(context.Background(), id, nil))
+		assert.Equal(t, "user:1", id.ID)
+	})
+}
+
 func TestUserSync_FetchSyncedUserHook(t *testing.T) {
 	type testCase struct {
 		desc        string
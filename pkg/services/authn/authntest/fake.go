@@ -15,6 +15,8 @@ type FakeService struct {
 	ExpectedIdentity   *authn.Identity
 	ExpectedErrs       []error
 	ExpectedIdentities []*authn.Identity
+	ExpectedSyncDiffs  []*authn.SyncDiff
+	ExpectedAvatarURLs map[int64]string
 	CurrentIndex       int
 }
 
@@ -66,6 +68,24 @@ func (f *FakeService) RedirectURL(ctx context.Context, client string, r *authn.R
 	return f.ExpectedRedirect, f.ExpectedErr
 }
 
+func (f *FakeService) PreviewIdentity(ctx context.Context, client string, claims map[string]any) (*authn.Identity, error) {
+	return f.ExpectedIdentity, f.ExpectedErr
+}
+
+func (f *FakeService) BackchannelLogout(ctx context.Context, client string, logoutToken string) error {
+	return f.ExpectedErr
+}
+
+func (f *FakeService) ShadowSyncDiffs(ctx context.Context) ([]*authn.SyncDiff, error) {
+	return f.ExpectedSyncDiffs, f.ExpectedErr
+}
+
+func (f *FakeService) RegisterShadowTeamSync(fn authn.TeamGroupsFn) {}
+
+func (f *FakeService) AvatarURLs(ctx context.Context, userIDs ...int64) (map[int64]string, error) {
+	return f.ExpectedAvatarURLs, f.ExpectedErr
+}
+
 func (f *FakeService) RegisterClient(c authn.Client) {}
 
 func (f *FakeService) SyncIdentity(ctx context.Context, identity *authn.Identity) error {
@@ -25,6 +25,26 @@ func (m *MockService) RedirectURL(ctx context.Context, client string, r *authn.R
 	panic("unimplemented")
 }
 
+func (m *MockService) PreviewIdentity(ctx context.Context, client string, claims map[string]any) (*authn.Identity, error) {
+	panic("unimplemented")
+}
+
+func (m *MockService) BackchannelLogout(ctx context.Context, client string, logoutToken string) error {
+	panic("unimplemented")
+}
+
+func (m *MockService) ShadowSyncDiffs(ctx context.Context) ([]*authn.SyncDiff, error) {
+	panic("unimplemented")
+}
+
+func (m *MockService) RegisterShadowTeamSync(fn authn.TeamGroupsFn) {
+	panic("unimplemented")
+}
+
+func (m *MockService) AvatarURLs(ctx context.Context, userIDs ...int64) (map[int64]string, error) {
+	panic("unimplemented")
+}
+
 func (m *MockService) RegisterClient(c authn.Client) {
 	panic("unimplemented")
 }
@@ -9,29 +9,57 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/exp/slices"
 	"golang.org/x/oauth2"
 
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/login/social"
 	"github.com/grafana/grafana/pkg/services/authn"
 	"github.com/grafana/grafana/pkg/services/login"
+	"github.com/grafana/grafana/pkg/services/loginattempt"
 	"github.com/grafana/grafana/pkg/services/org"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util/errutil"
+	"github.com/grafana/grafana/pkg/web"
 )
 
 const (
 	hostedDomainParamName        = "hd"
+	maxAgeParamName              = "max_age"
+	promptParamName              = "prompt"
+	audienceParamName            = "audience"
+	resourceParamName            = "resource"
 	codeVerifierParamName        = "code_verifier"
 	codeChallengeParamName       = "code_challenge"
 	codeChallengeMethodParamName = "code_challenge_method"
 	codeChallengeMethod          = "S256"
+	redirectURIParamName         = "redirect_uri"
+
+	attributeKeyProvider = "oauth.provider"
+	attributeKeyResult   = "oauth.result"
+	attributeKeyElapsed  = "oauth.elapsed_ms"
 
 	oauthStateQueryName  = "state"
 	oauthStateCookieName = "oauth_state"
 	oauthPKCECookieName  = "oauth_code_verifier"
+	// oauthIssuerQueryName is the issuer identifier returned in the authorization response (RFC 9207)
+	oauthIssuerQueryName = "iss"
+	// correlationIDSeparator separates the correlation id appended to the random part of the state
+	correlationIDSeparator = "."
+
+	// authTimeLeeway allows for clock skew with the provider when checking auth_time against max_age
+	authTimeLeeway = time.Minute
+	// maxAvatarURLLength caps the avatar URLs synced from the provider, longer ones are ignored
+	maxAvatarURLLength = 1024
 )
 
 var (
@@ -47,6 +75,17 @@ var (
 
 	errOAuthMissingRequiredEmail = errutil.Unauthorized("auth.oauth.email.missing", errutil.WithPublicMessage("Provider didn't return an email address"))
 	errOAuthEmailNotAllowed      = errutil.Unauthorized("auth.oauth.email.not-allowed", errutil.WithPublicMessage("Required email domain not fulfilled"))
+
+	errOAuthTooManyGroups = errutil.Unauthorized("auth.oauth.groups.too-many", errutil.WithPublicMessage("Provider returned too many groups for the user"))
+
+	errOAuthMissingAuthTime = errutil.Unauthorized("auth.oauth.auth-time.missing", errutil.WithPublicMessage("Provider didn't return the authentication time"))
+
+	errOAuthCallbackHostNotAllowed = errutil.BadRequest("auth.oauth.callback.host-not-allowed", errutil.WithPublicMessage("OAuth login is not allowed from this host"))
+
+	errOAuthIssuerMismatch = errutil.Unauthorized("auth.oauth.issuer.mismatch", errutil.WithPublicMessage("Authorization response was issued by an unexpected provider"))
+	errOAuthMissingIssuer  = errutil.Unauthorized("auth.oauth.issuer.missing", errutil.WithPublicMessage("Authorization response is missing the issuer"))
+
+	errOAuthLoginBlocked = errutil.Unauthorized("auth.oauth.blocked", errutil.WithPublicMessage("Too many consecutive failed login attempts, login temporarily blocked"))
 )
 
 func fromSocialErr(err *social.Error) error {
@@ -54,14 +93,21 @@ func fromSocialErr(err *social.Error) error {
 }
 
 var _ authn.RedirectClient = new(OAuth)
+var _ authn.FailedLoginClient = new(OAuth)
 
 func ProvideOAuth(
 	name string, cfg *setting.Cfg, oauthCfg *social.OAuthInfo,
 	connector social.SocialConnector, httpClient *http.Client,
+	loginAttempts loginattempt.Service, tracer tracing.Tracer, keySets *KeySetCache,
 ) *OAuth {
+	logger := log.New(name)
+	if keySets == nil {
+		keySets = NewKeySetCache(0, 0)
+	}
 	return &OAuth{
 		name, fmt.Sprintf("oauth_%s", strings.TrimPrefix(name, "auth.client.")),
-		log.New(name), cfg, oauthCfg, connector, httpClient,
+		logger, cfg, oauthCfg, connector, httpClient, loginAttempts, tracer, keySets,
+		newLoginPolicy(cfg, logger),
 	}
 }
 
@@ -73,6 +119,13 @@ type OAuth struct {
 	oauthCfg   *social.OAuthInfo
 	connector  social.SocialConnector
 	httpClient *http.Client
+	// loginAttempts is shared with password logins so failures from both count towards the same limit
+	loginAttempts loginattempt.Service
+	tracer        tracing.Tracer
+	// keySets caches the key sets verifying the back-channel logout tokens, it is shared by the providers
+	keySets *KeySetCache
+	// policy is nil unless a login policy webhook is configured
+	policy *loginPolicy
 }
 
 func (c *OAuth) Name() string {
@@ -92,13 +145,28 @@ func (c *OAuth) Authenticate(ctx context.Context, r *authn.Request) (*authn.Iden
 	}
 
 	// get state returned by the idp and hash it
-	stateQuery := hashOAuthState(r.HTTPRequest.URL.Query().Get(oauthStateQueryName), c.cfg.SecretKey, c.oauthCfg.ClientSecret)
+	state := r.HTTPRequest.URL.Query().Get(oauthStateQueryName)
+	stateQuery := hashOAuthState(state, c.cfg.SecretKey, c.oauthCfg.ClientSecret)
 	// compare the state returned by idp against the one we stored in cookie
 	if stateQuery != stateCookie.Value {
 		return nil, errOAuthInvalidState.Errorf("provided state did not match stored state")
 	}
 
-	var opts []oauth2.AuthCodeOption
+	// the correlation id can be trusted once the state matches the one stored on redirect
+	if correlationID := correlationIDFromState(state); correlationID != "" {
+		r.SetMeta(authn.MetaKeyCorrelationID, correlationID)
+		ctx = log.WithContextualAttributes(ctx, []any{"correlation_id", correlationID})
+		c.log.Debug("Handling OAuth callback", "correlation_id", correlationID)
+	}
+
+	if err := c.validateIssuer(r.HTTPRequest.URL.Query()); err != nil {
+		return nil, err
+	}
+
+	opts, err := c.redirectURIOptions(r)
+	if err != nil {
+		return nil, err
+	}
 	// if pkce is enabled for client validate we have the cookie and set it as url param
 	if c.oauthCfg.UsePKCE {
 		pkceCookie, err := r.HTTPRequest.Cookie(oauthPKCECookieName)
@@ -108,47 +176,156 @@ func (c *OAuth) Authenticate(ctx context.Context, r *authn.Request) (*authn.Iden
 		opts = append(opts, oauth2.SetAuthURLParam(codeVerifierParamName, pkceCookie.Value))
 	}
 
-	clientCtx := context.WithValue(ctx, oauth2.HTTPClient, c.httpClient)
+	opts = append(opts, audienceOptions(c.oauthCfg)...)
+
+	clientCtx := context.WithValue(social.WithRequestPhase(ctx, social.PhaseToken), oauth2.HTTPClient, c.httpClient)
 	// exchange auth code to a valid token
-	token, err := c.connector.Exchange(clientCtx, r.HTTPRequest.URL.Query().Get("code"), opts...)
+	exchangeCtx, span := c.startPhase(clientCtx, "oauth.Exchange")
+	token, err := c.connector.Exchange(exchangeCtx, r.HTTPRequest.URL.Query().Get("code"), opts...)
+	span.end(err)
 	if err != nil {
 		return nil, errOAuthTokenExchange.Errorf("failed to exchange code to token: %w", err)
 	}
 	token.TokenType = "Bearer"
+	// providers can issue refresh tokens without being asked to, they are never stored when not requested
+	if !c.oauthCfg.RequestRefreshToken {
+		token.RefreshToken = ""
+	}
 
-	userInfo, err := c.connector.UserInfo(ctx, c.connector.Client(clientCtx, token), token)
+	if err := c.checkAuthTime(token); err != nil {
+		return nil, err
+	}
+
+	userInfoCtx, span := c.startPhase(ctx, "oauth.UserInfo")
+	userInfo, err := c.connector.UserInfo(social.WithRequestPhase(userInfoCtx, social.PhaseUserInfo), c.connector.Client(clientCtx, token), token)
+	span.end(err)
 	if err != nil {
 		var sErr *social.Error
 		if errors.As(err, &sErr) {
 			return nil, fromSocialErr(sErr)
 		}
-		return nil, errOAuthUserInfo.Errorf("failed to get user info: %w", err)
+
+		fallback := c.userInfoFromIDToken(token)
+		if fallback == nil {
+			return nil, errOAuthUserInfo.Errorf("failed to get user info: %w", err)
+		}
+		c.log.FromContext(ctx).Warn("Failed to get user info, using the id token claims instead", "error", err)
+		userInfo = fallback
+	}
+
+	usernames := loginAttemptUsernames(userInfo)
+	for _, username := range usernames {
+		ok, err := c.loginAttempts.Validate(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errOAuthLoginBlocked.Errorf("too many consecutive failed login attempts for user - login for user temporarily blocked")
+		}
 	}
 
+	identity, err := c.identityFromUserInfo(userInfo, token)
+	if err == nil {
+		// the policy is checked before the identity is synced so denied logins never create or update users
+		err = c.policy.check(ctx, c.name, identity)
+	}
+	if err != nil {
+		c.recordFailedLogin(ctx, r, usernames)
+		return nil, err
+	}
+
+	if c.oauthCfg.BindSessionSID {
+		identity.IdPSessionID = c.sessionIDFromToken(token)
+	}
+
+	return identity, nil
+}
+
+// FailedLogin records a failed attempt for the user when the login fails after the authentication,
+// e.g. when the user can't be synced.
+func (c *OAuth) FailedLogin(ctx context.Context, identity *authn.Identity, r *authn.Request) {
+	c.recordFailedLogin(ctx, r, loginAttemptUsernames(&social.BasicUserInfo{Email: identity.Email, Login: identity.Login}))
+}
+
+// recordFailedLogin records a failed attempt for each username so failed OAuth and password logins count
+// towards the same limit.
+func (c *OAuth) recordFailedLogin(ctx context.Context, r *authn.Request, usernames []string) {
+	for _, username := range usernames {
+		if err := c.loginAttempts.Add(ctx, username, web.RemoteAddr(r.HTTPRequest)); err != nil {
+			c.log.FromContext(ctx).Warn("Failed to record failed login attempt", "username", username, "error", err)
+		}
+	}
+}
+
+// loginAttemptUsernames returns the usernames failed logins are recorded for.
+// Both the email and the login are used since password logins accept either of them.
+func loginAttemptUsernames(userInfo *social.BasicUserInfo) []string {
+	usernames := make([]string, 0, 2)
+	if userInfo.Email != "" {
+		usernames = append(usernames, userInfo.Email)
+	}
+	if userInfo.Login != "" && userInfo.Login != userInfo.Email {
+		usernames = append(usernames, userInfo.Login)
+	}
+	return usernames
+}
+
+// identityFromUserInfo maps the user info returned by the connector to an identity,
+// applying the configured role and Grafana admin mappings.
+func (c *OAuth) identityFromUserInfo(userInfo *social.BasicUserInfo, token *oauth2.Token) (*authn.Identity, error) {
 	if userInfo.Email == "" {
 		return nil, errOAuthMissingRequiredEmail.Errorf("required attribute email was not provided")
 	}
 
+	unverifiedEmail := c.cfg.OAuthRequireEmailVerified && !c.emailVerified(userInfo, token)
+	// existing users can be exempted, the verified email is then only required to sign up
+	if unverifiedEmail && !c.cfg.OAuthRequireEmailVerifiedExemptExisting {
+		return nil, authn.ErrEmailNotVerified.Errorf("provider didn't assert the email is verified")
+	}
+
+	userInfo.Email = c.connector.NormalizeEmail(userInfo.Email)
 	if !c.connector.IsEmailAllowed(userInfo.Email) {
 		return nil, errOAuthEmailNotAllowed.Errorf("provided email is not allowed")
 	}
 
+	if err := c.limitGroups(userInfo); err != nil {
+		return nil, err
+	}
+
+	tenantOrgID, err := c.tenantOrg(token)
+	if err != nil {
+		return nil, err
+	}
+
 	orgRoles, isGrafanaAdmin, _ := getRoles(c.cfg, func() (org.RoleType, *bool, error) {
 		if c.cfg.OAuthSkipOrgRoleUpdateSync {
 			return "", nil, nil
 		}
 		return userInfo.Role, userInfo.IsGrafanaAdmin, nil
 	})
+	isGrafanaAdmin = c.grafanaAdminFromClaim(userInfo, isGrafanaAdmin)
+	if tenantOrgID > 0 && !c.cfg.OAuthSkipOrgRoleUpdateSync {
+		orgRoles = tenantOrgRoles(c.cfg, orgRoles, tenantOrgID)
+	}
+
+	// in shadow mode the roles are only recorded and the user is synced as if role sync was skipped
+	var shadowOrgRoles map[int64]org.RoleType
+	var shadowIsGrafanaAdmin *bool
+	if c.cfg.OAuthSyncShadowMode {
+		shadowOrgRoles, shadowIsGrafanaAdmin = orgRoles, isGrafanaAdmin
+		orgRoles, isGrafanaAdmin = map[int64]org.RoleType{}, nil
+	}
 
 	lookupParams := login.UserLookupParams{}
 	if c.cfg.OAuthAllowInsecureEmailLookup {
 		lookupParams.Email = &userInfo.Email
 	}
 
-	return &authn.Identity{
+	identity := &authn.Identity{
 		Login:           userInfo.Login,
 		Name:            userInfo.Name,
 		Email:           userInfo.Email,
+		AvatarURL:       c.avatarURL(userInfo),
 		IsGrafanaAdmin:  isGrafanaAdmin,
 		AuthenticatedBy: c.moduleName,
 		AuthID:          userInfo.Id,
@@ -156,25 +333,58 @@ func (c *OAuth) Authenticate(ctx context.Context, r *authn.Request) (*authn.Iden
 		OAuthToken:      token,
 		OrgRoles:        orgRoles,
 		ClientParams: authn.ClientParams{
-			SyncUser:        true,
-			SyncTeams:       true,
+			SyncUser: true,
+			// in shadow mode the team changes are only recorded
+			SyncTeams:       !c.cfg.OAuthSyncShadowMode,
 			FetchSyncedUser: true,
 			SyncPermissions: true,
 			AllowSignUp:     c.connector.IsSignupAllowed(),
+			// only applies to users signing up, existing users are synced without a lookup
+			VerifyEmailDomain: c.cfg.OAuthSignupVerifyEmailDomain,
+			GeneratedLogin:    c.generateLogin(userInfo, token),
+			UnverifiedEmail:   unverifiedEmail,
 			// skip org role flag is checked and handled in the connector. For now we can skip the hook if no roles are passed
-			SyncOrgRoles: len(orgRoles) > 0,
-			LookUpParams: lookupParams,
+			SyncOrgRoles:         len(orgRoles) > 0,
+			PreserveManualOrgs:   c.cfg.OAuthSyncPreserveManualOrgs,
+			ShadowSync:           c.cfg.OAuthSyncShadowMode,
+			ShadowOrgRoles:       shadowOrgRoles,
+			ShadowIsGrafanaAdmin: shadowIsGrafanaAdmin,
+			SyncAvatar:           c.oauthCfg.SyncAvatar,
+			LookUpParams:         lookupParams,
 		},
-	}, nil
+	}
+
+	return identity, nil
 }
 
-func (c *OAuth) RedirectURL(ctx context.Context, r *authn.Request) (*authn.Redirect, error) {
-	var opts []oauth2.AuthCodeOption
+func (c *OAuth) RedirectURL(ctx context.Context, r *authn.Request) (redirect *authn.Redirect, err error) {
+	_, span := c.startPhase(ctx, "oauth.RedirectURL")
+	defer func() { span.end(err) }()
+
+	opts, err := c.redirectURIOptions(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the extra params come first so the params set below take precedence
+	opts = append(opts, extraAuthorizeParamOptions(c.oauthCfg)...)
 
 	if c.oauthCfg.HostedDomain != "" {
 		opts = append(opts, oauth2.SetAuthURLParam(hostedDomainParamName, c.oauthCfg.HostedDomain))
 	}
 
+	if c.oauthCfg.MaxAge > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam(maxAgeParamName, strconv.Itoa(c.oauthCfg.MaxAge)))
+	}
+
+	if r != nil {
+		if prompt := r.GetMeta(authn.MetaKeyPrompt); prompt != "" {
+			opts = append(opts, oauth2.SetAuthURLParam(promptParamName, prompt))
+		}
+	}
+
+	opts = append(opts, audienceOptions(c.oauthCfg)...)
+
 	var plainPKCE string
 	if c.oauthCfg.UsePKCE {
 		pkce, hashedPKCE, err := genPKCECode()
@@ -189,7 +399,16 @@ func (c *OAuth) RedirectURL(ctx context.Context, r *authn.Request) (*authn.Redir
 		)
 	}
 
-	state, hashedSate, err := genOAuthState(c.cfg.SecretKey, c.oauthCfg.ClientSecret)
+	correlationID, err := genCorrelationID()
+	if err != nil {
+		return nil, errOAuthGenState.Errorf("failed to generate correlation id: %w", err)
+	}
+	if r != nil {
+		r.SetMeta(authn.MetaKeyCorrelationID, correlationID)
+	}
+	c.log.Debug("Starting OAuth login", "correlation_id", correlationID)
+
+	state, hashedSate, err := genOAuthState(c.cfg.SecretKey, c.oauthCfg.ClientSecret, correlationID)
 	if err != nil {
 		return nil, errOAuthGenState.Errorf("failed to generate state: %w", err)
 	}
@@ -203,6 +422,335 @@ func (c *OAuth) RedirectURL(ctx context.Context, r *authn.Request) (*authn.Redir
 	}, nil
 }
 
+// redirectURIOptions selects the callback redirect_uri from the request host when Grafana is served from
+// several roots. The same value must be sent on the token exchange, otherwise the provider rejects it.
+// No option is returned when the request comes from root_url so the connector default is used.
+func (c *OAuth) redirectURIOptions(r *authn.Request) ([]oauth2.AuthCodeOption, error) {
+	if len(c.cfg.OAuthAllowedCallbackRoots) == 0 || r == nil || r.HTTPRequest == nil {
+		return nil, nil
+	}
+
+	host := r.HTTPRequest.Host
+	if appURL, err := url.Parse(c.cfg.AppURL); err == nil && strings.EqualFold(appURL.Host, host) {
+		return nil, nil
+	}
+
+	for _, root := range c.cfg.OAuthAllowedCallbackRoots {
+		rootURL, err := url.Parse(root)
+		if err != nil || rootURL.Host == "" {
+			c.log.Warn("Ignoring invalid OAuth callback root", "root", root)
+			continue
+		}
+		if strings.EqualFold(rootURL.Host, host) {
+			redirectURI := strings.TrimSuffix(root, "/") + social.SocialBaseUrl + strings.TrimPrefix(c.name, "auth.client.")
+			return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam(redirectURIParamName, redirectURI)}, nil
+		}
+	}
+
+	return nil, errOAuthCallbackHostNotAllowed.Errorf("host %s is not an allowed callback root", host)
+}
+
+// grafanaAdminFromClaim only lets the provider grant the Grafana server admin flag when
+// oauth_allow_admin_from_claim is enabled. The flag is granted either when the connector
+// mapped it or when the user is a member of one of the configured admin groups.
+func (c *OAuth) grafanaAdminFromClaim(userInfo *social.BasicUserInfo, isGrafanaAdmin *bool) *bool {
+	if !c.cfg.OAuthAllowAdminFromClaim {
+		if isGrafanaAdmin != nil && *isGrafanaAdmin {
+			c.log.Warn("Ignoring Grafana admin flag from provider, oauth_allow_admin_from_claim is disabled", "id", userInfo.Id)
+		}
+		return nil
+	}
+
+	if isGrafanaAdmin != nil && *isGrafanaAdmin {
+		c.log.Info("Granting Grafana admin from provider claim", "id", userInfo.Id, "login", userInfo.Login)
+		return isGrafanaAdmin
+	}
+
+	for _, group := range userInfo.Groups {
+		if slices.Contains(c.cfg.OAuthAdminGroups, group) {
+			c.log.Info("Granting Grafana admin from provider group", "id", userInfo.Id, "login", userInfo.Login, "group", group)
+			granted := true
+			return &granted
+		}
+	}
+
+	if len(c.cfg.OAuthAdminGroups) > 0 {
+		granted := false
+		return &granted
+	}
+
+	return isGrafanaAdmin
+}
+
+// generateLogin returns the login to sign up users without login with, following the
+// configured login generation rule.
+func (c *OAuth) generateLogin(userInfo *social.BasicUserInfo, token *oauth2.Token) string {
+	if userInfo.Login != "" {
+		return ""
+	}
+
+	var login string
+	switch c.oauthCfg.LoginGeneration {
+	case social.LoginGenerationEmailLocalPart:
+		login, _, _ = strings.Cut(userInfo.Email, "@")
+	case social.LoginGenerationName:
+		login = strings.Join(strings.Fields(userInfo.Name), ".")
+	case social.LoginGenerationClaim:
+		login, _ = c.idTokenClaims(token)[c.oauthCfg.LoginGenerationClaim].(string)
+	}
+
+	return sanitizeLogin(login)
+}
+
+// sanitizeLogin lowercases the login and only keeps letters, digits, dots, dashes and underscores.
+func sanitizeLogin(login string) string {
+	return strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, login)
+}
+
+// emailVerified returns true if the provider asserted the email is verified, either in the
+// user info or in the email_verified claim of the id token.
+func (c *OAuth) emailVerified(userInfo *social.BasicUserInfo, token *oauth2.Token) bool {
+	if userInfo.EmailVerified != nil {
+		return *userInfo.EmailVerified
+	}
+
+	switch verified := c.idTokenClaims(token)["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		// some providers encode the claim as a string
+		return strings.EqualFold(verified, "true")
+	}
+	return false
+}
+
+// userInfoFromIDToken returns the user info read from the id token claims when the fallback is enabled
+// and the id token has an email, nil otherwise. Roles aren't mapped from the claims, so the org roles of
+// the user are left as they are.
+func (c *OAuth) userInfoFromIDToken(token *oauth2.Token) *social.BasicUserInfo {
+	if !c.oauthCfg.UserInfoIDTokenFallback {
+		return nil
+	}
+
+	claims := c.idTokenClaims(token)
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil
+	}
+
+	userInfo := &social.BasicUserInfo{Email: email}
+	userInfo.Id, _ = claims["sub"].(string)
+	userInfo.Name, _ = claims["name"].(string)
+	// without preferred_username the login is left empty so it's generated like for other users without login
+	userInfo.Login, _ = claims["preferred_username"].(string)
+	if groups, ok := claims["groups"].([]any); ok {
+		for _, g := range groups {
+			if group, ok := g.(string); ok {
+				userInfo.Groups = append(userInfo.Groups, group)
+			}
+		}
+	}
+	return userInfo
+}
+
+// checkAuthTime requires the user to have authenticated with the provider within max_age seconds,
+// the login must be prompted again otherwise.
+func (c *OAuth) checkAuthTime(token *oauth2.Token) error {
+	if c.oauthCfg.MaxAge <= 0 {
+		return nil
+	}
+
+	authTime, _ := c.idTokenClaims(token)["auth_time"].(float64)
+	if authTime <= 0 {
+		return errOAuthMissingAuthTime.Errorf("id token has no auth_time claim while max_age is set")
+	}
+
+	maxAge := time.Duration(c.oauthCfg.MaxAge) * time.Second
+	if age := time.Since(time.Unix(int64(authTime), 0)); age > maxAge+authTimeLeeway {
+		return authn.ErrReauthenticate.Errorf("user authenticated %s ago, more than the max age of %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+// idTokenClaims returns the claims of the id token, read by the connector so encrypted id tokens
+// are decrypted first. The id token is received directly from the token endpoint, so its signature
+// isn't verified.
+func (c *OAuth) idTokenClaims(token *oauth2.Token) map[string]any {
+	claims, err := c.connector.IDTokenClaims(token)
+	if err != nil {
+		c.log.Warn("Failed to read id token claims", "error", err)
+		return nil
+	}
+	return claims
+}
+
+// tenantOrg checks the tenant claim of the id token against the allowed tenants and returns the org
+// the tenant is mapped to, zero when it isn't mapped. Every tenant is rejected when none is configured.
+func (c *OAuth) tenantOrg(token *oauth2.Token) (int64, error) {
+	claim := c.oauthCfg.TenantClaim
+	if claim == "" {
+		return 0, nil
+	}
+
+	tenant, _ := c.idTokenClaims(token)[claim].(string)
+	if tenant == "" {
+		return 0, authn.ErrTenantNotAllowed.Errorf("id token has no %s claim", claim)
+	}
+	if orgID, ok := c.oauthCfg.TenantOrgMapping[tenant]; ok {
+		return orgID, nil
+	}
+	if slices.Contains(c.oauthCfg.AllowedTenants, tenant) {
+		return 0, nil
+	}
+	return 0, authn.ErrTenantNotAllowed.Errorf("tenant %s is not allowed", tenant)
+}
+
+// tenantOrgRoles assigns the mapped role to the org of the tenant instead of the auto assigned org.
+// The role mapped to the org of the tenant is kept, otherwise the highest mapped role is used. Users
+// without a mapped role get the auto assigned role so they still land in the org of their tenant.
+func tenantOrgRoles(cfg *setting.Cfg, orgRoles map[int64]org.RoleType, orgID int64) map[int64]org.RoleType {
+	role, ok := orgRoles[orgID]
+	if !ok {
+		role = org.RoleType(cfg.AutoAssignOrgRole)
+		var highest org.RoleType
+		for _, r := range orgRoles {
+			if r.IsValid() && (!highest.IsValid() || r.Includes(highest)) {
+				highest = r
+			}
+		}
+		if highest.IsValid() {
+			role = highest
+		}
+	}
+	if !role.IsValid() {
+		return orgRoles
+	}
+	return map[int64]org.RoleType{orgID: role}
+}
+
+// limitGroups caps the number of groups synced for the user. When truncating, the groups
+// matching a mapping are kept first so they still apply.
+func (c *OAuth) limitGroups(userInfo *social.BasicUserInfo) error {
+	maxGroups := c.oauthCfg.MaxGroups
+	if maxGroups <= 0 || len(userInfo.Groups) <= maxGroups {
+		return nil
+	}
+
+	if c.oauthCfg.OversizedClaims == social.OversizedClaimsReject {
+		c.log.Warn("Rejecting user with too many groups", "id", userInfo.Id, "login", userInfo.Login, "groups", len(userInfo.Groups), "max_groups", maxGroups)
+		return errOAuthTooManyGroups.Errorf("provider returned %d groups, more than the maximum of %d", len(userInfo.Groups), maxGroups)
+	}
+
+	keep := make(map[int]bool, maxGroups)
+	for i, group := range userInfo.Groups {
+		if len(keep) < maxGroups && slices.Contains(c.cfg.OAuthAdminGroups, group) {
+			keep[i] = true
+		}
+	}
+	for i := range userInfo.Groups {
+		if len(keep) >= maxGroups {
+			break
+		}
+		keep[i] = true
+	}
+
+	groups := make([]string, 0, maxGroups)
+	for i, group := range userInfo.Groups {
+		if keep[i] {
+			groups = append(groups, group)
+		}
+	}
+
+	c.log.Warn("Truncating groups returned by the provider", "id", userInfo.Id, "login", userInfo.Login, "groups", len(userInfo.Groups), "max_groups", maxGroups)
+	userInfo.Groups = groups
+	return nil
+}
+
+// phaseSpan traces a phase of the OAuth login flow.
+type phaseSpan struct {
+	tracing.Span
+	start time.Time
+}
+
+func (c *OAuth) startPhase(ctx context.Context, name string) (context.Context, *phaseSpan) {
+	ctx, span := c.tracer.Start(ctx, name)
+	provider := strings.TrimPrefix(c.name, "auth.client.")
+	span.SetAttributes(attributeKeyProvider, provider, attribute.Key(attributeKeyProvider).String(provider))
+	return ctx, &phaseSpan{Span: span, start: time.Now()}
+}
+
+// end records the result of the phase and ends the span. Only the error is recorded,
+// tokens and user info are never added to spans.
+func (s *phaseSpan) end(err error) {
+	elapsed := time.Since(s.start).Milliseconds()
+	s.SetAttributes(attributeKeyElapsed, elapsed, attribute.Key(attributeKeyElapsed).Int64(elapsed))
+
+	result := "success"
+	if err != nil {
+		result = "error"
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.SetAttributes(attributeKeyResult, result, attribute.Key(attributeKeyResult).String(result))
+	s.End()
+}
+
+// audienceOptions returns the audience and resource parameters used to scope the issued
+// access token to the downstream APIs configured for the provider.
+// Multiple values are sent space delimited in a single parameter.
+func audienceOptions(oauthCfg *social.OAuthInfo) []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	if len(oauthCfg.Audiences) > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam(audienceParamName, strings.Join(oauthCfg.Audiences, " ")))
+	}
+	if len(oauthCfg.Resources) > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam(resourceParamName, strings.Join(oauthCfg.Resources, " ")))
+	}
+	return opts
+}
+
+// avatarURL returns the avatar provided for the user if it is an http(s) URL of a reasonable length.
+// Invalid avatars are ignored so the user falls back to gravatar.
+func (c *OAuth) avatarURL(userInfo *social.BasicUserInfo) string {
+	if !c.oauthCfg.SyncAvatar || userInfo.AvatarURL == "" {
+		return ""
+	}
+
+	if len(userInfo.AvatarURL) > maxAvatarURLLength {
+		c.log.Debug("Ignoring avatar from provider, the URL is too long", "id", userInfo.Id, "length", len(userInfo.AvatarURL))
+		return ""
+	}
+
+	u, err := url.Parse(userInfo.AvatarURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.log.Debug("Ignoring avatar from provider, it is not an http(s) URL", "id", userInfo.Id)
+		return ""
+	}
+	return userInfo.AvatarURL
+}
+
+// extraAuthorizeParamOptions returns the configured static authorize params. Reserved params are
+// skipped, they would otherwise override the state, PKCE challenge or redirect_uri of the flow.
+func extraAuthorizeParamOptions(oauthCfg *social.OAuthInfo) []oauth2.AuthCodeOption {
+	opts := make([]oauth2.AuthCodeOption, 0, len(oauthCfg.ExtraAuthorizeParams))
+	for name, value := range oauthCfg.ExtraAuthorizeParams {
+		if social.IsReservedAuthorizeParam(name) {
+			continue
+		}
+		if !oauthCfg.RequestRefreshToken && social.IsOfflineAccessParam(name, value) {
+			continue
+		}
+		opts = append(opts, oauth2.SetAuthURLParam(name, value))
+	}
+	return opts
+}
+
 // genPKCECode returns a random URL-friendly string and it's base64 URL encoded SHA256 digest.
 func genPKCECode() (string, string, error) {
 	// IETF RFC 7636 specifies that the code verifier should be 43-128
@@ -229,16 +777,60 @@ func genPKCECode() (string, string, error) {
 	return string(ascii), pkce, nil
 }
 
-func genOAuthState(secret, seed string) (string, string, error) {
+// genOAuthState returns a random state carrying the correlation id of the login flow and its hash.
+// The hash is stored in a cookie, so the correlation id can't be altered without failing the state check.
+func genOAuthState(secret, seed, correlationID string) (string, string, error) {
 	rnd := make([]byte, 32)
 	if _, err := rand.Read(rnd); err != nil {
 		return "", "", err
 	}
 	state := base64.URLEncoding.EncodeToString(rnd)
+	if correlationID != "" {
+		state += correlationIDSeparator + correlationID
+	}
 	return state, hashOAuthState(state, secret, seed), nil
 }
 
+// genCorrelationID returns a short random id users can quote to support to find the logs of their login.
+func genCorrelationID() (string, error) {
+	rnd := make([]byte, 6)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(rnd), nil
+}
+
+// correlationIDFromState returns the correlation id carried by the state, if any.
+func correlationIDFromState(state string) string {
+	_, correlationID, ok := strings.Cut(state, correlationIDSeparator)
+	if !ok {
+		return ""
+	}
+	return correlationID
+}
+
 func hashOAuthState(state, secret, seed string) string {
 	hashBytes := sha256.Sum256([]byte(state + secret + seed))
 	return hex.EncodeToString(hashBytes[:])
 }
+
+// validateIssuer checks the issuer identifier returned with the authorization response against the
+// configured issuer to defend against mix-up attacks (RFC 9207). Responses without an issuer are only
+// rejected when the provider is configured to always send it.
+func (c *OAuth) validateIssuer(query url.Values) error {
+	if c.oauthCfg.Issuer == "" {
+		return nil
+	}
+
+	if !query.Has(oauthIssuerQueryName) {
+		if c.oauthCfg.AuthorizationResponseIssRequired {
+			return errOAuthMissingIssuer.Errorf("authorization response has no iss parameter")
+		}
+		return nil
+	}
+
+	if iss := query.Get(oauthIssuerQueryName); iss != c.oauthCfg.Issuer {
+		return errOAuthIssuerMismatch.Errorf("authorization response issuer %q does not match %q", iss, c.oauthCfg.Issuer)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package clients
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// keySetDefaultTTL is how long a key set is cached when the provider sends no cache headers.
+	keySetDefaultTTL = 5 * time.Minute
+	// keySetMinRefresh limits how often tokens with an unknown key id can force a key set to be fetched.
+	keySetMinRefresh = 30 * time.Second
+	// keySetFetchTimeout bounds a key set fetch, which isn't tied to the request of any of the callers sharing it.
+	keySetFetchTimeout = 10 * time.Second
+
+	defaultKeySetCacheMaxEntries = 100
+	defaultKeySetCacheMaxTTL     = time.Hour
+)
+
+// KeySetCache is a bounded LRU cache of the key sets published by the providers, keyed by their URL. It is
+// shared by the OAuth clients so a key set is fetched once whatever the number of clients using it. Key sets
+// are cached for the max-age the provider sends, capped to the configured maximum. Concurrent misses for the
+// same key set share a single fetch. OIDC discovery documents aren't cached since the clients use the
+// endpoints configured for the provider and never fetch them.
+type KeySetCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxTTL     time.Duration
+	entries    map[string]*list.Element
+	// lru holds the entries, most recently used first
+	lru   *list.List
+	group singleflight.Group
+	now   func() time.Time
+}
+
+type keySetEntry struct {
+	url       string
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+// NewKeySetCache returns a cache holding up to maxEntries key sets for at most maxTTL. The defaults are used
+// for values of zero or less.
+func NewKeySetCache(maxEntries int, maxTTL time.Duration) *KeySetCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultKeySetCacheMaxEntries
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultKeySetCacheMaxTTL
+	}
+
+	return &KeySetCache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// get returns the key set published at url, it is fetched when it isn't cached or expired.
+func (c *KeySetCache) get(ctx context.Context, client *http.Client, url string) (*jose.JSONWebKeySet, error) {
+	if keys := c.lookup(url); keys != nil {
+		return keys, nil
+	}
+
+	ch := c.group.DoChan(url, func() (any, error) {
+		// the key set may have been stored by a fetch that completed since the lookup
+		if keys := c.lookup(url); keys != nil {
+			return keys, nil
+		}
+
+		// the fetch is shared, so a caller giving up must not cancel it for the others
+		fetchCtx, cancel := context.WithTimeout(context.Background(), keySetFetchTimeout)
+		defer cancel()
+
+		keys, ttl, err := fetchKeySet(fetchCtx, client, url)
+		if err != nil {
+			return nil, err
+		}
+		c.store(url, keys, ttl)
+		return keys, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*jose.JSONWebKeySet), nil
+	}
+}
+
+// invalidate drops the cached key set of url so the next get fetches it again, e.g. when a token is signed
+// with a key id missing from the key set after the provider rotated its keys. Key sets fetched less than
+// keySetMinRefresh ago are kept so tokens with unknown key ids can't make every request fetch the key set.
+// It returns whether the key set was dropped.
+func (c *KeySetCache) invalidate(url string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return true
+	}
+	if c.now().Sub(elem.Value.(*keySetEntry).fetchedAt) < keySetMinRefresh {
+		return false
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, url)
+	return true
+}
+
+func (c *KeySetCache) lookup(url string) *jose.JSONWebKeySet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*keySetEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, url)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.keys
+}
+
+func (c *KeySetCache) store(url string, keys *jose.JSONWebKeySet, ttl time.Duration) {
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[url]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, url)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := c.now()
+	c.entries[url] = c.lru.PushFront(&keySetEntry{url: url, keys: keys, fetchedAt: now, expiresAt: now.Add(ttl)})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*keySetEntry).url)
+	}
+}
+
+// fetchKeySet fetches the key set published at url and returns how long it can be cached.
+func fetchKeySet(ctx context.Context, client *http.Client, url string) (*jose.JSONWebKeySet, time.Duration, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch key set: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to fetch key set: unexpected status %d", resp.StatusCode)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode key set: %w", err)
+	}
+	return &keys, keySetTTL(resp.Header), nil
+}
+
+// keySetTTL returns how long a response can be cached from its Cache-Control and Expires headers,
+// keySetDefaultTTL when there are none.
+func keySetTTL(header http.Header) time.Duration {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0
+			case "max-age":
+				if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			return time.Until(t)
+		}
+		// an invalid date means the response is already expired
+		return 0
+	}
+	return keySetDefaultTTL
+}
@@ -0,0 +1,200 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKeySetServer(t *testing.T, cacheControl string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: []byte("secret"), KeyID: r.URL.Path, Algorithm: string(jose.HS256)}}})
+	}))
+	t.Cleanup(server.Close)
+	return server, &fetches
+}
+
+func TestKeySetCache_Get(t *testing.T) {
+	server, fetches := newKeySetServer(t, "")
+	cache := NewKeySetCache(0, 0)
+
+	keys, err := cache.get(context.Background(), server.Client(), server.URL+"/a")
+	require.NoError(t, err)
+	assert.Len(t, keys.Key("/a"), 1)
+	assert.EqualValues(t, 1, fetches.Load(), "a miss should fetch the key set")
+
+	_, err = cache.get(context.Background(), server.Client(), server.URL+"/a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, fetches.Load(), "a hit should not fetch the key set")
+
+	keys, err = cache.get(context.Background(), server.Client(), server.URL+"/b")
+	require.NoError(t, err)
+	assert.Len(t, keys.Key("/b"), 1)
+	assert.EqualValues(t, 2, fetches.Load(), "key sets should be cached by url")
+}
+
+func TestKeySetCache_Expiry(t *testing.T) {
+	tests := []struct {
+		desc         string
+		cacheControl string
+		maxTTL       time.Duration
+		expectedTTL  time.Duration
+	}{
+		{desc: "should use the default ttl without cache headers", expectedTTL: keySetDefaultTTL},
+		{desc: "should use the max-age of the provider", cacheControl: "public, max-age=60", expectedTTL: time.Minute},
+		{desc: "should cap the max-age of the provider", cacheControl: "max-age=86400", maxTTL: time.Hour, expectedTTL: time.Hour},
+		{desc: "should not cache a no-store key set", cacheControl: "no-store"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			server, fetches := newKeySetServer(t, tt.cacheControl)
+			now := time.Now()
+			cache := NewKeySetCache(0, tt.maxTTL)
+			cache.now = func() time.Time { return now }
+
+			_, err := cache.get(context.Background(), server.Client(), server.URL)
+			require.NoError(t, err)
+			if tt.expectedTTL == 0 {
+				_, err = cache.get(context.Background(), server.Client(), server.URL)
+				require.NoError(t, err)
+				assert.EqualValues(t, 2, fetches.Load())
+				return
+			}
+
+			now = now.Add(tt.expectedTTL - time.Second)
+			_, err = cache.get(context.Background(), server.Client(), server.URL)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, fetches.Load(), "the key set should be cached until it expires")
+
+			now = now.Add(time.Second)
+			_, err = cache.get(context.Background(), server.Client(), server.URL)
+			require.NoError(t, err)
+			assert.EqualValues(t, 2, fetches.Load(), "an expired key set should be fetched again")
+		})
+	}
+}
+
+func TestKeySetCache_Invalidate(t *testing.T) {
+	server, fetches := newKeySetServer(t, "")
+	now := time.Now()
+	cache := NewKeySetCache(0, 0)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.get(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+
+	assert.False(t, cache.invalidate(server.URL), "a key set fetched recently should not be invalidated")
+	_, err = cache.get(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, fetches.Load())
+
+	now = now.Add(keySetMinRefresh)
+	assert.True(t, cache.invalidate(server.URL))
+	_, err = cache.get(context.Background(), server.Client(), server.URL)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, fetches.Load(), "an invalidated key set should be fetched again")
+}
+
+func TestKeySetCache_Eviction(t *testing.T) {
+	server, fetches := newKeySetServer(t, "")
+	cache := NewKeySetCache(2, 0)
+
+	for _, path := range []string{"/a", "/b", "/a", "/c"} {
+		_, err := cache.get(context.Background(), server.Client(), server.URL+path)
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, fetches.Load())
+	assert.Len(t, cache.entries, 2)
+
+	// /b is the least recently used key set
+	_, err := cache.get(context.Background(), server.Client(), server.URL+"/a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, fetches.Load())
+	_, err = cache.get(context.Background(), server.Client(), server.URL+"/b")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, fetches.Load(), "the least recently used key set should be evicted")
+}
+
+func TestKeySetCache_ConcurrentMisses(t *testing.T) {
+	var fetches atomic.Int32
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-unblock
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{})
+	}))
+	t.Cleanup(server.Close)
+
+	cache := NewKeySetCache(0, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.get(context.Background(), server.Client(), server.URL)
+			assert.NoError(t, err)
+		}()
+	}
+
+	require.Eventually(t, func() bool { return fetches.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	// give the other goroutines time to join the fetch in flight
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, fetches.Load(), "concurrent misses should share a single fetch")
+}
+
+func TestKeySetCache_CanceledCaller(t *testing.T) {
+	var fetches atomic.Int32
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-unblock
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{})
+	}))
+	t.Cleanup(server.Close)
+
+	cache := NewKeySetCache(0, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := cache.get(ctx, server.Client(), server.URL)
+		first <- err
+	}()
+	require.Eventually(t, func() bool { return fetches.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	second := make(chan error)
+	go func() {
+		_, err := cache.get(context.Background(), server.Client(), server.URL)
+		second <- err
+	}()
+	// give the second caller time to join the fetch in flight
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled, "the canceled caller should stop waiting")
+
+	close(unblock)
+	assert.NoError(t, <-second, "the fetch should not be canceled with the caller that started it")
+	assert.EqualValues(t, 1, fetches.Load())
+}
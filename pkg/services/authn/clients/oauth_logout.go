@@ -0,0 +1,113 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/util/errutil"
+)
+
+const (
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	logoutTokenLeeway      = time.Minute
+)
+
+var (
+	errOAuthLogoutNotConfigured = errutil.BadRequest("auth.oauth.logout.not-configured", errutil.WithPublicMessage("Back-channel logout is not configured for the provider"))
+	errOAuthLogoutToken         = errutil.BadRequest("auth.oauth.logout.invalid-token", errutil.WithPublicMessage("Invalid logout token"))
+)
+
+var _ authn.BackchannelLogoutClient = new(OAuth)
+
+type logoutTokenClaims struct {
+	jwt.Claims
+	SessionID string                     `json:"sid"`
+	Nonce     string                     `json:"nonce"`
+	Events    map[string]json.RawMessage `json:"events"`
+}
+
+// ValidateLogoutToken validates a back-channel logout token sent by the provider and returns the sid it targets.
+// The token must be signed by one of the keys published at jwk_set_url.
+func (c *OAuth) ValidateLogoutToken(ctx context.Context, logoutToken string) (string, error) {
+	if !c.oauthCfg.BindSessionSID || c.oauthCfg.JwkSetUrl == "" {
+		return "", errOAuthLogoutNotConfigured.Errorf("bind_session_sid and jwk_set_url are required for back-channel logout")
+	}
+
+	parsed, err := jwt.ParseSigned(logoutToken)
+	if err != nil {
+		return "", errOAuthLogoutToken.Errorf("failed to parse logout token: %w", err)
+	}
+	if len(parsed.Headers) != 1 {
+		return "", errOAuthLogoutToken.Errorf("expected a single signature")
+	}
+
+	keys, err := c.logoutKeys(ctx, parsed.Headers[0].KeyID)
+	if err != nil {
+		return "", err
+	}
+
+	var claims logoutTokenClaims
+	var verified bool
+	for _, key := range keys {
+		if err := parsed.Claims(key, &claims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", errOAuthLogoutToken.Errorf("signature could not be verified with the provider keys")
+	}
+
+	expected := jwt.Expected{Audience: jwt.Audience{c.oauthCfg.ClientId}, Time: time.Now()}
+	if c.oauthCfg.Issuer != "" {
+		expected.Issuer = c.oauthCfg.Issuer
+	}
+	if err := claims.ValidateWithLeeway(expected, logoutTokenLeeway); err != nil {
+		return "", errOAuthLogoutToken.Errorf("invalid claims: %w", err)
+	}
+	if claims.IssuedAt == nil {
+		return "", errOAuthLogoutToken.Errorf("missing iat claim")
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return "", errOAuthLogoutToken.Errorf("missing back-channel logout event")
+	}
+	// a nonce is forbidden so an id token can't be used as a logout token
+	if claims.Nonce != "" {
+		return "", errOAuthLogoutToken.Errorf("logout token must not contain a nonce")
+	}
+	if claims.SessionID == "" {
+		return "", errOAuthLogoutToken.Errorf("missing sid claim")
+	}
+
+	return claims.SessionID, nil
+}
+
+// sessionIDFromToken returns the sid claim of the id token.
+func (c *OAuth) sessionIDFromToken(token *oauth2.Token) string {
+	sid, _ := c.idTokenClaims(token)["sid"].(string)
+	return sid
+}
+
+// logoutKeys returns the keys of the provider key set matching the key id. A key id missing from the cached
+// key set invalidates it, so keys rotated by the provider are picked up before the cached key set expires.
+func (c *OAuth) logoutKeys(ctx context.Context, keyID string) ([]jose.JSONWebKey, error) {
+	keySet, err := c.keySets.get(ctx, c.httpClient, c.oauthCfg.JwkSetUrl)
+	if err != nil {
+		return nil, err
+	}
+	if keys := keySet.Key(keyID); len(keys) > 0 || !c.keySets.invalidate(c.oauthCfg.JwkSetUrl) {
+		return keys, nil
+	}
+
+	keySet, err = c.keySets.get(ctx, c.httpClient, c.oauthCfg.JwkSetUrl)
+	if err != nil {
+		return nil, err
+	}
+	return keySet.Key(keyID), nil
+}
@@ -0,0 +1,239 @@
+package clients
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/login/social"
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/loginattempt/loginattempttest"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestOAuth_Authenticate_BindSessionSID(t *testing.T) {
+	idToken := unsignedJWT([]byte(`{"sub":"123","sid":"idp-session"}`))
+
+	for _, bind := range []bool{true, false} {
+		cfg := setting.NewCfg()
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://grafana.com/?state=some-state"),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+		c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{BindSessionSID: bind}, fakeConnector{
+			ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+			ExpectedToken:           (&oauth2.Token{}).WithExtra(map[string]any{"id_token": idToken}),
+			ExpectedIsEmailAllowed:  true,
+			ExpectedIsSignupAllowed: true,
+		}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+		identity, err := c.Authenticate(context.Background(), req)
+		require.NoError(t, err)
+
+		if bind {
+			assert.Equal(t, "idp-session", identity.IdPSessionID)
+		} else {
+			assert.Empty(t, identity.IdPSessionID)
+		}
+	}
+}
+
+func TestOAuth_ValidateLogoutToken(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: privateKey.Public(), KeyID: "1", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	}))
+	t.Cleanup(server.Close)
+
+	sign := func(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+		t.Helper()
+		sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "1").WithType("logout+jwt"))
+		require.NoError(t, err)
+		raw, err := jwt.Signed(sig).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"iss":    "https://idp.example.com",
+			"aud":    "grafana",
+			"iat":    time.Now().Unix(),
+			"jti":    "logout-1",
+			"sid":    "idp-session",
+			"events": map[string]any{backchannelLogoutEvent: map[string]any{}},
+		}
+	}
+
+	oauthCfg := &social.OAuthInfo{
+		ClientId:       "grafana",
+		BindSessionSID: true,
+		JwkSetUrl:      server.URL,
+		Issuer:         "https://idp.example.com",
+	}
+
+	type testCase struct {
+		desc        string
+		oauthCfg    *social.OAuthInfo
+		key         *rsa.PrivateKey
+		claims      func(claims map[string]any)
+		expectedErr error
+	}
+
+	tests := []testCase{
+		{
+			desc: "should return sid for valid logout token",
+		},
+		{
+			desc:        "should reject when back-channel logout is not configured",
+			oauthCfg:    &social.OAuthInfo{ClientId: "grafana", JwkSetUrl: server.URL},
+			expectedErr: errOAuthLogoutNotConfigured,
+		},
+		{
+			desc:        "should reject token signed by an unknown key",
+			key:         otherKey,
+			expectedErr: errOAuthLogoutToken,
+		},
+		{
+			desc:        "should reject token for another audience",
+			claims:      func(claims map[string]any) { claims["aud"] = "other" },
+			expectedErr: errOAuthLogoutToken,
+		},
+		{
+			desc:        "should reject token from another issuer",
+			claims:      func(claims map[string]any) { claims["iss"] = "https://other.example.com" },
+			expectedErr: errOAuthLogoutToken,
+		},
+		{
+			desc:        "should reject token without logout event",
+			claims:      func(claims map[string]any) { delete(claims, "events") },
+			expectedErr: errOAuthLogoutToken,
+		},
+		{
+			desc:        "should reject token with a nonce",
+			claims:      func(claims map[string]any) { claims["nonce"] = "some-nonce" },
+			expectedErr: errOAuthLogoutToken,
+		},
+		{
+			desc:        "should reject token without sid",
+			claims:      func(claims map[string]any) { delete(claims, "sid") },
+			expectedErr: errOAuthLogoutToken,
+		},
+		{
+			desc:        "should reject token without iat",
+			claims:      func(claims map[string]any) { delete(claims, "iat") },
+			expectedErr: errOAuthLogoutToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := oauthCfg
+			if tt.oauthCfg != nil {
+				cfg = tt.oauthCfg
+			}
+			key := privateKey
+			if tt.key != nil {
+				key = tt.key
+			}
+			claims := validClaims()
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), setting.NewCfg(), cfg, fakeConnector{}, server.Client(), loginattempttest.FakeLoginAttemptService{}, tracing.InitializeTracerForTest(), nil)
+
+			sid, err := c.ValidateLogoutToken(context.Background(), sign(t, key, claims))
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "idp-session", sid)
+		})
+	}
+}
+
+func TestOAuth_ValidateLogoutToken_KeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var fetches atomic.Int32
+	var rotated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []jose.JSONWebKey{{Key: oldKey.Public(), KeyID: "old", Algorithm: string(jose.RS256), Use: "sig"}}
+		if rotated.Load() {
+			keys = append(keys, jose.JSONWebKey{Key: newKey.Public(), KeyID: "new", Algorithm: string(jose.RS256), Use: "sig"})
+		}
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+	t.Cleanup(server.Close)
+
+	sign := func(t *testing.T, key *rsa.PrivateKey, keyID string) string {
+		t.Helper()
+		sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", keyID).WithType("logout+jwt"))
+		require.NoError(t, err)
+		raw, err := jwt.Signed(sig).Claims(map[string]any{
+			"aud":    "grafana",
+			"iat":    time.Now().Unix(),
+			"sid":    "idp-session",
+			"events": map[string]any{backchannelLogoutEvent: map[string]any{}},
+		}).CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+
+	now := time.Now()
+	keySets := NewKeySetCache(0, 0)
+	keySets.now = func() time.Time { return now }
+
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), setting.NewCfg(), &social.OAuthInfo{
+		ClientId:       "grafana",
+		BindSessionSID: true,
+		JwkSetUrl:      server.URL,
+	}, fakeConnector{}, server.Client(), loginattempttest.FakeLoginAttemptService{}, tracing.InitializeTracerForTest(), keySets)
+
+	_, err = c.ValidateLogoutToken(context.Background(), sign(t, oldKey, "old"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, fetches.Load())
+
+	// the provider rotates its keys while the cached key set is still valid
+	rotated.Store(true)
+	now = now.Add(keySetMinRefresh)
+
+	sid, err := c.ValidateLogoutToken(context.Background(), sign(t, newKey, "new"))
+	require.NoError(t, err)
+	assert.Equal(t, "idp-session", sid)
+	assert.EqualValues(t, 2, fetches.Load(), "the key set should be refreshed once for the unknown key id")
+
+	_, err = c.ValidateLogoutToken(context.Background(), sign(t, newKey, "new"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, fetches.Load(), "the refreshed key set should be cached")
+
+	_, err = c.ValidateLogoutToken(context.Background(), sign(t, newKey, "unknown"))
+	assert.ErrorIs(t, err, errOAuthLogoutToken)
+	assert.EqualValues(t, 2, fetches.Load(), "forced refreshes should be rate limited")
+}
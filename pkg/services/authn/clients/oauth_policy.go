@@ -0,0 +1,143 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util/errutil"
+)
+
+const (
+	defaultPolicyDenyReason = "Login denied by policy"
+	// maxPolicyResponseSize bounds how much of the webhook response is read
+	maxPolicyResponseSize = 64 * 1024
+)
+
+var (
+	errOAuthAccessDenied = errutil.Forbidden("auth.oauth.policy.denied").MustTemplate(
+		"login denied by policy webhook: {{ .Public.Reason }}",
+		errutil.WithPublic("{{ .Public.Reason }}"),
+	)
+	errOAuthPolicyUnavailable = errutil.Internal("auth.oauth.policy.unavailable", errutil.WithPublicMessage("Failed to evaluate the login policy"))
+)
+
+// loginPolicy asks an external webhook whether an OAuth login is allowed before the user is synced.
+type loginPolicy struct {
+	url      string
+	timeout  time.Duration
+	failOpen bool
+	client   *http.Client
+	log      log.Logger
+}
+
+type loginPolicyRequest struct {
+	Provider       string                 `json:"provider"`
+	Login          string                 `json:"login"`
+	Email          string                 `json:"email"`
+	Name           string                 `json:"name"`
+	AuthID         string                 `json:"authId"`
+	Groups         []string               `json:"groups"`
+	OrgRoles       map[int64]org.RoleType `json:"orgRoles"`
+	IsGrafanaAdmin *bool                  `json:"isGrafanaAdmin,omitempty"`
+}
+
+type loginPolicyResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// newLoginPolicy returns nil when no policy webhook is configured.
+func newLoginPolicy(cfg *setting.Cfg, logger log.Logger) *loginPolicy {
+	if cfg == nil || cfg.OAuthLoginPolicyWebhookURL == "" {
+		return nil
+	}
+
+	return &loginPolicy{
+		url:      cfg.OAuthLoginPolicyWebhookURL,
+		timeout:  cfg.OAuthLoginPolicyWebhookTimeout,
+		failOpen: cfg.OAuthLoginPolicyFailOpen,
+		client:   &http.Client{},
+		log:      logger,
+	}
+}
+
+// check sends the mapped identity, without any tokens, to the webhook and returns
+// errOAuthAccessDenied when the login is denied.
+func (p *loginPolicy) check(ctx context.Context, provider string, identity *authn.Identity) error {
+	if p == nil {
+		return nil
+	}
+
+	res, err := p.evaluate(ctx, provider, identity)
+	if err != nil {
+		if p.failOpen {
+			p.log.FromContext(ctx).Warn("Login policy webhook failed, allowing login", "provider", provider, "error", err)
+			return nil
+		}
+		return errOAuthPolicyUnavailable.Errorf("login policy webhook failed: %w", err)
+	}
+
+	if !res.Allow {
+		reason := res.Reason
+		if reason == "" {
+			reason = defaultPolicyDenyReason
+		}
+		return errOAuthAccessDenied.Build(errutil.TemplateData{Public: map[string]any{"Reason": reason}})
+	}
+
+	return nil
+}
+
+func (p *loginPolicy) evaluate(ctx context.Context, provider string, identity *authn.Identity) (*loginPolicyResponse, error) {
+	body, err := json.Marshal(loginPolicyRequest{
+		Provider:       provider,
+		Login:          identity.Login,
+		Email:          identity.Email,
+		Name:           identity.Name,
+		AuthID:         identity.AuthID,
+		Groups:         identity.Groups,
+		OrgRoles:       identity.OrgRoles,
+		IsGrafanaAdmin: identity.IsGrafanaAdmin,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var res loginPolicyResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPolicyResponseSize)).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	return &res, nil
+}
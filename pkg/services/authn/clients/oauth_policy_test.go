@@ -0,0 +1,169 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/login/social"
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/loginattempt/loginattempttest"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util/errutil"
+)
+
+func TestLoginPolicy_Check(t *testing.T) {
+	type testCase struct {
+		desc           string
+		failOpen       bool
+		delay          time.Duration
+		status         int
+		response       string
+		expectedErr    error
+		expectedReason string
+	}
+
+	tests := []testCase{
+		{
+			desc:     "should allow login",
+			status:   http.StatusOK,
+			response: `{"allow": true}`,
+		},
+		{
+			desc:           "should deny login with the provided reason",
+			status:         http.StatusOK,
+			response:       `{"allow": false, "reason": "Contractors can't access production"}`,
+			expectedErr:    errOAuthAccessDenied,
+			expectedReason: "Contractors can't access production",
+		},
+		{
+			desc:           "should deny login with a default reason",
+			status:         http.StatusOK,
+			response:       `{"allow": false}`,
+			expectedErr:    errOAuthAccessDenied,
+			expectedReason: defaultPolicyDenyReason,
+		},
+		{
+			desc:        "should reject login when webhook times out and failing closed",
+			delay:       200 * time.Millisecond,
+			status:      http.StatusOK,
+			response:    `{"allow": true}`,
+			expectedErr: errOAuthPolicyUnavailable,
+		},
+		{
+			desc:     "should allow login when webhook times out and failing open",
+			failOpen: true,
+			delay:    200 * time.Millisecond,
+			status:   http.StatusOK,
+			response: `{"allow": false}`,
+		},
+		{
+			desc:        "should reject login on unexpected status code when failing closed",
+			status:      http.StatusInternalServerError,
+			expectedErr: errOAuthPolicyUnavailable,
+		},
+		{
+			desc:        "should reject login on invalid response when failing closed",
+			status:      http.StatusOK,
+			response:    `not json`,
+			expectedErr: errOAuthPolicyUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var received loginPolicyRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+				if tt.delay > 0 {
+					select {
+					case <-time.After(tt.delay):
+					case <-r.Context().Done():
+						return
+					}
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			cfg := setting.NewCfg()
+			cfg.OAuthLoginPolicyWebhookURL = server.URL
+			cfg.OAuthLoginPolicyWebhookTimeout = 50 * time.Millisecond
+			cfg.OAuthLoginPolicyFailOpen = tt.failOpen
+
+			policy := newLoginPolicy(cfg, &logtest.Fake{})
+			err := policy.check(context.Background(), "auth.client.generic_oauth", &authn.Identity{
+				Login:      "test",
+				Email:      "test@example.com",
+				AuthID:     "123",
+				Groups:     []string{"contractors"},
+				OrgRoles:   map[int64]org.RoleType{1: org.RoleViewer},
+				OAuthToken: &oauth2.Token{AccessToken: "secret"},
+			})
+
+			assert.Equal(t, "auth.client.generic_oauth", received.Provider)
+			assert.Equal(t, "test@example.com", received.Email)
+			assert.Equal(t, []string{"contractors"}, received.Groups)
+			assert.Equal(t, map[int64]org.RoleType{1: org.RoleViewer}, received.OrgRoles)
+
+			if tt.expectedErr == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, tt.expectedErr)
+			if tt.expectedReason != "" {
+				var gfErr errutil.Error
+				require.True(t, errors.As(err, &gfErr))
+				assert.Equal(t, tt.expectedReason, gfErr.PublicMessage)
+			}
+		})
+	}
+}
+
+func TestLoginPolicy_NotConfigured(t *testing.T) {
+	policy := newLoginPolicy(setting.NewCfg(), &logtest.Fake{})
+	assert.Nil(t, policy)
+	assert.NoError(t, policy.check(context.Background(), "auth.client.generic_oauth", &authn.Identity{}))
+}
+
+func TestOAuth_Authenticate_LoginPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"allow": false, "reason": "Access revoked"}`))
+	}))
+	defer server.Close()
+
+	cfg := setting.NewCfg()
+	cfg.OAuthLoginPolicyWebhookURL = server.URL
+	cfg.OAuthLoginPolicyWebhookTimeout = time.Second
+	req := &authn.Request{HTTPRequest: &http.Request{
+		Header: map[string][]string{},
+		URL:    mustParseURL("http://grafana.com/?state=some-state"),
+	}}
+	req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{
+		ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+		ExpectedToken:           &oauth2.Token{},
+		ExpectedIsSignupAllowed: true,
+		ExpectedIsEmailAllowed:  true,
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+	identity, err := c.Authenticate(context.Background(), req)
+	assert.ErrorIs(t, err, errOAuthAccessDenied)
+	assert.Nil(t, identity)
+}
@@ -0,0 +1,123 @@
+package clients
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/remotecache"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/login/social"
+	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/loginattempt/loginattempttest"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/supportbundles/supportbundlestest"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestOAuth_PreviewIdentity(t *testing.T) {
+	type testCase struct {
+		desc                   string
+		claims                 map[string]any
+		allowAdminFromClaim    bool
+		expectedErr            error
+		expectedOrgRoles       map[int64]org.RoleType
+		expectedGroups         []string
+		expectedIsGrafanaAdmin *bool
+	}
+
+	tests := []testCase{
+		{
+			desc: "should map viewer role when no group matches",
+			claims: map[string]any{
+				"sub":    "123",
+				"email":  "viewer@grafana.com",
+				"groups": []string{"users"},
+			},
+			expectedOrgRoles: map[int64]org.RoleType{1: org.RoleViewer},
+			expectedGroups:   []string{"users"},
+		},
+		{
+			desc: "should map editor role from groups",
+			claims: map[string]any{
+				"sub":    "123",
+				"email":  "editor@grafana.com",
+				"groups": []string{"users", "editors"},
+			},
+			expectedOrgRoles: map[int64]org.RoleType{1: org.RoleEditor},
+			expectedGroups:   []string{"users", "editors"},
+		},
+		{
+			desc: "should ignore grafana admin mapping when not allowed from claim",
+			claims: map[string]any{
+				"sub":    "123",
+				"email":  "admin@grafana.com",
+				"groups": []string{"superusers"},
+			},
+			expectedOrgRoles: map[int64]org.RoleType{1: org.RoleAdmin},
+			expectedGroups:   []string{"superusers"},
+		},
+		{
+			desc: "should map grafana admin when allowed from claim",
+			claims: map[string]any{
+				"sub":    "123",
+				"email":  "admin@grafana.com",
+				"groups": []string{"superusers"},
+			},
+			allowAdminFromClaim:    true,
+			expectedOrgRoles:       map[int64]org.RoleType{1: org.RoleAdmin},
+			expectedGroups:         []string{"superusers"},
+			expectedIsGrafanaAdmin: boolPtr(true),
+		},
+		{
+			desc: "should return error when email is missing",
+			claims: map[string]any{
+				"sub":    "123",
+				"groups": []string{"users"},
+			},
+			expectedErr: errOAuthMissingRequiredEmail,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.OAuthAllowAdminFromClaim = tt.allowAdminFromClaim
+
+			sec := cfg.Raw.Section("auth.generic_oauth")
+			for k, v := range map[string]string{
+				"enabled":                    "true",
+				"allow_assign_grafana_admin": "true",
+				"groups_attribute_path":      "groups",
+				"role_attribute_path":        "contains(groups[*], 'superusers') && 'GrafanaAdmin' || contains(groups[*], 'editors') && 'Editor' || 'Viewer'",
+			} {
+				_, err := sec.NewKey(k, v)
+				require.NoError(t, err)
+			}
+
+			socialService := social.ProvideService(cfg, featuremgmt.WithFeatures(), &usagestats.UsageStatsMock{}, supportbundlestest.NewFakeBundleService(), remotecache.NewFakeCacheStorage())
+			connector, err := socialService.GetConnector("generic_oauth")
+			require.NoError(t, err)
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, socialService.GetOAuthInfoProvider("generic_oauth"), connector, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.PreviewIdentity(context.Background(), tt.claims)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "123", identity.AuthID)
+			assert.Equal(t, tt.claims["email"], identity.Email)
+			assert.Equal(t, tt.expectedOrgRoles, identity.OrgRoles)
+			assert.Equal(t, tt.expectedGroups, identity.Groups)
+			assert.Equal(t, tt.expectedIsGrafanaAdmin, identity.IsGrafanaAdmin)
+			assert.Nil(t, identity.OAuthToken)
+		})
+	}
+}
@@ -2,18 +2,30 @@ package clients
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/oauth2"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/login/social"
 	"github.com/grafana/grafana/pkg/services/authn"
+	"github.com/grafana/grafana/pkg/services/authn/authntest"
 	"github.com/grafana/grafana/pkg/services/login"
+	"github.com/grafana/grafana/pkg/services/loginattempt/loginattempttest"
 	"github.com/grafana/grafana/pkg/services/org"
 	"github.com/grafana/grafana/pkg/setting"
 )
@@ -212,7 +224,7 @@ func TestOAuth_Authenticate(t *testing.T) {
 				ExpectedToken:           &oauth2.Token{},
 				ExpectedIsSignupAllowed: true,
 				ExpectedIsEmailAllowed:  tt.isEmailAllowed,
-			}, nil)
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
 			identity, err := c.Authenticate(context.Background(), tt.req)
 			assert.ErrorIs(t, err, tt.expectedErr)
 
@@ -267,6 +279,12 @@ func TestOAuth_RedirectURL(t *testing.T) {
 			numCallOptions:    2,
 			authCodeUrlCalled: true,
 		},
+		{
+			desc:              "should generate redirect url with audience and resource if configured",
+			oauthCfg:          &social.OAuthInfo{Audiences: []string{"api-1"}, Resources: []string{"https://api.example.com"}},
+			numCallOptions:    2,
+			authCodeUrlCalled: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -281,7 +299,7 @@ func TestOAuth_RedirectURL(t *testing.T) {
 					require.Len(t, opts, tt.numCallOptions)
 					return ""
 				},
-			}, nil)
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
 
 			redirect, err := c.RedirectURL(context.Background(), nil)
 			assert.ErrorIs(t, err, tt.expectedErr)
@@ -299,6 +317,625 @@ func TestOAuth_RedirectURL(t *testing.T) {
 	}
 }
 
+func TestOAuth_RedirectURL_AudienceParams(t *testing.T) {
+	oauthCfg := &social.OAuthInfo{
+		Audiences: []string{"api-1", "api-2"},
+		Resources: []string{"https://api.example.com"},
+	}
+
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize"}}
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), setting.NewCfg(), oauthCfg, mockConnector{
+		AuthCodeURLFunc: config.AuthCodeURL,
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+	redirect, err := c.RedirectURL(context.Background(), nil)
+	require.NoError(t, err)
+
+	u, err := url.Parse(redirect.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "api-1 api-2", u.Query().Get(audienceParamName))
+	assert.Equal(t, "https://api.example.com", u.Query().Get(resourceParamName))
+}
+
+func TestOAuth_RedirectURL_CallbackRoots(t *testing.T) {
+	type testCase struct {
+		desc                string
+		host                string
+		expectedRedirectURI string
+		expectedErr         error
+	}
+
+	tests := []testCase{
+		{
+			desc:                "should use the configured redirect uri for root_url",
+			host:                "grafana.example.com",
+			expectedRedirectURI: "https://grafana.example.com/login/generic_oauth",
+		},
+		{
+			desc:                "should select the redirect uri of the allowed callback root",
+			host:                "grafana.internal.example.com",
+			expectedRedirectURI: "https://grafana.internal.example.com/grafana/login/generic_oauth",
+		},
+		{
+			desc:        "should reject hosts that are not allowed",
+			host:        "evil.example.com",
+			expectedErr: errOAuthCallbackHostNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.AppURL = "https://grafana.example.com/"
+			cfg.OAuthAllowedCallbackRoots = []string{"https://grafana.internal.example.com/grafana/"}
+
+			config := &oauth2.Config{
+				Endpoint:    oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize"},
+				RedirectURL: "https://grafana.example.com/login/generic_oauth",
+			}
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, mockConnector{
+				AuthCodeURLFunc: config.AuthCodeURL,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			redirect, err := c.RedirectURL(context.Background(), &authn.Request{HTTPRequest: &http.Request{Host: tt.host}})
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			u, err := url.Parse(redirect.URL)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedRedirectURI, u.Query().Get(redirectURIParamName))
+		})
+	}
+}
+
+func TestOAuth_Authenticate_CallbackRoots(t *testing.T) {
+	var exchangedRedirectURI string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		exchangedRedirectURI = r.PostForm.Get(redirectURIParamName)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"some-token","token_type":"Bearer"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := setting.NewCfg()
+	cfg.AppURL = "https://grafana.example.com/"
+	cfg.OAuthAllowedCallbackRoots = []string{"https://grafana.internal.example.com/"}
+
+	newRequest := func(host string) *authn.Request {
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Host:   host,
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://" + host + "/login/generic_oauth?state=some-state&code=some-code"),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+		return req
+	}
+
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, exchangeConnector{
+		fakeConnector: fakeConnector{
+			ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+			ExpectedIsEmailAllowed:  true,
+			ExpectedIsSignupAllowed: true,
+		},
+		config: &oauth2.Config{
+			Endpoint:    oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams},
+			RedirectURL: "https://grafana.example.com/login/generic_oauth",
+		},
+	}, server.Client(), loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+	_, err := c.Authenticate(context.Background(), newRequest("grafana.internal.example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://grafana.internal.example.com/login/generic_oauth", exchangedRedirectURI, "the token exchange uses the selected redirect uri")
+
+	exchangedRedirectURI = ""
+	_, err = c.Authenticate(context.Background(), newRequest("evil.example.com"))
+	assert.ErrorIs(t, err, errOAuthCallbackHostNotAllowed)
+	assert.Empty(t, exchangedRedirectURI, "the code is not exchanged for disallowed hosts")
+}
+
+// exchangeConnector exchanges the code with a real oauth2 config.
+type exchangeConnector struct {
+	fakeConnector
+	config *oauth2.Config
+}
+
+func (e exchangeConnector) Exchange(ctx context.Context, code string, authOptions ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return e.config.Exchange(ctx, code, authOptions...)
+}
+
+func TestOAuth_CorrelationID(t *testing.T) {
+	cfg := setting.NewCfg()
+	logger := &logtest.Fake{}
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize"}}
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, redirectingConnector{
+		fakeConnector: fakeConnector{
+			ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+			ExpectedToken:           &oauth2.Token{},
+			ExpectedIsEmailAllowed:  true,
+			ExpectedIsSignupAllowed: true,
+		},
+		authCodeURL: config.AuthCodeURL,
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+	c.log = logger
+
+	initiation := &authn.Request{HTTPRequest: &http.Request{}}
+	redirect, err := c.RedirectURL(context.Background(), initiation)
+	require.NoError(t, err)
+
+	correlationID := initiation.GetMeta(authn.MetaKeyCorrelationID)
+	require.NotEmpty(t, correlationID)
+	assert.Equal(t, []any{"correlation_id", correlationID}, logger.DebugLogs.Ctx, "the initiation is logged with the correlation id")
+
+	u, err := url.Parse(redirect.URL)
+	require.NoError(t, err)
+	state := u.Query().Get(oauthStateQueryName)
+
+	newCallback := func(state string) *authn.Request {
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://grafana.com/login/generic_oauth?code=some-code&state=" + url.QueryEscape(state)),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: redirect.Extra[authn.KeyOAuthState]})
+		return req
+	}
+
+	callback := newCallback(state)
+	_, err = c.Authenticate(context.Background(), callback)
+	require.NoError(t, err)
+	assert.Equal(t, correlationID, callback.GetMeta(authn.MetaKeyCorrelationID))
+	assert.Equal(t, "Handling OAuth callback", logger.DebugLogs.Message)
+	assert.Equal(t, []any{"correlation_id", correlationID}, logger.DebugLogs.Ctx, "the callback is logged with the same correlation id")
+
+	t.Run("a tampered correlation id fails the state check", func(t *testing.T) {
+		random, _, _ := strings.Cut(state, correlationIDSeparator)
+		callback := newCallback(random + correlationIDSeparator + "forged")
+		_, err := c.Authenticate(context.Background(), callback)
+		assert.ErrorIs(t, err, errOAuthInvalidState)
+		assert.Empty(t, callback.GetMeta(authn.MetaKeyCorrelationID))
+	})
+}
+
+// redirectingConnector builds authorize URLs with a real oauth2 config.
+type redirectingConnector struct {
+	fakeConnector
+	authCodeURL func(state string, opts ...oauth2.AuthCodeOption) string
+}
+
+func (r redirectingConnector) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return r.authCodeURL(state, opts...)
+}
+
+func TestOAuth_Authenticate_Issuer(t *testing.T) {
+	type testCase struct {
+		desc        string
+		issuer      string
+		required    bool
+		query       string
+		expectedErr error
+	}
+
+	tests := []testCase{
+		{
+			desc:   "should accept a matching iss",
+			issuer: "https://idp.example.com",
+			query:  "&iss=https%3A%2F%2Fidp.example.com",
+		},
+		{
+			desc:        "should reject a mismatching iss",
+			issuer:      "https://idp.example.com",
+			query:       "&iss=https%3A%2F%2Fattacker.example.com",
+			expectedErr: errOAuthIssuerMismatch,
+		},
+		{
+			desc:        "should reject a mismatching iss when required",
+			issuer:      "https://idp.example.com",
+			required:    true,
+			query:       "&iss=https%3A%2F%2Fattacker.example.com",
+			expectedErr: errOAuthIssuerMismatch,
+		},
+		{
+			desc:   "should accept an absent iss when not required",
+			issuer: "https://idp.example.com",
+		},
+		{
+			desc:        "should reject an absent iss when required",
+			issuer:      "https://idp.example.com",
+			required:    true,
+			expectedErr: errOAuthMissingIssuer,
+		},
+		{
+			desc:  "should ignore iss when no issuer is configured",
+			query: "&iss=https%3A%2F%2Fattacker.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state" + tt.query),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{Issuer: tt.issuer, AuthorizationResponseIssRequired: tt.required}, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+				ExpectedToken:           &oauth2.Token{},
+				ExpectedIsSignupAllowed: true,
+				ExpectedIsEmailAllowed:  true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.Authenticate(context.Background(), req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				assert.Nil(t, identity)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "some@email.com", identity.Email)
+		})
+	}
+}
+
+func TestOAuth_RedirectURL_MaxAge(t *testing.T) {
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize"}}
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), setting.NewCfg(), &social.OAuthInfo{MaxAge: 300}, mockConnector{
+		AuthCodeURLFunc: config.AuthCodeURL,
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+	req := &authn.Request{HTTPRequest: &http.Request{}}
+	redirect, err := c.RedirectURL(context.Background(), req)
+	require.NoError(t, err)
+
+	u, err := url.Parse(redirect.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "300", u.Query().Get(maxAgeParamName))
+	assert.False(t, u.Query().Has(promptParamName))
+
+	req.SetMeta(authn.MetaKeyPrompt, "login")
+	redirect, err = c.RedirectURL(context.Background(), req)
+	require.NoError(t, err)
+
+	u, err = url.Parse(redirect.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "login", u.Query().Get(promptParamName))
+}
+
+func TestOAuth_RedirectURL_ExtraAuthorizeParams(t *testing.T) {
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize"}}
+	oauthCfg := &social.OAuthInfo{
+		HostedDomain: "grafana.com",
+		UsePKCE:      true,
+		ExtraAuthorizeParams: map[string]string{
+			"tenant":         "acme",
+			"p":              "B2C_1_signin",
+			"hd":             "example.com",
+			"state":          "attacker-state",
+			"code_challenge": "attacker-challenge",
+			"Client_ID":      "attacker-client",
+		},
+	}
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), setting.NewCfg(), oauthCfg, mockConnector{
+		AuthCodeURLFunc: config.AuthCodeURL,
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+	redirect, err := c.RedirectURL(context.Background(), &authn.Request{HTTPRequest: &http.Request{}})
+	require.NoError(t, err)
+
+	u, err := url.Parse(redirect.URL)
+	require.NoError(t, err)
+	query := u.Query()
+	assert.Equal(t, "acme", query.Get("tenant"))
+	assert.Equal(t, "B2C_1_signin", query.Get("p"))
+	assert.Equal(t, "grafana.com", query.Get(hostedDomainParamName), "configured settings take precedence")
+
+	assert.NotEqual(t, "attacker-state", query.Get(oauthStateQueryName))
+	assert.NotEqual(t, "attacker-challenge", query.Get(codeChallengeParamName))
+	assert.Equal(t, codeChallengeMethod, query.Get(codeChallengeMethodParamName))
+	assert.Equal(t, []string{"client"}, query["client_id"])
+	assert.False(t, query.Has("Client_ID"))
+}
+
+func TestOAuth_Authenticate_MaxAge(t *testing.T) {
+	type testCase struct {
+		desc        string
+		maxAge      int
+		claims      string
+		expectedErr error
+	}
+
+	now := time.Now().Unix()
+	tests := []testCase{
+		{
+			desc:   "should accept authentication within max age",
+			maxAge: 300,
+			claims: fmt.Sprintf(`{"sub":"123","auth_time":%d}`, now-60),
+		},
+		{
+			desc:        "should require authenticating again when max age is exceeded",
+			maxAge:      300,
+			claims:      fmt.Sprintf(`{"sub":"123","auth_time":%d}`, now-600),
+			expectedErr: authn.ErrReauthenticate,
+		},
+		{
+			desc:        "should reject id token without auth_time when max age is set",
+			maxAge:      300,
+			claims:      `{"sub":"123"}`,
+			expectedErr: errOAuthMissingAuthTime,
+		},
+		{
+			desc:   "should ignore auth_time when max age is not set",
+			claims: fmt.Sprintf(`{"sub":"123","auth_time":%d}`, now-600),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{MaxAge: tt.maxAge}, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+				ExpectedToken:           (&oauth2.Token{}).WithExtra(map[string]any{"id_token": unsignedJWT([]byte(tt.claims))}),
+				ExpectedIsEmailAllowed:  true,
+				ExpectedIsSignupAllowed: true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			_, err := c.Authenticate(context.Background(), req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestOAuth_Authenticate_Tenant(t *testing.T) {
+	type testCase struct {
+		desc   string
+		claims string
+		// encryptedClaims are decrypted by the connector from an opaque id token
+		encryptedClaims  map[string]any
+		role             org.RoleType
+		expectedOrgRoles map[int64]org.RoleType
+		expectedErr      error
+	}
+
+	oauthCfg := &social.OAuthInfo{
+		TenantClaim:      "tid",
+		AllowedTenants:   []string{"acme"},
+		TenantOrgMapping: map[string]int64{"globex": 5},
+	}
+
+	tests := []testCase{
+		{
+			desc:             "should allow user of an allowed tenant",
+			claims:           `{"sub":"123","tid":"acme"}`,
+			role:             org.RoleEditor,
+			expectedOrgRoles: map[int64]org.RoleType{1: org.RoleEditor},
+		},
+		{
+			desc:        "should reject user of a tenant that is not allowed",
+			claims:      `{"sub":"123","tid":"initech"}`,
+			role:        org.RoleEditor,
+			expectedErr: authn.ErrTenantNotAllowed,
+		},
+		{
+			desc:        "should reject user without tenant claim",
+			claims:      `{"sub":"123"}`,
+			expectedErr: authn.ErrTenantNotAllowed,
+		},
+		{
+			desc:             "should assign the role in the org of a mapped tenant",
+			claims:           `{"sub":"123","tid":"globex"}`,
+			role:             org.RoleEditor,
+			expectedOrgRoles: map[int64]org.RoleType{5: org.RoleEditor},
+		},
+		{
+			desc:             "should assign the auto assigned role in the org of a mapped tenant without role",
+			claims:           `{"sub":"123","tid":"globex"}`,
+			expectedOrgRoles: map[int64]org.RoleType{5: org.RoleViewer},
+		},
+		{
+			desc:             "should read the tenant claim of an encrypted id token",
+			encryptedClaims:  map[string]any{"sub": "123", "tid": "globex"},
+			role:             org.RoleEditor,
+			expectedOrgRoles: map[int64]org.RoleType{5: org.RoleEditor},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.AutoAssignOrgRole = string(org.RoleViewer)
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			idToken := unsignedJWT([]byte(tt.claims))
+			if tt.encryptedClaims != nil {
+				idToken = "header.key.iv.ciphertext.tag"
+			}
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, oauthCfg, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: tt.role},
+				ExpectedToken:           (&oauth2.Token{}).WithExtra(map[string]any{"id_token": idToken}),
+				ExpectedIDTokenClaims:   tt.encryptedClaims,
+				ExpectedIsEmailAllowed:  true,
+				ExpectedIsSignupAllowed: true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.Authenticate(context.Background(), req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedOrgRoles, identity.OrgRoles)
+			assert.True(t, identity.ClientParams.SyncOrgRoles)
+		})
+	}
+}
+
+func TestTenantOrgRoles(t *testing.T) {
+	cfg := setting.NewCfg()
+	cfg.AutoAssignOrgRole = string(org.RoleViewer)
+
+	t.Run("should keep the role mapped to the org of the tenant", func(t *testing.T) {
+		orgRoles := map[int64]org.RoleType{1: org.RoleAdmin, 5: org.RoleEditor}
+		assert.Equal(t, map[int64]org.RoleType{5: org.RoleEditor}, tenantOrgRoles(cfg, orgRoles, 5))
+	})
+
+	t.Run("should use the highest mapped role otherwise", func(t *testing.T) {
+		orgRoles := map[int64]org.RoleType{1: org.RoleViewer, 2: org.RoleAdmin, 3: org.RoleEditor}
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, map[int64]org.RoleType{5: org.RoleAdmin}, tenantOrgRoles(cfg, orgRoles, 5))
+		}
+	})
+
+	t.Run("should use the auto assigned role without mapped role", func(t *testing.T) {
+		assert.Equal(t, map[int64]org.RoleType{5: org.RoleViewer}, tenantOrgRoles(cfg, map[int64]org.RoleType{}, 5))
+	})
+}
+
+func TestOAuth_Authenticate_UserInfoIDTokenFallback(t *testing.T) {
+	type testCase struct {
+		desc     string
+		fallback bool
+		claims   string
+		// encryptedClaims are decrypted by the connector from an opaque id token
+		encryptedClaims        map[string]any
+		loginGeneration        string
+		userInfoErr            error
+		expectedUserInfo       *social.BasicUserInfo
+		expectedGeneratedLogin string
+		expectedErr            error
+	}
+
+	tests := []testCase{
+		{
+			desc:        "should use the id token claims when user info is down and the id token has an email",
+			fallback:    true,
+			claims:      `{"sub":"123","email":"jdoe@example.com","name":"John Doe","preferred_username":"jdoe","groups":["admins","editors"]}`,
+			userInfoErr: errors.New("connection refused"),
+			expectedUserInfo: &social.BasicUserInfo{
+				Id:     "123",
+				Email:  "jdoe@example.com",
+				Name:   "John Doe",
+				Login:  "jdoe",
+				Groups: []string{"admins", "editors"},
+			},
+		},
+		{
+			desc:            "should generate the login when the id token has no preferred_username",
+			fallback:        true,
+			claims:          `{"sub":"123","email":"jdoe@example.com","name":"John Doe"}`,
+			loginGeneration: social.LoginGenerationEmailLocalPart,
+			userInfoErr:     errors.New("connection refused"),
+			expectedUserInfo: &social.BasicUserInfo{
+				Id:    "123",
+				Email: "jdoe@example.com",
+				Name:  "John Doe",
+			},
+			expectedGeneratedLogin: "jdoe",
+		},
+		{
+			desc:            "should read the claims of an encrypted id token",
+			fallback:        true,
+			encryptedClaims: map[string]any{"sub": "123", "email": "jdoe@example.com", "preferred_username": "jdoe"},
+			userInfoErr:     errors.New("connection refused"),
+			expectedUserInfo: &social.BasicUserInfo{
+				Id:    "123",
+				Email: "jdoe@example.com",
+				Login: "jdoe",
+			},
+		},
+		{
+			desc:        "should fail when user info is down and the id token has no email",
+			fallback:    true,
+			claims:      `{"sub":"123","name":"John Doe"}`,
+			userInfoErr: errors.New("connection refused"),
+			expectedErr: errOAuthUserInfo,
+		},
+		{
+			desc:        "should fail when user info is down and the fallback is disabled",
+			claims:      `{"sub":"123","email":"jdoe@example.com"}`,
+			userInfoErr: errors.New("connection refused"),
+			expectedErr: errOAuthUserInfo,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			idToken := unsignedJWT([]byte(tt.claims))
+			if tt.encryptedClaims != nil {
+				idToken = "header.key.iv.ciphertext.tag"
+			}
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{UserInfoIDTokenFallback: tt.fallback, LoginGeneration: tt.loginGeneration}, fakeConnector{
+				ExpectedUserInfoErr:     tt.userInfoErr,
+				ExpectedToken:           (&oauth2.Token{}).WithExtra(map[string]any{"id_token": idToken}),
+				ExpectedIDTokenClaims:   tt.encryptedClaims,
+				ExpectedIsEmailAllowed:  true,
+				ExpectedIsSignupAllowed: true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.Authenticate(context.Background(), req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedUserInfo.Id, identity.AuthID)
+			assert.Equal(t, tt.expectedUserInfo.Email, identity.Email)
+			assert.Equal(t, tt.expectedUserInfo.Name, identity.Name)
+			assert.Equal(t, tt.expectedUserInfo.Login, identity.Login)
+			assert.Equal(t, tt.expectedGeneratedLogin, identity.ClientParams.GeneratedLogin)
+			assert.Equal(t, tt.expectedUserInfo.Groups, identity.Groups)
+			assert.Empty(t, identity.OrgRoles, "roles are not mapped from the id token")
+		})
+	}
+
+	t.Run("should not tolerate user info errors returned by the provider checks", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://grafana.com/?state=some-state"),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+		c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{UserInfoIDTokenFallback: true}, fakeConnector{
+			ExpectedUserInfoErr:     &social.Error{},
+			ExpectedToken:           (&oauth2.Token{}).WithExtra(map[string]any{"id_token": unsignedJWT([]byte(`{"sub":"123","email":"jdoe@example.com"}`))}),
+			ExpectedIsEmailAllowed:  true,
+			ExpectedIsSignupAllowed: true,
+		}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+		identity, err := c.Authenticate(context.Background(), req)
+		var sErr *social.Error
+		assert.ErrorAs(t, err, &sErr)
+		assert.Nil(t, identity)
+	})
+}
+
 type mockConnector struct {
 	AuthCodeURLFunc func(state string, opts ...oauth2.AuthCodeOption) string
 	social.SocialConnector
@@ -311,6 +948,506 @@ func (m mockConnector) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption)
 	return ""
 }
 
+func TestOAuth_Authenticate_SyncShadowMode(t *testing.T) {
+	for _, shadow := range []bool{true, false} {
+		cfg := setting.NewCfg()
+		cfg.OAuthSyncShadowMode = shadow
+		cfg.OAuthAllowAdminFromClaim = true
+
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://grafana.com/?state=some-state"),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+		c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{
+			ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Editor", IsGrafanaAdmin: boolPtr(true)},
+			ExpectedToken:           &oauth2.Token{},
+			ExpectedIsSignupAllowed: true,
+			ExpectedIsEmailAllowed:  true,
+		}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+		identity, err := c.Authenticate(context.Background(), req)
+		require.NoError(t, err)
+
+		if shadow {
+			// the roles are only recorded, the user is synced as if role sync was skipped
+			assert.True(t, identity.ClientParams.ShadowSync)
+			assert.False(t, identity.ClientParams.SyncOrgRoles)
+			assert.False(t, identity.ClientParams.SyncTeams)
+			assert.Empty(t, identity.OrgRoles)
+			assert.Nil(t, identity.IsGrafanaAdmin)
+			assert.Equal(t, map[int64]org.RoleType{1: org.RoleEditor}, identity.ClientParams.ShadowOrgRoles)
+			assert.Equal(t, boolPtr(true), identity.ClientParams.ShadowIsGrafanaAdmin)
+		} else {
+			assert.False(t, identity.ClientParams.ShadowSync)
+			assert.True(t, identity.ClientParams.SyncOrgRoles)
+			assert.True(t, identity.ClientParams.SyncTeams)
+			assert.Equal(t, map[int64]org.RoleType{1: org.RoleEditor}, identity.OrgRoles)
+			assert.Equal(t, boolPtr(true), identity.IsGrafanaAdmin)
+		}
+	}
+}
+
+func TestOAuth_Authenticate_Avatar(t *testing.T) {
+	type testCase struct {
+		desc              string
+		syncAvatar        bool
+		avatarURL         string
+		expectedAvatarURL string
+	}
+
+	tests := []testCase{
+		{
+			desc:              "should sync a valid picture",
+			syncAvatar:        true,
+			avatarURL:         "https://idp.example.com/photos/123.png",
+			expectedAvatarURL: "https://idp.example.com/photos/123.png",
+		},
+		{
+			desc:       "should ignore a picture that is not an http(s) URL",
+			syncAvatar: true,
+			avatarURL:  "javascript:alert(1)",
+		},
+		{
+			desc:       "should ignore a picture without a host",
+			syncAvatar: true,
+			avatarURL:  "https:///photos/123.png",
+		},
+		{
+			desc:       "should ignore an oversized picture URL",
+			syncAvatar: true,
+			avatarURL:  "https://idp.example.com/photos/" + strings.Repeat("a", maxAvatarURLLength),
+		},
+		{
+			desc:       "should not sync the picture when avatar sync is disabled",
+			syncAvatar: false,
+			avatarURL:  "https://idp.example.com/photos/123.png",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{SyncAvatar: tt.syncAvatar}, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com", AvatarURL: tt.avatarURL},
+				ExpectedToken:           &oauth2.Token{},
+				ExpectedIsSignupAllowed: true,
+				ExpectedIsEmailAllowed:  true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.Authenticate(context.Background(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedAvatarURL, identity.AvatarURL)
+			assert.Equal(t, tt.syncAvatar, identity.ClientParams.SyncAvatar)
+		})
+	}
+}
+
+func TestOAuth_Authenticate_GrafanaAdminFromClaim(t *testing.T) {
+	type testCase struct {
+		desc                   string
+		allowAdminFromClaim    bool
+		adminGroups            []string
+		userInfo               *social.BasicUserInfo
+		expectedIsGrafanaAdmin *bool
+		expectedGrantLogs      int
+	}
+
+	tests := []testCase{
+		{
+			desc:                   "should ignore admin flag from connector when gate is disabled",
+			userInfo:               &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Admin", IsGrafanaAdmin: boolPtr(true)},
+			expectedIsGrafanaAdmin: nil,
+		},
+		{
+			desc:                   "should ignore admin group when gate is disabled",
+			adminGroups:            []string{"admins"},
+			userInfo:               &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Admin", Groups: []string{"admins"}},
+			expectedIsGrafanaAdmin: nil,
+		},
+		{
+			desc:                   "should grant admin from connector when gate is enabled",
+			allowAdminFromClaim:    true,
+			userInfo:               &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Admin", IsGrafanaAdmin: boolPtr(true)},
+			expectedIsGrafanaAdmin: boolPtr(true),
+			expectedGrantLogs:      1,
+		},
+		{
+			desc:                   "should grant admin when gate is enabled and user is member of admin group",
+			allowAdminFromClaim:    true,
+			adminGroups:            []string{"admins"},
+			userInfo:               &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Viewer", Groups: []string{"devs", "admins"}},
+			expectedIsGrafanaAdmin: boolPtr(true),
+			expectedGrantLogs:      1,
+		},
+		{
+			desc:                   "should not grant admin when gate is enabled and user is not member of admin group",
+			allowAdminFromClaim:    true,
+			adminGroups:            []string{"admins"},
+			userInfo:               &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Viewer", Groups: []string{"devs"}},
+			expectedIsGrafanaAdmin: boolPtr(false),
+		},
+		{
+			desc:                   "should not grant admin when gate is enabled and nothing is configured",
+			allowAdminFromClaim:    true,
+			userInfo:               &social.BasicUserInfo{Id: "123", Email: "some@email.com", Role: "Viewer", Groups: []string{"admins"}},
+			expectedIsGrafanaAdmin: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.OAuthAllowAdminFromClaim = tt.allowAdminFromClaim
+			cfg.OAuthAdminGroups = tt.adminGroups
+
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			logger := &logtest.Fake{}
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{
+				ExpectedUserInfo:        tt.userInfo,
+				ExpectedToken:           &oauth2.Token{},
+				ExpectedIsSignupAllowed: true,
+				ExpectedIsEmailAllowed:  true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+			c.log = logger
+
+			identity, err := c.Authenticate(context.Background(), req)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedIsGrafanaAdmin, identity.IsGrafanaAdmin)
+			assert.Equal(t, tt.expectedGrantLogs, logger.InfoLogs.Calls)
+		})
+	}
+}
+
+func TestOAuth_Authenticate_MaxGroups(t *testing.T) {
+	groups := make([]string, 0, 1000)
+	for i := 0; i < 999; i++ {
+		groups = append(groups, fmt.Sprintf("group-%d", i))
+	}
+	groups = append(groups, "admins")
+
+	type testCase struct {
+		desc            string
+		oversizedClaims string
+		expectedErr     error
+		expectedGroups  []string
+	}
+
+	tests := []testCase{
+		{
+			desc:            "should keep the groups matching a mapping when truncating",
+			oversizedClaims: social.OversizedClaimsTruncate,
+			expectedGroups:  []string{"group-0", "group-1", "admins"},
+		},
+		{
+			desc:            "should reject the user",
+			oversizedClaims: social.OversizedClaimsReject,
+			expectedErr:     errOAuthTooManyGroups,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.OAuthAllowAdminFromClaim = true
+			cfg.OAuthAdminGroups = []string{"admins"}
+
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			oauthCfg := &social.OAuthInfo{MaxGroups: 3, OversizedClaims: tt.oversizedClaims}
+			logger := &logtest.Fake{}
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, oauthCfg, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com", Groups: append([]string{}, groups...)},
+				ExpectedToken:           &oauth2.Token{},
+				ExpectedIsSignupAllowed: true,
+				ExpectedIsEmailAllowed:  true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+			c.log = logger
+
+			identity, err := c.Authenticate(context.Background(), req)
+			assert.Equal(t, 1, logger.WarnLogs.Calls)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedGroups, identity.Groups)
+			require.NotNil(t, identity.IsGrafanaAdmin)
+			assert.True(t, *identity.IsGrafanaAdmin)
+		})
+	}
+}
+
+func TestOAuth_Authenticate_Tracing(t *testing.T) {
+	cfg := setting.NewCfg()
+	req := &authn.Request{HTTPRequest: &http.Request{
+		Header: map[string][]string{},
+		URL:    mustParseURL("http://grafana.com/?state=some-state&code=some-code"),
+	}}
+	req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+	tracer := tracing.NewFakeTracer()
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{
+		ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+		ExpectedToken:           &oauth2.Token{AccessToken: "secret-access-token"},
+		ExpectedIsSignupAllowed: true,
+		ExpectedIsEmailAllowed:  true,
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracer, nil)
+
+	_, err := c.Authenticate(context.Background(), req)
+	require.NoError(t, err)
+
+	require.Len(t, tracer.Spans, 2)
+	for i, name := range []string{"oauth.Exchange", "oauth.UserInfo"} {
+		span := tracer.Spans[i]
+		assert.Equal(t, name, span.Name)
+		assert.True(t, span.IsEnded())
+		assert.Equal(t, "generic_oauth", span.Attributes[attributeKeyProvider].AsString())
+		assert.Equal(t, "success", span.Attributes[attributeKeyResult].AsString())
+		assert.Contains(t, span.Attributes, attribute.Key(attributeKeyElapsed))
+		for _, value := range span.Attributes {
+			assert.NotContains(t, value.Emit(), "secret-access-token")
+		}
+	}
+}
+
+// allowedEmailConnector only allows the given email.
+type allowedEmailConnector struct {
+	fakeConnector
+	allowedEmail string
+}
+
+func (c allowedEmailConnector) IsEmailAllowed(email string) bool {
+	return email == c.allowedEmail
+}
+
+func TestOAuth_Authenticate_NormalizedEmail(t *testing.T) {
+	cfg := setting.NewCfg()
+	cfg.OAuthAllowInsecureEmailLookup = true
+
+	req := &authn.Request{HTTPRequest: &http.Request{
+		Header: map[string][]string{},
+		URL:    mustParseURL("http://grafana.com/?state=some-state"),
+	}}
+	req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+	c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, allowedEmailConnector{
+		fakeConnector: fakeConnector{
+			ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "Some+alias@Email.COM"},
+			ExpectedToken:           &oauth2.Token{},
+			ExpectedIsSignupAllowed: true,
+			ExpectedNormalizedEmail: "some@email.com",
+		},
+		allowedEmail: "some@email.com",
+	}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+	identity, err := c.Authenticate(context.Background(), req)
+	require.NoError(t, err)
+
+	assert.Equal(t, "some@email.com", identity.Email)
+	require.NotNil(t, identity.ClientParams.LookUpParams.Email)
+	assert.Equal(t, "some@email.com", *identity.ClientParams.LookUpParams.Email)
+}
+
+func TestOAuth_Authenticate_GeneratedLogin(t *testing.T) {
+	type testCase struct {
+		desc          string
+		generation    string
+		claim         string
+		login         string
+		expectedLogin string
+	}
+
+	tests := []testCase{
+		{desc: "should not generate a login by default", expectedLogin: ""},
+		{desc: "should generate login from email local part", generation: social.LoginGenerationEmailLocalPart, expectedLogin: "jane.doe"},
+		{desc: "should generate login from name", generation: social.LoginGenerationName, expectedLogin: "jane.van.doe"},
+		{desc: "should generate login from claim", generation: social.LoginGenerationClaim, claim: "preferred_username", expectedLogin: "jdoe"},
+		{desc: "should not generate login from missing claim", generation: social.LoginGenerationClaim, claim: "nickname", expectedLogin: ""},
+		{desc: "should not generate login when provider returned one", generation: social.LoginGenerationName, login: "janedoe", expectedLogin: ""},
+	}
+
+	idToken := unsignedJWT([]byte(`{"sub":"123","preferred_username":"JDoe"}`))
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			oauthCfg := &social.OAuthInfo{LoginGeneration: tt.generation, LoginGenerationClaim: tt.claim}
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, oauthCfg, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "Jane.Doe@example.com", Name: "Jane van Doe", Login: tt.login},
+				ExpectedToken:           (&oauth2.Token{}).WithExtra(map[string]any{"id_token": idToken}),
+				ExpectedIsEmailAllowed:  true,
+				ExpectedIsSignupAllowed: true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.Authenticate(context.Background(), req)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedLogin, identity.ClientParams.GeneratedLogin)
+			assert.Equal(t, tt.login, identity.Login, "the login from the provider is never replaced")
+		})
+	}
+}
+
+func TestOAuth_Authenticate_RequireEmailVerified(t *testing.T) {
+	verified, unverified := true, false
+
+	type testCase struct {
+		desc               string
+		exemptExisting     bool
+		emailVerified      *bool
+		idToken            string
+		expectedErr        error
+		expectedUnverified bool
+	}
+
+	tests := []testCase{
+		{desc: "should accept verified email", emailVerified: &verified},
+		{desc: "should accept email verified in id token", idToken: `{"sub":"123","email_verified":true}`},
+		{desc: "should accept email verified as string in id token", idToken: `{"sub":"123","email_verified":"true"}`},
+		{desc: "should reject unverified email", emailVerified: &unverified, expectedErr: authn.ErrEmailNotVerified},
+		{desc: "should reject missing claim", idToken: `{"sub":"123"}`, expectedErr: authn.ErrEmailNotVerified},
+		{desc: "should prefer the user info over the id token", emailVerified: &unverified, idToken: `{"sub":"123","email_verified":true}`, expectedErr: authn.ErrEmailNotVerified},
+		{desc: "should only reject signup when existing users are exempt", exemptExisting: true, emailVerified: &unverified, expectedUnverified: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.OAuthRequireEmailVerified = true
+			cfg.OAuthRequireEmailVerifiedExemptExisting = tt.exemptExisting
+
+			req := &authn.Request{HTTPRequest: &http.Request{
+				Header: map[string][]string{},
+				URL:    mustParseURL("http://grafana.com/?state=some-state"),
+			}}
+			req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+			token := &oauth2.Token{}
+			if tt.idToken != "" {
+				token = token.WithExtra(map[string]any{"id_token": unsignedJWT([]byte(tt.idToken))})
+			}
+
+			c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{
+				ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com", EmailVerified: tt.emailVerified},
+				ExpectedToken:           token,
+				ExpectedIsEmailAllowed:  true,
+				ExpectedIsSignupAllowed: true,
+			}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+			identity, err := c.Authenticate(context.Background(), req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedUnverified, identity.ClientParams.UnverifiedEmail)
+		})
+	}
+}
+
+func TestOAuth_Authenticate_SharedLoginAttempts(t *testing.T) {
+	cfg := setting.NewCfg()
+	attempts := &sharedLoginAttempts{maxAttempts: 4, attempts: map[string]int64{}}
+	userInfo := &social.BasicUserInfo{Id: "123", Email: "bob@grafana.com", Login: "bob", Role: "Viewer"}
+
+	newOAuthRequest := func() *authn.Request {
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://grafana.com/?state=some-state"),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+		return req
+	}
+	newOAuth := func(emailAllowed bool) *OAuth {
+		return ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{
+			ExpectedUserInfo:        userInfo,
+			ExpectedToken:           &oauth2.Token{},
+			ExpectedIsSignupAllowed: true,
+			ExpectedIsEmailAllowed:  emailAllowed,
+		}, nil, attempts, tracing.InitializeTracerForTest(), nil)
+	}
+	passwordReq := func() *authn.Request {
+		return &authn.Request{HTTPRequest: &http.Request{Header: map[string][]string{}}}
+	}
+
+	failingOAuth := newOAuth(false)
+	failingPassword := ProvidePassword(attempts, authntest.FakePasswordClient{ExpectedErr: errInvalidPassword})
+
+	// alternate failed password and oauth logins for the same user until the shared limit is reached
+	for i := 0; i < 2; i++ {
+		_, err := failingPassword.AuthenticatePassword(context.Background(), passwordReq(), "bob@grafana.com", "wrong")
+		require.ErrorIs(t, err, errPasswordAuthFailed)
+
+		_, err = failingOAuth.Authenticate(context.Background(), newOAuthRequest())
+		require.ErrorIs(t, err, errOAuthEmailNotAllowed)
+	}
+
+	// neither login method accepts the user anymore, even with valid credentials
+	password := ProvidePassword(attempts, authntest.FakePasswordClient{ExpectedIdentity: &authn.Identity{}})
+	_, err := password.AuthenticatePassword(context.Background(), passwordReq(), "bob@grafana.com", "correct")
+	assert.ErrorIs(t, err, errPasswordAuthFailed)
+
+	_, err = newOAuth(true).Authenticate(context.Background(), newOAuthRequest())
+	assert.ErrorIs(t, err, errOAuthLoginBlocked)
+
+	// another user is not affected
+	_, err = password.AuthenticatePassword(context.Background(), passwordReq(), "alice@grafana.com", "correct")
+	assert.NoError(t, err)
+
+	t.Run("should record a failed attempt when the login fails after the authentication", func(t *testing.T) {
+		attempts := &sharedLoginAttempts{maxAttempts: 4, attempts: map[string]int64{}}
+		c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, &social.OAuthInfo{}, fakeConnector{}, nil, attempts, tracing.InitializeTracerForTest(), nil)
+
+		c.FailedLogin(context.Background(), &authn.Identity{Email: "carol@grafana.com", Login: "carol"}, passwordReq())
+		assert.Equal(t, map[string]int64{"carol@grafana.com": 1, "carol": 1}, attempts.attempts)
+	})
+}
+
+// sharedLoginAttempts is an in-memory login attempt service counting failed attempts per username.
+type sharedLoginAttempts struct {
+	maxAttempts int64
+	attempts    map[string]int64
+}
+
+func (s *sharedLoginAttempts) Add(ctx context.Context, username, IPAddress string) error {
+	s.attempts[username]++
+	return nil
+}
+
+func (s *sharedLoginAttempts) Validate(ctx context.Context, username string) (bool, error) {
+	return s.attempts[username] < s.maxAttempts, nil
+}
+
+func (s *sharedLoginAttempts) Reset(ctx context.Context, username string) error {
+	delete(s.attempts, username)
+	return nil
+}
+
 var _ social.SocialConnector = new(fakeConnector)
 
 type fakeConnector struct {
@@ -318,8 +1455,11 @@ type fakeConnector struct {
 	ExpectedUserInfoErr     error
 	ExpectedIsEmailAllowed  bool
 	ExpectedIsSignupAllowed bool
+	ExpectedNormalizedEmail string
 	ExpectedToken           *oauth2.Token
 	ExpectedTokenErr        error
+	// ExpectedIDTokenClaims are returned instead of the claims of the id token, e.g. for encrypted id tokens
+	ExpectedIDTokenClaims map[string]any
 	social.SocialConnector
 }
 
@@ -335,6 +1475,34 @@ func (f fakeConnector) IsSignupAllowed() bool {
 	return f.ExpectedIsSignupAllowed
 }
 
+func (f fakeConnector) NormalizeEmail(email string) string {
+	if f.ExpectedNormalizedEmail != "" {
+		return f.ExpectedNormalizedEmail
+	}
+	return email
+}
+
+func (f fakeConnector) IDTokenClaims(token *oauth2.Token) (map[string]any, error) {
+	if f.ExpectedIDTokenClaims != nil {
+		return f.ExpectedIDTokenClaims, nil
+	}
+
+	idToken, _ := token.Extra("id_token").(string)
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
 func (f fakeConnector) Exchange(ctx context.Context, code string, authOptions ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	return f.ExpectedToken, f.ExpectedTokenErr
 }
@@ -350,3 +1518,51 @@ func mustParseURL(s string) *url.URL {
 	}
 	return u
 }
+
+func TestOAuth_RequestRefreshToken(t *testing.T) {
+	for _, requestRefreshToken := range []bool{true, false} {
+		cfg := setting.NewCfg()
+		config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/authorize"}}
+		oauthCfg := &social.OAuthInfo{
+			RequestRefreshToken:  requestRefreshToken,
+			ExtraAuthorizeParams: map[string]string{"access_type": "offline", "prompt": "consent", "tenant": "acme"},
+		}
+
+		c := ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, oauthCfg, mockConnector{
+			AuthCodeURLFunc: config.AuthCodeURL,
+		}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+		redirect, err := c.RedirectURL(context.Background(), &authn.Request{HTTPRequest: &http.Request{}})
+		require.NoError(t, err)
+		u, err := url.Parse(redirect.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "acme", u.Query().Get("tenant"))
+
+		req := &authn.Request{HTTPRequest: &http.Request{
+			Header: map[string][]string{},
+			URL:    mustParseURL("http://grafana.com/?state=some-state"),
+		}}
+		req.HTTPRequest.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: hashOAuthState("some-state", cfg.SecretKey, "")})
+
+		c = ProvideOAuth(authn.ClientWithPrefix("generic_oauth"), cfg, oauthCfg, fakeConnector{
+			ExpectedUserInfo:        &social.BasicUserInfo{Id: "123", Email: "some@email.com"},
+			ExpectedToken:           &oauth2.Token{AccessToken: "access-token", RefreshToken: "refresh-token"},
+			ExpectedIsSignupAllowed: true,
+			ExpectedIsEmailAllowed:  true,
+		}, nil, loginattempttest.FakeLoginAttemptService{ExpectedValid: true}, tracing.InitializeTracerForTest(), nil)
+
+		identity, err := c.Authenticate(context.Background(), req)
+		require.NoError(t, err)
+
+		if requestRefreshToken {
+			assert.Equal(t, "offline", u.Query().Get("access_type"))
+			assert.Equal(t, "consent", u.Query().Get(promptParamName))
+			assert.Equal(t, "refresh-token", identity.OAuthToken.RefreshToken)
+		} else {
+			assert.False(t, u.Query().Has("access_type"))
+			assert.False(t, u.Query().Has(promptParamName))
+			assert.Empty(t, identity.OAuthToken.RefreshToken, "refresh tokens are not stored when not requested")
+			assert.Equal(t, "access-token", identity.OAuthToken.AccessToken)
+		}
+	}
+}
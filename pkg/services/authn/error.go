@@ -8,4 +8,7 @@ var (
 	ErrClientNotConfigured = errutil.BadRequest("auth.client.notConfigured")
 	ErrUnsupportedIdentity = errutil.NotImplemented("auth.identity.unsupported")
 	ErrExpiredAccessToken  = errutil.Unauthorized("oauth.expired-token", errutil.WithPublicMessage("OAuth access token expired"))
+	ErrEmailNotVerified    = errutil.Unauthorized("auth.email.not-verified", errutil.WithPublicMessage("Provider didn't verify the email address"))
+	ErrReauthenticate      = errutil.Unauthorized("auth.reauthenticate", errutil.WithPublicMessage("Authentication is too old, please log in again"))
+	ErrTenantNotAllowed    = errutil.Unauthorized("auth.tenant.not-allowed", errutil.WithPublicMessage("Your tenant is not allowed to log in to this instance"))
 )
@@ -13,6 +13,7 @@ import (
 const (
 	maxInvalidLoginAttempts int64 = 5
 	loginAttemptsWindow           = time.Minute * 5
+	loginAttemptsRetention        = time.Minute * 10
 )
 
 func ProvideService(db db.DB, cfg *setting.Cfg, lock *serverlock.ServerLockService) *Service {
@@ -71,7 +72,7 @@ func (s *Service) Validate(ctx context.Context, username string) (bool, error) {
 
 	loginAttemptCountQuery := GetUserLoginAttemptCountQuery{
 		Username: username,
-		Since:    time.Now().Add(-loginAttemptsWindow),
+		Since:    time.Now().Add(-s.window()),
 	}
 
 	count, err := s.store.GetUserLoginAttemptCount(ctx, loginAttemptCountQuery)
@@ -79,17 +80,37 @@ func (s *Service) Validate(ctx context.Context, username string) (bool, error) {
 		return false, err
 	}
 
-	if count >= maxInvalidLoginAttempts {
+	if count >= s.maxAttempts() {
 		return false, nil
 	}
 
 	return true, nil
 }
 
+// maxAttempts returns the number of failed attempts, from any login method, after which a user is blocked.
+func (s *Service) maxAttempts() int64 {
+	if s.cfg.BruteForceLoginProtectionMaxAttempts > 0 {
+		return s.cfg.BruteForceLoginProtectionMaxAttempts
+	}
+	return maxInvalidLoginAttempts
+}
+
+func (s *Service) window() time.Duration {
+	if s.cfg.BruteForceLoginProtectionWindow > 0 {
+		return s.cfg.BruteForceLoginProtectionWindow
+	}
+	return loginAttemptsWindow
+}
+
 func (s *Service) cleanup(ctx context.Context) {
+	retention := loginAttemptsRetention
+	if s.window() > retention {
+		retention = s.window()
+	}
+
 	err := s.lock.LockAndExecute(ctx, "delete old login attempts", time.Minute*10, func(context.Context) {
 		cmd := DeleteOldLoginAttemptsCommand{
-			OlderThan: time.Now().Add(time.Minute * -10),
+			OlderThan: time.Now().Add(-retention),
 		}
 		if deletedLogs, err := s.store.DeleteOldLoginAttempts(ctx, cmd); err != nil {
 			s.logger.Error("Problem deleting expired login attempts", "error", err.Error())
@@ -15,6 +15,7 @@ func TestService_Validate(t *testing.T) {
 		name          string
 		loginAttempts int64
 		disabled      bool
+		maxAttempts   int64
 		expected      bool
 		expectedErr   error
 	}{
@@ -58,12 +59,27 @@ func TestService_Validate(t *testing.T) {
 			expected:      true,
 			expectedErr:   nil,
 		},
+		{
+			name:          "When max attempts is configured and user login attempt count is less than configured max",
+			loginAttempts: 2,
+			maxAttempts:   3,
+			expected:      true,
+			expectedErr:   nil,
+		},
+		{
+			name:          "When max attempts is configured and user login attempt count equals configured max",
+			loginAttempts: 3,
+			maxAttempts:   3,
+			expected:      false,
+			expectedErr:   nil,
+		},
 	}
 
 	for _, tt := range testCases {
 		t.Run(tt.name, func(t *testing.T) {
 			cfg := setting.NewCfg()
 			cfg.DisableBruteForceLoginProtection = tt.disabled
+			cfg.BruteForceLoginProtectionMaxAttempts = tt.maxAttempts
 			service := &Service{
 				store: fakeStore{
 					ExpectedCount: tt.loginAttempts,
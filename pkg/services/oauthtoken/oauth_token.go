@@ -2,8 +2,10 @@ package oauthtoken
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -26,6 +28,8 @@ var (
 	ExpiryDelta            = 10 * time.Second
 	ErrNoRefreshTokenFound = errors.New("no refresh token found")
 	ErrNotAnOAuthProvider  = errors.New("not an oauth provider")
+	// ErrRefreshTokenRevoked is returned when the provider rejects the refresh token, the user has to login again.
+	ErrRefreshTokenRevoked = errors.New("refresh token revoked")
 )
 
 type Service struct {
@@ -40,6 +44,7 @@ type OAuthTokenService interface {
 	IsOAuthPassThruEnabled(*datasources.DataSource) bool
 	HasOAuthEntry(context.Context, identity.Requester) (*login.UserAuth, bool, error)
 	TryTokenRefresh(context.Context, *login.UserAuth) error
+	RefreshToken(ctx context.Context, userID int64, provider string) (*oauth2.Token, error)
 	InvalidateOAuthTokens(context.Context, *login.UserAuth) error
 }
 
@@ -83,7 +88,7 @@ func (o *Service) GetCurrentOAuthToken(ctx context.Context, usr identity.Request
 		return nil
 	}
 
-	token, err := o.tryGetOrRefreshAccessToken(ctx, authInfo)
+	token, err := o.tryGetOrRefreshAccessToken(ctx, authInfo, false)
 	if err != nil {
 		if errors.Is(err, ErrNoRefreshTokenFound) {
 			return buildOAuthTokenFromAuthInfo(authInfo)
@@ -141,11 +146,39 @@ func (o *Service) TryTokenRefresh(ctx context.Context, usr *login.UserAuth) erro
 	_, err, _ := o.singleFlightGroup.Do(lockKey, func() (any, error) {
 		logger.Debug("Singleflight request for getting a new access token", "key", lockKey)
 
-		return o.tryGetOrRefreshAccessToken(ctx, usr)
+		return o.tryGetOrRefreshAccessToken(ctx, usr, false)
 	})
 	return err
 }
 
+// RefreshToken uses the stored refresh token of the user for the given provider to get a new access token,
+// even if the stored one hasn't expired yet, and persists the rotated token.
+// It is meant for background jobs acting on behalf of users outside of a login.
+// ErrRefreshTokenRevoked is returned when the provider rejects the refresh token.
+func (o *Service) RefreshToken(ctx context.Context, userID int64, provider string) (*oauth2.Token, error) {
+	authModule := provider
+	if !strings.HasPrefix(authModule, "oauth_") {
+		authModule = "oauth_" + provider
+	}
+
+	authInfo, err := o.AuthInfoService.GetAuthInfo(ctx, &login.GetAuthInfoQuery{UserId: userID, AuthModule: authModule})
+	if err != nil {
+		return nil, err
+	}
+
+	lockKey := fmt.Sprintf("oauth-force-refresh-token-%d-%s", userID, authModule)
+	token, err, _ := o.singleFlightGroup.Do(lockKey, func() (any, error) {
+		logger.Debug("Singleflight request for refreshing the access token", "key", lockKey)
+
+		return o.tryGetOrRefreshAccessToken(ctx, authInfo, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return token.(*oauth2.Token), nil
+}
+
 func buildOAuthTokenFromAuthInfo(authInfo *login.UserAuth) *oauth2.Token {
 	token := &oauth2.Token{
 		AccessToken:  authInfo.OAuthAccessToken,
@@ -191,7 +224,7 @@ func (o *Service) InvalidateOAuthTokens(ctx context.Context, usr *login.UserAuth
 	})
 }
 
-func (o *Service) tryGetOrRefreshAccessToken(ctx context.Context, usr *login.UserAuth) (*oauth2.Token, error) {
+func (o *Service) tryGetOrRefreshAccessToken(ctx context.Context, usr *login.UserAuth, forceRefresh bool) (*oauth2.Token, error) {
 	if err := checkOAuthRefreshToken(usr); err != nil {
 		return nil, err
 	}
@@ -212,11 +245,22 @@ func (o *Service) tryGetOrRefreshAccessToken(ctx context.Context, usr *login.Use
 
 	persistedToken := buildOAuthTokenFromAuthInfo(usr)
 
+	sourceToken := persistedToken
+	if forceRefresh {
+		// the token source only uses the refresh token once the access token has expired
+		expired := *persistedToken
+		expired.Expiry = time.Now().Add(-time.Minute)
+		sourceToken = &expired
+	}
+
 	// TokenSource handles refreshing the token if it has expired
-	token, err := connect.TokenSource(ctx, persistedToken).Token()
+	token, err := connect.TokenSource(ctx, sourceToken).Token()
 	if err != nil {
 		logger.Error("Failed to retrieve oauth access token",
 			"provider", usr.AuthModule, "userId", usr.UserId, "error", err)
+		if isRefreshTokenRevoked(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRefreshTokenRevoked, err)
+		}
 		return nil, err
 	}
 
@@ -249,6 +293,28 @@ func (o *Service) tryGetOrRefreshAccessToken(ctx context.Context, usr *login.Use
 	return token, nil
 }
 
+// isRefreshTokenRevoked returns true if the provider rejected the refresh token as described in RFC 6749 section 5.2.
+func isRefreshTokenRevoked(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(retrieveErr.Body, &body); err != nil {
+		// some providers don't answer with json
+		values, err := url.ParseQuery(string(retrieveErr.Body))
+		if err != nil {
+			return false
+		}
+		body.Error = values.Get("error")
+	}
+
+	return body.Error == "invalid_grant"
+}
+
 // IsOAuthPassThruEnabled returns true if Forward OAuth Identity (oauthPassThru) is enabled for the provided data source.
 func IsOAuthPassThruEnabled(ds *datasources.DataSource) bool {
 	return ds.JsonData != nil && ds.JsonData.Get("oauthPassThru").MustBool()
@@ -3,12 +3,14 @@ package oauthtoken
 import (
 	"context"
 	"errors"
+	"net/http"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
 	"golang.org/x/sync/singleflight"
 
@@ -220,6 +222,100 @@ func TestService_TryTokenRefresh_DifferentAuthModuleForUser(t *testing.T) {
 	socialConnector.AssertNotCalled(t, "TokenSource")
 }
 
+func TestService_RefreshToken(t *testing.T) {
+	t.Run("refreshes a valid token and persists the rotated token", func(t *testing.T) {
+		srv, authInfoStore, socialConnector := setupOAuthTokenService(t)
+		ctx := context.Background()
+
+		authInfoStore.ExpectedOAuth = &login.UserAuth{
+			UserId:            1,
+			AuthModule:        "oauth_generic_oauth",
+			OAuthAccessToken:  "testaccess",
+			OAuthRefreshToken: "testrefresh",
+			OAuthExpiry:       time.Now().Add(time.Hour),
+			OAuthTokenType:    "Bearer",
+		}
+
+		newToken := &oauth2.Token{
+			AccessToken:  "testaccess_new",
+			RefreshToken: "testrefresh_new",
+			Expiry:       time.Now().Add(2 * time.Hour),
+			TokenType:    "Bearer",
+		}
+
+		var sourceToken *oauth2.Token
+		socialConnector.On("TokenSource", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			sourceToken = args.Get(1).(*oauth2.Token)
+		}).Return(oauth2.StaticTokenSource(newToken))
+
+		token, err := srv.RefreshToken(ctx, 1, "generic_oauth")
+		require.NoError(t, err)
+		assert.Equal(t, newToken, token)
+
+		// the stored token is refreshed even though it hasn't expired
+		assert.False(t, sourceToken.Valid())
+		assert.Equal(t, "testrefresh", sourceToken.RefreshToken)
+
+		assert.Equal(t, newToken.AccessToken, authInfoStore.ExpectedOAuth.OAuthAccessToken)
+		assert.Equal(t, newToken.RefreshToken, authInfoStore.ExpectedOAuth.OAuthRefreshToken)
+		assert.Equal(t, newToken.Expiry, authInfoStore.ExpectedOAuth.OAuthExpiry)
+	})
+
+	t.Run("returns a distinct error when the refresh token is revoked", func(t *testing.T) {
+		srv, authInfoStore, socialConnector := setupOAuthTokenService(t)
+		ctx := context.Background()
+
+		authInfoStore.ExpectedOAuth = &login.UserAuth{
+			UserId:            1,
+			AuthModule:        "oauth_generic_oauth",
+			OAuthAccessToken:  "testaccess",
+			OAuthRefreshToken: "testrefresh",
+			OAuthExpiry:       time.Now().Add(-time.Hour),
+			OAuthTokenType:    "Bearer",
+		}
+
+		socialConnector.On("TokenSource", mock.Anything, mock.Anything).Return(errTokenSource{err: &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: http.StatusBadRequest},
+			Body:     []byte(`{"error":"invalid_grant","error_description":"Token has been revoked."}`),
+		}})
+
+		token, err := srv.RefreshToken(ctx, 1, "generic_oauth")
+		assert.Nil(t, token)
+		assert.ErrorIs(t, err, ErrRefreshTokenRevoked)
+
+		// the stored token is left untouched
+		assert.Equal(t, "testrefresh", authInfoStore.ExpectedOAuth.OAuthRefreshToken)
+	})
+
+	t.Run("does not report other refresh errors as revoked", func(t *testing.T) {
+		srv, authInfoStore, socialConnector := setupOAuthTokenService(t)
+		ctx := context.Background()
+
+		authInfoStore.ExpectedOAuth = &login.UserAuth{
+			UserId:            1,
+			AuthModule:        "oauth_generic_oauth",
+			OAuthRefreshToken: "testrefresh",
+		}
+
+		socialConnector.On("TokenSource", mock.Anything, mock.Anything).Return(errTokenSource{err: &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: http.StatusInternalServerError},
+			Body:     []byte(`{"error":"server_error"}`),
+		}})
+
+		_, err := srv.RefreshToken(ctx, 1, "generic_oauth")
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrRefreshTokenRevoked)
+	})
+}
+
+type errTokenSource struct {
+	err error
+}
+
+func (s errTokenSource) Token() (*oauth2.Token, error) {
+	return nil, s.err
+}
+
 func setupOAuthTokenService(t *testing.T) (*Service, *FakeAuthInfoStore, *socialtest.MockSocialConnector) {
 	t.Helper()
 
@@ -16,6 +16,7 @@ type MockOauthTokenService struct {
 	HasOAuthEntryFunc          func(ctx context.Context, usr identity.Requester) (*login.UserAuth, bool, error)
 	InvalidateOAuthTokensFunc  func(ctx context.Context, usr *login.UserAuth) error
 	TryTokenRefreshFunc        func(ctx context.Context, usr *login.UserAuth) error
+	RefreshTokenFunc           func(ctx context.Context, userID int64, provider string) (*oauth2.Token, error)
 }
 
 func (m *MockOauthTokenService) GetCurrentOAuthToken(ctx context.Context, usr identity.Requester) *oauth2.Token {
@@ -52,3 +53,10 @@ func (m *MockOauthTokenService) TryTokenRefresh(ctx context.Context, usr *login.
 	}
 	return nil
 }
+
+func (m *MockOauthTokenService) RefreshToken(ctx context.Context, userID int64, provider string) (*oauth2.Token, error) {
+	if m.RefreshTokenFunc != nil {
+		return m.RefreshTokenFunc(ctx, userID, provider)
+	}
+	return nil, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/api/dtos"
 	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/services/authn"
 	contextmodel "github.com/grafana/grafana/pkg/services/contexthandler/model"
 	"github.com/grafana/grafana/pkg/services/login"
 	"github.com/grafana/grafana/pkg/services/user"
@@ -18,13 +19,15 @@ type Service interface {
 type OSSService struct {
 	searchUserFilter user.SearchUserFilter
 	userService      user.Service
+	authnService     authn.Service
 }
 
-func ProvideUsersService(searchUserFilter user.SearchUserFilter, userService user.Service,
+func ProvideUsersService(searchUserFilter user.SearchUserFilter, userService user.Service, authnService authn.Service,
 ) *OSSService {
 	return &OSSService{
 		searchUserFilter: searchUserFilter,
 		userService:      userService,
+		authnService:     authnService,
 	}
 }
 
@@ -100,8 +103,12 @@ func (s *OSSService) SearchUser(c *contextmodel.ReqContext) (*user.SearchUserQue
 		return nil, err
 	}
 
+	avatarURLs := s.syncedAvatarURLs(c, res.Users)
 	for _, user := range res.Users {
 		user.AvatarURL = dtos.GetGravatarUrl(user.Email)
+		if avatarURL, ok := avatarURLs[user.ID]; ok {
+			user.AvatarURL = avatarURL
+		}
 		user.AuthLabels = make([]string, 0)
 		if user.AuthModule != nil && len(user.AuthModule) > 0 {
 			for _, authModule := range user.AuthModule {
@@ -116,6 +123,24 @@ func (s *OSSService) SearchUser(c *contextmodel.ReqContext) (*user.SearchUserQue
 	return res, nil
 }
 
+// syncedAvatarURLs returns the avatars synced from the identity providers of the users, if any.
+func (s *OSSService) syncedAvatarURLs(c *contextmodel.ReqContext, users []*user.UserSearchHitDTO) map[int64]string {
+	if s.authnService == nil || len(users) == 0 {
+		return nil
+	}
+
+	userIDs := make([]int64, 0, len(users))
+	for _, u := range users {
+		userIDs = append(userIDs, u.ID)
+	}
+	avatarURLs, err := s.authnService.AvatarURLs(c.Req.Context(), userIDs...)
+	if err != nil {
+		c.Logger.Warn("Failed to get synced avatars", "error", err)
+		return nil
+	}
+	return avatarURLs
+}
+
 // swagger:response searchUsersResponse
 type SearchUsersResponse struct {
 	// The response message
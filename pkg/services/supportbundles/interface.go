@@ -24,13 +24,56 @@ type Bundle struct {
 	UID       string `json:"uid"`
 	State     State  `json:"state"`
 	Creator   string `json:"creator"`
+	OrgID     int64  `json:"orgId,omitempty"`
 	CreatedAt int64  `json:"createdAt"`
 	ExpiresAt int64  `json:"expiresAt"`
 	TarBytes  []byte `json:"tarBytes,omitempty"`
+	// Size is the size in bytes of the stored archive.
+	Size int64 `json:"size,omitempty"`
+	// Checksum is the hex encoded SHA-256 of the stored archive.
+	Checksum string `json:"checksum,omitempty"`
+	// Collectors is the collector selection the bundle contains.
+	Collectors []string `json:"collectors,omitempty"`
+	// Error is the reason the generation failed, it is only set for bundles in the error state.
+	Error string `json:"error,omitempty"`
+	// Imported is set for bundles generated outside of Grafana and registered from disk.
+	Imported bool `json:"imported,omitempty"`
+	// Encrypted is set when the stored archive is encrypted for the configured recipients.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// ContentPurged is set once the archive has been removed, the bundle record is kept.
+	ContentPurged bool `json:"contentPurged,omitempty"`
+	// Labels organize bundles, e.g. by case id or customer, and can be used to filter them.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// IdempotencyKey is the optional key provided by the client on creation.
+	// Creating a bundle with the same key while a previous one is still pending returns that bundle.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// QueuePosition is the position of a pending bundle waiting for generation to start.
+	// It is not persisted and is only set while the bundle is queued.
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// EstimatedStart is the estimated unix time at which a queued bundle starts generating.
+	EstimatedStart int64 `json:"estimatedStart,omitempty"`
+	// Progress is the generation progress in percent, derived from the completed collectors.
+	// It is not persisted and only reaches 100 once the bundle is in a terminal state.
+	Progress int `json:"progress"`
 }
 
 type CollectorFunc func(context.Context) (*SupportItem, error)
 
+// PreflightFunc reports whether a collector is able to run right now.
+// It must be fast and free of side effects and returns an error describing why the
+// collector can't run.
+type PreflightFunc func(context.Context) error
+
+// CollectorPreflight is the result of checking whether a selected collector can run.
+type CollectorPreflight struct {
+	UID         string `json:"uid"`
+	DisplayName string `json:"displayName"`
+	Runnable    bool   `json:"runnable"`
+	Reason      string `json:"reason,omitempty"`
+}
+
 type Collector struct {
 	// UID is a unique identifier for the collector.
 	UID string `json:"uid"`
@@ -46,6 +89,25 @@ type Collector struct {
 	Default bool `json:"default"`
 	// Fn is the function that collects the support item.
 	Fn CollectorFunc `json:"-"`
+	// Preflight optionally checks if the collector can run without collecting anything.
+	Preflight PreflightFunc `json:"-"`
+	// AllowedOrgIDs optionally restricts the collector to bundles created in the listed organizations.
+	// Collectors exposing instance wide data can use it to limit themselves to the main org.
+	AllowedOrgIDs []int64 `json:"-"`
+}
+
+// AllowedForOrg returns true if bundles created in the organization can include the collector.
+func (c Collector) AllowedForOrg(orgID int64) bool {
+	if len(c.AllowedOrgIDs) == 0 {
+		return true
+	}
+
+	for _, id := range c.AllowedOrgIDs {
+		if id == orgID {
+			return true
+		}
+	}
+	return false
 }
 
 type Service interface {
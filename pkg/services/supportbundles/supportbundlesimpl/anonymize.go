@@ -0,0 +1,164 @@
+package supportbundlesimpl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultAnonymizeFields are the fields holding identities pseudonymized in anonymized bundles.
+var defaultAnonymizeFields = []string{"login", "email", "user", "username", "hostname", "org_name", "orgName"}
+
+const (
+	// minAnonymizeValueLength skips values too short to be replaced everywhere they occur without
+	// mangling unrelated content.
+	minAnonymizeValueLength = 3
+	pseudonymPrefix         = "anon-"
+	pseudonymLength         = 12
+)
+
+// bundleAnonymizer pseudonymizes the values of identifiable fields in the text files of a bundle.
+// Values are replaced wherever they occur as a whole token, not only next to their field, so
+// references across files stay consistent. Pseudonyms are keyed with a per bundle salt so they can't be correlated
+// across bundles.
+type bundleAnonymizer struct {
+	patterns []*regexp.Regexp
+	// salt is mixed with the bundle UID to derive the per bundle salt, a random salt is used when empty.
+	salt string
+}
+
+func newBundleAnonymizer(fields []string, salt string) *bundleAnonymizer {
+	if len(fields) == 0 {
+		fields = defaultAnonymizeFields
+	}
+
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		names = append(names, regexp.QuoteMeta(f))
+	}
+	field := `(?i)\b(?:` + strings.Join(names, "|") + `)\b"?\s*[:=]\s*`
+
+	return &bundleAnonymizer{
+		patterns: []*regexp.Regexp{
+			// "email": "user@example.com", email="user@example.com"
+			regexp.MustCompile(field + `"([^"\\\n]+)"`),
+			// email=user@example.com, email: user@example.com
+			regexp.MustCompile(field + `([^\s"',;{}\[\]]+)`),
+		},
+		salt: salt,
+	}
+}
+
+// identities adds the values of the identifiable fields in data to values. Binary data is skipped.
+func (a *bundleAnonymizer) identities(values map[string]bool, data []byte) {
+	if !isText(data) {
+		return
+	}
+	for _, re := range a.patterns {
+		for _, m := range re.FindAllSubmatch(data, -1) {
+			if value := string(m[1]); anonymizable(value) {
+				values[value] = true
+			}
+		}
+	}
+}
+
+// pseudonymizer returns a function replacing the values with their pseudonyms in text data, the
+// values are collected with identities from every file of the bundle first.
+func (a *bundleAnonymizer) pseudonymizer(uid string, values map[string]bool) (func(data []byte) []byte, error) {
+	if len(values) == 0 {
+		return func(data []byte) []byte { return data }, nil
+	}
+
+	key, err := a.bundleSalt(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// longer values first so a value containing another one is replaced as a whole
+	sorted := make([]string, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	pseudonyms := make(map[string][]byte, len(sorted))
+	alternatives := make([]string, 0, len(sorted))
+	for _, value := range sorted {
+		pseudonyms[value] = []byte(pseudonym(key, value))
+		alternatives = append(alternatives, tokenPattern(value))
+	}
+	re, err := regexp.Compile(strings.Join(alternatives, "|"))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(data []byte) []byte {
+		if !isText(data) {
+			return data
+		}
+		return re.ReplaceAllFunc(data, func(match []byte) []byte {
+			return pseudonyms[string(match)]
+		})
+	}, nil
+}
+
+// tokenPattern matches value only as a whole token, e.g. "admin" doesn't match in "admin_password".
+// Word boundaries are only required on the sides where value starts or ends with a word character
+// since \b never matches next to a value like "(bob)" otherwise.
+func tokenPattern(value string) string {
+	pattern := regexp.QuoteMeta(value)
+	if isWordByte(value[0]) {
+		pattern = `\b` + pattern
+	}
+	if isWordByte(value[len(value)-1]) {
+		pattern += `\b`
+	}
+	return pattern
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// anonymizable reports whether value is replaced. Literals and numbers are kept since replacing
+// them everywhere they occur would mangle unrelated content.
+func anonymizable(value string) bool {
+	if len(value) < minAnonymizeValueLength || strings.HasPrefix(value, pseudonymPrefix) {
+		return false
+	}
+	switch value {
+	case "null", "true", "false":
+		return false
+	}
+	return strings.Trim(value, "0123456789") != ""
+}
+
+func (a *bundleAnonymizer) bundleSalt(uid string) ([]byte, error) {
+	if a.salt == "" {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		return salt, nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.salt))
+	mac.Write([]byte(uid))
+	return mac.Sum(nil), nil
+}
+
+func pseudonym(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:pseudonymLength]
+}
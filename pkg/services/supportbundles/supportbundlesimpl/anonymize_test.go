@@ -0,0 +1,216 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestBundleAnonymizer(t *testing.T) {
+	files := map[string][]byte{
+		"users.json": []byte(`[{"login": "bob", "email": "bob@example.com", "id": 1234}]`),
+		"server.log": []byte("logger=context userId=1234 login=bob email=bob@example.com msg=\"Request completed\"\n"),
+		"basic.md":   []byte("# Instance\nhostname: grafana-prod-1.internal\nContact bob@example.com\n"),
+		"data.bin":   append([]byte{0}, []byte(`"email": "bob@example.com"`)...),
+	}
+	pseudonymPattern := regexp.MustCompile(pseudonymPrefix + `[0-9a-f]{12}`)
+
+	t.Run("the same value maps to the same pseudonym within a bundle", func(t *testing.T) {
+		a := newBundleAnonymizer(nil, "")
+
+		anonymized, pseudonyms, err := anonymizeFiles(a, "bundle-1", files)
+		require.NoError(t, err)
+		assert.Equal(t, 3, pseudonyms)
+
+		for _, name := range []string{"users.json", "server.log", "basic.md"} {
+			assert.NotContains(t, string(anonymized[name]), "bob@example.com", name)
+			assert.NotContains(t, string(anonymized[name]), "grafana-prod-1", name)
+		}
+		assert.Equal(t, files["data.bin"], anonymized["data.bin"], "binary files are left as is")
+		assert.Contains(t, string(anonymized["server.log"]), "userId=1234", "numbers are not pseudonymized")
+
+		email := findSubmatch(t, anonymized["users.json"], `"email": "(.+?)"`)
+		assert.Regexp(t, pseudonymPattern, email)
+		assert.Equal(t, email, findSubmatch(t, anonymized["server.log"], `email=(\S+)`))
+		assert.Contains(t, string(anonymized["basic.md"]), "Contact "+email, "values are replaced outside of their field too")
+		assert.NotEqual(t, email, findSubmatch(t, anonymized["users.json"], `"login": "(.+?)"`))
+	})
+
+	t.Run("pseudonyms differ across bundles", func(t *testing.T) {
+		for _, salt := range []string{"", "configured-salt"} {
+			a := newBundleAnonymizer(nil, salt)
+
+			first, _, err := anonymizeFiles(a, "bundle-1", files)
+			require.NoError(t, err)
+			second, _, err := anonymizeFiles(a, "bundle-2", files)
+			require.NoError(t, err)
+
+			assert.NotEqual(t,
+				findSubmatch(t, first["users.json"], `"email": "(.+?)"`),
+				findSubmatch(t, second["users.json"], `"email": "(.+?)"`))
+		}
+	})
+
+	t.Run("a configured salt derives the same pseudonyms for the same bundle", func(t *testing.T) {
+		a := newBundleAnonymizer(nil, "configured-salt")
+
+		first, _, err := anonymizeFiles(a, "bundle-1", files)
+		require.NoError(t, err)
+		second, _, err := anonymizeFiles(a, "bundle-1", files)
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("configured fields replace the defaults", func(t *testing.T) {
+		a := newBundleAnonymizer([]string{"hostname"}, "")
+
+		anonymized, pseudonyms, err := anonymizeFiles(a, "bundle-1", files)
+		require.NoError(t, err)
+		assert.Equal(t, 1, pseudonyms)
+		assert.NotContains(t, string(anonymized["basic.md"]), "grafana-prod-1")
+		assert.Contains(t, string(anonymized["users.json"]), "bob@example.com")
+	})
+
+	t.Run("values are only replaced as whole tokens", func(t *testing.T) {
+		a := newBundleAnonymizer(nil, "")
+
+		anonymized, pseudonyms, err := anonymizeFiles(a, "bundle-1", map[string][]byte{
+			"users.json":  []byte(`{"login": "admin", "email": "admin@example.com"}`),
+			"settings.md": []byte("admin_password = *********\nadmin_user = admin\nsuperadmin: true\nowner: (admin)\n"),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, pseudonyms)
+
+		login := findSubmatch(t, anonymized["users.json"], `"login": "(.+?)"`)
+		assert.Regexp(t, pseudonymPattern, login)
+		settings := string(anonymized["settings.md"])
+		assert.Contains(t, settings, "admin_password = *********")
+		assert.Contains(t, settings, "admin_user = "+login)
+		assert.Contains(t, settings, "superadmin: true")
+		assert.Contains(t, settings, "owner: ("+login+")")
+	})
+}
+
+func TestService_createAnonymized(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
+		queue:          newGenerationQueue(1),
+		generations:    newGenerationTracker(),
+		anonymizer:     newBundleAnonymizer(nil, ""),
+	}
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "users",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return &supportbundles.SupportItem{Filename: "users.json", FileBytes: []byte(`{"login": "alice", "email": "alice@example.com"}`)}, nil
+		},
+	})
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "dashboards",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return &supportbundles.SupportItem{Filename: "dashboards.md", FileBytes: []byte("owner: alice\nfolder: alice_team\n")}, nil
+		},
+	})
+
+	bundle, err := s.create(context.Background(), []string{"users", "dashboards"}, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "", true)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		b, err := s.store.Get(context.Background(), bundle.UID)
+		return err == nil && b.State == supportbundles.StateComplete
+	}, 5*time.Second, 10*time.Millisecond)
+
+	files := filesInTar(t, readArchive(t, s, bundle.UID))
+	assert.NotContains(t, files["/bundle/users.json"], "alice")
+	assert.NotContains(t, files["/bundle/dashboards.md"], "owner: alice\n", "identities are replaced across files")
+	assert.Contains(t, files["/bundle/dashboards.md"], "folder: alice_team", "identities are only replaced as whole tokens")
+
+	manifest, err := s.store.GetManifest(context.Background(), bundle.UID)
+	require.NoError(t, err)
+	require.NotNil(t, manifest)
+	assert.Equal(t, 2, manifest.Pseudonyms)
+}
+
+// progressFailingStore fails to read the progress, which records whether a bundle is anonymized.
+type progressFailingStore struct {
+	bundleStore
+}
+
+func (progressFailingStore) GetProgress(ctx context.Context, uid string) (*bundleProgress, error) {
+	return nil, errors.New("kvstore unavailable")
+}
+
+func TestService_createAnonymizedWithoutProgress(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          progressFailingStore{bundleStore: newStore(kvstore.NewFakeKVStore())},
+		archiveDir:     t.TempDir(),
+		queue:          newGenerationQueue(1),
+		generations:    newGenerationTracker(),
+		anonymizer:     newBundleAnonymizer(nil, ""),
+	}
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "users",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return &supportbundles.SupportItem{Filename: "users.json", FileBytes: []byte(`{"login": "alice"}`)}, nil
+		},
+	})
+
+	bundle, err := s.create(context.Background(), []string{"users"}, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "", true)
+	require.NoError(t, err)
+
+	// the bundle fails rather than being generated without anonymization
+	require.Eventually(t, func() bool {
+		b, err := s.store.Get(context.Background(), bundle.UID)
+		return err == nil && b.State == supportbundles.StateError
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// anonymizeFiles anonymizes the files like a bundle is: the identities are collected from every file before
+// any of them is pseudonymized. It returns the anonymized files and the number of distinct identities.
+func anonymizeFiles(a *bundleAnonymizer, uid string, files map[string][]byte) (map[string][]byte, int, error) {
+	identities := map[string]bool{}
+	for _, data := range files {
+		a.identities(identities, data)
+	}
+
+	pseudonymize, err := a.pseudonymizer(uid, identities)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	anonymized := make(map[string][]byte, len(files))
+	for name, data := range files {
+		anonymized[name] = pseudonymize(data)
+	}
+	return anonymized, len(identities), nil
+}
+
+// findSubmatch returns the first submatch of pattern in data.
+func findSubmatch(t *testing.T, data []byte, pattern string) string {
+	t.Helper()
+
+	m := regexp.MustCompile(pattern).FindSubmatch(data)
+	require.NotNil(t, m, pattern)
+	return string(m[1])
+}
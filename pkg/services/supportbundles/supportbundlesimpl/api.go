@@ -1,9 +1,10 @@
 package supportbundlesimpl
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 
 	grafanaApi "github.com/grafana/grafana/pkg/api"
@@ -15,7 +16,11 @@ import (
 	"github.com/grafana/grafana/pkg/web"
 )
 
-const rootUrl = "/api/support-bundles"
+const (
+	rootUrl = "/api/support-bundles"
+
+	maxIdempotencyKeyLength = 128
+)
 
 func (s *Service) registerAPIEndpoints(httpServer *grafanaApi.HTTPServer, routeRegister routing.RouteRegister) {
 	authorize := ac.Middleware(s.accessControl)
@@ -31,14 +36,22 @@ func (s *Service) registerAPIEndpoints(httpServer *grafanaApi.HTTPServer, routeR
 	routeRegister.Group(rootUrl, func(subrouter routing.RouteRegister) {
 		subrouter.Get("/", authorize(ac.EvalPermission(ActionRead)), routing.Wrap(s.handleList))
 		subrouter.Post("/", authorize(ac.EvalPermission(ActionCreate)), routing.Wrap(s.handleCreate))
+		subrouter.Post("/preflight", authorize(ac.EvalPermission(ActionCreate)), routing.Wrap(s.handlePreflight))
+		subrouter.Get("/export", authorize(ac.EvalPermission(ActionRead)), s.handleExport)
 		subrouter.Get("/:uid", authorize(ac.EvalPermission(ActionRead)), s.handleDownload)
+		subrouter.Get("/:uid/signature", authorize(ac.EvalPermission(ActionRead)), routing.Wrap(s.handleDownloadSignature))
 		subrouter.Delete("/:uid", authorize(ac.EvalPermission(ActionDelete)), s.handleRemove)
 		subrouter.Get("/collectors", authorize(ac.EvalPermission(ActionCreate)), routing.Wrap(s.handleGetCollectors))
 	})
 }
 
 func (s *Service) handleList(ctx *contextmodel.ReqContext) response.Response {
-	bundles, err := s.list(ctx.Req.Context())
+	labels, err := parseLabelSelector(ctx.Query("labels"))
+	if err != nil {
+		return response.Error(http.StatusBadRequest, err.Error(), err)
+	}
+
+	bundles, err := s.list(ctx.Req.Context(), ListFilter{Labels: labels})
 	if err != nil {
 		return response.Error(http.StatusInternalServerError, "failed to list bundles", err)
 	}
@@ -53,7 +66,10 @@ func (s *Service) handleList(ctx *contextmodel.ReqContext) response.Response {
 
 func (s *Service) handleCreate(ctx *contextmodel.ReqContext) response.Response {
 	type command struct {
-		Collectors []string `json:"collectors"`
+		Collectors     []string `json:"collectors"`
+		IdempotencyKey string   `json:"idempotencyKey"`
+		// Anonymize pseudonymizes the identities in the bundle, e.g. to share it with a vendor.
+		Anonymize bool `json:"anonymize"`
 	}
 
 	var c command
@@ -61,7 +77,14 @@ func (s *Service) handleCreate(ctx *contextmodel.ReqContext) response.Response {
 		return response.Error(http.StatusBadRequest, "failed to parse request", err)
 	}
 
-	bundle, err := s.create(context.Background(), c.Collectors, ctx.SignedInUser)
+	if len(c.IdempotencyKey) > maxIdempotencyKeyLength {
+		return response.Error(http.StatusBadRequest, fmt.Sprintf("idempotency key must not be longer than %d characters", maxIdempotencyKeyLength), nil)
+	}
+
+	bundle, err := s.create(ctx.Req.Context(), c.Collectors, ctx.SignedInUser, c.IdempotencyKey, c.Anonymize)
+	if errors.Is(err, ErrCollectorRestricted) {
+		return response.Error(http.StatusForbidden, err.Error(), err)
+	}
 	if err != nil {
 		return response.Error(http.StatusInternalServerError, "failed to create support bundle", err)
 	}
@@ -74,6 +97,19 @@ func (s *Service) handleCreate(ctx *contextmodel.ReqContext) response.Response {
 	return response.JSON(http.StatusCreated, data)
 }
 
+func (s *Service) handlePreflight(ctx *contextmodel.ReqContext) response.Response {
+	type command struct {
+		Collectors []string `json:"collectors"`
+	}
+
+	var c command
+	if err := web.Bind(ctx.Req, &c); err != nil {
+		return response.Error(http.StatusBadRequest, "failed to parse request", err)
+	}
+
+	return response.JSON(http.StatusOK, s.PreflightCollectors(ctx.Req.Context(), c.Collectors, ctx.SignedInUser.GetOrgID()))
+}
+
 func (s *Service) handleDownload(ctx *contextmodel.ReqContext) response.Response {
 	uid := web.Params(ctx.Req)[":uid"]
 	bundle, err := s.get(ctx.Req.Context(), uid)
@@ -85,13 +121,75 @@ func (s *Service) handleDownload(ctx *contextmodel.ReqContext) response.Response
 		return response.Redirect("/support-bundles")
 	}
 
+	archive, err := s.store.OpenArchive(ctx.Req.Context(), uid)
+	if errors.Is(err, ErrContentPurged) {
+		return response.Error(http.StatusGone, "support bundle content has been purged", err)
+	}
+	if err != nil {
+		return response.Error(http.StatusInternalServerError, "failed to open support bundle archive", err)
+	}
+
 	ctx.Resp.Header().Set("Content-Type", "application/tar+gzip")
-	ctx.Resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", uid))
-	if len(s.encryptionPublicKeys) > 0 {
-		ctx.Resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz.age", uid))
+	ctx.Resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", s.downloadFilename(bundle)))
+
+	return archiveResponse{archive: archive}
+}
+
+func (s *Service) handleExport(ctx *contextmodel.ReqContext) response.Response {
+	orgID := ctx.SignedInUser.GetOrgID()
+	archive, err := s.ExportAll(ctx.Req.Context(), orgID)
+	if err != nil {
+		return response.Error(http.StatusInternalServerError, "failed to export support bundles", err)
+	}
+
+	ctx.Resp.Header().Set("Content-Type", "application/zip")
+	ctx.Resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=support-bundles-org-%d.zip", orgID))
+
+	return archiveResponse{archive: archive}
+}
+
+func (s *Service) handleDownloadSignature(ctx *contextmodel.ReqContext) response.Response {
+	uid := web.Params(ctx.Req)[":uid"]
+	if s.signer == nil {
+		return response.Error(http.StatusNotFound, "support bundle signing is not enabled", nil)
 	}
 
-	return response.CreateNormalResponse(ctx.Resp.Header(), bundle.TarBytes, http.StatusOK)
+	signature, err := s.signer.getSignature(ctx.Req.Context(), uid)
+	if err != nil {
+		if errors.Is(err, ErrBundleNotSigned) {
+			return response.Error(http.StatusNotFound, "support bundle signature not found", err)
+		}
+		return response.Error(http.StatusInternalServerError, "failed to get support bundle signature", err)
+	}
+
+	ctx.Resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.sig.json", uid))
+	return response.JSON(http.StatusOK, signature)
+}
+
+// archiveResponse streams a bundle archive to the client without loading it in memory.
+type archiveResponse struct {
+	archive io.ReadCloser
+}
+
+func (r archiveResponse) WriteTo(ctx *contextmodel.ReqContext) {
+	defer func() {
+		if err := r.archive.Close(); err != nil {
+			ctx.Logger.Warn("Failed to close support bundle archive", "error", err)
+		}
+	}()
+
+	ctx.Resp.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(ctx.Resp, r.archive); err != nil {
+		ctx.Logger.Error("Failed to write support bundle archive", "error", err)
+	}
+}
+
+func (archiveResponse) Status() int {
+	return http.StatusOK
+}
+
+func (archiveResponse) Body() []byte {
+	return nil
 }
 
 func (s *Service) handleRemove(ctx *contextmodel.ReqContext) response.Response {
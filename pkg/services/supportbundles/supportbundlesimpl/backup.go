@@ -0,0 +1,112 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+// metadataBackupVersion is the schema version of the documents produced by ExportMetadata.
+const metadataBackupVersion = 1
+
+// metadataBackup is a snapshot of the bundle catalog. It only holds the bundle records,
+// the archives have to be backed up separately.
+type metadataBackup struct {
+	Version int                     `json:"version"`
+	Bundles []supportbundles.Bundle `json:"bundles"`
+}
+
+// ExportMetadata returns a versioned JSON document of all the bundle records, without their archives.
+func (s *store) ExportMetadata(ctx context.Context) ([]byte, error) {
+	bundles, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(metadataBackup{Version: metadataBackupVersion, Bundles: bundles})
+}
+
+// ImportMetadata restores the bundle records of a document produced by ExportMetadata. Bundles that
+// already exist are overwritten when overwrite is true and skipped otherwise. The document is
+// validated before anything is written and the written records are restored if the import fails.
+func (s *store) ImportMetadata(ctx context.Context, data []byte, overwrite bool) error {
+	var backup metadataBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return fmt.Errorf("invalid support bundle metadata backup: %w", err)
+	}
+	if backup.Version != metadataBackupVersion {
+		return fmt.Errorf("unsupported support bundle metadata backup version %d", backup.Version)
+	}
+	for _, b := range backup.Bundles {
+		if b.UID == "" {
+			return errors.New("invalid support bundle metadata backup: bundle without uid")
+		}
+		switch b.State {
+		case supportbundles.StatePending, supportbundles.StateComplete, supportbundles.StateError, supportbundles.StateTimeout:
+		default:
+			return fmt.Errorf("invalid support bundle metadata backup: bundle %s has unknown state %q", b.UID, b.State)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type previousRecord struct {
+		uid     string
+		data    string
+		existed bool
+	}
+	written := make([]previousRecord, 0, len(backup.Bundles))
+
+	rollback := func() {
+		for _, prev := range written {
+			var err error
+			if prev.existed {
+				err = s.kv.Set(ctx, prev.uid, prev.data)
+			} else {
+				err = s.kv.Del(ctx, prev.uid)
+			}
+			if err != nil {
+				s.log.Error("Failed to restore support bundle record after a failed import", "uid", prev.uid, "error", err)
+			}
+		}
+	}
+
+	// the counters are recomputed once the records are written or restored
+	defer func() {
+		if err := s.ReconcileStateCounts(ctx); err != nil {
+			s.log.Warn("Failed to reconcile support bundle state counts after an import", "error", err)
+		}
+	}()
+
+	for i := range backup.Bundles {
+		bundle := backup.Bundles[i]
+		existing, ok, err := s.kv.Get(ctx, bundle.UID)
+		if err != nil {
+			rollback()
+			return err
+		}
+		if ok && !overwrite {
+			continue
+		}
+
+		// archives stored inline are content, not metadata, and are kept when overwriting
+		bundle.TarBytes = nil
+		if ok {
+			var current supportbundles.Bundle
+			if err := json.Unmarshal([]byte(existing), &current); err == nil {
+				bundle.TarBytes = current.TarBytes
+			}
+		}
+		if err := s.set(ctx, &bundle); err != nil {
+			rollback()
+			return err
+		}
+		written = append(written, previousRecord{uid: bundle.UID, data: existing, existed: ok})
+	}
+
+	return nil
+}
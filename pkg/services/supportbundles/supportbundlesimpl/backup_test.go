@@ -0,0 +1,106 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestStore_ExportImportMetadata(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(kvstore.NewFakeKVStore())
+	usr := &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}
+
+	complete, _, err := s.Create(ctx, usr, "")
+	require.NoError(t, err)
+	require.NoError(t, s.Update(ctx, complete.UID, supportbundles.StateComplete, []byte("archive")))
+	pending, _, err := s.Create(ctx, usr, "")
+	require.NoError(t, err)
+
+	exported, err := s.List()
+	require.NoError(t, err)
+	data, err := s.ExportMetadata(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "tarBytes", "archives are not exported")
+
+	t.Run("round trip restores the cleared store", func(t *testing.T) {
+		require.NoError(t, s.Remove(ctx, complete.UID))
+		require.NoError(t, s.Remove(ctx, pending.UID))
+		cleared, err := s.List()
+		require.NoError(t, err)
+		require.Empty(t, cleared)
+
+		require.NoError(t, s.ImportMetadata(ctx, data, false))
+
+		imported, err := s.List()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, exported, imported)
+	})
+
+	t.Run("existing bundles are skipped unless overwriting", func(t *testing.T) {
+		require.NoError(t, s.Fail(ctx, pending.UID, "failed after the export"))
+
+		require.NoError(t, s.ImportMetadata(ctx, data, false))
+		bundle, err := s.Get(ctx, pending.UID)
+		require.NoError(t, err)
+		assert.Equal(t, supportbundles.StateError, bundle.State)
+
+		require.NoError(t, s.ImportMetadata(ctx, data, true))
+		bundle, err = s.Get(ctx, pending.UID)
+		require.NoError(t, err)
+		assert.Equal(t, supportbundles.StatePending, bundle.State)
+	})
+
+	t.Run("invalid documents are rejected", func(t *testing.T) {
+		assert.Error(t, s.ImportMetadata(ctx, []byte(`not json`), true))
+		assert.Error(t, s.ImportMetadata(ctx, []byte(`{"version": 2, "bundles": []}`), true))
+		assert.Error(t, s.ImportMetadata(ctx, []byte(`{"version": 1, "bundles": [{"uid": "", "state": "complete"}]}`), true))
+		assert.Error(t, s.ImportMetadata(ctx, []byte(`{"version": 1, "bundles": [{"uid": "a", "state": "unknown"}]}`), true))
+	})
+}
+
+func TestStore_ImportMetadataPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	kv := &failingSetKVStore{FakeKVStore: kvstore.NewFakeKVStore()}
+	s := newStore(kv)
+
+	existing, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+	require.NoError(t, s.Update(ctx, existing.UID, supportbundles.StateComplete, []byte("archive")))
+	before, err := s.Get(ctx, existing.UID)
+	require.NoError(t, err)
+
+	data := []byte(`{"version": 1, "bundles": [
+		{"uid": "` + existing.UID + `", "state": "error", "createdAt": 1},
+		{"uid": "new", "state": "complete", "createdAt": 2},
+		{"uid": "fails", "state": "complete", "createdAt": 3}
+	]}`)
+	kv.failKey = "fails"
+	require.Error(t, s.ImportMetadata(ctx, data, true))
+
+	after, err := s.Get(ctx, existing.UID)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "the overwritten bundle should be restored")
+	_, err = s.Get(ctx, "new")
+	assert.Error(t, err, "the imported bundle should be removed")
+}
+
+// failingSetKVStore fails to set failKey.
+type failingSetKVStore struct {
+	*kvstore.FakeKVStore
+	failKey string
+}
+
+func (f *failingSetKVStore) Set(ctx context.Context, orgId int64, namespace string, key string, value string) error {
+	if key == f.failKey {
+		return errors.New("set failed")
+	}
+	return f.FakeKVStore.Set(ctx, orgId, namespace, key, value)
+}
@@ -0,0 +1,156 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+const (
+	defaultCleanupInterval = 24 * time.Hour
+	defaultCleanupJitter   = time.Minute
+	cleanupLockKey         = "lock"
+	// defaultPendingGracePeriod is how long a bundle can stay pending before the cleanup marks it as
+	// failed. It must exceed bundleCreationTimeout so running generations are never reaped.
+	defaultPendingGracePeriod = time.Hour
+)
+
+// cleanupLock is an advisory lock stored in the kvstore so that a single replica
+// sweeps expired bundles per cleanup interval in HA setups.
+//
+// The holder keeps the lock for a whole interval and renews it on its next sweep,
+// other replicas only take it over once it expired. The kvstore has no
+// compare-and-swap, so the lock is read back after being written and two replicas
+// racing for an expired lock only let the last writer sweep.
+type cleanupLock struct {
+	kv    *kvstore.NamespacedKVStore
+	owner string
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+type cleanupLockState struct {
+	Owner     string `json:"owner"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+func newCleanupLock(kv kvstore.KVStore, ttl time.Duration) *cleanupLock {
+	return &cleanupLock{
+		kv:    kvstore.WithNamespace(kv, 0, "supportbundlecleanup"),
+		owner: uuid.NewString(),
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+// tryAcquire takes or renews the lock. It returns false without an error when
+// another replica holds it.
+func (l *cleanupLock) tryAcquire(ctx context.Context) (bool, error) {
+	current, err := l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if current != nil && current.Owner != l.owner && l.now().Unix() < current.ExpiresAt {
+		return false, nil
+	}
+
+	data, err := json.Marshal(cleanupLockState{Owner: l.owner, ExpiresAt: l.now().Add(l.ttl).Unix()})
+	if err != nil {
+		return false, err
+	}
+	if err := l.kv.Set(ctx, cleanupLockKey, string(data)); err != nil {
+		return false, err
+	}
+
+	current, err = l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	return current != nil && current.Owner == l.owner, nil
+}
+
+func (l *cleanupLock) get(ctx context.Context) (*cleanupLockState, error) {
+	data, ok, err := l.kv.Get(ctx, cleanupLockKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var state cleanupLockState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		// an unreadable lock is treated as expired and overwritten
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// sweep removes the expired bundles when this replica holds the cleanup lock.
+// It returns whether the sweep ran.
+func (s *Service) sweep(ctx context.Context) bool {
+	if s.cleanupLock != nil {
+		acquired, err := s.cleanupLock.tryAcquire(ctx)
+		if err != nil {
+			s.log.Warn("Failed to acquire support bundle cleanup lock, skipping cleanup", "error", err)
+			return false
+		}
+		if !acquired {
+			s.log.Debug("Support bundle cleanup is handled by another instance, skipping cleanup")
+			return false
+		}
+	}
+
+	s.cleanup(ctx)
+	return true
+}
+
+// reapStalePending marks the pending bundles older than the grace period as failed when their
+// generation isn't running or queued on this instance and has no persisted progress to resume
+// from, e.g. because the generating goroutine died.
+func (s *Service) reapStalePending(ctx context.Context, bundles []supportbundles.Bundle) {
+	gracePeriod := s.pendingGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultPendingGracePeriod
+	}
+
+	for _, b := range bundles {
+		if b.State != supportbundles.StatePending || time.Since(time.Unix(b.CreatedAt, 0)) <= gracePeriod {
+			continue
+		}
+		if s.generations.running(b.UID) || s.inflight.running(b.UID) {
+			continue
+		}
+		if s.queue != nil {
+			if position, _ := s.queue.position(b.UID); position > 0 {
+				continue
+			}
+		}
+
+		progress, err := s.store.GetProgress(ctx, b.UID)
+		if err != nil {
+			s.log.Error("Failed to get support bundle progress", "uid", b.UID, "error", err)
+			continue
+		}
+		if progress != nil {
+			continue
+		}
+
+		s.log.Warn("Marking stale pending support bundle as failed", "uid", b.UID)
+		if err := s.store.Fail(ctx, b.UID, "generation did not complete"); err != nil {
+			s.log.Error("Failed to update stale pending bundle", "uid", b.UID, "error", err)
+		}
+	}
+}
+
+// startupJitter returns a random delay applied before the first sweep so replicas
+// started together don't contend for the cleanup lock at the same time.
+func (s *Service) startupJitter() time.Duration {
+	if s.cleanupJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.cleanupJitter)))
+}
@@ -0,0 +1,101 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestService_sweepSingleReplica(t *testing.T) {
+	kv := kvstore.NewFakeKVStore()
+	bundles := newStore(kv)
+	now := time.Now()
+
+	newWorker := func() *Service {
+		lock := newCleanupLock(kv, time.Hour)
+		lock.now = func() time.Time { return now }
+		return &Service{
+			log:         log.New("test"),
+			queue:       newGenerationQueue(1),
+			store:       bundles,
+			cleanupLock: lock,
+		}
+	}
+	first, second := newWorker(), newWorker()
+
+	createExpired := func() string {
+		bundle, _, err := bundles.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		bundle.State = supportbundles.StateComplete
+		bundle.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+		require.NoError(t, bundles.set(context.Background(), bundle))
+		return bundle.UID
+	}
+
+	uid := createExpired()
+	assert.True(t, first.sweep(context.Background()))
+	assert.False(t, second.sweep(context.Background()), "the second replica must skip while the first holds the lock")
+
+	_, err := bundles.Get(context.Background(), uid)
+	require.Error(t, err, "expired bundle should have been removed")
+
+	// the holder renews the lock on its next sweep
+	assert.True(t, first.sweep(context.Background()))
+	assert.False(t, second.sweep(context.Background()))
+
+	// another replica takes over once the holder stopped renewing the lock
+	now = now.Add(2 * time.Hour)
+	uid = createExpired()
+	assert.True(t, second.sweep(context.Background()))
+	assert.False(t, first.sweep(context.Background()))
+
+	_, err = bundles.Get(context.Background(), uid)
+	require.Error(t, err, "expired bundle should have been removed")
+}
+
+func TestService_reapStalePending(t *testing.T) {
+	bundles := newStore(kvstore.NewFakeKVStore())
+	s := &Service{
+		log:                log.New("test"),
+		generations:        newGenerationTracker(),
+		queue:              newGenerationQueue(1),
+		store:              bundles,
+		pendingGracePeriod: time.Hour,
+	}
+
+	createPending := func(age time.Duration) string {
+		bundle, _, err := bundles.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		bundle.CreatedAt = time.Now().Add(-age).Unix()
+		require.NoError(t, bundles.set(context.Background(), bundle))
+		return bundle.UID
+	}
+
+	stale := createPending(2 * time.Hour)
+	recent := createPending(time.Minute)
+	running := createPending(2 * time.Hour)
+	s.generations.start(running, 0, 1)
+	resumable := createPending(2 * time.Hour)
+	require.NoError(t, bundles.SetProgress(context.Background(), resumable, &bundleProgress{Collectors: []string{"basic"}}))
+
+	s.cleanup(context.Background())
+
+	bundle, err := bundles.Get(context.Background(), stale)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StateError, bundle.State, "stale bundle without an in-flight generation should be reaped")
+	assert.Equal(t, "generation did not complete", bundle.Error)
+
+	for _, uid := range []string{recent, running, resumable} {
+		bundle, err := bundles.Get(context.Background(), uid)
+		require.NoError(t, err)
+		assert.Equal(t, supportbundles.StatePending, bundle.State)
+	}
+}
@@ -0,0 +1,105 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+)
+
+// compactGracePeriod is how long a key must stay orphaned before Compact removes it.
+// The kvstore doesn't record when keys were written, so a key is only removed once it
+// was found orphaned by a previous compaction at least this long ago.
+const compactGracePeriod = time.Hour
+
+// orphanKey identifies a key of one of the bundle namespaces that no longer has a bundle.
+type orphanKey struct {
+	namespace string
+	key       string
+}
+
+// Compact removes the progress, archive, manifest and idempotency keys left behind by bundles that
+// no longer exist, for instance when a removal was interrupted, and returns how many were reclaimed.
+// It is safe to run while bundles are created: keys written just before their bundle, such as the
+// archive reference written by CreateImported, can be found orphaned by one compaction but are only
+// removed once still orphaned compactGracePeriod later, by when their bundle has been written.
+func (s *store) Compact(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	candidates := map[orphanKey]string{}
+	for namespace, kv := range map[string]*kvstore.NamespacedKVStore{
+		"progress": s.progressKV,
+		"archive":  s.archiveKV,
+		"manifest": s.manifestKV,
+	} {
+		keys, err := kv.Keys(ctx, "")
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			candidates[orphanKey{namespace: namespace, key: k.Key}] = k.Key
+		}
+	}
+
+	indexed, err := s.idempotencyKV.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, items := range indexed {
+		for indexKey, uid := range items {
+			candidates[orphanKey{namespace: "idempotency", key: indexKey}] = uid
+		}
+	}
+
+	bundleKeys, err := s.kv.Keys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	bundles := make(map[string]bool, len(bundleKeys))
+	for _, k := range bundleKeys {
+		bundles[k.Key] = true
+	}
+
+	now := s.now()
+	seen := make(map[orphanKey]time.Time, len(s.orphansSeen))
+	reclaimed := 0
+	for k, uid := range candidates {
+		if bundles[uid] {
+			continue
+		}
+
+		firstSeen, ok := s.orphansSeen[k]
+		if !ok || now.Sub(firstSeen) < compactGracePeriod {
+			if !ok {
+				firstSeen = now
+			}
+			seen[k] = firstSeen
+			continue
+		}
+
+		if err := s.removeOrphan(ctx, k); err != nil {
+			s.log.Warn("Failed to remove orphaned support bundle key", "namespace", k.namespace, "key", k.key, "error", err)
+			seen[k] = firstSeen
+			continue
+		}
+		reclaimed++
+	}
+	// keys that are no longer orphaned, or were removed, are forgotten
+	s.orphansSeen = seen
+
+	return reclaimed, nil
+}
+
+func (s *store) removeOrphan(ctx context.Context, k orphanKey) error {
+	switch k.namespace {
+	case "progress":
+		return s.RemoveProgress(ctx, k.key)
+	case "archive":
+		return s.removeArchive(ctx, k.key)
+	case "manifest":
+		return s.manifestKV.Del(ctx, k.key)
+	default:
+		return s.idempotencyKV.Del(ctx, k.key)
+	}
+}
@@ -0,0 +1,72 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestStore_Compact(t *testing.T) {
+	s := newStore(kvstore.NewFakeKVStore())
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	bundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "key")
+	require.NoError(t, err)
+	require.NoError(t, s.SetProgress(ctx, bundle.UID, &bundleProgress{Collectors: []string{"basic"}}))
+
+	// keys left behind by a removal that was interrupted
+	orphanArchive := filepath.Join(t.TempDir(), "orphan.tar.gz")
+	require.NoError(t, os.WriteFile(orphanArchive, []byte("data"), 0600))
+	require.NoError(t, s.archiveKV.Set(ctx, "removed-uid", orphanArchive))
+	require.NoError(t, s.SetProgress(ctx, "removed-uid", &bundleProgress{}))
+	require.NoError(t, s.idempotencyKV.Set(ctx, "1/alice/key", "removed-uid"))
+
+	reclaimed, err := s.Compact(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, reclaimed, "orphans are kept during the grace period")
+
+	now = now.Add(compactGracePeriod)
+	reclaimed, err = s.Compact(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, reclaimed)
+
+	_, ok, err := s.archiveKV.Get(ctx, "removed-uid")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoFileExists(t, orphanArchive)
+	progress, err := s.GetProgress(ctx, "removed-uid")
+	require.NoError(t, err)
+	assert.Nil(t, progress)
+
+	progress, err = s.GetProgress(ctx, bundle.UID)
+	require.NoError(t, err)
+	assert.NotNil(t, progress, "keys of existing bundles are kept")
+	existing, err := s.getByIdempotencyKey(ctx, idempotencyIndexKey(1, "bob", "key"))
+	require.NoError(t, err)
+	assert.NotNil(t, existing)
+
+	t.Run("keys written for a new bundle are never reclaimed", func(t *testing.T) {
+		// the bundle is written right after the compaction listed the keys
+		require.NoError(t, s.SetProgress(ctx, "new-uid", &bundleProgress{}))
+		reclaimed, err := s.Compact(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, reclaimed)
+
+		require.NoError(t, s.kv.Set(ctx, "new-uid", `{"uid":"new-uid"}`))
+		now = now.Add(compactGracePeriod)
+		reclaimed, err = s.Compact(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, reclaimed)
+		assert.Empty(t, s.orphansSeen)
+	})
+}
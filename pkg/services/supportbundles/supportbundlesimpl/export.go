@@ -0,0 +1,117 @@
+package supportbundlesimpl
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+const exportIndexFilename = "index.json"
+
+// exportIndexEntry describes a bundle included in an export.
+type exportIndexEntry struct {
+	UID       string `json:"uid"`
+	Filename  string `json:"filename"`
+	Creator   string `json:"creator"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// ExportAll returns a zip archive containing the archive of every complete and
+// non-expired bundle of the organization, named by uid, together with an index.json
+// listing them. The archive is streamed as it is read and bundles are copied one at a
+// time, so they are never held in memory.
+func (s *Service) ExportAll(ctx context.Context, orgID int64) (io.ReadCloser, error) {
+	bundles, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	index := make([]exportIndexEntry, 0, len(bundles))
+	for _, b := range bundles {
+		if b.OrgID != orgID || b.State != supportbundles.StateComplete || b.ContentPurged || now >= b.ExpiresAt {
+			continue
+		}
+		index = append(index, exportIndexEntry{
+			UID:       b.UID,
+			Filename:  archiveFilename(b.UID, b.Encrypted),
+			Creator:   b.Creator,
+			CreatedAt: b.CreatedAt,
+			ExpiresAt: b.ExpiresAt,
+		})
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.writeExport(ctx, pw, index))
+	}()
+
+	return pr, nil
+}
+
+func (s *Service) writeExport(ctx context.Context, w io.Writer, index []exportIndexEntry) error {
+	zw := zip.NewWriter(w)
+
+	iw, err := zw.Create(exportIndexFilename)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(iw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(index); err != nil {
+		return fmt.Errorf("failed to write support bundle export index: %w", err)
+	}
+
+	for _, entry := range index {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.exportBundle(ctx, zw, entry); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func (s *Service) exportBundle(ctx context.Context, zw *zip.Writer, entry exportIndexEntry) error {
+	archive, err := s.store.OpenArchive(ctx, entry.UID)
+	if err != nil {
+		return fmt.Errorf("failed to open support bundle %s: %w", entry.UID, err)
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			s.log.Warn("Failed to close support bundle archive", "uid", entry.UID, "error", err)
+		}
+	}()
+
+	// the archives are already compressed
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     entry.Filename,
+		Method:   zip.Store,
+		Modified: time.Unix(entry.CreatedAt, 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fw, archive); err != nil {
+		return fmt.Errorf("failed to export support bundle %s: %w", entry.UID, err)
+	}
+	return nil
+}
+
+// archiveFilename returns the filename of a bundle archive named name, with the extension of an
+// encrypted archive when the bundle was encrypted on generation.
+func archiveFilename(name string, encrypted bool) string {
+	if encrypted {
+		return name + ".tar.gz.age"
+	}
+	return name + ".tar.gz"
+}
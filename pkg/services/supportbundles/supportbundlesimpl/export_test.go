@@ -0,0 +1,96 @@
+package supportbundlesimpl
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestService_ExportAll(t *testing.T) {
+	bundles := newStore(kvstore.NewFakeKVStore())
+	s := &Service{
+		log:   log.New("test"),
+		store: bundles,
+		// imported and inline bundles aren't encrypted even when encryption is configured
+		encryptionPublicKeys: []string{"age1key"},
+	}
+	ctx := context.Background()
+	archiveDir := t.TempDir()
+
+	create := func(orgID int64, state supportbundles.State, content string, encrypted bool) *supportbundles.Bundle {
+		bundle, _, err := bundles.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: orgID, Login: "bob"}, "")
+		require.NoError(t, err)
+		if state == supportbundles.StatePending {
+			return bundle
+		}
+
+		archivePath := filepath.Join(archiveDir, bundle.UID+".tar.gz")
+		require.NoError(t, os.WriteFile(archivePath, []byte(content), 0o600))
+		require.NoError(t, bundles.UpdateArchive(ctx, bundle.UID, state, ArchiveMeta{Path: archivePath, Encrypted: encrypted}))
+		return bundle
+	}
+
+	first := create(1, supportbundles.StateComplete, "first bundle", false)
+	encrypted := create(1, supportbundles.StateComplete, "encrypted bundle", true)
+	// bundles stored inline are exported as well
+	inline, _, err := bundles.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "alice"}, "")
+	require.NoError(t, err)
+	require.NoError(t, bundles.Update(ctx, inline.UID, supportbundles.StateComplete, []byte("inline bundle")))
+
+	// left out of the export
+	create(2, supportbundles.StateComplete, "other org", false)
+	create(1, supportbundles.StatePending, "", false)
+	create(1, supportbundles.StateError, "failed", false)
+	expired := create(1, supportbundles.StateComplete, "expired", false)
+	stored, err := bundles.Get(ctx, expired.UID)
+	require.NoError(t, err)
+	stored.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, bundles.set(ctx, stored))
+
+	archive, err := s.ExportAll(ctx, 1)
+	require.NoError(t, err)
+	data, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, archive.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	members := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		members[f.Name] = string(content)
+	}
+
+	require.Len(t, members, 4)
+	assert.Equal(t, "first bundle", members[first.UID+".tar.gz"])
+	assert.Equal(t, "encrypted bundle", members[encrypted.UID+".tar.gz.age"])
+	assert.Equal(t, "inline bundle", members[inline.UID+".tar.gz"])
+
+	var index []exportIndexEntry
+	require.NoError(t, json.Unmarshal([]byte(members[exportIndexFilename]), &index))
+	require.Len(t, index, 3)
+	for _, entry := range index {
+		assert.Contains(t, members, entry.Filename)
+		assert.NotZero(t, entry.CreatedAt)
+	}
+	assert.Equal(t, zr.File[0].Name, exportIndexFilename, "the index comes first")
+}
@@ -0,0 +1,54 @@
+package supportbundlesimpl
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+const (
+	defaultDownloadFilenameTemplate = "{uid}"
+	// maxDownloadFilenameLength bounds the rendered filename, the archive extension is appended after truncation.
+	maxDownloadFilenameLength = 128
+)
+
+// downloadFilename renders the filename template for the Content-Disposition header of a bundle
+// download. The supported placeholders are {uid}, {created} (UTC creation date), {org} and {creator}.
+// Characters outside of letters, digits, dots, dashes and underscores are replaced so rendered
+// values can't inject header parameters.
+func (s *Service) downloadFilename(bundle *supportbundles.Bundle) string {
+	template := s.downloadFilenameTemplate
+	if template == "" {
+		template = defaultDownloadFilenameTemplate
+	}
+
+	name := strings.NewReplacer(
+		"{uid}", bundle.UID,
+		"{created}", time.Unix(bundle.CreatedAt, 0).UTC().Format("2006-01-02"),
+		"{org}", strconv.FormatInt(bundle.OrgID, 10),
+		"{creator}", bundle.Creator,
+	).Replace(template)
+
+	name = sanitizeFilename(name)
+	if len(name) > maxDownloadFilenameLength {
+		name = name[:maxDownloadFilenameLength]
+	}
+	if strings.Trim(name, "._-") == "" {
+		name = bundle.UID
+	}
+
+	return archiveFilename(name, bundle.Encrypted)
+}
+
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,89 @@
+package supportbundlesimpl
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+func TestService_downloadFilename(t *testing.T) {
+	bundle := &supportbundles.Bundle{
+		UID:       "abc123",
+		OrgID:     2,
+		Creator:   "bob",
+		CreatedAt: time.Date(2023, 10, 5, 12, 0, 0, 0, time.UTC).Unix(),
+	}
+
+	tests := []struct {
+		desc                 string
+		template             string
+		bundle               *supportbundles.Bundle
+		encryptionConfigured bool
+		expected             string
+	}{
+		{desc: "default template", expected: "abc123.tar.gz"},
+		{desc: "uid placeholder", template: "bundle-{uid}", expected: "bundle-abc123.tar.gz"},
+		{desc: "created placeholder", template: "bundle-{created}", expected: "bundle-2023-10-05.tar.gz"},
+		{desc: "org placeholder", template: "org-{org}", expected: "org-2.tar.gz"},
+		{desc: "creator placeholder", template: "{creator}", expected: "bob.tar.gz"},
+		{
+			desc:     "every placeholder",
+			template: "case-1234_{org}_{creator}_{created}_{uid}",
+			expected: "case-1234_2_bob_2023-10-05_abc123.tar.gz",
+		},
+		{
+			desc:     "encrypted archive",
+			template: "{creator}",
+			bundle:   &supportbundles.Bundle{UID: "abc123", Creator: "bob", Encrypted: true},
+			expected: "bob.tar.gz.age",
+		},
+		{
+			desc:                 "unencrypted archive while encryption is configured",
+			template:             "{creator}",
+			encryptionConfigured: true,
+			expected:             "bob.tar.gz",
+		},
+		{
+			desc:     "malicious creator is sanitized",
+			template: "{creator}-{uid}",
+			bundle:   &supportbundles.Bundle{UID: "abc123", Creator: "bob\r\nSet-Cookie: a=b; filename=\"../../etc/passwd\""},
+			expected: "bob__Set-Cookie__a_b__filename__.._.._etc_passwd_-abc123.tar.gz",
+		},
+		{
+			desc:     "unsafe template characters are sanitized",
+			template: "support bundle/{uid}",
+			expected: "support_bundle_abc123.tar.gz",
+		},
+		{
+			desc:     "long names are truncated",
+			template: "{creator}",
+			bundle:   &supportbundles.Bundle{UID: "abc123", Creator: strings.Repeat("a", 300)},
+			expected: strings.Repeat("a", maxDownloadFilenameLength) + ".tar.gz",
+		},
+		{
+			desc:     "empty names fall back to the uid",
+			template: "{creator}",
+			bundle:   &supportbundles.Bundle{UID: "abc123"},
+			expected: "abc123.tar.gz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := &Service{downloadFilenameTemplate: tt.template}
+			if tt.encryptionConfigured {
+				s.encryptionPublicKeys = []string{"age1key"}
+			}
+			b := bundle
+			if tt.bundle != nil {
+				b = tt.bundle
+			}
+
+			assert.Equal(t, tt.expected, s.downloadFilename(b))
+		})
+	}
+}
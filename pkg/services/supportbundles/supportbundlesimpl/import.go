@@ -0,0 +1,163 @@
+package supportbundlesimpl
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+var (
+	// ErrImportPathNotAllowed is returned when the imported file is outside of the allowed root or imports are disabled.
+	ErrImportPathNotAllowed = errors.New("support bundle import path is not allowed")
+	// ErrImportInvalidArchive is returned when the imported file is not a gzip compressed tar archive.
+	ErrImportInvalidArchive = errors.New("support bundle import is not a gzip compressed tar archive")
+)
+
+// ImportMeta describes a bundle generated outside of Grafana.
+type ImportMeta struct {
+	Creator string
+	OrgID   int64
+	// Collectors is the collector selection the bundle contains, if known.
+	Collectors []string
+	// CreatedAt is the unix time the bundle was generated at, the import time is used when zero.
+	CreatedAt int64
+}
+
+// ImportFromPath registers a bundle archive already on disk, e.g. generated by on-host tooling, without
+// uploading it. The file is streamed into the archive directory while it is validated and its checksum
+// computed, so it is never held in memory as a whole. Only files under the configured import root can be
+// imported. Imported bundles are not signed since they weren't generated by Grafana.
+func (s *Service) ImportFromPath(ctx context.Context, path string, meta ImportMeta) (*supportbundles.Bundle, error) {
+	src, err := s.openImport(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = src.Close() }()
+
+	if s.archiveDir != "" {
+		if err := os.MkdirAll(s.archiveDir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create support bundle directory: %w", err)
+		}
+	}
+
+	dst, err := os.CreateTemp(s.archiveDir, "import-*.tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create support bundle archive: %w", err)
+	}
+	archivePath := dst.Name()
+
+	h := sha256.New()
+	w := &archiveWriter{w: io.MultiWriter(dst, h), limit: s.maxArchiveBytes}
+	err = validateArchive(io.TeeReader(src, w))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.removeArchive(archivePath)
+		return nil, err
+	}
+
+	bundle, err := s.store.CreateImported(ctx, meta, archivePath, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		s.removeArchive(archivePath)
+		return nil, err
+	}
+
+	s.log.Info("Imported support bundle", "uid", bundle.UID, "path", path, "size", bundle.Size)
+	return bundle, nil
+}
+
+// openImport opens path after checking it resolves to a regular file under the import root.
+// Symbolic links are resolved first so they can't point outside of the root.
+func (s *Service) openImport(path string) (*os.File, error) {
+	if s.importRoot == "" {
+		return nil, fmt.Errorf("%w: no import root is configured", ErrImportPathNotAllowed)
+	}
+
+	root, err := filepath.EvalSymlinks(s.importRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve support bundle import root: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve support bundle import path: %w", err)
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return nil, err
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%w: %s is outside of %s", ErrImportPathNotAllowed, path, s.importRoot)
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		_ = f.Close()
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrImportPathNotAllowed, path)
+	}
+	return f, nil
+}
+
+// validateArchive reads r to the end, checking it is a gzip compressed tar archive with at least one entry.
+func validateArchive(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrImportInvalidArchive, err)
+	}
+
+	tr := tar.NewReader(gz)
+	entries := 0
+	for {
+		_, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, errArchiveTooLarge) {
+				return err
+			}
+			return fmt.Errorf("%w: %s", ErrImportInvalidArchive, err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			if errors.Is(err, errArchiveTooLarge) {
+				return err
+			}
+			return fmt.Errorf("%w: %s", ErrImportInvalidArchive, err)
+		}
+		entries++
+	}
+	if entries == 0 {
+		return fmt.Errorf("%w: the archive is empty", ErrImportInvalidArchive)
+	}
+
+	// the tar end marker can be followed by padding and the gzip trailer, they are part of the archive too
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return fmt.Errorf("%w: %s", ErrImportInvalidArchive, err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	return nil
+}
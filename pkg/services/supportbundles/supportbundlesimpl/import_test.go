@@ -0,0 +1,115 @@
+package supportbundlesimpl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+func TestService_ImportFromPath(t *testing.T) {
+	importRoot := t.TempDir()
+	newService := func(t *testing.T) *Service {
+		return &Service{
+			log:        log.New("test"),
+			store:      newStore(kvstore.NewFakeKVStore()),
+			archiveDir: t.TempDir(),
+			importRoot: importRoot,
+		}
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	content := []byte(`{"version": "10.0.0"}`)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bundle/basic.json", Mode: 0o600, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	archive := buf.Bytes()
+
+	t.Run("imports a gzip compressed tar archive", func(t *testing.T) {
+		s := newService(t)
+		path := filepath.Join(importRoot, "external.tar.gz")
+		require.NoError(t, os.WriteFile(path, archive, 0o600))
+
+		bundle, err := s.ImportFromPath(context.Background(), path, ImportMeta{Creator: "support-tool", OrgID: 1})
+		require.NoError(t, err)
+
+		checksum := sha256.Sum256(archive)
+		assert.Equal(t, supportbundles.StateComplete, bundle.State)
+		assert.True(t, bundle.Imported)
+		assert.Equal(t, "support-tool", bundle.Creator)
+		assert.Equal(t, int64(len(archive)), bundle.Size)
+		assert.Equal(t, hex.EncodeToString(checksum[:]), bundle.Checksum)
+
+		stored, err := s.store.Get(context.Background(), bundle.UID)
+		require.NoError(t, err)
+		assert.True(t, stored.Imported)
+		assert.Equal(t, archive, readArchive(t, s, bundle.UID))
+		_, err = os.Stat(path)
+		assert.NoError(t, err, "the imported file is left in place")
+	})
+
+	t.Run("rejects files that are not a gzip compressed tar archive", func(t *testing.T) {
+		s := newService(t)
+
+		var notTar bytes.Buffer
+		gw := gzip.NewWriter(&notTar)
+		_, err := gw.Write([]byte("plain text, not a tar archive"))
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		for name, data := range map[string][]byte{
+			"not-gzip.tar.gz":  []byte("plain text"),
+			"not-tar.tar.gz":   notTar.Bytes(),
+			"truncated.tar.gz": archive[:len(archive)/2],
+		} {
+			path := filepath.Join(importRoot, name)
+			require.NoError(t, os.WriteFile(path, data, 0o600))
+
+			_, err := s.ImportFromPath(context.Background(), path, ImportMeta{Creator: "support-tool"})
+			assert.ErrorIs(t, err, ErrImportInvalidArchive, name)
+		}
+
+		bundles, err := s.store.List()
+		require.NoError(t, err)
+		assert.Empty(t, bundles)
+		entries, err := os.ReadDir(s.archiveDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "partially copied archives should be removed")
+	})
+
+	t.Run("rejects paths outside of the import root", func(t *testing.T) {
+		s := newService(t)
+		outside := filepath.Join(t.TempDir(), "external.tar.gz")
+		require.NoError(t, os.WriteFile(outside, archive, 0o600))
+
+		_, err := s.ImportFromPath(context.Background(), outside, ImportMeta{Creator: "support-tool"})
+		assert.ErrorIs(t, err, ErrImportPathNotAllowed)
+
+		link := filepath.Join(importRoot, "link.tar.gz")
+		require.NoError(t, os.Symlink(outside, link))
+		_, err = s.ImportFromPath(context.Background(), link, ImportMeta{Creator: "support-tool"})
+		assert.ErrorIs(t, err, ErrImportPathNotAllowed)
+
+		s.importRoot = ""
+		inside := filepath.Join(importRoot, "inside.tar.gz")
+		require.NoError(t, os.WriteFile(inside, archive, 0o600))
+		_, err = s.ImportFromPath(context.Background(), inside, ImportMeta{Creator: "support-tool"})
+		assert.ErrorIs(t, err, ErrImportPathNotAllowed, "imports are disabled without an import root")
+	})
+}
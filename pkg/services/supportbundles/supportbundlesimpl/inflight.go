@@ -0,0 +1,69 @@
+package supportbundlesimpl
+
+import "sync"
+
+// generationHandle is a generation queued or running on this instance.
+type generationHandle struct {
+	uid  string
+	done chan struct{}
+}
+
+// Done is closed once the generation ended, whatever its outcome.
+func (h *generationHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// inflightGenerations makes sure a bundle is generated by a single goroutine at a time. Starting
+// a generation for a bundle already queued or running returns the handle of that generation, so
+// racing resumes and retries don't run the collectors twice or store each other's results.
+type inflightGenerations struct {
+	mu      sync.Mutex
+	handles map[string]*generationHandle
+}
+
+func newInflightGenerations() *inflightGenerations {
+	return &inflightGenerations{handles: map[string]*generationHandle{}}
+}
+
+// start registers a generation of the bundle with the given uid. It returns the handle of the
+// generation already in flight and false if there is one, the caller must not generate the bundle
+// then. Every started generation must be followed by a finish. Generations aren't deduplicated on
+// a nil receiver.
+func (g *inflightGenerations) start(uid string) (*generationHandle, bool) {
+	if g == nil {
+		return &generationHandle{uid: uid, done: make(chan struct{})}, true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if h, ok := g.handles[uid]; ok {
+		return h, false
+	}
+	h := &generationHandle{uid: uid, done: make(chan struct{})}
+	g.handles[uid] = h
+	return h, true
+}
+
+// finish unregisters the generation and notifies the holders of its handle.
+func (g *inflightGenerations) finish(h *generationHandle) {
+	defer close(h.done)
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.handles[h.uid] == h {
+		delete(g.handles, h.uid)
+	}
+}
+
+// running returns true if the bundle is queued or being generated on this instance.
+func (g *inflightGenerations) running(uid string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.handles[uid]
+	return ok
+}
@@ -0,0 +1,110 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestService_startGenerationInflight(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
+		queue:          newGenerationQueue(2),
+		generations:    newGenerationTracker(),
+		inflight:       newInflightGenerations(),
+	}
+
+	var runs atomic.Int32
+	unblock := make(chan struct{})
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "blocking",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			runs.Add(1)
+			<-unblock
+			return &supportbundles.SupportItem{Filename: "blocking.json", FileBytes: []byte(`{}`)}, nil
+		},
+	})
+
+	bundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	handles := make([]*generationHandle, 2)
+	for i := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			handles[i] = s.startGeneration(context.Background(), bundle.UID, []string{"blocking"})
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Same(t, handles[0], handles[1], "the second generation should get the in-flight handle")
+	assert.True(t, s.inflight.running(bundle.UID))
+
+	close(unblock)
+	select {
+	case <-handles[0].Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation did not complete")
+	}
+
+	assert.Equal(t, int32(1), runs.Load(), "collectors should run once")
+	assert.False(t, s.inflight.running(bundle.UID), "the generation should be unregistered once complete")
+
+	stored, err := s.store.Get(context.Background(), bundle.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StateComplete, stored.State)
+
+	// a later generation of the same bundle runs again
+	<-s.startGeneration(context.Background(), bundle.UID, []string{"blocking"}).Done()
+	assert.Equal(t, int32(2), runs.Load())
+}
+
+func TestService_startGenerationInflight_Panic(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
+		queue:          newGenerationQueue(1),
+		generations:    newGenerationTracker(),
+		inflight:       newInflightGenerations(),
+	}
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "panicking",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			panic("collector failed")
+		},
+	})
+
+	bundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	select {
+	case <-s.startGeneration(context.Background(), bundle.UID, []string{"panicking"}).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation did not complete")
+	}
+	assert.False(t, s.inflight.running(bundle.UID), "the generation should be unregistered after a panic")
+}
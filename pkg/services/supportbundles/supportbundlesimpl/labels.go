@@ -0,0 +1,83 @@
+package supportbundlesimpl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+const (
+	// maxLabels, maxLabelKeyLength and maxLabelValueLength cap the labels stored with a bundle
+	// since every listing decodes them.
+	maxLabels           = 20
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 255
+)
+
+// ErrInvalidLabels is returned when setting labels exceeding the caps or with an empty key.
+var ErrInvalidLabels = errors.New("invalid support bundle labels")
+
+// ListFilter selects the bundles returned by ListFiltered, zero fields match every bundle.
+type ListFilter struct {
+	// From and To select the bundles created in [From, To), as unix timestamps.
+	From int64
+	To   int64
+	// Creator selects the bundles created by the user with this login.
+	Creator string
+	// Labels selects the bundles having every label with the same value.
+	Labels map[string]string
+}
+
+func (f ListFilter) matches(b *supportbundles.Bundle) bool {
+	if b.CreatedAt < f.From || (f.To > 0 && b.CreatedAt >= f.To) {
+		return false
+	}
+	if f.Creator != "" && b.Creator != f.Creator {
+		return false
+	}
+	for k, v := range f.Labels {
+		if value, ok := b.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLabelSelector parses a selector of comma separated key=value pairs, e.g. "case=1234,severity=high",
+// into the labels a bundle must have. An empty selector matches every bundle.
+func parseLabelSelector(selector string) (map[string]string, error) {
+	if selector == "" {
+		return nil, nil
+	}
+
+	labels := map[string]string{}
+	for _, pair := range strings.Split(selector, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%w: invalid label selector %q, expected key=value", ErrInvalidLabels, pair)
+		}
+		labels[k] = strings.TrimSpace(v)
+	}
+	return labels, validateLabels(labels)
+}
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%w: %d labels, the maximum is %d", ErrInvalidLabels, len(labels), maxLabels)
+	}
+	for k, v := range labels {
+		if k == "" {
+			return fmt.Errorf("%w: empty label key", ErrInvalidLabels)
+		}
+		if len(k) > maxLabelKeyLength {
+			return fmt.Errorf("%w: label key is longer than %d characters", ErrInvalidLabels, maxLabelKeyLength)
+		}
+		if len(v) > maxLabelValueLength {
+			return fmt.Errorf("%w: value of label %q is longer than %d characters", ErrInvalidLabels, k, maxLabelValueLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestStore_SetLabels(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(kvstore.NewFakeKVStore())
+
+	bundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetLabels(ctx, bundle.UID, map[string]string{"case": "1234", "severity": "high"}))
+	stored, err := s.Get(ctx, bundle.UID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"case": "1234", "severity": "high"}, stored.Labels)
+
+	t.Run("should reject labels exceeding the caps", func(t *testing.T) {
+		tooMany := map[string]string{}
+		for i := 0; i <= maxLabels; i++ {
+			tooMany[fmt.Sprintf("label-%d", i)] = "value"
+		}
+
+		for desc, labels := range map[string]map[string]string{
+			"too many labels": tooMany,
+			"empty key":       {"": "value"},
+			"long key":        {strings.Repeat("k", maxLabelKeyLength+1): "value"},
+			"long value":      {"case": strings.Repeat("v", maxLabelValueLength+1)},
+		} {
+			assert.ErrorIs(t, s.SetLabels(ctx, bundle.UID, labels), ErrInvalidLabels, desc)
+		}
+
+		stored, err := s.Get(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"case": "1234", "severity": "high"}, stored.Labels, "rejected labels should not be stored")
+	})
+
+	t.Run("should remove the labels", func(t *testing.T) {
+		require.NoError(t, s.SetLabels(ctx, bundle.UID, nil))
+		stored, err := s.Get(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.Empty(t, stored.Labels)
+	})
+}
+
+func TestStore_ListFiltered(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(kvstore.NewFakeKVStore())
+
+	for _, b := range []struct {
+		login     string
+		createdAt int64
+		labels    map[string]string
+	}{
+		{login: "alice", createdAt: 100, labels: map[string]string{"case": "1234", "severity": "high"}},
+		{login: "bob", createdAt: 200, labels: map[string]string{"case": "1234", "severity": "low"}},
+		{login: "alice", createdAt: 300, labels: map[string]string{"case": "5678"}},
+		{login: "bob", createdAt: 400},
+	} {
+		bundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: b.login}, "")
+		require.NoError(t, err)
+		bundle.CreatedAt = b.createdAt
+		require.NoError(t, s.set(ctx, bundle))
+		require.NoError(t, s.SetLabels(ctx, bundle.UID, b.labels))
+	}
+
+	createdAt := func(bundles []supportbundles.Bundle) []int64 {
+		res := []int64{}
+		for _, b := range bundles {
+			res = append(res, b.CreatedAt)
+		}
+		return res
+	}
+
+	testCases := []struct {
+		desc     string
+		filter   ListFilter
+		expected []int64
+	}{
+		{desc: "should return all without filter", expected: []int64{400, 300, 200, 100}},
+		{desc: "should match a label", filter: ListFilter{Labels: map[string]string{"case": "1234"}}, expected: []int64{200, 100}},
+		{desc: "should match every label", filter: ListFilter{Labels: map[string]string{"case": "1234", "severity": "high"}}, expected: []int64{100}},
+		{desc: "should not match a missing label", filter: ListFilter{Labels: map[string]string{"customer": "acme"}}, expected: []int64{}},
+		{desc: "should compose with the creator", filter: ListFilter{Creator: "bob", Labels: map[string]string{"case": "1234"}}, expected: []int64{200}},
+		{desc: "should compose with the time range", filter: ListFilter{From: 150, To: 400, Labels: map[string]string{"case": "1234"}}, expected: []int64{200}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			bundles, err := s.ListFiltered(ctx, tc.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, createdAt(bundles))
+		})
+	}
+}
+
+func TestParseLabelSelector(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		selector    string
+		expected    map[string]string
+		expectedErr bool
+	}{
+		{desc: "should match every bundle without selector", selector: ""},
+		{desc: "should parse a label", selector: "case=1234", expected: map[string]string{"case": "1234"}},
+		{desc: "should parse several labels", selector: "case=1234, severity=high", expected: map[string]string{"case": "1234", "severity": "high"}},
+		{desc: "should parse an empty value", selector: "customer=", expected: map[string]string{"customer": ""}},
+		{desc: "should reject a label without value", selector: "case", expectedErr: true},
+		{desc: "should reject an empty key", selector: "=1234", expectedErr: true},
+		{desc: "should reject labels exceeding the caps", selector: strings.Repeat("k", maxLabelKeyLength+1) + "=1234", expectedErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			labels, err := parseLabelSelector(tc.selector)
+			if tc.expectedErr {
+				assert.ErrorIs(t, err, ErrInvalidLabels)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, labels)
+		})
+	}
+}
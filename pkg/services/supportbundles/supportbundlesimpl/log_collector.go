@@ -0,0 +1,209 @@
+package supportbundlesimpl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+const (
+	defaultLogsLevel        = "error"
+	defaultLogsTimeWindow   = time.Hour
+	defaultLogsMaxSizeBytes = 5 * 1024 * 1024
+	defaultLogsRedactedKeys = "password passwd secret token api_key apikey authorization cookie"
+
+	// maxLogLineSize is the longest log line the collector is able to read.
+	maxLogLineSize = 1024 * 1024
+)
+
+var logLevels = map[string]int{
+	"debug":    0,
+	"dbug":     0,
+	"info":     1,
+	"warn":     2,
+	"warning":  2,
+	"error":    3,
+	"eror":     3,
+	"critical": 4,
+	"crit":     4,
+}
+
+var (
+	logfmtLevelRegex = regexp.MustCompile(`(?:^|\s)level=(\w+)`)
+	logfmtTimeRegex  = regexp.MustCompile(`(?:^|\s)t=(\S+)`)
+	jsonLevelRegex   = regexp.MustCompile(`"level":"(\w+)"`)
+	jsonTimeRegex    = regexp.MustCompile(`"t":"([^"]+)"`)
+	bearerRegex      = regexp.MustCompile(`(?i)(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*`)
+)
+
+type logCollectorConfig struct {
+	path       string
+	minLevel   string
+	window     time.Duration
+	maxBytes   int
+	redactKeys []string
+}
+
+func readLogCollectorConfig(cfg *setting.Cfg) logCollectorConfig {
+	section := cfg.SectionWithEnvOverrides("support_bundles")
+	return logCollectorConfig{
+		path:       cfg.Raw.Section("log.file").Key("file_name").MustString(filepath.Join(cfg.LogsPath, "grafana.log")),
+		minLevel:   strings.ToLower(section.Key("logs_level").MustString(defaultLogsLevel)),
+		window:     section.Key("logs_time_window").MustDuration(defaultLogsTimeWindow),
+		maxBytes:   section.Key("logs_max_size_bytes").MustInt(defaultLogsMaxSizeBytes),
+		redactKeys: util.SplitString(section.Key("logs_redacted_keys").MustString(defaultLogsRedactedKeys)),
+	}
+}
+
+// logCollector includes the most recent lines of the log file written by Grafana,
+// filtered by level and time window. Values of keys matching the redaction list
+// and credentials sent in authorization headers are redacted.
+func logCollector(cfg logCollectorConfig) supportbundles.Collector {
+	redactor := newLogRedactor(cfg.redactKeys)
+
+	return supportbundles.Collector{
+		UID:               "logs",
+		DisplayName:       "Server logs",
+		Description:       fmt.Sprintf("Recent server logs at level %s or above from the last %s", cfg.minLevel, cfg.window),
+		IncludedByDefault: false,
+		Default:           false,
+		Preflight: func(ctx context.Context) error {
+			if _, err := os.Stat(cfg.path); err != nil {
+				return fmt.Errorf("log file is not readable, file logging may be disabled: %w", err)
+			}
+			return nil
+		},
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			f, err := os.Open(cfg.path)
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = f.Close() }()
+
+			data, err := collectLogs(f, cfg, redactor, time.Now())
+			if err != nil {
+				return nil, err
+			}
+
+			return &supportbundles.SupportItem{
+				Filename:  "server.log",
+				FileBytes: data,
+			}, nil
+		},
+	}
+}
+
+// collectLogs keeps the most recent matching lines that fit in cfg.maxBytes.
+// Lines without a level or timestamp, such as stack traces, follow the decision
+// made for the preceding line.
+func collectLogs(r io.Reader, cfg logCollectorConfig, redactor *logRedactor, now time.Time) ([]byte, error) {
+	minLevel, ok := logLevels[cfg.minLevel]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q", cfg.minLevel)
+	}
+	since := now.Add(-cfg.window)
+
+	var (
+		lines   [][]byte
+		size    int
+		include bool
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		if lvl, ts, ok := parseLogLine(line); ok {
+			include = lvl >= minLevel && !ts.Before(since)
+		}
+		if !include {
+			continue
+		}
+
+		redacted := append(redactor.redact(line), '\n')
+		lines = append(lines, redacted)
+		size += len(redacted)
+
+		// drop the oldest lines to stay within the configured size
+		for size > cfg.maxBytes && len(lines) > 0 {
+			size -= len(lines[0])
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return bytes.Join(lines, nil), nil
+}
+
+// parseLogLine extracts the level and time of a log line written in the text or json format.
+func parseLogLine(line []byte) (int, time.Time, bool) {
+	levelRegex, timeRegex := logfmtLevelRegex, logfmtTimeRegex
+	if bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) {
+		levelRegex, timeRegex = jsonLevelRegex, jsonTimeRegex
+	}
+
+	levelMatch := levelRegex.FindSubmatch(line)
+	timeMatch := timeRegex.FindSubmatch(line)
+	if levelMatch == nil || timeMatch == nil {
+		return 0, time.Time{}, false
+	}
+
+	lvl, ok := logLevels[strings.ToLower(string(levelMatch[1]))]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, string(timeMatch[1]))
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	return lvl, ts, true
+}
+
+type logRedactor struct {
+	quoted   *regexp.Regexp
+	unquoted *regexp.Regexp
+}
+
+func newLogRedactor(keys []string) *logRedactor {
+	if len(keys) == 0 {
+		return &logRedactor{}
+	}
+
+	escaped := make([]string, 0, len(keys))
+	for _, k := range keys {
+		escaped = append(escaped, regexp.QuoteMeta(k))
+	}
+
+	// matches keys containing one of the redacted names in both logfmt (key=value) and json ("key":"value")
+	prefix := `(?i)((?:^|[\s{,])"?[\w.\-]*(?:` + strings.Join(escaped, "|") + `)[\w.\-]*"?\s*[=:]\s*)`
+	return &logRedactor{
+		quoted:   regexp.MustCompile(prefix + `"(?:[^"\\]|\\.)*"`),
+		unquoted: regexp.MustCompile(prefix + `[^\s",}]+`),
+	}
+}
+
+func (r *logRedactor) redact(line []byte) []byte {
+	line = bearerRegex.ReplaceAll(line, []byte("$1 [REDACTED]"))
+	if r.quoted == nil {
+		return line
+	}
+
+	line = r.quoted.ReplaceAll(line, []byte(`${1}"[REDACTED]"`))
+	return r.unquoted.ReplaceAll(line, []byte("${1}[REDACTED]"))
+}
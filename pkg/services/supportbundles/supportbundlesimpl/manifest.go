@@ -0,0 +1,92 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// collectorStatsBundles is the number of most recent bundles aggregated by CollectorStats.
+const collectorStatsBundles = 50
+
+// collectorTiming is when a collector ran during a bundle generation and how long it took.
+type collectorTiming struct {
+	UID string `json:"uid"`
+	// Start is the unix time in milliseconds at which the collector started.
+	Start      int64 `json:"start"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// bundleManifest is the metadata of a bundle generation, stored next to the bundle.
+type bundleManifest struct {
+	Collectors []collectorTiming `json:"collectors"`
+	// Redactions is the number of matches masked by the sanitizing pass.
+	Redactions int `json:"redactions,omitempty"`
+	// Pseudonyms is the number of distinct identities replaced in an anonymized bundle.
+	Pseudonyms int `json:"pseudonyms,omitempty"`
+}
+
+// CollectorStat is the aggregated duration of a collector across recent bundles.
+type CollectorStat struct {
+	UID string `json:"uid"`
+	// Samples is the number of bundles the collector ran in.
+	Samples     int           `json:"samples"`
+	AvgDuration time.Duration `json:"avgDuration"`
+	P95Duration time.Duration `json:"p95Duration"`
+}
+
+// CollectorStats aggregates the collector timings recorded in the manifests of the most
+// recent bundles, slowest collectors first. Only the manifests are read, not the archives.
+func (s *Service) CollectorStats(ctx context.Context) []CollectorStat {
+	bundles, err := s.store.List()
+	if err != nil {
+		s.log.Error("Failed to list bundles for collector stats", "error", err)
+		return nil
+	}
+	if len(bundles) > collectorStatsBundles {
+		bundles = bundles[:collectorStatsBundles]
+	}
+
+	durations := map[string][]time.Duration{}
+	for _, b := range bundles {
+		manifest, err := s.store.GetManifest(ctx, b.UID)
+		if err != nil {
+			s.log.Warn("Failed to get support bundle manifest", "uid", b.UID, "error", err)
+			continue
+		}
+		if manifest == nil {
+			continue
+		}
+		for _, timing := range manifest.Collectors {
+			durations[timing.UID] = append(durations[timing.UID], time.Duration(timing.DurationMs)*time.Millisecond)
+		}
+	}
+
+	stats := make([]CollectorStat, 0, len(durations))
+	for uid, samples := range durations {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+		var total time.Duration
+		for _, d := range samples {
+			total += d
+		}
+		// nearest-rank percentile
+		p95 := int(math.Ceil(0.95*float64(len(samples)))) - 1
+
+		stats = append(stats, CollectorStat{
+			UID:         uid,
+			Samples:     len(samples),
+			AvgDuration: total / time.Duration(len(samples)),
+			P95Duration: samples[p95],
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].AvgDuration != stats[j].AvgDuration {
+			return stats[i].AvgDuration > stats[j].AvgDuration
+		}
+		return stats[i].UID < stats[j].UID
+	})
+	return stats
+}
@@ -0,0 +1,96 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestService_CollectorStats(t *testing.T) {
+	s := &Service{
+		log:   log.New("test"),
+		store: newStore(kvstore.NewFakeKVStore()),
+	}
+	ctx := context.Background()
+
+	withManifest := func(timings ...collectorTiming) {
+		bundle, _, err := s.store.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		require.NoError(t, s.store.SetManifest(ctx, bundle.UID, &bundleManifest{Collectors: timings}))
+	}
+
+	withManifest(
+		collectorTiming{UID: "basic", DurationMs: 100},
+		collectorTiming{UID: "db", DurationMs: 1000},
+	)
+	withManifest(
+		collectorTiming{UID: "basic", DurationMs: 300},
+		collectorTiming{UID: "db", DurationMs: 3000},
+	)
+	withManifest(collectorTiming{UID: "basic", DurationMs: 200})
+	// bundles generated before manifests were recorded are skipped
+	_, _, err := s.store.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	stats := s.CollectorStats(ctx)
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, CollectorStat{UID: "db", Samples: 2, AvgDuration: 2 * time.Second, P95Duration: 3 * time.Second}, stats[0])
+	assert.Equal(t, CollectorStat{UID: "basic", Samples: 3, AvgDuration: 200 * time.Millisecond, P95Duration: 300 * time.Millisecond}, stats[1])
+}
+
+func TestService_bundleManifest(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
+	}
+	for _, uid := range []string{"fast", "slow"} {
+		delay := time.Duration(0)
+		if uid == "slow" {
+			delay = 20 * time.Millisecond
+		}
+		s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+			UID: uid,
+			Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+				time.Sleep(delay)
+				return &supportbundles.SupportItem{Filename: "item.json", FileBytes: []byte(`{}`)}, nil
+			},
+		})
+	}
+
+	bundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+	s.startBundleWork(context.Background(), []string{"fast", "slow"}, bundle.UID)
+
+	manifest, err := s.store.GetManifest(context.Background(), bundle.UID)
+	require.NoError(t, err)
+	require.NotNil(t, manifest)
+	require.Len(t, manifest.Collectors, 2)
+
+	timings := map[string]collectorTiming{}
+	for _, timing := range manifest.Collectors {
+		assert.NotZero(t, timing.Start)
+		timings[timing.UID] = timing
+	}
+	assert.GreaterOrEqual(t, timings["slow"].DurationMs, int64(20))
+
+	require.NoError(t, s.store.Remove(context.Background(), bundle.UID))
+	manifest, err = s.store.GetManifest(context.Background(), bundle.UID)
+	require.NoError(t, err)
+	assert.Nil(t, manifest, "the manifest is removed with the bundle")
+}
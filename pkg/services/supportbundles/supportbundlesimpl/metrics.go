@@ -0,0 +1,144 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+const (
+	metricsNamespace = "grafana"
+	metricsSubsystem = "support_bundle"
+
+	// storageMetricsInterval is how often the storage gauges are updated.
+	storageMetricsInterval = time.Minute
+	// maxOrgLabels caps the number of organizations labeled in the storage gauges,
+	// the bundles of the other organizations are aggregated under "other".
+	maxOrgLabels  = 10
+	otherOrgLabel = "other"
+)
+
+type bundleMetrics struct {
+	archiveBytes      prometheus.Histogram
+	peakBufferedBytes prometheus.Gauge
+
+	storedBundles *prometheus.GaugeVec
+	storedBytes   *prometheus.GaugeVec
+}
+
+func newBundleMetrics(r prometheus.Registerer) *bundleMetrics {
+	return &bundleMetrics{
+		archiveBytes: promauto.With(r).NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "archive_bytes",
+			Help:      "Size in bytes of the generated support bundle archives.",
+			Buckets:   prometheus.ExponentialBuckets(64*1024, 4, 8),
+		}),
+		peakBufferedBytes: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "generation_peak_buffered_bytes",
+			Help:      "Peak number of collected bytes held in memory by the last support bundle generation.",
+		}),
+		storedBundles: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "stored_bundles",
+			Help:      "Number of stored support bundles by state.",
+		}, []string{"state"}),
+		storedBytes: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "stored_bytes",
+			Help:      "Total size in bytes of the stored support bundle archives by organization.",
+		}, []string{"org_id"}),
+	}
+}
+
+// observeGeneration records the archive size and the peak memory of a finished generation.
+// It is a no-op on a nil receiver so services built without metrics keep working.
+func (m *bundleMetrics) observeGeneration(archiveBytes, peakBufferedBytes int64) {
+	if m == nil {
+		return
+	}
+	m.archiveBytes.Observe(float64(archiveBytes))
+	m.peakBufferedBytes.Set(float64(peakBufferedBytes))
+}
+
+// observeStorage sets the storage gauges from the state counters and the archive sizes of the stored
+// bundles. The organizations with the most bundles are labeled, the others are aggregated to bound
+// the cardinality.
+func (m *bundleMetrics) observeStorage(counts map[supportbundles.State]int, sizes []bundleSize) {
+	if m == nil {
+		return
+	}
+
+	perOrg := map[int64]int{}
+	for _, b := range sizes {
+		perOrg[b.OrgID]++
+	}
+	orgIDs := make([]int64, 0, len(perOrg))
+	for orgID := range perOrg {
+		orgIDs = append(orgIDs, orgID)
+	}
+	sort.Slice(orgIDs, func(i, j int) bool {
+		if perOrg[orgIDs[i]] != perOrg[orgIDs[j]] {
+			return perOrg[orgIDs[i]] > perOrg[orgIDs[j]]
+		}
+		return orgIDs[i] < orgIDs[j]
+	})
+	labeled := map[int64]bool{}
+	for i := 0; i < len(orgIDs) && i < maxOrgLabels; i++ {
+		labeled[orgIDs[i]] = true
+	}
+
+	for state, count := range counts {
+		m.storedBundles.WithLabelValues(state.String()).Set(float64(count))
+	}
+	// organizations without bundles since the last update must not be reported anymore
+	m.storedBytes.Reset()
+	for _, b := range sizes {
+		org := otherOrgLabel
+		if labeled[b.OrgID] {
+			org = strconv.FormatInt(b.OrgID, 10)
+		}
+		m.storedBytes.WithLabelValues(org).Add(float64(b.Size))
+	}
+}
+
+// reportStorageMetrics updates the storage gauges every storageMetricsInterval until ctx is done.
+func (s *Service) reportStorageMetrics(ctx context.Context) {
+	ticker := time.NewTicker(storageMetricsInterval)
+	defer ticker.Stop()
+	for {
+		s.updateStorageMetrics(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateStorageMetrics reads the state counters and the size of the bundles only, neither the bundles
+// nor their archives are decoded.
+func (s *Service) updateStorageMetrics(ctx context.Context) {
+	counts, err := s.store.CountByState(ctx)
+	if err != nil {
+		s.log.Warn("Failed to count support bundles for the storage metrics", "error", err)
+		return
+	}
+	sizes, err := s.store.ListSizes(ctx)
+	if err != nil {
+		s.log.Warn("Failed to list support bundle sizes for the storage metrics", "error", err)
+		return
+	}
+	s.metrics.observeStorage(counts, sizes)
+}
@@ -0,0 +1,78 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestBundleMetrics_observeStorage(t *testing.T) {
+	m := newBundleMetrics(prometheus.NewRegistry())
+
+	m.observeStorage(map[supportbundles.State]int{
+		supportbundles.StateComplete: 2,
+		supportbundles.StatePending:  1,
+		supportbundles.StateError:    1,
+	}, []bundleSize{
+		{OrgID: 1, Size: 100},
+		{OrgID: 1, Size: 50},
+		{OrgID: 1},
+		{OrgID: 2},
+	})
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.storedBundles.WithLabelValues("complete")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.storedBundles.WithLabelValues("pending")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.storedBundles.WithLabelValues("error")))
+	assert.Equal(t, 150.0, testutil.ToFloat64(m.storedBytes.WithLabelValues("1")))
+
+	t.Run("organizations past the limit are aggregated", func(t *testing.T) {
+		sizes := make([]bundleSize, 0, maxOrgLabels+2)
+		for orgID := int64(1); orgID <= maxOrgLabels+2; orgID++ {
+			sizes = append(sizes, bundleSize{OrgID: orgID, Size: 10})
+		}
+		m.observeStorage(map[supportbundles.State]int{supportbundles.StateComplete: len(sizes)}, sizes)
+
+		assert.Equal(t, maxOrgLabels+1, testutil.CollectAndCount(m.storedBytes))
+		assert.Equal(t, 20.0, testutil.ToFloat64(m.storedBytes.WithLabelValues(otherOrgLabel)))
+		assert.Equal(t, 10.0, testutil.ToFloat64(m.storedBytes.WithLabelValues(strconv.Itoa(maxOrgLabels))))
+	})
+
+	t.Run("removed bundles are no longer reported", func(t *testing.T) {
+		m.observeStorage(map[supportbundles.State]int{supportbundles.StateComplete: 0}, nil)
+		assert.Zero(t, testutil.ToFloat64(m.storedBundles.WithLabelValues("complete")))
+		assert.Zero(t, testutil.CollectAndCount(m.storedBytes))
+	})
+}
+
+func TestService_updateStorageMetrics(t *testing.T) {
+	bundles := newStore(kvstore.NewFakeKVStore())
+	s := &Service{
+		log:     log.New("test"),
+		store:   bundles,
+		metrics: newBundleMetrics(prometheus.NewRegistry()),
+	}
+	ctx := context.Background()
+
+	inline, _, err := bundles.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+	require.NoError(t, bundles.Update(ctx, inline.UID, supportbundles.StateComplete, []byte("inline bundle")))
+	_, _, err = bundles.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 2, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	s.updateStorageMetrics(ctx)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.storedBundles.WithLabelValues("complete")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.storedBundles.WithLabelValues("pending")))
+	assert.Equal(t, float64(len("inline bundle")), testutil.ToFloat64(s.metrics.storedBytes.WithLabelValues("1")))
+	assert.Zero(t, testutil.ToFloat64(s.metrics.storedBytes.WithLabelValues("2")))
+}
@@ -0,0 +1,143 @@
+package supportbundlesimpl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+// partialArchive holds the items collected by a pending generation until the bundle archive is
+// written. Items are appended as their collector completes, encrypted with the secrets service as
+// they are neither sanitized nor anonymized yet. The file outlives a restart so a resumed
+// generation keeps the items of the collectors that already ran.
+type partialArchive struct {
+	f       *os.File
+	secrets secrets.Service
+	// size is the size of the complete records, anything past it is discarded.
+	size int64
+}
+
+// openPartialArchive opens the partial archive referenced by the progress or creates one. The
+// progress is updated to reference the new archive, and to forget the completed collectors if
+// their items were lost with the previous one.
+func (s *Service) openPartialArchive(uid string, progress *bundleProgress) (*partialArchive, error) {
+	if progress.PartialArchive != "" {
+		f, err := os.OpenFile(progress.PartialArchive, os.O_RDWR, 0)
+		if err == nil {
+			// drop the item of a collector interrupted before its completion was persisted
+			if err := f.Truncate(progress.PartialSize); err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("failed to truncate partial support bundle archive: %w", err)
+			}
+			return &partialArchive{f: f, secrets: s.secrets, size: progress.PartialSize}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to open partial support bundle archive: %w", err)
+		}
+	}
+	if len(progress.Completed) > 0 {
+		s.log.Warn("Partial support bundle archive not found, collecting again", "uid", uid, "path", progress.PartialArchive)
+		progress.Completed = nil
+		progress.Timings = nil
+	}
+
+	if s.archiveDir != "" {
+		if err := os.MkdirAll(s.archiveDir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create support bundle directory: %w", err)
+		}
+	}
+	f, err := os.CreateTemp(s.archiveDir, uid+"-*.partial")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial support bundle archive: %w", err)
+	}
+	progress.PartialArchive = f.Name()
+	progress.PartialSize = 0
+
+	return &partialArchive{f: f, secrets: s.secrets}, nil
+}
+
+// append encrypts the item and writes it to the archive. The write is synced so the size
+// persisted with the progress never covers a record lost on a crash.
+func (p *partialArchive) append(ctx context.Context, item *supportbundles.SupportItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	encrypted, err := p.secrets.Encrypt(ctx, data, secrets.WithoutScope())
+	if err != nil {
+		return fmt.Errorf("failed to encrypt support bundle item: %w", err)
+	}
+
+	record := make([]byte, 8+len(encrypted))
+	binary.BigEndian.PutUint64(record, uint64(len(encrypted)))
+	copy(record[8:], encrypted)
+
+	if _, err := p.f.WriteAt(record, p.size); err != nil {
+		return err
+	}
+	if err := p.f.Sync(); err != nil {
+		return err
+	}
+	p.size += int64(len(record))
+	return nil
+}
+
+// items calls fn with every item of the archive, in the order they were appended. Items are
+// decrypted one at a time so a single item is held in memory.
+func (p *partialArchive) items(ctx context.Context, fn func(item *supportbundles.SupportItem) error) error {
+	r := bufio.NewReader(io.NewSectionReader(p.f, 0, p.size))
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read partial support bundle archive: %w", err)
+		}
+
+		length := binary.BigEndian.Uint64(header)
+		if length > uint64(p.size) {
+			return errors.New("corrupted partial support bundle archive")
+		}
+		encrypted := make([]byte, length)
+		if _, err := io.ReadFull(r, encrypted); err != nil {
+			return fmt.Errorf("failed to read partial support bundle archive: %w", err)
+		}
+		data, err := p.secrets.Decrypt(ctx, encrypted)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt support bundle item: %w", err)
+		}
+
+		var item supportbundles.SupportItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			return fmt.Errorf("failed to decode support bundle item: %w", err)
+		}
+		if err := fn(&item); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *partialArchive) Close() error {
+	return p.f.Close()
+}
+
+// removePartialArchive removes the partial archive at path, if any.
+func removePartialArchive(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
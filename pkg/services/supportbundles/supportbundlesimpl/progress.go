@@ -0,0 +1,148 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+// bundleProgress is the persisted state of a bundle generation. It is updated after
+// every collector so an interrupted generation can resume the remaining collectors.
+type bundleProgress struct {
+	// Collectors are the collectors requested on creation.
+	Collectors []string `json:"collectors"`
+	// Completed are the UIDs of the collectors that already ran.
+	Completed []string `json:"completed,omitempty"`
+	// PartialArchive is the path of the file holding the encrypted items of the completed collectors.
+	PartialArchive string `json:"partialArchive,omitempty"`
+	// PartialSize is the size of the partial archive once the items of the completed collectors
+	// were written to it.
+	PartialSize int64 `json:"partialSize,omitempty"`
+	// Timings are the timings of the completed collectors.
+	Timings []collectorTiming `json:"timings,omitempty"`
+	// Anonymize is set when the identities in the bundle are pseudonymized.
+	Anonymize bool `json:"anonymize,omitempty"`
+}
+
+func (p *bundleProgress) isCompleted(collectorUID string) bool {
+	for _, uid := range p.Completed {
+		if uid == collectorUID {
+			return true
+		}
+	}
+	return false
+}
+
+// resumePendingBundles resumes the generation of the bundles interrupted by a restart.
+// Pending bundles without persisted progress can't be resumed and are marked as failed
+// once they are older than the creation timeout.
+func (s *Service) resumePendingBundles(ctx context.Context) {
+	bundles, err := s.store.List()
+	if err != nil {
+		s.log.Error("Failed to list bundles to resume", "error", err)
+		return
+	}
+
+	for _, b := range bundles {
+		if b.State != supportbundles.StatePending {
+			continue
+		}
+
+		progress, err := s.store.GetProgress(ctx, b.UID)
+		if err != nil {
+			s.log.Error("Failed to get support bundle progress", "uid", b.UID, "error", err)
+			continue
+		}
+
+		if progress != nil {
+			s.log.Info("Resuming support bundle generation", "uid", b.UID, "completed", len(progress.Completed))
+			s.startGeneration(ctx, b.UID, progress.Collectors)
+			continue
+		}
+
+		if time.Since(time.Unix(b.CreatedAt, 0)) > bundleCreationTimeout {
+			s.log.Warn("Marking stuck support bundle as failed", "uid", b.UID)
+			if err := s.store.Fail(ctx, b.UID, "generation did not complete before the instance restarted"); err != nil {
+				s.log.Error("Failed to update stuck bundle", "uid", b.UID, "error", err)
+			}
+		}
+	}
+}
+
+// generationTracker tracks the collectors completed by the generations running on
+// this instance to report their progress while they are pending.
+type generationTracker struct {
+	mu          sync.Mutex
+	generations map[string]*trackedGeneration
+}
+
+type trackedGeneration struct {
+	completed int
+	total     int
+}
+
+func newGenerationTracker() *generationTracker {
+	return &generationTracker{generations: map[string]*trackedGeneration{}}
+}
+
+// start tracks a generation of total collectors, of which completed already ran
+// before an interruption. The methods are no-ops on a nil receiver.
+func (t *generationTracker) start(uid string, completed, total int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.generations[uid] = &trackedGeneration{completed: completed, total: total}
+}
+
+func (t *generationTracker) collectorDone(uid string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if g, ok := t.generations[uid]; ok && g.completed < g.total {
+		g.completed++
+	}
+}
+
+func (t *generationTracker) finish(uid string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.generations, uid)
+}
+
+// running returns true if the bundle is being generated on this instance.
+func (t *generationTracker) running(uid string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.generations[uid]
+	return ok
+}
+
+// percent returns the progress of a running generation. It stays below 100 as the
+// archive still has to be written and stored once every collector completed.
+func (t *generationTracker) percent(uid string) int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.generations[uid]
+	if !ok || g.total == 0 {
+		return 0
+	}
+	if g.completed >= g.total {
+		return 99
+	}
+	return g.completed * 100 / g.total
+}
@@ -0,0 +1,203 @@
+package supportbundlesimpl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestService_resumePendingBundles(t *testing.T) {
+	bundles := newStore(kvstore.NewFakeKVStore())
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		queue:          newGenerationQueue(1),
+		store:          bundles,
+		archiveDir:     t.TempDir(),
+	}
+
+	var firstCalls, secondCalls atomic.Int32
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "first",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			firstCalls.Add(1)
+			return &supportbundles.SupportItem{Filename: "first.txt", FileBytes: []byte("collected again")}, nil
+		},
+	})
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "second",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			secondCalls.Add(1)
+			return &supportbundles.SupportItem{Filename: "second.txt", FileBytes: []byte("second")}, nil
+		},
+	})
+
+	ctx := context.Background()
+	usr := &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}
+
+	// bundle interrupted after the first collector completed, while the second was being stored
+	partial, _, err := s.store.Create(ctx, usr, "")
+	require.NoError(t, err)
+	partialProgress := &bundleProgress{Collectors: []string{"first", "second"}}
+	archive, err := s.openPartialArchive(partial.UID, partialProgress)
+	require.NoError(t, err)
+	require.NoError(t, archive.append(ctx, &supportbundles.SupportItem{Filename: "first.txt", FileBytes: []byte("first")}))
+	partialProgress.Completed = []string{"first"}
+	partialProgress.PartialSize = archive.size
+	require.NoError(t, archive.append(ctx, &supportbundles.SupportItem{Filename: "second.txt", FileBytes: []byte("interrupted")}))
+	require.NoError(t, archive.Close())
+	require.NoError(t, s.store.SetProgress(ctx, partial.UID, partialProgress))
+
+	// bundle stuck in pending without any progress
+	stuck, _, err := s.store.Create(ctx, usr, "")
+	require.NoError(t, err)
+	stuck.CreatedAt = time.Now().Add(-2 * bundleCreationTimeout).Unix()
+	require.NoError(t, bundles.set(ctx, stuck))
+
+	// recent bundle without progress is left alone
+	recent, _, err := s.store.Create(ctx, usr, "")
+	require.NoError(t, err)
+
+	s.resumePendingBundles(ctx)
+
+	// the progress is removed once the generation is done
+	require.Eventually(t, func() bool {
+		progress, err := s.store.GetProgress(ctx, partial.UID)
+		return err == nil && progress == nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Zero(t, firstCalls.Load())
+	assert.Equal(t, int32(1), secondCalls.Load())
+
+	resumed, err := s.store.Get(ctx, partial.UID)
+	require.NoError(t, err)
+	require.Equal(t, supportbundles.StateComplete, resumed.State)
+	files := filesInTar(t, readArchive(t, s, resumed.UID))
+	assert.Equal(t, "first", files["/bundle/first.txt"])
+	assert.Equal(t, "second", files["/bundle/second.txt"])
+	assert.NoFileExists(t, partialProgress.PartialArchive, "the partial archive is removed with the progress")
+
+	stuckBundle, err := s.store.Get(ctx, stuck.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StateError, stuckBundle.State)
+
+	recentBundle, err := s.store.Get(ctx, recent.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StatePending, recentBundle.State)
+}
+
+func filesInTar(t *testing.T, tarBytes []byte) map[string]string {
+	t.Helper()
+
+	gr, err := gzip.NewReader(bytes.NewReader(tarBytes))
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(data)
+	}
+	return files
+}
+
+// blockingStore holds UpdateArchive until released to observe a generation before its archive is stored.
+type blockingStore struct {
+	bundleStore
+	storing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) UpdateArchive(ctx context.Context, uid string, state supportbundles.State, archive ArchiveMeta) error {
+	close(b.storing)
+	<-b.release
+	return b.bundleStore.UpdateArchive(ctx, uid, state, archive)
+}
+
+func TestService_generationProgress(t *testing.T) {
+	store := &blockingStore{
+		bundleStore: newStore(kvstore.NewFakeKVStore()),
+		storing:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		queue:          newGenerationQueue(1),
+		generations:    newGenerationTracker(),
+		store:          store,
+		archiveDir:     t.TempDir(),
+	}
+
+	// each collector waits for the test to let it complete
+	steps := make(chan struct{})
+	collectors := []string{"a", "b", "c", "d"}
+	for _, uid := range collectors {
+		uid := uid
+		s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+			UID: uid,
+			Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+				<-steps
+				return &supportbundles.SupportItem{Filename: uid + ".txt", FileBytes: []byte(uid)}, nil
+			},
+		})
+	}
+
+	ctx := context.Background()
+	bundle, err := s.create(ctx, collectors, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "", false)
+	require.NoError(t, err)
+
+	progress := func() int {
+		b, err := s.get(ctx, bundle.UID)
+		require.NoError(t, err)
+		return b.Progress
+	}
+
+	assert.Zero(t, progress())
+	for _, expected := range []int{25, 50, 75} {
+		steps <- struct{}{}
+		require.Eventually(t, func() bool { return progress() == expected }, time.Second, 5*time.Millisecond)
+	}
+
+	// every collector completed but the archive isn't stored yet
+	steps <- struct{}{}
+	<-store.storing
+	b, err := s.get(ctx, bundle.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StatePending, b.State)
+	assert.Equal(t, 99, b.Progress)
+
+	close(store.release)
+	require.Eventually(t, func() bool {
+		b, err := s.get(ctx, bundle.UID)
+		return err == nil && b.State == supportbundles.StateComplete && b.Progress == 100
+	}, time.Second, 5*time.Millisecond)
+}
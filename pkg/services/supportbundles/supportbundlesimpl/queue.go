@@ -0,0 +1,116 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// generationQueue limits the number of support bundles generated at the same time.
+// Bundles that can't start right away wait in FIFO order, which allows reporting
+// their position in the queue while they wait.
+type generationQueue struct {
+	mu            sync.Mutex
+	maxConcurrent int
+	running       int
+	waiting       []*queuedGeneration
+
+	// avgDuration is a moving average of completed generation durations,
+	// used to estimate when a queued bundle will start.
+	avgDuration time.Duration
+}
+
+type queuedGeneration struct {
+	uid   string
+	ready chan struct{}
+}
+
+func newGenerationQueue(maxConcurrent int) *generationQueue {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	return &generationQueue{maxConcurrent: maxConcurrent}
+}
+
+// acquire blocks until the bundle with the given uid is allowed to start generating.
+// Every successful acquire must be followed by a release.
+func (q *generationQueue) acquire(ctx context.Context, uid string) error {
+	q.mu.Lock()
+	if q.running < q.maxConcurrent && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+
+	entry := &queuedGeneration{uid: uid, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, entry)
+	q.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, w := range q.waiting {
+			if w == entry {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// the slot was handed over while the context was cancelled, give it back.
+		q.releaseLocked()
+		return ctx.Err()
+	}
+}
+
+// release frees the slot held by a generation that took the given time to complete
+// and hands it over to the next bundle in the queue.
+func (q *generationQueue) release(took time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.avgDuration == 0 {
+		q.avgDuration = took
+	} else {
+		q.avgDuration = (q.avgDuration*3 + took) / 4
+	}
+
+	q.releaseLocked()
+}
+
+func (q *generationQueue) releaseLocked() {
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+
+	// the slot is handed over directly, running stays the same
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+}
+
+// position returns the 1-based position of the bundle in the queue and an estimate
+// of when it will start generating. A position of 0 means the bundle isn't queued.
+func (q *generationQueue) position(uid string) (int, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, w := range q.waiting {
+		if w.uid != uid {
+			continue
+		}
+
+		position := i + 1
+		if q.avgDuration == 0 {
+			return position, time.Time{}
+		}
+
+		rounds := (position-1)/q.maxConcurrent + 1
+		return position, time.Now().Add(time.Duration(rounds) * q.avgDuration)
+	}
+
+	return 0, time.Time{}
+}
@@ -0,0 +1,132 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestGenerationQueue_Position(t *testing.T) {
+	q := newGenerationQueue(1)
+	require.NoError(t, q.acquire(context.Background(), "a"))
+
+	acquired := make(chan string, 2)
+	for _, uid := range []string{"b", "c"} {
+		uid := uid
+		go func() {
+			_ = q.acquire(context.Background(), uid)
+			acquired <- uid
+		}()
+		// make sure the bundle is queued before enqueuing the next one
+		require.Eventually(t, func() bool {
+			position, _ := q.position(uid)
+			return position > 0
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	assertPosition(t, q, "a", 0)
+	assertPosition(t, q, "b", 1)
+	assertPosition(t, q, "c", 2)
+
+	q.release(time.Minute)
+	assert.Equal(t, "b", <-acquired)
+	assertPosition(t, q, "b", 0)
+	assertPosition(t, q, "c", 1)
+
+	_, estimatedStart := q.position("c")
+	assert.False(t, estimatedStart.IsZero())
+
+	q.release(time.Minute)
+	assert.Equal(t, "c", <-acquired)
+	assertPosition(t, q, "c", 0)
+}
+
+func TestGenerationQueue_ConcurrentEnqueue(t *testing.T) {
+	const n = 10
+	q := newGenerationQueue(1)
+	require.NoError(t, q.acquire(context.Background(), "running"))
+
+	acquired := make(chan string, n)
+	for i := 0; i < n; i++ {
+		uid := fmt.Sprintf("bundle-%d", i)
+		go func() {
+			_ = q.acquire(context.Background(), uid)
+			acquired <- uid
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.waiting) == n
+	}, time.Second, 10*time.Millisecond)
+
+	// every queued bundle has a distinct position
+	positions := make([]int, 0, n)
+	byPosition := make(map[int]string, n)
+	for i := 0; i < n; i++ {
+		uid := fmt.Sprintf("bundle-%d", i)
+		position, _ := q.position(uid)
+		positions = append(positions, position)
+		byPosition[position] = uid
+	}
+	sort.Ints(positions)
+	for i, position := range positions {
+		assert.Equal(t, i+1, position)
+	}
+
+	// bundles start in the order of their reported position
+	for position := 1; position <= n; position++ {
+		q.release(time.Second)
+		assert.Equal(t, byPosition[position], <-acquired)
+	}
+}
+
+func TestService_getQueuedBundle(t *testing.T) {
+	s := &Service{
+		tracer: tracing.InitializeTracerForTest(),
+		log:    log.New("test"),
+		queue:  newGenerationQueue(1),
+		store:  newStore(kvstore.NewFakeKVStore()),
+	}
+
+	bundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.queue.acquire(context.Background(), "other"))
+	go func() {
+		_ = s.queue.acquire(context.Background(), bundle.UID)
+	}()
+
+	require.Eventually(t, func() bool {
+		b, err := s.get(context.Background(), bundle.UID)
+		return err == nil && b.QueuePosition == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// queue information is not persisted
+	stored, err := s.store.Get(context.Background(), bundle.UID)
+	require.NoError(t, err)
+	assert.Zero(t, stored.QueuePosition)
+
+	s.queue.release(time.Second)
+	require.Eventually(t, func() bool {
+		b, err := s.get(context.Background(), bundle.UID)
+		return err == nil && b.QueuePosition == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func assertPosition(t *testing.T, q *generationQueue, uid string, expected int) {
+	t.Helper()
+	position, _ := q.position(uid)
+	assert.Equal(t, expected, position)
+}
@@ -0,0 +1,112 @@
+package supportbundlesimpl
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+// defaultSanitizePatterns match common token and key formats.
+var defaultSanitizePatterns = []string{
+	// Grafana service account tokens and API keys
+	`glsa_[A-Za-z0-9]{32}_[A-Fa-f0-9]{8}`,
+	`eyJrIjoi[A-Za-z0-9+/=]+`,
+	// JSON web tokens
+	`eyJ[A-Za-z0-9_\-]+\.eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+`,
+	// AWS access keys
+	`(?:AKIA|ASIA)[0-9A-Z]{16}`,
+	// GitHub and Slack tokens
+	`gh[pousr]_[A-Za-z0-9]{36}`,
+	`xox[abposr]-[A-Za-z0-9\-]{10,}`,
+}
+
+// sanitizeSniffLen is how much of a file is inspected to tell text from binary content.
+const sanitizeSniffLen = 8000
+
+var redactedValue = []byte("[REDACTED]")
+
+// bundleSanitizer masks the matches of the configured patterns in the text files of a bundle.
+type bundleSanitizer struct {
+	patterns []*regexp.Regexp
+}
+
+// newBundleSanitizer compiles the patterns, the default patterns are used when none are configured.
+// Invalid patterns are logged and skipped.
+func newBundleSanitizer(patterns []string, logger log.Logger) *bundleSanitizer {
+	if len(patterns) == 0 {
+		patterns = defaultSanitizePatterns
+	}
+
+	s := &bundleSanitizer{patterns: make([]*regexp.Regexp, 0, len(patterns))}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Error("Ignoring invalid support bundle sanitize pattern", "pattern", pattern, "error", err)
+			continue
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s
+}
+
+// isText reports whether data looks like text, binary files contain NUL bytes.
+func isText(data []byte) bool {
+	if len(data) > sanitizeSniffLen {
+		data = data[:sanitizeSniffLen]
+	}
+	return bytes.IndexByte(data, 0) == -1
+}
+
+// size returns the size of data once sanitized, without holding the sanitized data.
+func (s *bundleSanitizer) size(data []byte) int64 {
+	var size int64
+	forEachLine(data, func(line []byte) {
+		sanitized, _ := s.sanitizeLine(line)
+		size += int64(len(sanitized))
+	})
+	return size
+}
+
+// write writes data sanitized line by line to w and returns the number of redactions.
+func (s *bundleSanitizer) write(w io.Writer, data []byte) (int, error) {
+	var (
+		redactions int
+		err        error
+	)
+	forEachLine(data, func(line []byte) {
+		if err != nil {
+			return
+		}
+		sanitized, n := s.sanitizeLine(line)
+		redactions += n
+		_, err = w.Write(sanitized)
+	})
+	return redactions, err
+}
+
+func (s *bundleSanitizer) sanitizeLine(line []byte) ([]byte, int) {
+	var redactions int
+	for _, re := range s.patterns {
+		matches := len(re.FindAllIndex(line, -1))
+		if matches == 0 {
+			continue
+		}
+		redactions += matches
+		line = re.ReplaceAllLiteral(line, redactedValue)
+	}
+	return line, redactions
+}
+
+// forEachLine calls fn with each line of data, including its line break.
+func forEachLine(data []byte, fn func(line []byte)) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		fn(data[:end])
+		data = data[end:]
+	}
+}
@@ -3,26 +3,31 @@ package supportbundlesimpl
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
 	grafanaApi "github.com/grafana/grafana/pkg/api"
 	"github.com/grafana/grafana/pkg/api/routing"
 	"github.com/grafana/grafana/pkg/infra/db"
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/infra/usagestats"
 	ac "github.com/grafana/grafana/pkg/services/accesscontrol"
 	"github.com/grafana/grafana/pkg/services/auth/identity"
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
 	"github.com/grafana/grafana/pkg/services/pluginsintegration/pluginsettings"
 	"github.com/grafana/grafana/pkg/services/pluginsintegration/pluginstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
 	"github.com/grafana/grafana/pkg/services/supportbundles"
 	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
 	"github.com/grafana/grafana/pkg/setting"
 )
 
 const (
-	cleanUpInterval       = 24 * time.Hour
 	bundleCreationTimeout = 20 * time.Minute
 )
 
@@ -33,13 +38,46 @@ type Service struct {
 	features       *featuremgmt.FeatureManager
 	pluginSettings pluginsettings.Service
 	pluginStore    pluginstore.Store
+	queue          *generationQueue
+	generations    *generationTracker
+	inflight       *inflightGenerations
 	store          bundleStore
+	tracer         tracing.Tracer
+	// secrets encrypts the items of pending generations until they are written to the bundle archive.
+	secrets secrets.Service
 
 	log                  log.Logger
+	metrics              *bundleMetrics
 	encryptionPublicKeys []string
 
+	// signer signs generated bundles, bundles are not signed when nil.
+	signer *bundleSigner
+	// sanitizer masks secrets in the text files of generated bundles, bundles are not sanitized when nil.
+	sanitizer *bundleSanitizer
+	// anonymizer pseudonymizes identities in the bundles created with anonymize.
+	anonymizer *bundleAnonymizer
+
+	// archiveDir is where generated archives are written, the temp dir is used when empty.
+	archiveDir      string
+	maxArchiveBytes int64
+	// importRoot is the directory bundles can be imported from with ImportFromPath, imports are disabled when empty.
+	importRoot string
+
+	// downloadFilenameTemplate is the filename of downloaded archives, without extension.
+	downloadFilenameTemplate string
+
+	cleanupInterval time.Duration
+	cleanupJitter   time.Duration
+	// cleanupLock makes a single replica sweep expired bundles, every replica sweeps when nil.
+	cleanupLock *cleanupLock
+	// pendingGracePeriod is how long a bundle can stay pending before the cleanup marks it as failed.
+	pendingGracePeriod time.Duration
+
 	enabled         bool
 	serverAdminOnly bool
+	// dropRestricted drops collectors restricted to other organizations from
+	// the selection instead of rejecting the bundle creation.
+	dropRestricted bool
 }
 
 func ProvideService(
@@ -52,23 +90,62 @@ func ProvideService(
 	kvStore kvstore.KVStore,
 	pluginSettings pluginsettings.Service,
 	pluginStore pluginstore.Store,
+	promRegister prometheus.Registerer,
 	routeRegister routing.RouteRegister,
+	secretsService secrets.Service,
 	settings setting.Provider,
 	sql db.DB,
+	tracer tracing.Tracer,
 	usageStats usagestats.Service) (*Service, error) {
 	section := cfg.SectionWithEnvOverrides("support_bundles")
+	cleanupInterval := section.Key("cleanup_interval").MustDuration(defaultCleanupInterval)
+	if cleanupInterval <= 0 {
+		cleanupInterval = defaultCleanupInterval
+	}
+	pendingGracePeriod := section.Key("pending_grace_period").MustDuration(defaultPendingGracePeriod)
+	if pendingGracePeriod <= bundleCreationTimeout {
+		log.New("supportbundle.service").Warn("Support bundle pending grace period must exceed the generation timeout, using the default",
+			"pending_grace_period", pendingGracePeriod, "generation_timeout", bundleCreationTimeout)
+		pendingGracePeriod = defaultPendingGracePeriod
+	}
+
 	s := &Service{
 		accessControl:        accessControl,
+		archiveDir:           filepath.Join(cfg.DataPath, "support_bundles"),
 		bundleRegistry:       bundleRegistry,
 		cfg:                  cfg,
+		cleanupInterval:      cleanupInterval,
+		cleanupJitter:        section.Key("cleanup_jitter").MustDuration(defaultCleanupJitter),
+		cleanupLock:          newCleanupLock(kvStore, cleanupInterval),
+		dropRestricted:       section.Key("restricted_collectors").In("reject", []string{"reject", "drop"}) == "drop",
 		enabled:              section.Key("enabled").MustBool(true),
 		encryptionPublicKeys: section.Key("public_keys").Strings(" "),
 		features:             features,
+		generations:          newGenerationTracker(),
+		inflight:             newInflightGenerations(),
 		log:                  log.New("supportbundle.service"),
+		maxArchiveBytes:      section.Key("max_archive_size_bytes").MustInt64(0),
+		metrics:              newBundleMetrics(promRegister),
+		pendingGracePeriod:   pendingGracePeriod,
 		pluginSettings:       pluginSettings,
 		pluginStore:          pluginStore,
+		secrets:              secretsService,
+		queue:                newGenerationQueue(section.Key("max_concurrent_generations").MustInt(2)),
 		serverAdminOnly:      section.Key("server_admin_only").MustBool(true),
 		store:                newStore(kvStore),
+		tracer:               tracer,
+	}
+
+	s.downloadFilenameTemplate = section.Key("download_filename_template").MustString(defaultDownloadFilenameTemplate)
+	s.importRoot = section.Key("import_allowed_root").MustString("")
+	s.anonymizer = newBundleAnonymizer(section.Key("anonymize_fields").Strings(" "), section.Key("anonymize_salt").String())
+
+	if section.Key("sign_bundles").MustBool(false) {
+		s.signer = newBundleSigner(kvStore, secretsService)
+	}
+
+	if section.Key("sanitize_contents").MustBool(false) {
+		s.sanitizer = newBundleSanitizer(section.Key("sanitize_patterns").Strings(" "), s.log)
 	}
 
 	usageStats.RegisterMetricsFunc(s.getUsageStats)
@@ -88,6 +165,7 @@ func ProvideService(
 	s.bundleRegistry.RegisterSupportItemCollector(settingsCollector(settings))
 	s.bundleRegistry.RegisterSupportItemCollector(dbCollector(sql))
 	s.bundleRegistry.RegisterSupportItemCollector(pluginInfoCollector(pluginStore, pluginSettings, s.log))
+	s.bundleRegistry.RegisterSupportItemCollector(logCollector(readLogCollectorConfig(cfg)))
 
 	return s, nil
 }
@@ -97,45 +175,143 @@ func (s *Service) Run(ctx context.Context) error {
 		return nil
 	}
 
-	ticker := time.NewTicker(cleanUpInterval)
-	defer ticker.Stop()
-	s.cleanup(ctx)
+	if err := s.store.ReconcileStateCounts(ctx); err != nil {
+		s.log.Warn("Failed to reconcile support bundle state counts", "error", err)
+	}
+	s.resumePendingBundles(ctx)
+	go s.reportStorageMetrics(ctx)
+
 	select {
-	case <-ticker.C:
-		s.cleanup(ctx)
+	case <-time.After(s.startupJitter()):
 	case <-ctx.Done():
-		break
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(s.cleanupInterval)
+	defer ticker.Stop()
+	for {
+		s.sweep(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return ctx.Err()
 }
 
-func (s *Service) create(ctx context.Context, collectors []string, usr identity.Requester) (*supportbundles.Bundle, error) {
-	bundle, err := s.store.Create(ctx, usr)
+func (s *Service) create(ctx context.Context, collectors []string, usr identity.Requester, idempotencyKey string, anonymize bool) (*supportbundles.Bundle, error) {
+	collectors, err := s.checkOrgRestrictions(collectors, usr.GetOrgID())
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, created, err := s.store.Create(ctx, usr, idempotencyKey)
 	if err != nil {
 		return nil, err
 	}
 
-	go func(uid string, collectors []string) {
-		ctx, cancel := context.WithTimeout(context.Background(), bundleCreationTimeout)
+	if !created {
+		// a bundle with the same idempotency key is already being generated
+		s.setQueueStatus(bundle)
+		return bundle, nil
+	}
+
+	// persist the requested collectors so the generation can be resumed after a restart
+	if err := s.store.SetProgress(ctx, bundle.UID, &bundleProgress{Collectors: collectors, Anonymize: anonymize}); err != nil {
+		if anonymize {
+			// the bundle would be generated without being anonymized
+			if err := s.store.Fail(ctx, bundle.UID, "failed to persist anonymize option"); err != nil {
+				s.log.Error("Failed to update bundle after error", "uid", bundle.UID, "error", err)
+			}
+			return nil, err
+		}
+		s.log.Warn("Failed to persist support bundle progress", "uid", bundle.UID, "error", err)
+	}
+
+	s.startGeneration(ctx, bundle.UID, collectors)
+	return bundle, nil
+}
+
+// startGeneration generates the bundle in the background once a generation slot is available.
+// The generation outlives ctx, only its span is kept so the generation is traced under it.
+// If the bundle is already queued or generating on this instance, the handle of that generation
+// is returned and no other generation is started.
+func (s *Service) startGeneration(ctx context.Context, uid string, collectors []string) *generationHandle {
+	handle, started := s.inflight.start(uid)
+	if !started {
+		s.log.Debug("Support bundle is already being generated", "uid", uid)
+		return handle
+	}
+
+	parent := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	go func() {
+		defer s.inflight.finish(handle)
+
+		// wait for a free generation slot, the creation timeout only applies once generation starts
+		_ = s.queue.acquire(context.Background(), uid)
+		start := time.Now()
+
+		ctx, cancel := context.WithTimeout(parent, bundleCreationTimeout)
 		defer func() {
 			if err := recover(); err != nil {
 				s.log.Error("Support bundle collection panic", "err", err)
 			}
 			cancel()
+			s.queue.release(time.Since(start))
 		}()
 
 		s.startBundleWork(ctx, collectors, uid)
-	}(bundle.UID, collectors)
+	}()
+	return handle
+}
+
+func (s *Service) get(ctx context.Context, uid string) (*supportbundles.Bundle, error) {
+	// read the progress before the state so a generation finishing in between reports 100
+	percent := s.generations.percent(uid)
+	bundle, err := s.store.Get(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
 
+	s.setQueueStatus(bundle)
+	s.setProgress(bundle, percent)
 	return bundle, nil
 }
 
-func (s *Service) get(ctx context.Context, uid string) (*supportbundles.Bundle, error) {
-	return s.store.Get(ctx, uid)
+func (s *Service) list(ctx context.Context, filter ListFilter) ([]supportbundles.Bundle, error) {
+	bundles, err := s.store.ListFiltered(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range bundles {
+		s.setQueueStatus(&bundles[i])
+		s.setProgress(&bundles[i], s.generations.percent(bundles[i].UID))
+	}
+	return bundles, nil
+}
+
+// setProgress sets the transient generation progress of a bundle. It is only 100
+// once the bundle reached a terminal state.
+func (s *Service) setProgress(bundle *supportbundles.Bundle, percent int) {
+	if bundle.State != supportbundles.StatePending {
+		bundle.Progress = 100
+		return
+	}
+	bundle.Progress = percent
 }
 
-func (s *Service) list(ctx context.Context) ([]supportbundles.Bundle, error) {
-	return s.store.List()
+// setQueueStatus sets the transient queue information of a pending bundle.
+func (s *Service) setQueueStatus(bundle *supportbundles.Bundle) {
+	if s.queue == nil || bundle.State != supportbundles.StatePending {
+		return
+	}
+
+	position, estimatedStart := s.queue.position(bundle.UID)
+	bundle.QueuePosition = position
+	if !estimatedStart.IsZero() {
+		bundle.EstimatedStart = estimatedStart.Unix()
+	}
 }
 
 func (s *Service) remove(ctx context.Context, uid string) error {
@@ -150,17 +326,25 @@ func (s *Service) remove(ctx context.Context, uid string) error {
 		return fmt.Errorf("could not remove a support bundle with uid %s as it is still being created", uid)
 	}
 
+	if s.signer != nil {
+		if err := s.signer.removeSignature(ctx, uid); err != nil {
+			s.log.Warn("Failed to remove support bundle signature", "uid", uid, "error", err)
+		}
+	}
+
 	// Remove the KV store entry
 	return s.store.Remove(ctx, uid)
 }
 
 func (s *Service) cleanup(ctx context.Context) {
-	bundles, err := s.list(ctx)
+	bundles, err := s.list(ctx, ListFilter{})
 	if err != nil {
 		s.log.Error("Failed to list bundles to clean up", "error", err)
 	}
 
 	if err == nil {
+		s.reapStalePending(ctx, bundles)
+
 		for _, b := range bundles {
 			if time.Now().Unix() >= b.ExpiresAt {
 				if err := s.remove(ctx, b.UID); err != nil {
@@ -169,6 +353,13 @@ func (s *Service) cleanup(ctx context.Context) {
 			}
 		}
 	}
+
+	reclaimed, err := s.store.Compact(ctx)
+	if err != nil {
+		s.log.Error("Failed to compact support bundle store", "error", err)
+	} else if reclaimed > 0 {
+		s.log.Info("Removed orphaned support bundle keys", "count", reclaimed)
+	}
 }
 
 func (s *Service) getUsageStats(ctx context.Context) (map[string]interface{}, error) {
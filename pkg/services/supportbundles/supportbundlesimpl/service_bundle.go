@@ -5,27 +5,63 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"time"
 
 	"filippo.io/age"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
 	"github.com/grafana/grafana/pkg/services/supportbundles"
 )
 
-var ErrCollectorPanicked = errors.New("collector panicked")
+var (
+	ErrCollectorPanicked = errors.New("collector panicked")
+	// ErrCollectorRestricted is returned when a requested collector isn't allowed for the organization of the bundle.
+	ErrCollectorRestricted = errors.New("collector is restricted to other organizations")
+
+	errArchiveTooLarge = errors.New("support bundle archive exceeds the maximum size")
+)
 
 type bundleResult struct {
-	tarBytes []byte
-	err      error
+	archive *bundleArchive
+	err     error
+}
+
+// bundleArchive is a generated bundle archive written to disk.
+type bundleArchive struct {
+	path string
+	size int64
+	// peakBuffered is the peak number of collected bytes held in memory during generation.
+	peakBuffered int64
+	// checksum is the SHA-256 of the archive.
+	checksum []byte
+	// encrypted is set when the archive was encrypted for the configured recipients.
+	encrypted bool
 }
 
 func (s *Service) startBundleWork(ctx context.Context, collectors []string, uid string) {
-	result := make(chan bundleResult)
+	ctx, span := s.tracer.Start(ctx, "supportbundles.generate")
+	span.SetAttributes("uid", uid, attribute.Key("uid").String(uid))
+	state := supportbundles.StateError
+	defer func() {
+		span.SetAttributes("state", state.String(), attribute.Key("state").String(state.String()))
+		if state != supportbundles.StateComplete {
+			span.SetStatus(codes.Error, "support bundle generation ended in state "+state.String())
+		}
+		span.End()
+	}()
+
+	result := make(chan bundleResult, 1)
 
 	go func() {
 		defer func() {
@@ -35,137 +71,438 @@ func (s *Service) startBundleWork(ctx context.Context, collectors []string, uid
 			}
 		}()
 
-		bundleBytes, err := s.bundle(ctx, collectors, uid)
+		archive, err := s.writeArchive(ctx, collectors, uid)
 		if err != nil {
 			result <- bundleResult{err: err}
+			return
+		}
+		result <- bundleResult{archive: archive}
+	}()
+
+	// the progress is only needed while the bundle is pending, it is dropped once the terminal state is stored
+	defer func() {
+		s.generations.finish(uid)
+		if err := s.store.RemoveProgress(context.Background(), uid); err != nil {
+			s.log.Warn("Failed to remove support bundle progress", "uid", uid, "error", err)
 		}
-		result <- bundleResult{tarBytes: bundleBytes}
-		close(result)
 	}()
 
 	select {
 	case <-ctx.Done():
 		s.log.Warn("Context cancelled while collecting support bundle")
+		state = supportbundles.StateTimeout
 		if err := s.store.Update(ctx, uid, supportbundles.StateTimeout, nil); err != nil {
 			s.log.Error("Failed to update bundle after timeout")
 		}
+		// the archive may still be written after the timeout
+		go func() {
+			if r := <-result; r.archive != nil {
+				s.removeArchive(r.archive.path)
+			}
+		}()
 		return
 	case r := <-result:
 		if r.err != nil {
 			s.log.Error("Failed to make bundle", "error", r.err, "uid", uid)
-			if err := s.store.Update(ctx, uid, supportbundles.StateError, nil); err != nil {
+			if err := s.store.Fail(ctx, uid, r.err.Error()); err != nil {
 				s.log.Error("Failed to update bundle after error")
 			}
 			return
 		}
-		if err := s.store.Update(ctx, uid, supportbundles.StateComplete, r.tarBytes); err != nil {
+		s.metrics.observeGeneration(r.archive.size, r.archive.peakBuffered)
+		if s.signer != nil {
+			// the bundle is only complete once signed so every downloadable bundle has a signature
+			if err := s.signer.sign(ctx, uid, r.archive.checksum); err != nil {
+				s.log.Error("Failed to sign bundle", "error", err, "uid", uid)
+				s.removeArchive(r.archive.path)
+				if err := s.store.Fail(ctx, uid, "failed to sign bundle: "+err.Error()); err != nil {
+					s.log.Error("Failed to update bundle after error")
+				}
+				return
+			}
+		}
+		meta := ArchiveMeta{Path: r.archive.path, Checksum: hex.EncodeToString(r.archive.checksum), Encrypted: r.archive.encrypted}
+		if err := s.store.UpdateArchive(ctx, uid, supportbundles.StateComplete, meta); err != nil {
 			s.log.Error("Failed to update bundle after completion")
+			s.removeArchive(r.archive.path)
+			return
 		}
+		state = supportbundles.StateComplete
 		return
 	}
 }
 
-func (s *Service) bundle(ctx context.Context, collectors []string, uid string) ([]byte, error) {
+// writeArchive generates the bundle into a file. The archive is streamed through
+// compression and encryption to the file and is never held in memory as a whole.
+func (s *Service) writeArchive(ctx context.Context, collectors []string, uid string) (archive *bundleArchive, err error) {
+	if s.archiveDir != "" {
+		if err := os.MkdirAll(s.archiveDir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create support bundle directory: %w", err)
+		}
+	}
+
+	f, err := os.CreateTemp(s.archiveDir, uid+"-*.tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create support bundle archive: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		// also covers a collector panic, where no archive is returned
+		if err != nil || archive == nil {
+			s.removeArchive(f.Name())
+		}
+	}()
+
+	h := sha256.New()
+	w := &archiveWriter{w: io.MultiWriter(f, h), limit: s.maxArchiveBytes}
+	peakBuffered, err := s.bundle(ctx, collectors, uid, w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundleArchive{
+		path:         f.Name(),
+		size:         w.written,
+		peakBuffered: peakBuffered,
+		checksum:     h.Sum(nil),
+		encrypted:    len(s.encryptionPublicKeys) > 0,
+	}, nil
+}
+
+func (s *Service) removeArchive(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.log.Warn("Failed to remove support bundle archive", "path", path, "error", err)
+	}
+}
+
+// archiveWriter counts the bytes written to an archive and enforces the maximum archive size.
+type archiveWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (a *archiveWriter) Write(p []byte) (int, error) {
+	if a.limit > 0 && a.written+int64(len(p)) > a.limit {
+		return 0, errArchiveTooLarge
+	}
+
+	n, err := a.w.Write(p)
+	a.written += int64(n)
+	return n, err
+}
+
+// selectedCollectors returns the registered collectors matching the selection
+// together with the collectors that are always included, sorted by UID.
+// Collectors restricted to other organizations are left out.
+func (s *Service) selectedCollectors(collectors []string, orgID int64) []supportbundles.Collector {
 	lookup := make(map[string]bool, len(collectors))
 	for _, c := range collectors {
 		lookup[c] = true
 	}
 
-	files := map[string][]byte{}
-
+	selected := make([]supportbundles.Collector, 0, len(collectors))
 	for _, collector := range s.bundleRegistry.Collectors() {
 		if !lookup[collector.UID] && !collector.IncludedByDefault {
 			continue
 		}
-		item, err := collector.Fn(ctx)
+		if !collector.AllowedForOrg(orgID) {
+			continue
+		}
+		selected = append(selected, collector)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].UID < selected[j].UID
+	})
+	return selected
+}
+
+// checkOrgRestrictions validates that bundles created in the organization can include the requested
+// collectors. Restricted collectors are rejected or, when configured, dropped from the selection.
+func (s *Service) checkOrgRestrictions(collectors []string, orgID int64) ([]string, error) {
+	registered := s.bundleRegistry.Collectors()
+	allowed := make([]string, 0, len(collectors))
+
+	for _, uid := range collectors {
+		collector, ok := registered[uid]
+		if !ok || collector.AllowedForOrg(orgID) {
+			allowed = append(allowed, uid)
+			continue
+		}
+
+		if !s.dropRestricted {
+			return nil, fmt.Errorf("%w: %s is not available in organization %d", ErrCollectorRestricted, uid, orgID)
+		}
+		s.log.Info("Dropping support bundle collector restricted to other organizations", "collector", uid, "orgID", orgID)
+	}
+
+	return allowed, nil
+}
+
+// PreflightCollectors reports for each selected collector whether it is able to run
+// right now, without collecting anything.
+func (s *Service) PreflightCollectors(ctx context.Context, collectors []string, orgID int64) []supportbundles.CollectorPreflight {
+	registered := s.bundleRegistry.Collectors()
+	result := make([]supportbundles.CollectorPreflight, 0, len(collectors))
+
+	for _, uid := range collectors {
+		collector, ok := registered[uid]
+		if !ok {
+			result = append(result, supportbundles.CollectorPreflight{UID: uid, Reason: "unknown collector"})
+			continue
+		}
+		if !collector.AllowedForOrg(orgID) {
+			result = append(result, supportbundles.CollectorPreflight{
+				UID:         uid,
+				DisplayName: collector.DisplayName,
+				Reason:      ErrCollectorRestricted.Error(),
+			})
+		}
+	}
+
+	for _, collector := range s.selectedCollectors(collectors, orgID) {
+		preflight := supportbundles.CollectorPreflight{
+			UID:         collector.UID,
+			DisplayName: collector.DisplayName,
+			Runnable:    true,
+		}
+
+		if collector.Preflight != nil {
+			if err := collector.Preflight(ctx); err != nil {
+				preflight.Runnable = false
+				preflight.Reason = err.Error()
+			}
+		}
+
+		result = append(result, preflight)
+	}
+
+	return result
+}
+
+// bundle runs the collectors and writes the resulting archive to w. Items are stored in the partial
+// archive as their collector completes and streamed to w once every collector ran, so a single item
+// is held in memory at a time. It returns the size of the largest item.
+func (s *Service) bundle(ctx context.Context, collectors []string, uid string, w io.Writer) (int64, error) {
+	// resume from the persisted progress, if any. It also records whether the bundle is anonymized so
+	// the generation fails rather than producing a bundle that isn't
+	progress, err := s.store.GetProgress(ctx, uid)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get support bundle progress: %w", err)
+	}
+	if progress == nil {
+		progress = &bundleProgress{Collectors: collectors}
+	}
+
+	partial, err := s.openPartialArchive(uid, progress)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = partial.Close() }()
+	// the partial archive is referenced before anything is written to it so it's removed with the progress
+	if err := s.store.SetProgress(ctx, uid, progress); err != nil {
+		s.log.Warn("Failed to persist support bundle progress", "uid", uid, "error", err)
+	}
+
+	// collectors restricted to other organizations are left out, including the ones always included
+	var orgID int64
+	if b, err := s.store.Get(ctx, uid); err == nil {
+		orgID = b.OrgID
+	} else {
+		s.log.Warn("Failed to get support bundle", "uid", uid, "error", err)
+	}
+
+	selected := s.selectedCollectors(collectors, orgID)
+	alreadyCompleted := 0
+	for _, collector := range selected {
+		if progress.isCompleted(collector.UID) {
+			alreadyCompleted++
+		}
+	}
+	s.generations.start(uid, alreadyCompleted, len(selected))
+
+	for _, collector := range selected {
+		if progress.isCompleted(collector.UID) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		start := time.Now()
+		item, err := s.collect(ctx, collector)
+		progress.Timings = append(progress.Timings, collectorTiming{
+			UID:        collector.UID,
+			Start:      start.UnixMilli(),
+			DurationMs: time.Since(start).Milliseconds(),
+		})
 		if err != nil {
 			s.log.Warn("Failed to collect support bundle item", "error", err, "collector", collector.UID)
 		}
 
-		// write item to file
+		// write item to the partial archive
 		if item != nil {
-			files[item.Filename] = item.FileBytes
+			if err := partial.append(ctx, item); err != nil {
+				return 0, fmt.Errorf("unable to store support bundle item: %w", err)
+			}
+		}
+
+		progress.Completed = append(progress.Completed, collector.UID)
+		progress.PartialSize = partial.size
+		if err := s.store.SetProgress(ctx, uid, progress); err != nil {
+			s.log.Warn("Failed to persist support bundle progress", "uid", uid, "error", err)
 		}
+		s.generations.collectorDone(uid)
 	}
 
-	// create tar.gz file
-	var buf bytes.Buffer
-	errCompress := compress(files, &buf)
-	if errCompress != nil {
-		return nil, errCompress
+	manifest := &bundleManifest{Collectors: progress.Timings}
+	defer func() {
+		if err := s.store.SetManifest(ctx, uid, manifest); err != nil {
+			s.log.Warn("Failed to store support bundle manifest", "uid", uid, "error", err)
+		}
+	}()
+
+	// identities are pseudonymized before the sanitizing pass so secrets are masked in the anonymized files,
+	// they are collected from every item first so they are replaced across files
+	pseudonymize := func(data []byte) []byte { return data }
+	if progress.Anonymize {
+		identities := map[string]bool{}
+		if err := partial.items(ctx, func(item *supportbundles.SupportItem) error {
+			s.anonymizer.identities(identities, item.FileBytes)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		if pseudonymize, err = s.anonymizer.pseudonymizer(uid, identities); err != nil {
+			return 0, fmt.Errorf("unable to anonymize support bundle: %w", err)
+		}
+		manifest.Pseudonyms = len(identities)
 	}
 
-	final := buf
+	out := w
+	var ew io.WriteCloser
 	if len(s.encryptionPublicKeys) > 0 {
-		var err error
-		final, err = encrypt(buf, s.encryptionPublicKeys...)
-		if err != nil {
-			return nil, err
+		if ew, err = encrypt(w, s.encryptionPublicKeys...); err != nil {
+			return 0, err
+		}
+		out = ew
+	}
+
+	// the items are read back from the partial archive one at a time and streamed to the archive
+	var peakBuffered int64
+	archive := newBundleTar(out, s.sanitizer)
+	if err := partial.items(ctx, func(item *supportbundles.SupportItem) error {
+		if size := int64(len(item.FileBytes)); size > peakBuffered {
+			peakBuffered = size
+		}
+		return archive.add(item.Filename, pseudonymize(item.FileBytes))
+	}); err != nil {
+		return peakBuffered, fmt.Errorf("unable to write support bundle: %w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return peakBuffered, err
+	}
+	manifest.Redactions = archive.redactions
+
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			return peakBuffered, fmt.Errorf("unable to close support bundle encryption: %w", err)
 		}
 	}
 
-	return final.Bytes(), nil
+	return peakBuffered, nil
 }
 
-func encrypt(buf bytes.Buffer, publicKeys ...string) (bytes.Buffer, error) {
-	final := bytes.Buffer{}
+// collect runs a collector in its own span.
+func (s *Service) collect(ctx context.Context, collector supportbundles.Collector) (item *supportbundles.SupportItem, err error) {
+	ctx, span := s.tracer.Start(ctx, "supportbundles.collector."+collector.UID)
+	defer func() {
+		var size int64
+		if item != nil {
+			size = int64(len(item.FileBytes))
+		}
+		span.SetAttributes("bytes", size, attribute.Key("bytes").Int64(size))
+		span.SetAttributes("success", err == nil, attribute.Key("success").Bool(err == nil))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	return collector.Fn(ctx)
+}
+
+// encrypt returns a writer encrypting everything written to it into w for the given recipients.
+// The writer must be closed to flush the last encrypted chunk.
+func encrypt(w io.Writer, publicKeys ...string) (io.WriteCloser, error) {
 	recipients := make([]age.Recipient, 0, len(publicKeys))
 	for _, key := range publicKeys {
 		recipient, err := age.ParseX25519Recipient(key)
 		if err != nil {
-			return final, fmt.Errorf("unable to parse support bundle recipient public key: %w", err)
+			return nil, fmt.Errorf("unable to parse support bundle recipient public key: %w", err)
 		}
 		recipients = append(recipients, recipient)
 	}
 
-	w, err := age.Encrypt(&final, recipients...)
+	ew, err := age.Encrypt(w, recipients...)
 	if err != nil {
-		return final, fmt.Errorf("unable to open support bundle encryption header: %w", err)
-	}
-
-	if _, err = w.Write(buf.Bytes()); err != nil {
-		return final, fmt.Errorf("unable to write support bundle encryption: %w", err)
+		return nil, fmt.Errorf("unable to open support bundle encryption header: %w", err)
 	}
 
-	if err := w.Close(); err != nil {
-		return final, fmt.Errorf("unable to close support bundle encryption: %w", err)
-	}
+	return ew, nil
+}
 
-	return final, nil
+// bundleTar writes the files of a bundle to a tar.gz archive. When a sanitizer is set, text files
+// are sanitized as they are written and the redactions are counted.
+type bundleTar struct {
+	zr         *gzip.Writer
+	tw         *tar.Writer
+	sanitizer  *bundleSanitizer
+	redactions int
 }
 
-func compress(files map[string][]byte, buf io.Writer) error {
-	// tar > gzip > buf
-	zr := gzip.NewWriter(buf)
-	tw := tar.NewWriter(zr)
+func newBundleTar(w io.Writer, sanitizer *bundleSanitizer) *bundleTar {
+	// tar > gzip > w
+	zr := gzip.NewWriter(w)
+	return &bundleTar{zr: zr, tw: tar.NewWriter(zr), sanitizer: sanitizer}
+}
 
-	for name, data := range files {
-		header := &tar.Header{
-			Name:    name,
-			ModTime: time.Now(),
-			Mode:    int64(0o644),
-			Size:    int64(len(data)),
-		}
+func (b *bundleTar) add(name string, data []byte) error {
+	sanitize := b.sanitizer != nil && isText(data)
 
-		header.Name = filepath.ToSlash("/bundle/" + header.Name)
-		// write header
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
+	size := int64(len(data))
+	if sanitize {
+		size = b.sanitizer.size(data)
+	}
 
-		if _, err := io.Copy(tw, bytes.NewReader(data)); err != nil {
-			return err
-		}
+	header := &tar.Header{
+		Name:    filepath.ToSlash("/bundle/" + name),
+		ModTime: time.Now(),
+		Mode:    int64(0o644),
+		Size:    size,
+	}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return err
 	}
 
-	// produce tar
-	if err := tw.Close(); err != nil {
+	if sanitize {
+		n, err := b.sanitizer.write(b.tw, data)
+		b.redactions += n
 		return err
 	}
-	// produce gzip
-	if err := zr.Close(); err != nil {
+
+	_, err := io.Copy(b.tw, bytes.NewReader(data))
+	return err
+}
+
+// Close writes the tar footer and flushes the compression, it doesn't close the underlying writer.
+func (b *bundleTar) Close() error {
+	if err := b.tw.Close(); err != nil {
 		return err
 	}
-	//
-	return nil
+	return b.zr.Close()
 }
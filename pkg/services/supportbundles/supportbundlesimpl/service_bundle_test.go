@@ -5,9 +5,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"errors"
 	"io"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"filippo.io/age"
 	"github.com/stretchr/testify/assert"
@@ -15,6 +19,8 @@ import (
 
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	"github.com/grafana/grafana/pkg/services/supportbundles"
 	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
 	"github.com/grafana/grafana/pkg/services/user"
@@ -30,9 +36,12 @@ const (
 
 func TestService_bundleCreate(t *testing.T) {
 	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
 		log:            log.New("test"),
 		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
 		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
 	}
 
 	cfg := setting.NewCfg()
@@ -40,7 +49,7 @@ func TestService_bundleCreate(t *testing.T) {
 	collector := basicCollector(cfg)
 	s.bundleRegistry.RegisterSupportItemCollector(collector)
 
-	createdBundle, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"})
+	createdBundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
 	require.NoError(t, err)
 
 	s.startBundleWork(context.Background(), []string{collector.UID}, createdBundle.UID)
@@ -51,17 +60,74 @@ func TestService_bundleCreate(t *testing.T) {
 	assert.Equal(t, createdBundle.UID, bundle.UID)
 	assert.Equal(t, supportbundles.StateComplete, bundle.State)
 	assert.Equal(t, "bob", bundle.Creator)
-	assert.NotZero(t, len(bundle.TarBytes))
+	archive := readArchive(t, s, bundle.UID)
+	assert.NotZero(t, len(archive))
 
-	confirmFilesInTar(t, bundle.TarBytes)
+	confirmFilesInTar(t, archive)
+}
+
+func TestService_bundleTracing(t *testing.T) {
+	tracer := tracing.NewFakeTracer()
+	s := &Service{
+		tracer:         tracer,
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
+	}
+
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "first",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return &supportbundles.SupportItem{Filename: "first.json", FileBytes: []byte(`{"first":true}`)}, nil
+		},
+	})
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "failing",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return nil, errors.New("collector failed")
+		},
+	})
+
+	createdBundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	s.startBundleWork(context.Background(), []string{"first", "failing"}, createdBundle.UID)
+
+	spans := map[string]*tracing.FakeSpan{}
+	for _, span := range tracer.Spans {
+		require.True(t, span.IsEnded(), span.Name)
+		spans[span.Name] = span
+	}
+	require.Len(t, spans, 3)
+
+	first := spans["supportbundles.collector.first"]
+	require.NotNil(t, first)
+	assert.Equal(t, int64(len(`{"first":true}`)), first.Attributes["bytes"].AsInt64())
+	assert.True(t, first.Attributes["success"].AsBool())
+
+	failing := spans["supportbundles.collector.failing"]
+	require.NotNil(t, failing)
+	assert.Equal(t, int64(0), failing.Attributes["bytes"].AsInt64())
+	assert.False(t, failing.Attributes["success"].AsBool())
+	assert.Error(t, failing.Err)
+
+	generate := spans["supportbundles.generate"]
+	require.NotNil(t, generate)
+	assert.Equal(t, createdBundle.UID, generate.Attributes["uid"].AsString())
+	assert.Equal(t, supportbundles.StateComplete.String(), generate.Attributes["state"].AsString())
 }
 
 func TestService_bundleEncryptDecrypt(t *testing.T) {
 	s := &Service{
+		tracer:               tracing.InitializeTracerForTest(),
 		log:                  log.New("test"),
 		bundleRegistry:       bundleregistry.ProvideService(),
+		secrets:              fakes.NewFakeSecretsService(),
 		store:                newStore(kvstore.NewFakeKVStore()),
 		encryptionPublicKeys: []string{testAgePublicKey},
+		archiveDir:           t.TempDir(),
 	}
 
 	cfg := setting.NewCfg()
@@ -69,7 +135,7 @@ func TestService_bundleEncryptDecrypt(t *testing.T) {
 	collector := basicCollector(cfg)
 	s.bundleRegistry.RegisterSupportItemCollector(collector)
 
-	createdBundle, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"})
+	createdBundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
 	require.NoError(t, err)
 
 	s.startBundleWork(context.Background(), []string{collector.UID}, createdBundle.UID)
@@ -80,9 +146,11 @@ func TestService_bundleEncryptDecrypt(t *testing.T) {
 	assert.Equal(t, createdBundle.UID, bundle.UID)
 	assert.Equal(t, supportbundles.StateComplete, bundle.State)
 	assert.Equal(t, "bob", bundle.Creator)
-	assert.NotZero(t, len(bundle.TarBytes))
+	assert.True(t, bundle.Encrypted)
+	archive := readArchive(t, s, bundle.UID)
+	assert.NotZero(t, len(archive))
 
-	tarBytes := decryptTar(t, bundle.TarBytes, testAgePrivateKey)
+	tarBytes := decryptTar(t, archive, testAgePrivateKey)
 	assert.NotZero(t, len(tarBytes))
 
 	confirmFilesInTar(t, tarBytes)
@@ -90,10 +158,13 @@ func TestService_bundleEncryptDecrypt(t *testing.T) {
 
 func TestService_bundleEncryptDecryptMultipleRecipients(t *testing.T) {
 	s := &Service{
+		tracer:               tracing.InitializeTracerForTest(),
 		log:                  log.New("test"),
 		bundleRegistry:       bundleregistry.ProvideService(),
+		secrets:              fakes.NewFakeSecretsService(),
 		store:                newStore(kvstore.NewFakeKVStore()),
 		encryptionPublicKeys: []string{testAgePublicKey, testAgePublicKey2},
+		archiveDir:           t.TempDir(),
 	}
 
 	cfg := setting.NewCfg()
@@ -101,7 +172,7 @@ func TestService_bundleEncryptDecryptMultipleRecipients(t *testing.T) {
 	collector := basicCollector(cfg)
 	s.bundleRegistry.RegisterSupportItemCollector(collector)
 
-	createdBundle, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"})
+	createdBundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
 	require.NoError(t, err)
 
 	s.startBundleWork(context.Background(), []string{collector.UID}, createdBundle.UID)
@@ -112,19 +183,247 @@ func TestService_bundleEncryptDecryptMultipleRecipients(t *testing.T) {
 	assert.Equal(t, createdBundle.UID, bundle.UID)
 	assert.Equal(t, supportbundles.StateComplete, bundle.State)
 	assert.Equal(t, "bob", bundle.Creator)
-	assert.NotZero(t, len(bundle.TarBytes))
+	archive := readArchive(t, s, bundle.UID)
+	assert.NotZero(t, len(archive))
 
-	tarBytes := decryptTar(t, bundle.TarBytes, testAgePrivateKey)
+	tarBytes := decryptTar(t, archive, testAgePrivateKey)
 	assert.NotZero(t, len(tarBytes))
 
 	confirmFilesInTar(t, tarBytes)
 
-	tarBytes2 := decryptTar(t, bundle.TarBytes, testAgePrivateKey2)
+	tarBytes2 := decryptTar(t, archive, testAgePrivateKey2)
 	assert.NotZero(t, len(tarBytes2))
 
 	confirmFilesInTar(t, tarBytes2)
 }
 
+func TestService_bundleStreamsArchive(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+		archiveDir:     t.TempDir(),
+	}
+
+	// random data doesn't compress, so the archive is at least as large as the collected files
+	for _, uid := range []string{"first", "second"} {
+		data := make([]byte, 256*1024)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		filename := uid + ".bin"
+		s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+			UID: uid,
+			Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+				return &supportbundles.SupportItem{Filename: filename, FileBytes: data}, nil
+			},
+		})
+	}
+
+	createdBundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	w := &recordingWriter{}
+	peakBuffered, err := s.bundle(context.Background(), []string{"first", "second"}, createdBundle.UID, w)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(256*1024), peakBuffered, "a single item should be held in memory")
+	assert.Greater(t, w.written, int64(512*1024))
+	// the archive is written as it is produced rather than in one piece at the end
+	assert.Less(t, w.largestWrite, w.written/4)
+}
+
+func TestService_bundleArchiveLimit(t *testing.T) {
+	s := &Service{
+		tracer:          tracing.InitializeTracerForTest(),
+		log:             log.New("test"),
+		bundleRegistry:  bundleregistry.ProvideService(),
+		secrets:         fakes.NewFakeSecretsService(),
+		store:           newStore(kvstore.NewFakeKVStore()),
+		archiveDir:      t.TempDir(),
+		maxArchiveBytes: 1024,
+	}
+
+	data := make([]byte, 64*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "large",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return &supportbundles.SupportItem{Filename: "large.bin", FileBytes: data}, nil
+		},
+	})
+
+	createdBundle, _, err := s.store.Create(context.Background(), &user.SignedInUser{UserID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	s.startBundleWork(context.Background(), []string{"large"}, createdBundle.UID)
+
+	bundle, err := s.get(context.Background(), createdBundle.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StateError, bundle.State)
+	assert.NotEmpty(t, bundle.Error, "the failure reason is recorded with the bundle")
+
+	// the partial archive is removed
+	entries, err := os.ReadDir(s.archiveDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestService_PreflightCollectors(t *testing.T) {
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          newStore(kvstore.NewFakeKVStore()),
+	}
+
+	collected := false
+	s.bundleRegistry.RegisterSupportItemCollector(basicCollector(setting.NewCfg()))
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID:         "restricted",
+		DisplayName: "Restricted",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			collected = true
+			return nil, nil
+		},
+		Preflight: func(ctx context.Context) error {
+			return errors.New("missing permission datasources:read")
+		},
+	})
+
+	preflight := s.PreflightCollectors(context.Background(), []string{"restricted", "unknown"}, 1)
+
+	assert.Equal(t, []supportbundles.CollectorPreflight{
+		{UID: "unknown", Reason: "unknown collector"},
+		{UID: "basic", DisplayName: "Basic information", Runnable: true},
+		{UID: "restricted", DisplayName: "Restricted", Reason: "missing permission datasources:read"},
+	}, preflight)
+	assert.False(t, collected, "preflight must not run the collector")
+}
+
+// recordingWriter discards what is written to it and records the write sizes.
+type recordingWriter struct {
+	written      int64
+	largestWrite int64
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if int64(len(p)) > w.largestWrite {
+		w.largestWrite = int64(len(p))
+	}
+	return len(p), nil
+}
+
+func readArchive(t *testing.T, s *Service, uid string) []byte {
+	t.Helper()
+
+	archive, err := s.store.OpenArchive(context.Background(), uid)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, archive.Close()) }()
+
+	data, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	return data
+}
+
+func TestService_createOrgRestrictedCollector(t *testing.T) {
+	setup := func(t *testing.T, dropRestricted bool) (*Service, *atomic.Bool) {
+		t.Helper()
+
+		s := &Service{
+			tracer:         tracing.InitializeTracerForTest(),
+			log:            log.New("test"),
+			bundleRegistry: bundleregistry.ProvideService(),
+			secrets:        fakes.NewFakeSecretsService(),
+			queue:          newGenerationQueue(1),
+			store:          newStore(kvstore.NewFakeKVStore()),
+			archiveDir:     t.TempDir(),
+			dropRestricted: dropRestricted,
+		}
+
+		collected := &atomic.Bool{}
+		s.bundleRegistry.RegisterSupportItemCollector(basicCollector(setting.NewCfg()))
+		s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+			UID:           "instance",
+			DisplayName:   "Instance",
+			AllowedOrgIDs: []int64{1},
+			Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+				collected.Store(true)
+				return &supportbundles.SupportItem{Filename: "instance.txt", FileBytes: []byte("instance")}, nil
+			},
+		})
+		return s, collected
+	}
+
+	waitForBundle := func(t *testing.T, s *Service, uid string) *supportbundles.Bundle {
+		t.Helper()
+
+		var bundle *supportbundles.Bundle
+		require.Eventually(t, func() bool {
+			var err error
+			bundle, err = s.get(context.Background(), uid)
+			return err == nil && bundle.State != supportbundles.StatePending
+		}, time.Second, 10*time.Millisecond)
+		return bundle
+	}
+
+	t.Run("allowed org can include the restricted collector", func(t *testing.T) {
+		s, collected := setup(t, false)
+
+		created, err := s.create(context.Background(), []string{"basic", "instance"}, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "", false)
+		require.NoError(t, err)
+
+		bundle := waitForBundle(t, s, created.UID)
+		require.Equal(t, supportbundles.StateComplete, bundle.State)
+		assert.True(t, collected.Load())
+		assert.Contains(t, filesInTar(t, readArchive(t, s, bundle.UID)), "/bundle/instance.txt")
+	})
+
+	t.Run("other orgs are rejected", func(t *testing.T) {
+		s, collected := setup(t, false)
+
+		_, err := s.create(context.Background(), []string{"basic", "instance"}, &user.SignedInUser{UserID: 1, OrgID: 2, Login: "bob"}, "", false)
+		require.ErrorIs(t, err, ErrCollectorRestricted)
+		assert.Contains(t, err.Error(), "instance")
+
+		bundles, err := s.store.List()
+		require.NoError(t, err)
+		assert.Empty(t, bundles)
+		assert.False(t, collected.Load())
+	})
+
+	t.Run("other orgs have the collector dropped when configured", func(t *testing.T) {
+		s, collected := setup(t, true)
+
+		created, err := s.create(context.Background(), []string{"basic", "instance"}, &user.SignedInUser{UserID: 1, OrgID: 2, Login: "bob"}, "", false)
+		require.NoError(t, err)
+
+		bundle := waitForBundle(t, s, created.UID)
+		require.Equal(t, supportbundles.StateComplete, bundle.State)
+		assert.False(t, collected.Load())
+
+		files := filesInTar(t, readArchive(t, s, bundle.UID))
+		assert.Contains(t, files, "/bundle/basic.json")
+		assert.NotContains(t, files, "/bundle/instance.txt")
+	})
+
+	t.Run("preflight reports the restricted collector for other orgs", func(t *testing.T) {
+		s, _ := setup(t, false)
+
+		preflight := s.PreflightCollectors(context.Background(), []string{"instance"}, 2)
+
+		assert.Equal(t, []supportbundles.CollectorPreflight{
+			{UID: "instance", DisplayName: "Instance", Reason: ErrCollectorRestricted.Error()},
+			{UID: "basic", DisplayName: "Basic information", Runnable: true},
+		}, preflight)
+	})
+}
+
 func decryptTar(t *testing.T, tarBytes []byte, privateKey string) []byte {
 	reader := bytes.NewReader(tarBytes)
 	t.Helper()
@@ -0,0 +1,259 @@
+package supportbundlesimpl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+var (
+	// ErrBundleNotSigned is returned when verifying a bundle generated without a signature.
+	ErrBundleNotSigned = errors.New("support bundle is not signed")
+	// ErrSignatureInvalid is returned when a bundle doesn't match its signature.
+	ErrSignatureInvalid = errors.New("support bundle signature is invalid")
+)
+
+const (
+	signatureAlgorithm  = "ed25519-sha256"
+	activeSigningKeyKey = "active"
+	signingKeyPrefix    = "key/"
+)
+
+// bundleSignature is a detached signature over the SHA-256 checksum of a bundle archive.
+type bundleSignature struct {
+	UID       string `json:"uid"`
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyId"`
+	// PublicKey allows verifying the signature without access to this instance.
+	PublicKey []byte `json:"publicKey"`
+	Checksum  string `json:"checksum"`
+	Signature []byte `json:"signature"`
+}
+
+// signingKey is a bundle signing key. Keys are kept after a rotation so the bundles
+// they signed can still be verified.
+type signingKey struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"publicKey"`
+	// EncryptedPrivateKey is the private key encrypted with the secrets service.
+	EncryptedPrivateKey []byte `json:"encryptedPrivateKey"`
+	CreatedAt           int64  `json:"createdAt"`
+}
+
+// bundleSigner signs generated bundles and verifies their signatures.
+type bundleSigner struct {
+	secrets    secrets.Service
+	keys       *kvstore.NamespacedKVStore
+	signatures *kvstore.NamespacedKVStore
+	mu         sync.Mutex
+}
+
+func newBundleSigner(kv kvstore.KVStore, secretsService secrets.Service) *bundleSigner {
+	return &bundleSigner{
+		secrets:    secretsService,
+		keys:       kvstore.WithNamespace(kv, 0, "supportbundlesigningkeys"),
+		signatures: kvstore.WithNamespace(kv, 0, "supportbundlesignature"),
+	}
+}
+
+// rotate creates a new signing key used for the bundles generated from now on.
+func (b *bundleSigner) rotate(ctx context.Context) (*signingKey, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rotateLocked(ctx)
+}
+
+func (b *bundleSigner) rotateLocked(ctx context.Context) (*signingKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate support bundle signing key: %w", err)
+	}
+
+	encrypted, err := b.secrets.Encrypt(ctx, privateKey, secrets.WithoutScope())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt support bundle signing key: %w", err)
+	}
+
+	key := &signingKey{
+		ID:                  uuid.NewString(),
+		PublicKey:           publicKey,
+		EncryptedPrivateKey: encrypted,
+		CreatedAt:           time.Now().Unix(),
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.keys.Set(ctx, signingKeyPrefix+key.ID, string(data)); err != nil {
+		return nil, err
+	}
+	if err := b.keys.Set(ctx, activeSigningKeyKey, key.ID); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// activeKey returns the key signing new bundles, creating it on first use.
+func (b *bundleSigner) activeKey(ctx context.Context) (*signingKey, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, ok, err := b.keys.Get(ctx, activeSigningKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return b.rotateLocked(ctx)
+	}
+	return b.getKey(ctx, id)
+}
+
+func (b *bundleSigner) getKey(ctx context.Context, id string) (*signingKey, error) {
+	data, ok, err := b.keys.Get(ctx, signingKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("support bundle signing key %s not found", id)
+	}
+
+	var key signingKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// sign stores a detached signature of the archive checksum of the bundle.
+func (b *bundleSigner) sign(ctx context.Context, uid string, checksum []byte) error {
+	key, err := b.activeKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := b.secrets.Decrypt(ctx, key.EncryptedPrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt support bundle signing key: %w", err)
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("support bundle signing key %s is invalid", key.ID)
+	}
+
+	signature := bundleSignature{
+		UID:       uid,
+		Algorithm: signatureAlgorithm,
+		KeyID:     key.ID,
+		PublicKey: key.PublicKey,
+		Checksum:  hex.EncodeToString(checksum),
+		Signature: ed25519.Sign(privateKey, signedMessage(uid, checksum)),
+	}
+	data, err := json.Marshal(signature)
+	if err != nil {
+		return err
+	}
+	return b.signatures.Set(ctx, uid, string(data))
+}
+
+// verify checks the archive against the signature of the bundle. The public key is
+// looked up in the key ring rather than trusted from the signature.
+func (b *bundleSigner) verify(ctx context.Context, uid string, archive io.Reader) error {
+	signature, err := b.getSignature(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	key, err := b.getKey(ctx, signature.KeyID)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, archive); err != nil {
+		return fmt.Errorf("failed to read support bundle archive: %w", err)
+	}
+	checksum := h.Sum(nil)
+
+	if hex.EncodeToString(checksum) != signature.Checksum {
+		return fmt.Errorf("%w: checksum mismatch", ErrSignatureInvalid)
+	}
+	if !bytes.Equal(key.PublicKey, signature.PublicKey) || len(key.PublicKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(key.PublicKey, signedMessage(uid, checksum), signature.Signature) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (b *bundleSigner) getSignature(ctx context.Context, uid string) (*bundleSignature, error) {
+	data, ok, err := b.signatures.Get(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrBundleNotSigned
+	}
+
+	var signature bundleSignature
+	if err := json.Unmarshal([]byte(data), &signature); err != nil {
+		return nil, err
+	}
+	return &signature, nil
+}
+
+func (b *bundleSigner) removeSignature(ctx context.Context, uid string) error {
+	return b.signatures.Del(ctx, uid)
+}
+
+// signedMessage binds the checksum to the bundle so a signature can't be reused for another bundle.
+func signedMessage(uid string, checksum []byte) []byte {
+	return append([]byte(signatureAlgorithm+":"+uid+":"), checksum...)
+}
+
+// VerifySignature checks that the archive of a bundle matches the detached signature
+// produced by this instance when the bundle was generated.
+func (s *Service) VerifySignature(ctx context.Context, uid string) error {
+	if s.signer == nil {
+		return ErrBundleNotSigned
+	}
+
+	archive, err := s.store.OpenArchive(ctx, uid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			s.log.Warn("Failed to close support bundle archive", "uid", uid, "error", err)
+		}
+	}()
+
+	return s.signer.verify(ctx, uid, archive)
+}
+
+// RotateSigningKey replaces the key signing new bundles. Previous keys are kept to
+// verify the bundles they signed.
+func (s *Service) RotateSigningKey(ctx context.Context) error {
+	if s.signer == nil {
+		return errors.New("support bundle signing is not enabled")
+	}
+
+	key, err := s.signer.rotate(ctx)
+	if err != nil {
+		return err
+	}
+	s.log.Info("Rotated support bundle signing key", "keyId", key.ID)
+	return nil
+}
@@ -0,0 +1,111 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/supportbundles/bundleregistry"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestService_signBundle(t *testing.T) {
+	kv := kvstore.NewFakeKVStore()
+	bundles := newStore(kv)
+	s := &Service{
+		tracer:         tracing.InitializeTracerForTest(),
+		log:            log.New("test"),
+		bundleRegistry: bundleregistry.ProvideService(),
+		secrets:        fakes.NewFakeSecretsService(),
+		store:          bundles,
+		signer:         newBundleSigner(kv, fakes.NewFakeSecretsService()),
+		archiveDir:     t.TempDir(),
+	}
+	s.bundleRegistry.RegisterSupportItemCollector(supportbundles.Collector{
+		UID: "basic",
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			return &supportbundles.SupportItem{Filename: "basic.json", FileBytes: []byte(`{"grafana":"ok"}`)}, nil
+		},
+	})
+
+	generate := func(t *testing.T) string {
+		t.Helper()
+		bundle, _, err := bundles.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		s.startBundleWork(context.Background(), []string{"basic"}, bundle.UID)
+
+		generated, err := bundles.Get(context.Background(), bundle.UID)
+		require.NoError(t, err)
+		require.Equal(t, supportbundles.StateComplete, generated.State)
+		return bundle.UID
+	}
+
+	t.Run("signed bundle verifies", func(t *testing.T) {
+		uid := generate(t)
+
+		signature, err := s.signer.getSignature(context.Background(), uid)
+		require.NoError(t, err)
+		assert.Equal(t, signatureAlgorithm, signature.Algorithm)
+		assert.Equal(t, uid, signature.UID)
+		assert.Len(t, signature.Checksum, 64)
+
+		bundle, err := bundles.Get(context.Background(), uid)
+		require.NoError(t, err)
+		assert.Equal(t, signature.Checksum, bundle.Checksum, "the signed checksum is recorded with the bundle")
+
+		require.NoError(t, s.VerifySignature(context.Background(), uid))
+	})
+
+	t.Run("tampered bundle fails verification", func(t *testing.T) {
+		uid := generate(t)
+
+		archivePath, ok, err := bundles.archiveKV.Get(context.Background(), uid)
+		require.NoError(t, err)
+		require.True(t, ok)
+		data, err := os.ReadFile(archivePath)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(archivePath, data, 0o600))
+
+		assert.ErrorIs(t, s.VerifySignature(context.Background(), uid), ErrSignatureInvalid)
+	})
+
+	t.Run("bundles signed before a rotation still verify", func(t *testing.T) {
+		before := generate(t)
+		require.NoError(t, s.RotateSigningKey(context.Background()))
+		after := generate(t)
+
+		require.NoError(t, s.VerifySignature(context.Background(), before))
+		require.NoError(t, s.VerifySignature(context.Background(), after))
+
+		beforeSignature, err := s.signer.getSignature(context.Background(), before)
+		require.NoError(t, err)
+		afterSignature, err := s.signer.getSignature(context.Background(), after)
+		require.NoError(t, err)
+		assert.NotEqual(t, beforeSignature.KeyID, afterSignature.KeyID)
+	})
+
+	t.Run("unsigned bundle", func(t *testing.T) {
+		bundle, _, err := bundles.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		require.NoError(t, bundles.Update(context.Background(), bundle.UID, supportbundles.StateComplete, []byte("inline")))
+
+		assert.ErrorIs(t, s.VerifySignature(context.Background(), bundle.UID), ErrBundleNotSigned)
+	})
+
+	t.Run("removing a bundle removes its signature", func(t *testing.T) {
+		uid := generate(t)
+		require.NoError(t, s.remove(context.Background(), uid))
+
+		_, err := s.signer.getSignature(context.Background(), uid)
+		assert.ErrorIs(t, err, ErrBundleNotSigned)
+	})
+}
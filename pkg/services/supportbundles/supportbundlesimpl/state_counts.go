@@ -0,0 +1,104 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+const stateCountKeyPrefix = "state/"
+
+var bundleStates = []supportbundles.State{
+	supportbundles.StatePending,
+	supportbundles.StateComplete,
+	supportbundles.StateError,
+	supportbundles.StateTimeout,
+}
+
+func stateCountKey(state supportbundles.State) string {
+	return stateCountKeyPrefix + state.String()
+}
+
+// CountByState returns the number of bundles per state from the counters maintained on every
+// state transition, without reading the bundles.
+func (s *store) CountByState(ctx context.Context) (map[supportbundles.State]int, error) {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+
+	counts := make(map[supportbundles.State]int, len(bundleStates))
+	for _, state := range bundleStates {
+		count, err := s.getStateCount(ctx, state)
+		if err != nil {
+			return nil, err
+		}
+		counts[state] = count
+	}
+	return counts, nil
+}
+
+// ReconcileStateCounts recomputes the state counters from the stored bundles. The counters are
+// updated separately from the bundles, so they can drift when an update fails halfway.
+func (s *store) ReconcileStateCounts(ctx context.Context) error {
+	bundles, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[supportbundles.State]int, len(bundleStates))
+	for _, b := range bundles {
+		counts[b.State]++
+	}
+
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+
+	for _, state := range bundleStates {
+		if err := s.statKV.Set(ctx, stateCountKey(state), strconv.Itoa(counts[state])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transitionStateCount moves a bundle from one state counter to another. An empty from is
+// used for created bundles and an empty to for removed ones.
+func (s *store) transitionStateCount(ctx context.Context, from, to supportbundles.State) {
+	if from == to {
+		return
+	}
+
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+
+	if from != "" {
+		s.addStateCount(ctx, from, -1)
+	}
+	if to != "" {
+		s.addStateCount(ctx, to, 1)
+	}
+}
+
+func (s *store) addStateCount(ctx context.Context, state supportbundles.State, delta int) {
+	count, err := s.getStateCount(ctx, state)
+	if err != nil {
+		s.log.Warn("Failed to get support bundle state count", "state", state, "error", err)
+		return
+	}
+
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+	if err := s.statKV.Set(ctx, stateCountKey(state), strconv.Itoa(count)); err != nil {
+		s.log.Warn("Failed to update support bundle state count", "state", state, "error", err)
+	}
+}
+
+func (s *store) getStateCount(ctx context.Context, state supportbundles.State) (int, error) {
+	value, ok, err := s.statKV.Get(ctx, stateCountKey(state))
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
@@ -1,10 +1,15 @@
 package supportbundlesimpl
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -21,50 +26,134 @@ import (
 
 const (
 	defaultBundleExpiration = 72 * time.Hour // 72h
+	// maxBundleErrorLength caps the failure reason stored with a bundle.
+	maxBundleErrorLength = 1024
 )
 
 const key = "count"
 
+// ErrContentPurged is returned when opening the archive of a bundle whose content has been purged.
+var ErrContentPurged = errors.New("support bundle content has been purged")
+
 func newStore(kv kvstore.KVStore) *store {
 	return &store{
-		kv:     kvstore.WithNamespace(kv, 0, "supportbundle"),
-		statKV: kvstore.WithNamespace(kv, 0, "supportbundlestats"),
-		log:    log.New("supportbundle.store"),
+		kv:            kvstore.WithNamespace(kv, 0, "supportbundle"),
+		statKV:        kvstore.WithNamespace(kv, 0, "supportbundlestats"),
+		idempotencyKV: kvstore.WithNamespace(kv, 0, "supportbundleidempotency"),
+		progressKV:    kvstore.WithNamespace(kv, 0, "supportbundleprogress"),
+		archiveKV:     kvstore.WithNamespace(kv, 0, "supportbundlearchive"),
+		manifestKV:    kvstore.WithNamespace(kv, 0, "supportbundlemanifest"),
+		log:           log.New("supportbundle.store"),
+		now:           time.Now,
 	}
 }
 
 type store struct {
-	kv     *kvstore.NamespacedKVStore
-	log    log.Logger
-	mu     sync.Mutex
-	statKV *kvstore.NamespacedKVStore
+	kv  *kvstore.NamespacedKVStore
+	log log.Logger
+	// mu serializes the writes to the bundle records. The kvstore has no revisions to check, so every
+	// read-modify-write of a bundle takes it to not overwrite a concurrent update.
+	mu            sync.Mutex
+	statKV        *kvstore.NamespacedKVStore
+	idempotencyKV *kvstore.NamespacedKVStore
+	progressKV    *kvstore.NamespacedKVStore
+	archiveKV     *kvstore.NamespacedKVStore
+	manifestKV    *kvstore.NamespacedKVStore
+
+	now func() time.Time
+	// orphansSeen records when Compact first found each orphaned key.
+	orphansSeen map[orphanKey]time.Time
+	// countMu serializes the updates of the per state counters.
+	countMu sync.Mutex
 }
 
 type bundleStore interface {
-	Create(ctx context.Context, usr identity.Requester) (*supportbundles.Bundle, error)
+	// Create creates a new pending bundle. When an idempotency key is provided and a pending bundle
+	// was already created with the same key by the same user, that bundle is returned instead and
+	// created is false.
+	Create(ctx context.Context, usr identity.Requester, idempotencyKey string) (bundle *supportbundles.Bundle, created bool, err error)
 	Get(ctx context.Context, uid string) (*supportbundles.Bundle, error)
 	StatsCount(ctx context.Context) (int64, error)
 	List() ([]supportbundles.Bundle, error)
+	// ListByTimeRange returns the bundles created in [from, to), as unix timestamps, newest first and without archives.
+	ListByTimeRange(ctx context.Context, from, to int64) ([]supportbundles.Bundle, error)
+	// ListFiltered returns the bundles matching the filter, newest first and without archives.
+	ListFiltered(ctx context.Context, filter ListFilter) ([]supportbundles.Bundle, error)
+	// SetLabels replaces the labels of a bundle, an empty map removes them. Labels exceeding the caps
+	// are rejected with ErrInvalidLabels.
+	SetLabels(ctx context.Context, uid string, labels map[string]string) error
 	Remove(ctx context.Context, uid string) error
+	// Purge removes the archive of a bundle but keeps its record and manifest, e.g. to keep an index of
+	// past bundles without their content. Opening the archive of a purged bundle returns ErrContentPurged.
+	Purge(ctx context.Context, uid string) error
+	// Update stores tarBytes inline with the bundle. It is kept for callers building the archive in
+	// memory, generated archives are written to a file and referenced with UpdateArchive instead.
 	Update(ctx context.Context, uid string, state supportbundles.State, tarBytes []byte) error
+	// Fail moves a bundle to the error state and records why the generation failed.
+	Fail(ctx context.Context, uid string, reason string) error
+	// UpdateArchive updates the state of a bundle and references the archive already written to disk.
+	// The size, checksum and encryption of the archive are recorded with the bundle.
+	UpdateArchive(ctx context.Context, uid string, state supportbundles.State, archive ArchiveMeta) error
+	// OpenArchive returns the archive of a bundle, whether it is stored inline or in a file.
+	OpenArchive(ctx context.Context, uid string) (io.ReadCloser, error)
+	// CreateImported creates a complete bundle referencing an externally generated archive already
+	// written to archivePath.
+	CreateImported(ctx context.Context, meta ImportMeta, archivePath string, checksum string) (*supportbundles.Bundle, error)
+	// GetProgress returns the persisted generation progress of a bundle or nil if there is none.
+	GetProgress(ctx context.Context, uid string) (*bundleProgress, error)
+	SetProgress(ctx context.Context, uid string, progress *bundleProgress) error
+	// RemoveProgress removes the progress of a bundle together with its partial archive.
+	RemoveProgress(ctx context.Context, uid string) error
+	// GetManifest returns the manifest of a bundle or nil if there is none.
+	GetManifest(ctx context.Context, uid string) (*bundleManifest, error)
+	SetManifest(ctx context.Context, uid string, manifest *bundleManifest) error
+	// SetMetadata replaces the metadata of a bundle without touching its state or stored archive.
+	SetMetadata(ctx context.Context, uid string, meta BundleMeta) error
+	// ExportMetadata returns a versioned JSON document of all the bundle records, without their archives.
+	ExportMetadata(ctx context.Context) ([]byte, error)
+	// ImportMetadata restores the bundle records exported with ExportMetadata, existing bundles are
+	// overwritten when overwrite is true and skipped otherwise.
+	ImportMetadata(ctx context.Context, data []byte, overwrite bool) error
+	// CountByState returns the number of bundles per state without reading the bundles.
+	CountByState(ctx context.Context) (map[supportbundles.State]int, error)
+	// ListSizes returns the organization and archive size of every bundle, the other fields aren't decoded.
+	ListSizes(ctx context.Context) ([]bundleSize, error)
+	// ReconcileStateCounts recomputes the counters returned by CountByState from the stored bundles.
+	ReconcileStateCounts(ctx context.Context) error
+	// Compact removes the keys left behind by removed bundles and returns how many were reclaimed.
+	Compact(ctx context.Context) (reclaimed int, err error)
 }
 
-func (s *store) Create(ctx context.Context, usr identity.Requester) (*supportbundles.Bundle, error) {
+func (s *store) Create(ctx context.Context, usr identity.Requester, idempotencyKey string) (*supportbundles.Bundle, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexKey := idempotencyIndexKey(usr.GetOrgID(), usr.GetLogin(), idempotencyKey)
+	if idempotencyKey != "" {
+		existing, err := s.getByIdempotencyKey(ctx, indexKey)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing != nil && existing.State == supportbundles.StatePending {
+			return existing, false, nil
+		}
+	}
+
 	uid, err := uuid.NewRandom()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	bundle := supportbundles.Bundle{
-		UID:       uid.String(),
-		State:     supportbundles.StatePending,
-		Creator:   usr.GetLogin(),
-		CreatedAt: time.Now().Unix(),
-		ExpiresAt: time.Now().Add(defaultBundleExpiration).Unix(),
+		UID:            uid.String(),
+		State:          supportbundles.StatePending,
+		Creator:        usr.GetLogin(),
+		OrgID:          usr.GetOrgID(),
+		CreatedAt:      time.Now().Unix(),
+		ExpiresAt:      time.Now().Add(defaultBundleExpiration).Unix(),
+		IdempotencyKey: idempotencyKey,
 	}
 
-	s.mu.Lock()
-
 	bundlesCreatedString, _, err := s.statKV.Get(ctx, key)
 	if err != nil {
 		s.log.Warn("An error has occurred upon retrieving value at statKV", "key", key)
@@ -80,32 +169,200 @@ func (s *store) Create(ctx context.Context, usr identity.Requester) (*supportbun
 	if err := s.statKV.Set(ctx, key, fmt.Sprint(bundlesCreated)); err != nil {
 		s.log.Warn("An error has occurred upon setting a value at statKV", "key", key)
 	}
-	s.mu.Unlock()
 
 	if err := s.set(ctx, &bundle); err != nil {
+		return nil, false, err
+	}
+	s.transitionStateCount(ctx, "", bundle.State)
+
+	if idempotencyKey != "" {
+		if err := s.idempotencyKV.Set(ctx, indexKey, bundle.UID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &bundle, true, nil
+}
+
+// getByIdempotencyKey returns the bundle indexed under the given key or nil if there is none.
+func (s *store) getByIdempotencyKey(ctx context.Context, indexKey string) (*supportbundles.Bundle, error) {
+	uid, ok, err := s.idempotencyKV.Get(ctx, indexKey)
+	if err != nil || !ok {
 		return nil, err
 	}
-	return &bundle, nil
+
+	data, ok, err := s.kv.Get(ctx, uid)
+	if err != nil || !ok {
+		// the bundle has been removed, the stale index entry gets overwritten
+		return nil, err
+	}
+
+	var b supportbundles.Bundle
+	if err := json.Unmarshal([]byte(data), &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// idempotencyIndexKey scopes idempotency keys to the creating user so keys from different users don't collide.
+func idempotencyIndexKey(orgID int64, login, idempotencyKey string) string {
+	return fmt.Sprintf("%d/%s/%s", orgID, url.PathEscape(login), idempotencyKey)
 }
 
 func (s *store) Update(ctx context.Context, uid string, state supportbundles.State, tarBytes []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	bundle, err := s.Get(ctx, uid)
 	if err != nil {
 		return err
 	}
 
+	previous := bundle.State
 	bundle.State = state
 	bundle.TarBytes = tarBytes
+	bundle.Size = int64(len(tarBytes))
 
-	return s.set(ctx, bundle)
+	if err := s.set(ctx, bundle); err != nil {
+		return err
+	}
+	s.transitionStateCount(ctx, previous, state)
+	return nil
+}
+
+func (s *store) Fail(ctx context.Context, uid string, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bundle, err := s.Get(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	if len(reason) > maxBundleErrorLength {
+		reason = strings.ToValidUTF8(reason[:maxBundleErrorLength], "")
+	}
+	previous := bundle.State
+	bundle.State = supportbundles.StateError
+	bundle.Error = reason
+	bundle.TarBytes = nil
+
+	if err := s.set(ctx, bundle); err != nil {
+		return err
+	}
+	s.transitionStateCount(ctx, previous, supportbundles.StateError)
+	return nil
+}
+
+func (s *store) UpdateArchive(ctx context.Context, uid string, state supportbundles.State, archive ArchiveMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(archive.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := s.archiveKV.Set(ctx, uid, archive.Path); err != nil {
+		return err
+	}
+
+	bundle, err := s.Get(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	previous := bundle.State
+	bundle.State = state
+	bundle.TarBytes = nil
+	bundle.Size = info.Size()
+	bundle.Checksum = archive.Checksum
+	bundle.Encrypted = archive.Encrypted
+
+	if err := s.set(ctx, bundle); err != nil {
+		return err
+	}
+	s.transitionStateCount(ctx, previous, state)
+	return nil
+}
+
+func (s *store) CreateImported(ctx context.Context, meta ImportMeta, archivePath string, checksum string) (*supportbundles.Bundle, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	bundle := supportbundles.Bundle{
+		UID:        uid.String(),
+		State:      supportbundles.StateComplete,
+		Creator:    meta.Creator,
+		OrgID:      meta.OrgID,
+		CreatedAt:  now.Unix(),
+		ExpiresAt:  now.Add(defaultBundleExpiration).Unix(),
+		Size:       info.Size(),
+		Checksum:   checksum,
+		Collectors: meta.Collectors,
+		Imported:   true,
+	}
+	if meta.CreatedAt != 0 {
+		bundle.CreatedAt = meta.CreatedAt
+	}
+
+	if err := s.archiveKV.Set(ctx, bundle.UID, archivePath); err != nil {
+		return nil, err
+	}
+	if err := s.set(ctx, &bundle); err != nil {
+		if err := s.archiveKV.Del(ctx, bundle.UID); err != nil {
+			s.log.Warn("Failed to remove support bundle archive reference", "uid", bundle.UID, "error", err)
+		}
+		return nil, err
+	}
+	s.transitionStateCount(ctx, "", bundle.State)
+
+	return &bundle, nil
+}
+
+func (s *store) OpenArchive(ctx context.Context, uid string) (io.ReadCloser, error) {
+	bundle, err := s.Get(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.ContentPurged {
+		return nil, ErrContentPurged
+	}
+
+	archivePath, ok, err := s.archiveKV.Get(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return os.Open(archivePath)
+	}
+
+	// bundles stored before archives were written to files
+	if len(bundle.TarBytes) == 0 {
+		return nil, errors.New("support bundle archive not found")
+	}
+	return io.NopCloser(bytes.NewReader(bundle.TarBytes)), nil
 }
 
 func (s *store) set(ctx context.Context, bundle *supportbundles.Bundle) error {
-	data, err := json.Marshal(&bundle)
+	// queue information is transient and never persisted
+	stored := *bundle
+	stored.QueuePosition = 0
+	stored.EstimatedStart = 0
+
+	data, err := json.Marshal(&stored)
 	if err != nil {
 		return err
 	}
-	return s.kv.Set(ctx, bundle.UID, string(data))
+	return s.kv.Set(ctx, stored.UID, string(data))
 }
 
 func (s *store) Get(ctx context.Context, uid string) (*supportbundles.Bundle, error) {
@@ -126,7 +383,169 @@ func (s *store) Get(ctx context.Context, uid string) (*supportbundles.Bundle, er
 }
 
 func (s *store) Remove(ctx context.Context, uid string) error {
-	return s.kv.Del(ctx, uid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bundle, getErr := s.Get(ctx, uid)
+	if getErr == nil && bundle.IdempotencyKey != "" {
+		indexKey := idempotencyIndexKey(bundle.OrgID, bundle.Creator, bundle.IdempotencyKey)
+		if indexed, ok, err := s.idempotencyKV.Get(ctx, indexKey); err == nil && ok && indexed == uid {
+			if err := s.idempotencyKV.Del(ctx, indexKey); err != nil {
+				s.log.Warn("Failed to remove support bundle idempotency key", "uid", uid, "error", err)
+			}
+		}
+	}
+
+	if err := s.RemoveProgress(ctx, uid); err != nil {
+		s.log.Warn("Failed to remove support bundle progress", "uid", uid, "error", err)
+	}
+
+	if err := s.removeArchive(ctx, uid); err != nil {
+		s.log.Warn("Failed to remove support bundle archive", "uid", uid, "error", err)
+	}
+
+	if err := s.manifestKV.Del(ctx, uid); err != nil {
+		s.log.Warn("Failed to remove support bundle manifest", "uid", uid, "error", err)
+	}
+
+	if err := s.kv.Del(ctx, uid); err != nil {
+		return err
+	}
+	if getErr == nil {
+		s.transitionStateCount(ctx, bundle.State, "")
+	}
+	return nil
+}
+
+func (s *store) Purge(ctx context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bundle, err := s.Get(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	// the bundle is marked first so a failed removal can be retried and the archive is never served
+	bundle.ContentPurged = true
+	bundle.TarBytes = nil
+	if err := s.set(ctx, bundle); err != nil {
+		return err
+	}
+	return s.removeArchive(ctx, uid)
+}
+
+func (s *store) removeArchive(ctx context.Context, uid string) error {
+	archivePath, ok, err := s.archiveKV.Get(ctx, uid)
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := os.Remove(archivePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.archiveKV.Del(ctx, uid)
+}
+
+func (s *store) GetProgress(ctx context.Context, uid string) (*bundleProgress, error) {
+	data, ok, err := s.progressKV.Get(ctx, uid)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var p bundleProgress
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *store) SetProgress(ctx context.Context, uid string, progress *bundleProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return s.progressKV.Set(ctx, uid, string(data))
+}
+
+func (s *store) RemoveProgress(ctx context.Context, uid string) error {
+	progress, err := s.GetProgress(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		if err := removePartialArchive(progress.PartialArchive); err != nil {
+			return err
+		}
+	}
+	return s.progressKV.Del(ctx, uid)
+}
+
+func (s *store) GetManifest(ctx context.Context, uid string) (*bundleManifest, error) {
+	data, ok, err := s.manifestKV.Get(ctx, uid)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var m bundleManifest
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *store) SetManifest(ctx context.Context, uid string, manifest *bundleManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return s.manifestKV.Set(ctx, uid, string(data))
+}
+
+// BundleMeta is the metadata describing the content of a bundle archive. It changes when collectors
+// are appended to or retried in an existing bundle.
+type BundleMeta struct {
+	// Collectors is the collector selection of the bundle.
+	Collectors []string
+	// Manifest replaces the stored manifest, the existing one is kept when nil.
+	Manifest *bundleManifest
+	// Size is the size in bytes of the archive.
+	Size int64
+	// Checksum is the hex encoded SHA-256 of the archive.
+	Checksum string
+}
+
+// ArchiveMeta references a generated archive already written to disk, it is recorded with the bundle
+// by UpdateArchive.
+type ArchiveMeta struct {
+	// Path is the path of the archive file.
+	Path string
+	// Checksum is the hex encoded SHA-256 of the archive.
+	Checksum string
+	// Encrypted is set when the archive is encrypted for the configured recipients.
+	Encrypted bool
+}
+
+func (s *store) SetMetadata(ctx context.Context, uid string, meta BundleMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bundle, err := s.Get(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	if meta.Manifest != nil {
+		if err := s.SetManifest(ctx, uid, meta.Manifest); err != nil {
+			return err
+		}
+	}
+
+	bundle.Collectors = meta.Collectors
+	bundle.Size = meta.Size
+	bundle.Checksum = meta.Checksum
+
+	return s.set(ctx, bundle)
 }
 
 func (s *store) List() ([]supportbundles.Bundle, error) {
@@ -155,6 +574,86 @@ func (s *store) List() ([]supportbundles.Bundle, error) {
 	return res, nil
 }
 
+// bundleSize is the organization and archive size of a stored bundle.
+type bundleSize struct {
+	OrgID int64 `json:"orgId"`
+	Size  int64 `json:"size"`
+}
+
+func (s *store) ListSizes(ctx context.Context) ([]bundleSize, error) {
+	data, err := s.kv.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]bundleSize, 0)
+	for _, items := range data {
+		for _, item := range items {
+			var b bundleSize
+			if err := json.Unmarshal([]byte(item), &b); err != nil {
+				return nil, err
+			}
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+// ListByTimeRange returns the bundles whose CreatedAt is within [from, to). The end is exclusive so
+// consecutive ranges don't return the same bundle twice.
+func (s *store) ListByTimeRange(ctx context.Context, from, to int64) ([]supportbundles.Bundle, error) {
+	bundles, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]supportbundles.Bundle, 0, len(bundles))
+	for _, b := range bundles {
+		if b.CreatedAt >= from && b.CreatedAt < to {
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+func (s *store) ListFiltered(ctx context.Context, filter ListFilter) ([]supportbundles.Bundle, error) {
+	bundles, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]supportbundles.Bundle, 0, len(bundles))
+	for _, b := range bundles {
+		if filter.matches(&b) {
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+func (s *store) SetLabels(ctx context.Context, uid string, labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bundle, err := s.Get(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	bundle.Labels = nil
+	if len(labels) > 0 {
+		bundle.Labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			bundle.Labels[k] = v
+		}
+	}
+	return s.set(ctx, bundle)
+}
+
 func (s *store) StatsCount(ctx context.Context) (int64, error) {
 	countString, exists, err := s.statKV.Get(ctx, key)
 	if err != nil {
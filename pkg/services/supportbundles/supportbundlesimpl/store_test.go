@@ -0,0 +1,375 @@
+package supportbundlesimpl
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestStore_CreateIdempotencyKey(t *testing.T) {
+	t.Run("concurrent creations with the same key produce a single bundle", func(t *testing.T) {
+		s := newStore(kvstore.NewFakeKVStore())
+		usr := &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}
+
+		var wg sync.WaitGroup
+		uids := make([]string, 2)
+		created := make([]bool, 2)
+		for i := range uids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				bundle, ok, err := s.Create(context.Background(), usr, "generate-1")
+				if assert.NoError(t, err) {
+					uids[i], created[i] = bundle.UID, ok
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, uids[0], uids[1])
+		assert.ElementsMatch(t, []bool{true, false}, created)
+
+		count, err := s.StatsCount(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("keys are scoped to the creator", func(t *testing.T) {
+		s := newStore(kvstore.NewFakeKVStore())
+
+		first, _, err := s.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "generate-1")
+		require.NoError(t, err)
+		second, created, err := s.Create(context.Background(), &user.SignedInUser{UserID: 2, OrgID: 1, Login: "alice"}, "generate-1")
+		require.NoError(t, err)
+
+		assert.True(t, created)
+		assert.NotEqual(t, first.UID, second.UID)
+	})
+
+	t.Run("a new bundle is created once the previous one is done", func(t *testing.T) {
+		s := newStore(kvstore.NewFakeKVStore())
+		usr := &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}
+
+		first, _, err := s.Create(context.Background(), usr, "generate-1")
+		require.NoError(t, err)
+		require.NoError(t, s.Update(context.Background(), first.UID, supportbundles.StateComplete, nil))
+
+		second, created, err := s.Create(context.Background(), usr, "generate-1")
+		require.NoError(t, err)
+		assert.True(t, created)
+		assert.NotEqual(t, first.UID, second.UID)
+	})
+
+	t.Run("creations without a key are never deduplicated", func(t *testing.T) {
+		s := newStore(kvstore.NewFakeKVStore())
+		usr := &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}
+
+		first, _, err := s.Create(context.Background(), usr, "")
+		require.NoError(t, err)
+		second, created, err := s.Create(context.Background(), usr, "")
+		require.NoError(t, err)
+
+		assert.True(t, created)
+		assert.NotEqual(t, first.UID, second.UID)
+	})
+}
+
+func TestStore_Fail(t *testing.T) {
+	s := newStore(kvstore.NewFakeKVStore())
+	ctx := context.Background()
+
+	bundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+	require.NoError(t, s.Fail(ctx, bundle.UID, "collector db failed: connection refused"))
+
+	failed, err := s.Get(ctx, bundle.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StateError, failed.State)
+	assert.Equal(t, "collector db failed: connection refused", failed.Error)
+
+	bundles, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, bundles, 1)
+	assert.Equal(t, "collector db failed: connection refused", bundles[0].Error, "the reason is listed without the archive")
+
+	t.Run("long reasons are capped", func(t *testing.T) {
+		require.NoError(t, s.Fail(ctx, bundle.UID, strings.Repeat("a", 2*maxBundleErrorLength)))
+
+		failed, err := s.Get(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.Len(t, failed.Error, maxBundleErrorLength)
+	})
+}
+
+func TestStore_ListByTimeRange(t *testing.T) {
+	s := newStore(kvstore.NewFakeKVStore())
+	ctx := context.Background()
+
+	for _, createdAt := range []int64{100, 200, 300} {
+		bundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		bundle.CreatedAt = createdAt
+		bundle.TarBytes = []byte("archive")
+		require.NoError(t, s.set(ctx, bundle))
+	}
+
+	createdAt := func(bundles []supportbundles.Bundle) []int64 {
+		res := []int64{}
+		for _, b := range bundles {
+			assert.Empty(t, b.TarBytes, "only the metadata is listed")
+			res = append(res, b.CreatedAt)
+		}
+		return res
+	}
+
+	testCases := []struct {
+		desc     string
+		from, to int64
+		expected []int64
+	}{
+		{desc: "should return none outside of the range", from: 400, to: 500, expected: []int64{}},
+		{desc: "should include the start and exclude the end", from: 100, to: 300, expected: []int64{200, 100}},
+		{desc: "should return all newest first", from: 0, to: 1000, expected: []int64{300, 200, 100}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			bundles, err := s.ListByTimeRange(ctx, tc.from, tc.to)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, createdAt(bundles))
+		})
+	}
+}
+
+func TestStore_OpenArchive(t *testing.T) {
+	t.Run("archives stored inline are still readable", func(t *testing.T) {
+		s := newStore(kvstore.NewFakeKVStore())
+
+		bundle, _, err := s.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+		require.NoError(t, s.Update(context.Background(), bundle.UID, supportbundles.StateComplete, []byte("inline")))
+
+		archive, err := s.OpenArchive(context.Background(), bundle.UID)
+		require.NoError(t, err)
+		data, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, archive.Close())
+		assert.Equal(t, "inline", string(data))
+	})
+
+	t.Run("archives written to a file are read from and removed with the bundle", func(t *testing.T) {
+		s := newStore(kvstore.NewFakeKVStore())
+
+		bundle, _, err := s.Create(context.Background(), &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+		require.NoError(t, err)
+
+		archivePath := filepath.Join(t.TempDir(), bundle.UID+".tar.gz")
+		require.NoError(t, os.WriteFile(archivePath, []byte("file"), 0o600))
+		require.NoError(t, s.UpdateArchive(context.Background(), bundle.UID, supportbundles.StateComplete, ArchiveMeta{Path: archivePath, Checksum: "abc123"}))
+
+		stored, err := s.Get(context.Background(), bundle.UID)
+		require.NoError(t, err)
+		assert.Equal(t, supportbundles.StateComplete, stored.State)
+		assert.Empty(t, stored.TarBytes)
+		assert.Equal(t, int64(4), stored.Size, "the archive size is recorded")
+		assert.Equal(t, "abc123", stored.Checksum, "the archive checksum is recorded")
+
+		archive, err := s.OpenArchive(context.Background(), bundle.UID)
+		require.NoError(t, err)
+		data, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, archive.Close())
+		assert.Equal(t, "file", string(data))
+
+		require.NoError(t, s.Remove(context.Background(), bundle.UID))
+		_, err = os.Stat(archivePath)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestStore_Purge(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(kvstore.NewFakeKVStore())
+
+	fileBundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), fileBundle.UID+".tar.gz")
+	require.NoError(t, os.WriteFile(archivePath, []byte("file"), 0o600))
+	require.NoError(t, s.UpdateArchive(ctx, fileBundle.UID, supportbundles.StateComplete, ArchiveMeta{Path: archivePath}))
+
+	inlineBundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+	require.NoError(t, s.Update(ctx, inlineBundle.UID, supportbundles.StateComplete, []byte("inline")))
+
+	for _, bundle := range []*supportbundles.Bundle{fileBundle, inlineBundle} {
+		manifest := &bundleManifest{Collectors: []collectorTiming{{UID: "basic"}}}
+		require.NoError(t, s.SetManifest(ctx, bundle.UID, manifest))
+
+		require.NoError(t, s.Purge(ctx, bundle.UID))
+
+		stored, err := s.Get(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.True(t, stored.ContentPurged)
+		assert.Empty(t, stored.TarBytes)
+		assert.Equal(t, supportbundles.StateComplete, stored.State)
+		assert.Equal(t, bundle.CreatedAt, stored.CreatedAt)
+		assert.Equal(t, bundle.Creator, stored.Creator)
+
+		storedManifest, err := s.GetManifest(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.Equal(t, manifest, storedManifest, "the manifest is kept")
+
+		_, err = s.OpenArchive(ctx, bundle.UID)
+		assert.ErrorIs(t, err, ErrContentPurged)
+	}
+
+	_, err = os.Stat(archivePath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, ok, err := s.archiveKV.Get(ctx, fileBundle.UID)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, s.Purge(ctx, fileBundle.UID), "purging twice is a no-op")
+}
+
+func TestStore_SetMetadata(t *testing.T) {
+	s := newStore(kvstore.NewFakeKVStore())
+	ctx := context.Background()
+
+	bundle, _, err := s.Create(ctx, &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}, "")
+	require.NoError(t, err)
+
+	archivePath := filepath.Join(t.TempDir(), bundle.UID+".tar.gz")
+	require.NoError(t, os.WriteFile(archivePath, []byte("file"), 0o600))
+	require.NoError(t, s.UpdateArchive(ctx, bundle.UID, supportbundles.StateComplete, ArchiveMeta{Path: archivePath}))
+	require.NoError(t, s.SetManifest(ctx, bundle.UID, &bundleManifest{Collectors: []collectorTiming{{UID: "basic"}}}))
+
+	require.NoError(t, s.SetMetadata(ctx, bundle.UID, BundleMeta{
+		Collectors: []string{"basic", "settings"},
+		Manifest:   &bundleManifest{Collectors: []collectorTiming{{UID: "basic"}, {UID: "settings"}}},
+		Size:       8,
+		Checksum:   "abc123",
+	}))
+
+	stored, err := s.Get(ctx, bundle.UID)
+	require.NoError(t, err)
+	assert.Equal(t, supportbundles.StateComplete, stored.State)
+	assert.Equal(t, []string{"basic", "settings"}, stored.Collectors)
+	assert.Equal(t, int64(8), stored.Size)
+	assert.Equal(t, "abc123", stored.Checksum)
+
+	manifest, err := s.GetManifest(ctx, bundle.UID)
+	require.NoError(t, err)
+	assert.Len(t, manifest.Collectors, 2)
+
+	t.Run("the archive reference is untouched", func(t *testing.T) {
+		stored, ok, err := s.archiveKV.Get(ctx, bundle.UID)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, archivePath, stored)
+
+		archive, err := s.OpenArchive(ctx, bundle.UID)
+		require.NoError(t, err)
+		data, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, archive.Close())
+		assert.Equal(t, "file", string(data))
+	})
+
+	t.Run("the manifest is kept when none is provided", func(t *testing.T) {
+		require.NoError(t, s.SetMetadata(ctx, bundle.UID, BundleMeta{Collectors: []string{"basic"}, Size: 4}))
+
+		manifest, err := s.GetManifest(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.Len(t, manifest.Collectors, 2)
+	})
+
+	t.Run("unknown bundles are rejected", func(t *testing.T) {
+		assert.Error(t, s.SetMetadata(ctx, "unknown", BundleMeta{}))
+	})
+
+	t.Run("concurrent state updates are kept", func(t *testing.T) {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.SetMetadata(ctx, bundle.UID, BundleMeta{Collectors: []string{"basic"}, Size: 4}))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Fail(ctx, bundle.UID, "collector failed"))
+		}()
+		wg.Wait()
+
+		stored, err := s.Get(ctx, bundle.UID)
+		require.NoError(t, err)
+		assert.Equal(t, supportbundles.StateError, stored.State)
+		assert.Equal(t, []string{"basic"}, stored.Collectors)
+	})
+}
+
+func TestStore_CountByState(t *testing.T) {
+	ctx := context.Background()
+	kv := kvstore.NewFakeKVStore()
+	s := newStore(kv)
+	usr := &user.SignedInUser{UserID: 1, OrgID: 1, Login: "bob"}
+
+	create := func() string {
+		bundle, _, err := s.Create(ctx, usr, "")
+		require.NoError(t, err)
+		return bundle.UID
+	}
+
+	pending := create()
+	complete := create()
+	failed := create()
+	removed := create()
+	require.NoError(t, s.Update(ctx, complete, supportbundles.StateComplete, []byte("archive")))
+	require.NoError(t, s.Fail(ctx, failed, "collector failed"))
+	require.NoError(t, s.Update(ctx, removed, supportbundles.StateComplete, []byte("archive")))
+	require.NoError(t, s.Remove(ctx, removed))
+
+	counts, err := s.CountByState(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[supportbundles.State]int{
+		supportbundles.StatePending:  1,
+		supportbundles.StateComplete: 1,
+		supportbundles.StateError:    1,
+		supportbundles.StateTimeout:  0,
+	}, counts)
+
+	t.Run("counts follow state transitions", func(t *testing.T) {
+		require.NoError(t, s.Update(ctx, pending, supportbundles.StateTimeout, nil))
+
+		counts, err := s.CountByState(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, counts[supportbundles.StatePending])
+		assert.Equal(t, 1, counts[supportbundles.StateTimeout])
+	})
+
+	t.Run("reconcile fixes counters that drifted", func(t *testing.T) {
+		require.NoError(t, s.statKV.Set(ctx, stateCountKey(supportbundles.StateComplete), "42"))
+
+		require.NoError(t, s.ReconcileStateCounts(ctx))
+
+		counts, err := s.CountByState(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[supportbundles.State]int{
+			supportbundles.StatePending:  0,
+			supportbundles.StateComplete: 1,
+			supportbundles.StateError:    1,
+			supportbundles.StateTimeout:  1,
+		}, counts)
+	})
+}
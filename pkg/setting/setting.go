@@ -207,18 +207,20 @@ type Cfg struct {
 	RendererRenderKeyLifeTime      time.Duration
 
 	// Security
-	DisableInitAdminCreation          bool
-	DisableBruteForceLoginProtection  bool
-	CookieSecure                      bool
-	CookieSameSiteDisabled            bool
-	CookieSameSiteMode                http.SameSite
-	AllowEmbedding                    bool
-	XSSProtectionHeader               bool
-	ContentTypeProtectionHeader       bool
-	StrictTransportSecurity           bool
-	StrictTransportSecurityMaxAge     int
-	StrictTransportSecurityPreload    bool
-	StrictTransportSecuritySubDomains bool
+	DisableInitAdminCreation             bool
+	DisableBruteForceLoginProtection     bool
+	BruteForceLoginProtectionMaxAttempts int64
+	BruteForceLoginProtectionWindow      time.Duration
+	CookieSecure                         bool
+	CookieSameSiteDisabled               bool
+	CookieSameSiteMode                   http.SameSite
+	AllowEmbedding                       bool
+	XSSProtectionHeader                  bool
+	ContentTypeProtectionHeader          bool
+	StrictTransportSecurity              bool
+	StrictTransportSecurityMaxAge        int
+	StrictTransportSecurityPreload       bool
+	StrictTransportSecuritySubDomains    bool
 	// CSPEnabled toggles Content Security Policy support.
 	CSPEnabled bool
 	// CSPTemplate contains the Content Security Policy template.
@@ -312,6 +314,36 @@ type Cfg struct {
 	OAuthAutoLogin                bool
 	OAuthCookieMaxAge             int
 	OAuthAllowInsecureEmailLookup bool
+	OAuthAllowAdminFromClaim      bool
+	OAuthAdminGroups              []string
+	// OAuthSignupVerifyEmailDomain requires the email domain of users signing up with OAuth to have MX records
+	OAuthSignupVerifyEmailDomain   bool
+	OAuthSignupBlockedEmailDomains []string
+	// OAuthRequireEmailVerified rejects OAuth logins unless the provider asserts the email is verified
+	OAuthRequireEmailVerified bool
+	// OAuthRequireEmailVerifiedExemptExisting only requires the verified email to sign up
+	OAuthRequireEmailVerifiedExemptExisting bool
+	// OAuthAllowedCallbackRoots are the roots, besides root_url, the OAuth callback can be served from
+	OAuthAllowedCallbackRoots []string
+	// OAuthSyncShadowMode records the role changes OAuth logins would sync without applying them
+	OAuthSyncShadowMode bool
+	// OAuthSyncPreserveManualOrgs keeps the org memberships not managed by OAuth org sync
+	OAuthSyncPreserveManualOrgs bool
+	// OAuthLoginPolicyWebhookURL is called with the mapped identity of OAuth logins to allow or deny them
+	OAuthLoginPolicyWebhookURL     string
+	OAuthLoginPolicyWebhookTimeout time.Duration
+	// OAuthLoginPolicyFailOpen allows logins when the policy webhook can't be reached
+	OAuthLoginPolicyFailOpen bool
+	// OAuthHomeRealmDomains maps email domains to the OAuth provider their users log in with,
+	// domains starting with *. match their subdomains
+	OAuthHomeRealmDomains map[string]string
+	// OAuthMaxTokenLifetime caps the lifetime of sessions created by an OAuth login, regardless of the
+	// expiry of the provider tokens. Disabled when zero.
+	OAuthMaxTokenLifetime time.Duration
+	// OAuthKeySetCacheMaxEntries and OAuthKeySetCacheMaxTTL bound the cache of the key sets published by the
+	// OAuth providers.
+	OAuthKeySetCacheMaxEntries int
+	OAuthKeySetCacheMaxTTL     time.Duration
 
 	// JWT Auth
 	JWTAuthEnabled                 bool
@@ -1397,6 +1429,8 @@ func readSecuritySettings(iniFile *ini.File, cfg *Cfg) error {
 	cfg.SecretKey = SecretKey
 	DisableGravatar = security.Key("disable_gravatar").MustBool(true)
 	cfg.DisableBruteForceLoginProtection = security.Key("disable_brute_force_login_protection").MustBool(false)
+	cfg.BruteForceLoginProtectionMaxAttempts = security.Key("brute_force_login_protection_max_attempts").MustInt64(5)
+	cfg.BruteForceLoginProtectionWindow = security.Key("brute_force_login_protection_window").MustDuration(5 * time.Minute)
 
 	CookieSecure = security.Key("cookie_secure").MustBool(false)
 	cfg.CookieSecure = CookieSecure
@@ -1514,6 +1548,22 @@ func readAuthOktaSettings(cfg *Cfg) {
 	cfg.OktaSkipOrgRoleSync = sec.Key("skip_org_role_sync").MustBool(false)
 }
 
+// parseHomeRealmDomains parses a list of domain=provider pairs, invalid pairs are logged and skipped.
+func parseHomeRealmDomains(logger log.Logger, value string) map[string]string {
+	domains := map[string]string{}
+	for _, pair := range util.SplitString(value) {
+		domain, provider, ok := strings.Cut(pair, "=")
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		provider = strings.TrimSpace(provider)
+		if !ok || domain == "" || provider == "" {
+			logger.Warn("Ignoring invalid OAuth home realm domain mapping, expected domain=provider", "mapping", pair)
+			continue
+		}
+		domains[domain] = provider
+	}
+	return domains
+}
+
 func readAuthSettings(iniFile *ini.File, cfg *Cfg) (err error) {
 	auth := iniFile.Section("auth")
 
@@ -1526,6 +1576,27 @@ func readAuthSettings(iniFile *ini.File, cfg *Cfg) (err error) {
 	}
 
 	cfg.OAuthAllowInsecureEmailLookup = auth.Key("oauth_allow_insecure_email_lookup").MustBool(false)
+	cfg.OAuthAllowAdminFromClaim = auth.Key("oauth_allow_admin_from_claim").MustBool(false)
+	cfg.OAuthAdminGroups = util.SplitString(auth.Key("oauth_admin_groups").String())
+	cfg.OAuthSignupVerifyEmailDomain = auth.Key("oauth_signup_verify_email_domain").MustBool(false)
+	cfg.OAuthSignupBlockedEmailDomains = util.SplitString(auth.Key("oauth_signup_blocked_email_domains").String())
+	cfg.OAuthRequireEmailVerified = auth.Key("oauth_require_email_verified").MustBool(false)
+	cfg.OAuthRequireEmailVerifiedExemptExisting = auth.Key("oauth_require_email_verified_exempt_existing_users").MustBool(false)
+	cfg.OAuthAllowedCallbackRoots = util.SplitString(auth.Key("oauth_allowed_callback_roots").String())
+	cfg.OAuthSyncShadowMode = auth.Key("oauth_sync_shadow_mode").MustBool(false)
+	cfg.OAuthSyncPreserveManualOrgs = auth.Key("oauth_sync_preserve_manual_orgs").MustBool(false)
+	cfg.OAuthLoginPolicyWebhookURL = auth.Key("oauth_login_policy_webhook_url").String()
+	cfg.OAuthLoginPolicyWebhookTimeout = auth.Key("oauth_login_policy_webhook_timeout").MustDuration(5 * time.Second)
+	cfg.OAuthLoginPolicyFailOpen = auth.Key("oauth_login_policy_fail_open").MustBool(false)
+	cfg.OAuthHomeRealmDomains = parseHomeRealmDomains(cfg.Logger, auth.Key("oauth_home_realm_domains").String())
+	if val := auth.Key("oauth_max_token_lifetime").String(); val != "" {
+		cfg.OAuthMaxTokenLifetime, err = gtime.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+	}
+	cfg.OAuthKeySetCacheMaxEntries = auth.Key("oauth_jwks_cache_max_entries").MustInt(100)
+	cfg.OAuthKeySetCacheMaxTTL = auth.Key("oauth_jwks_cache_max_ttl").MustDuration(time.Hour)
 
 	const defaultMaxLifetime = "30d"
 	maxLifetimeDurationVal := valueAsString(auth, "login_maximum_lifetime_duration", defaultMaxLifetime)
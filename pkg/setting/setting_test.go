@@ -383,6 +383,18 @@ func TestAuthDurationSettings(t *testing.T) {
 	require.Equal(t, maxLifetimeDurationTest, cfg.LoginMaxLifetime)
 }
 
+func TestOAuthHomeRealmDomainsSettings(t *testing.T) {
+	f := ini.Empty()
+	cfg := NewCfg()
+	sec, err := f.NewSection("auth")
+	require.NoError(t, err)
+	_, err = sec.NewKey("oauth_home_realm_domains", "Example.com=okta, *.corp.example.com=azuread invalid =generic_oauth")
+	require.NoError(t, err)
+	err = readAuthSettings(f, cfg)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"example.com": "okta", "*.corp.example.com": "azuread"}, cfg.OAuthHomeRealmDomains)
+}
+
 func TestGetCDNPath(t *testing.T) {
 	var err error
 	cfg := NewCfg()
@@ -51,7 +51,10 @@ export class LoginCtrl extends PureComponent<Props, State> {
       isLoggingIn: false,
       isChangingPassword: false,
       showDefaultPasswordWarning: false,
-      loginErrorMessage: config.loginError,
+      loginErrorMessage: withCorrelationId(
+        getOAuthLoginErrorMessage(config.loginErrorMessageId, config.loginError),
+        config.loginErrorCorrelationId
+      ),
     };
   }
 
@@ -174,3 +177,37 @@ function getErrorMessage(err: FetchError<undefined | { messageId?: string; messa
       return err.data?.message;
   }
 }
+
+function getOAuthLoginErrorMessage(messageId: string | undefined, message: string | undefined): string | undefined {
+  switch (messageId) {
+    case 'auth.oauth.denied':
+      return t('login.error.oauth-denied', 'The login provider denied the login request');
+    case 'auth.oauth.state.missing':
+    case 'auth.oauth.state.invalid':
+    case 'auth.oauth.pkce.missing':
+      return t('login.error.oauth-session-invalid', 'Your login session is invalid or has expired. Please try again.');
+    case 'auth.oauth.token.exchange':
+      return t('login.error.oauth-token-exchange', 'Failed to get a token from the login provider');
+    case 'auth.oauth.email.missing':
+      return t('login.error.oauth-email-missing', "The login provider didn't return an email address");
+    case 'auth.oauth.email.not-allowed':
+      return t('login.error.oauth-email-not-allowed', 'Your email domain is not allowed to log in');
+    case 'auth.oauth.blocked':
+      return t(
+        'login.error.blocked',
+        'You have exceeded the number of login attempts for this user. Please try again later.'
+      );
+    case 'auth.client.notConfigured':
+      return t('login.error.oauth-not-configured', 'This login provider is not configured');
+    default:
+      return message;
+  }
+}
+
+// withCorrelationId appends the id of the failed login flow so users can quote it to support
+function withCorrelationId(message: string | undefined, correlationId: string | undefined): string | undefined {
+  if (!message || !correlationId) {
+    return message;
+  }
+  return t('login.error.with-reference', '{{message}} Reference: {{reference}}', { message, reference: correlationId });
+}
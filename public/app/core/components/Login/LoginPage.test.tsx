@@ -115,6 +115,18 @@ describe('Login Page', () => {
     expect(alert).toHaveTextContent('Oh no there was an error :(');
   });
 
+  it('shows translated oauth errors', async () => {
+    runtimeMock.config.loginError = 'Provided state does not match stored state';
+    runtimeMock.config.loginErrorMessageId = 'auth.oauth.state.invalid';
+
+    render(<LoginPage />);
+
+    const alert = await screen.findByRole('alert', { name: 'Login failed' });
+    expect(alert).toHaveTextContent('Your login session is invalid or has expired. Please try again.');
+
+    runtimeMock.config.loginErrorMessageId = undefined;
+  });
+
   it('shows an error with incorrect password', async () => {
     postMock.mockRejectedValueOnce({
       data: {